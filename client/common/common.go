@@ -13,6 +13,7 @@ import (
 )
 
 // key used to encrypt data. AES-256 GCM. Server has same key
+// This is payload key 0, newer keys are handed out by the server's keyring
 const KeyOne = "ENTER_KEY_HERE"
 
 type Coord struct {
@@ -31,6 +32,61 @@ type Payload struct {
 	Time         int64
 	// ApproxLocation Coord
 	ForgeResistance string
+	// Attestation is an HMAC of the payload keyed with the device secret,
+	// AttestationVersion says how it was computed (0 means ForgeResistance only)
+	AttestationVersion int    `json:",omitempty"`
+	Attestation        string `json:",omitempty"`
+	// PortalURL is the raw captive portal redirect the fields were read from,
+	// the server parses it again and rejects the payload if they disagree
+	PortalURL string `json:",omitempty"`
+	// Fix is where the device was, from gpsd, nil without a GPS
+	Fix *Fix `json:",omitempty"`
+	// Interface is the wifi interface that saw the payphone, devices can have several
+	Interface string `json:",omitempty"`
+	// Test submissions are verified like any other but stored apart from
+	// entries, for trying a device against production without it counting
+	Test bool `json:",omitempty"`
+}
+
+// Fix is a GPS position
+type Fix struct {
+	Lat  float64
+	Long float64
+	// Accuracy is the horizontal error estimate in metres
+	Accuracy float64
+	// Time of the fix, unix seconds
+	Time int64
+}
+
+// Sighting is a payphone hotspot heard in a passive wifi scan. Unlike an entry
+// the device never got through the portal, so there is no payphone ID and the
+// BSSID is all that identifies it.
+type Sighting struct {
+	BSSID string
+	SSID  string
+	// Signal is in dBm
+	Signal float64
+	// Frequency is in MHz
+	Frequency int
+	// Time is when the hotspot was last heard, unix seconds
+	Time      int64
+	Fix       *Fix   `json:",omitempty"`
+	Interface string `json:",omitempty"`
+}
+
+// ScanReport is the plaintext of a FrameTypeScanSightings frame
+type ScanReport struct {
+	Time      int64
+	Sightings []Sighting
+}
+
+// LogRecord is one line of a device's log, uploaded so field devices can be
+// debugged without physical access
+type LogRecord struct {
+	// Time is unix milliseconds
+	Time    int64
+	Level   string
+	Message string
 }
 
 type Entry struct {
@@ -70,8 +126,56 @@ const (
 	FrameTypeSendDeviceData = 0x01
 	FrameTypeGetKey         = 0x02
 	FrameTypeTest           = 0x03
+	// same as FrameTypeSendDeviceData with the payload key ID after the UUID
+	FrameTypeSendDeviceDataV2 = 0x04
+	// same envelope as FrameTypeSendDeviceDataV2, the plaintext is a ScanReport
+	FrameTypeScanSightings = 0x05
+	// same envelope again, the plaintext is gzipped LogRecords, one json object per line
+	FrameTypeDeviceLogs = 0x06
 )
 
+// sizes of the fixed parts of a frame
+const (
+	UUIDLength      = 36
+	KeyIDLength     = 2
+	SignatureLength = 256
+	NonceLength     = 12
+)
+
+// GetKeyContext prefixes the data signed in a FrameTypeGetKey request, so the
+// signature can't be replayed as anything else
+const GetKeyContext = "indicum-get-key"
+
+// attestation versions, see AttestationMessage
+const (
+	// AttestationLegacy is the old ForgeResistance hash, anyone can compute it
+	AttestationLegacy = 0
+	// AttestationHMACv1 is an HMAC-SHA256 with the per device secret from enrollment
+	AttestationHMACv1 = 1
+)
+
+// AttestationMessage is the data the attestation HMAC is computed over. Every
+// field the server stores is in it, so none can be changed without the device secret.
+// Optional fields are only appended when set, so payloads from clients that
+// don't send them attest the same way they always have.
+func AttestationMessage(version int, data Payload, deviceUUID string) []byte {
+	message := fmt.Sprintf("indicum-attestation-v%d\n%s\n%s\n%d\n%d\n%s",
+		version, data.PayphoneMAC, data.PayphoneID, data.PayphoneTime, data.Time, deviceUUID)
+	if data.PortalURL != "" {
+		message += "\nportal " + data.PortalURL
+	}
+	if data.Fix != nil {
+		message += fmt.Sprintf("\nfix %.7f %.7f %.1f %d", data.Fix.Lat, data.Fix.Long, data.Fix.Accuracy, data.Fix.Time)
+	}
+	if data.Interface != "" {
+		message += "\ninterface " + data.Interface
+	}
+	if data.Test {
+		message += "\ntest"
+	}
+	return []byte(message)
+}
+
 // GenerateSecureRandomString creates a cryptographically secure random string of length x.
 func GenerateRandomString(x int) (string, error) {
 	// Define a set of characters to use.
@@ -95,23 +199,32 @@ func GenerateRandomString(x int) (string, error) {
 }
 
 func Encrypt(plaintext, key []byte) ([]byte, []byte, error) {
-	block, err := aes.NewCipher(key)
+	nonce := make([]byte, 12)
+	_, err := io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		return nil, nil, fmt.Errorf(err.Error())
 	}
 
-	nonce := make([]byte, 12)
-	_, err = io.ReadFull(rand.Reader, nonce)
+	ciphertext, err := EncryptWithNonce(plaintext, key, nonce)
 	if err != nil {
-		return nil, nil, fmt.Errorf(err.Error())
+		return nil, nil, err
+	}
+	return ciphertext, nonce, nil
+}
+
+// EncryptWithNonce is Encrypt with a given nonce, for the conformance vectors.
+// Never reuse a nonce with the same key.
+func EncryptWithNonce(plaintext, key, nonce []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf(err.Error())
 	}
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, nil, fmt.Errorf(err.Error())
+		return nil, fmt.Errorf(err.Error())
 	}
-	ciphertext := aesgcm.Seal(nil, nonce, plaintext, nil)
-	return ciphertext, nonce, nil
+	return aesgcm.Seal(nil, nonce, plaintext, nil), nil
 }
 
 func Decrypt(ciphertext, key, nonce []byte) ([]byte, error) {
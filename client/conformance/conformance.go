@@ -0,0 +1,351 @@
+// Package conformance checks the frame encoder against the golden vectors in
+// protocol/vectors at the root of the repo. The device server runs the same
+// vectors through its decoder (frametool conformance), so a change to the
+// signing or encryption order, or a field that only one of the two common
+// packages has, fails both checks instead of failing in the field.
+//
+// Every vector gives a device, payload key, nonce and the input (payload, scan
+// report, log lines or get key timestamp), and the exact plaintext and frame
+// that have to come out. Vectors the client can't produce (old frame versions,
+// tampered frames) have Encoder false and are only checked by the server.
+package conformance
+
+import (
+	"bytes"
+	"client-indicum/common"
+	"client-indicum/upload"
+	"compress/gzip"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// File is one version of the vectors, <dir>/v<version>/vectors.json
+type File struct {
+	Version     int
+	Description string
+	Devices     []Device
+	PayloadKeys []PayloadKey
+	// Now is the server clock the verdicts assume, unix seconds
+	Now     int64
+	Vectors []Vector
+}
+
+type Device struct {
+	Name string
+	UUID string
+	// PrivateKey is PKCS#8 and PublicKey PKIX, both PEM, the way enrollment stores them
+	PrivateKey string
+	PublicKey  string
+	// Secret is the attestation secret, empty for devices enrolled before there were secrets
+	Secret string
+}
+
+// PayloadKey is a key in the server keyring, State is as in the keyring file
+type PayloadKey struct {
+	ID    uint16
+	State string
+	Key   string
+}
+
+type Vector struct {
+	Name        string
+	Description string
+	// Device is who the frame says it is from
+	Device string
+	// Signer signs the frame instead of Device when set
+	Signer string `json:",omitempty"`
+	// ClientSecret attests with this secret instead of the device's
+	ClientSecret *string `json:",omitempty"`
+	FrameType    byte
+	KeyID        uint16
+	Nonce        string `json:",omitempty"`
+	// Timestamp of a get key request, unix seconds
+	Timestamp  int64              `json:",omitempty"`
+	Payload    *common.Payload    `json:",omitempty"`
+	ScanReport *common.ScanReport `json:",omitempty"`
+	LogRecords []common.LogRecord `json:",omitempty"`
+	// Plaintext and Frame are hex
+	Plaintext string `json:",omitempty"`
+	Frame     string
+	Encoder   bool
+	// Verdict is the server's, accept or reject
+	Verdict string
+	Reason  string
+}
+
+type Result struct {
+	Name string
+	// Skipped is true for vectors only the server checks
+	Skipped bool
+	Err     error
+}
+
+// Load reads every version of the vectors in fsys
+func Load(fsys fs.FS) ([]File, error) {
+	names, err := fs.Glob(fsys, "v*/vectors.json")
+	if err != nil {
+		return nil, fmt.Errorf("Can't list vectors %v", err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No conformance vectors found")
+	}
+	sort.Strings(names)
+
+	var files []File
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read %s %v", name, err)
+		}
+		// a field common.Payload doesn't have is drift, not something to skip over
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		var file File
+		if err := decoder.Decode(&file); err != nil {
+			return nil, fmt.Errorf("Can't parse %s %v", name, err)
+		}
+		if path.Dir(name) != fmt.Sprintf("v%d", file.Version) {
+			return nil, fmt.Errorf("%s says it is version %d", name, file.Version)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Check encodes every vector in fsys and compares it with the expected frame
+func Check(fsys fs.FS) ([]Result, error) {
+	files, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, file := range files {
+		for _, vector := range file.Vectors {
+			result := Result{Name: fmt.Sprintf("v%d/%s", file.Version, vector.Name)}
+			if vector.Encoder {
+				result.Err = checkVector(file, vector)
+			} else {
+				result.Skipped = true
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func (file File) device(name string) (Device, error) {
+	for _, device := range file.Devices {
+		if device.Name == name {
+			return device, nil
+		}
+	}
+	return Device{}, fmt.Errorf("No device %q", name)
+}
+
+func (file File) payloadKey(id uint16) (upload.PayloadKey, error) {
+	for _, key := range file.PayloadKeys {
+		if key.ID == id {
+			secret, err := hex.DecodeString(key.Key)
+			if err != nil {
+				return upload.PayloadKey{}, fmt.Errorf("Payload key %d is not hex", id)
+			}
+			return upload.PayloadKey{ID: id, Secret: secret}, nil
+		}
+	}
+	return upload.PayloadKey{}, fmt.Errorf("No payload key %d", id)
+}
+
+// newDevice is the identity the vector is encoded with
+func (file File) newDevice(vector Vector) (*upload.Device, error) {
+	device, err := file.device(vector.Device)
+	if err != nil {
+		return nil, err
+	}
+	signer := device
+	if vector.Signer != "" {
+		if signer, err = file.device(vector.Signer); err != nil {
+			return nil, err
+		}
+	}
+	privKey, err := parsePrivateKey(signer.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Device %s: %v", signer.Name, err)
+	}
+	secret := device.Secret
+	if vector.ClientSecret != nil {
+		secret = *vector.ClientSecret
+	}
+	payloadKey, err := file.payloadKey(vector.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return upload.NewDevice(device.UUID, privKey, secret, payloadKey), nil
+}
+
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block in private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse private key %v", err)
+	}
+	privKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is a %T, not RSA", parsed)
+	}
+	return privKey, nil
+}
+
+func checkVector(file File, vector Vector) error {
+	device, err := file.newDevice(vector)
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(vector.Frame)
+	if err != nil {
+		return fmt.Errorf("Frame is not hex")
+	}
+
+	var got []byte
+	if vector.FrameType == common.FrameTypeGetKey {
+		got, err = upload.EncodeGetKeyRequest(device, time.Unix(vector.Timestamp, 0))
+		if err != nil {
+			return err
+		}
+		return compareFrames(vector.FrameType, got, want)
+	}
+
+	plaintext, err := encodePlaintext(device, vector)
+	if err != nil {
+		return err
+	}
+	wantPlaintext, err := hex.DecodeString(vector.Plaintext)
+	if err != nil {
+		return fmt.Errorf("Plaintext is not hex")
+	}
+	if !bytes.Equal(plaintext, wantPlaintext) {
+		return fmt.Errorf("plaintext differs\n  got  %s\n  want %s\n  got hex %x", printable(plaintext), printable(wantPlaintext), plaintext)
+	}
+
+	nonce, err := hex.DecodeString(vector.Nonce)
+	if err != nil || len(nonce) != common.NonceLength {
+		return fmt.Errorf("Nonce is not %d hex bytes", common.NonceLength)
+	}
+	got, err = upload.EncodeSealed(device, vector.FrameType, plaintext, nonce)
+	if err != nil {
+		return err
+	}
+	return compareFrames(vector.FrameType, got, want)
+}
+
+// encodePlaintext is what the client encrypts for the vector
+func encodePlaintext(device *upload.Device, vector Vector) ([]byte, error) {
+	switch vector.FrameType {
+	case common.FrameTypeSendDeviceDataV2:
+		if vector.Payload == nil {
+			return nil, fmt.Errorf("No payload")
+		}
+		return upload.DeviceDataPlaintext(device, *vector.Payload)
+	case common.FrameTypeScanSightings:
+		if vector.ScanReport == nil {
+			return nil, fmt.Errorf("No scan report")
+		}
+		return json.Marshal(vector.ScanReport)
+	case common.FrameTypeDeviceLogs:
+		// gzip output can change between Go releases, so the vector has the
+		// compressed bytes and only what they decompress to is checked
+		plaintext, err := hex.DecodeString(vector.Plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("Plaintext is not hex")
+		}
+		records, err := readLogs(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(records, vector.LogRecords) {
+			return nil, fmt.Errorf("Plaintext decompresses to %+v, not the vector's log records", records)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("The client doesn't encode frame type %x, set Encoder to false", vector.FrameType)
+}
+
+func readLogs(plaintext []byte) ([]common.LogRecord, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, fmt.Errorf("Log plaintext isn't gzipped %v", err)
+	}
+	var records []common.LogRecord
+	decoder := json.NewDecoder(gz)
+	for {
+		var record common.LogRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode log record %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+// compareFrames says where got and want first differ
+func compareFrames(frameType byte, got, want []byte) error {
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	return fmt.Errorf("frame differs from byte %d (%s), got %d bytes, want %d\n  got  %x", i, part(frameType, i), len(got), len(want), got)
+}
+
+// part names the field at offset in a frame
+func part(frameType byte, offset int) string {
+	header := len(common.FRAMESTART) + 1 + 2
+	if offset < header {
+		return "header"
+	}
+	offset -= header
+
+	var fields []string
+	var lengths []int
+	switch frameType {
+	case common.FrameTypeGetKey:
+		fields, lengths = []string{"uuid", "timestamp", "signature"}, []int{common.UUIDLength, 8, common.SignatureLength}
+	case common.FrameTypeSendDeviceData:
+		fields, lengths = []string{"uuid", "signature", "nonce"}, []int{common.UUIDLength, common.SignatureLength, common.NonceLength}
+	default:
+		fields, lengths = []string{"uuid", "key id", "signature", "nonce"}, []int{common.UUIDLength, common.KeyIDLength, common.SignatureLength, common.NonceLength}
+	}
+	for i, field := range fields {
+		if offset < lengths[i] {
+			return field
+		}
+		offset -= lengths[i]
+	}
+	return "ciphertext"
+}
+
+// printable shows JSON plaintext as text and anything else as hex
+func printable(plaintext []byte) string {
+	if json.Valid(plaintext) {
+		return string(plaintext)
+	}
+	return hex.EncodeToString(plaintext)
+}
@@ -0,0 +1,35 @@
+package conformance
+
+import (
+	"os"
+	"testing"
+)
+
+// vectorsDir is protocol/vectors at the root of the repo
+const vectorsDir = "../../protocol/vectors"
+
+// TestVectors encodes every vector the client can produce and compares the
+// plaintext and frame, the same as `client-indicum conformance`
+func TestVectors(t *testing.T) {
+	results, err := Check(os.DirFS(vectorsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := 0
+	for _, result := range results {
+		t.Run(result.Name, func(t *testing.T) {
+			if result.Skipped {
+				t.Skip("only the server checks this vector")
+			}
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+		})
+		if !result.Skipped {
+			encoded++
+		}
+	}
+	if encoded == 0 {
+		t.Fatal("no vector was encoded")
+	}
+}
@@ -0,0 +1,453 @@
+// Package daemon is the device main loop. It replaces run-on-device.sh:
+// wait for the payphone SSID, sign in to the portal, upload the payphone
+// details and rotate the MAC so the next payphone sees a new client.
+//
+// Every interface gets its own worker running that loop, with its own portal
+// session and MAC. The device identity, spool, status and sightings waiting
+// for upload are shared between them.
+package daemon
+
+import (
+	"client-indicum/common"
+	"client-indicum/gps"
+	"client-indicum/logring"
+	"client-indicum/mac"
+	"client-indicum/portal"
+	"client-indicum/scan"
+	"client-indicum/spool"
+	"client-indicum/status"
+	"client-indicum/upload"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Interfaces are the wifi interfaces Run starts a worker for, Interface is
+	// the one Step works on
+	Interfaces    []string
+	Interface     string
+	SSID          string
+	ServerAddress string
+	Interval      time.Duration
+	Portal        portal.Config
+	Device        *upload.Device
+	// PayloadKeyPath is where keys fetched from the server are kept
+	PayloadKeyPath string
+	Spool          *spool.Spool
+	Status         *status.Status
+	// ScanInterval is how often to passively scan for payphone hotspots, 0 disables it
+	ScanInterval time.Duration
+	// GPS attaches a fix to every payload and sighting, nil without a GPS
+	GPS *gps.Client
+	// Logs are uploaded every LogUploadInterval while online, nil or 0 disables it
+	Logs              *logring.Ring
+	LogUploadInterval time.Duration
+	// Test marks every payload as a test submission, the server checks them
+	// the same way but keeps them out of entries and expires them
+	Test bool
+
+	// CurrentSSID and RotateMAC default to iwgetid and rtnetlink,
+	// the simulator swaps them out since it has no wifi card
+	CurrentSSID func(ctx context.Context, iface string) (string, error)
+	RotateMAC   func(iface string) (net.HardwareAddr, error)
+	Scan        func(ctx context.Context, iface string) ([]scan.BSS, error)
+
+	keyRefresh *keyRefresh
+	scans      *scans
+	logUploads *logUploads
+}
+
+// logUploads remembers which log lines the server already has
+type logUploads struct {
+	mu   sync.Mutex
+	last time.Time
+	next uint64
+}
+
+// sightings from passive scans wait in memory until there is internet. They
+// are low confidence, losing them on a restart isn't worth a spool.
+type scans struct {
+	mu sync.Mutex
+	// last scan on each interface
+	last    map[string]time.Time
+	pending []common.Sighting
+}
+
+// most sightings kept waiting for an upload, the oldest are dropped first
+const maxPendingSightings = 200
+
+// fixes older than this aren't attached, the device has probably moved
+const maxFixAge = 30 * time.Second
+
+// fix returns the current GPS fix, nil if there isn't a recent one
+func (cfg *Config) fix() *common.Fix {
+	if cfg.GPS == nil {
+		return nil
+	}
+	return cfg.GPS.Latest(maxFixAge)
+}
+
+// the payload key is refreshed from the server once a day, and sooner if the
+// server starts rejecting uploads (the key we have might be retired)
+type keyRefresh struct {
+	mu   sync.Mutex
+	last time.Time
+	// fetching is set while a worker asks the server, the others don't wait for it
+	fetching bool
+}
+
+const (
+	keyRefreshInterval = 24 * time.Hour
+	keyRetryInterval   = 5 * time.Minute
+)
+
+func (cfg *Config) setDefaults() {
+	if cfg.CurrentSSID == nil {
+		cfg.CurrentSSID = currentSSID
+	}
+	if cfg.RotateMAC == nil {
+		cfg.RotateMAC = mac.Rotate
+	}
+	if cfg.Scan == nil {
+		cfg.Scan = scan.Run
+	}
+	if cfg.keyRefresh == nil {
+		cfg.keyRefresh = &keyRefresh{}
+	}
+	if cfg.scans == nil {
+		cfg.scans = &scans{last: make(map[string]time.Time)}
+	}
+	if cfg.logUploads == nil {
+		cfg.logUploads = &logUploads{}
+	}
+}
+
+// Run starts a worker for every interface and waits for them to stop when
+// ctx is cancelled
+func Run(ctx context.Context, cfg Config) error {
+	// set here so the workers share the key refresh and scan state
+	cfg.setDefaults()
+	cfg.Status.SetSpoolDepth(cfg.Spool.Depth)
+
+	ifaces := cfg.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []string{cfg.Interface}
+	}
+
+	var wg sync.WaitGroup
+	for _, iface := range ifaces {
+		workerCfg := cfg
+		workerCfg.Interface = iface
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(ctx, workerCfg)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// worker runs Step on cfg.Interface every cfg.Interval
+func worker(ctx context.Context, cfg Config) {
+	if addr, err := mac.Current(cfg.Interface); err == nil {
+		cfg.Status.SetMAC(cfg.Interface, addr.String())
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := Step(ctx, cfg); err != nil {
+			log.Printf("[ERROR] %s: %v\n", cfg.Interface, err)
+		}
+		// the systemd watchdog is only fed while every worker keeps stepping
+		cfg.Status.Stepped(cfg.Interface)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Step is one pass of the loop
+func Step(ctx context.Context, cfg Config) error {
+	cfg.setDefaults()
+	passiveScan(ctx, cfg)
+
+	ssid, err := cfg.CurrentSSID(ctx, cfg.Interface)
+	if err != nil {
+		return err
+	}
+	if ssid != cfg.SSID {
+		// not near a payphone, use the time to empty the spool
+		drainSpool(cfg)
+		return nil
+	}
+
+	portalCfg := cfg.Portal
+	portalCfg.Interface = cfg.Interface
+	session, err := portal.NewSession(portalCfg)
+	if err != nil {
+		return err
+	}
+
+	details, err := session.Detect(ctx)
+	if err != nil {
+		// connected but no portal, resetting the MAC usually fixes it
+		rotateMAC(cfg)
+		return fmt.Errorf("Can't detect portal: %v", err)
+	}
+	log.Printf("[INFO] %s: portal seen mac=%s id=%s time=%d\n", cfg.Interface, details.PayphoneMAC, details.PayphoneID, details.PayphoneTime)
+	cfg.Status.PortalSeen(status.PortalEvent{
+		Time:         time.Now(),
+		Interface:    cfg.Interface,
+		PayphoneMAC:  details.PayphoneMAC,
+		PayphoneID:   details.PayphoneID,
+		PayphoneTime: details.PayphoneTime,
+	})
+
+	data := common.Payload{
+		PayphoneMAC:  details.PayphoneMAC,
+		PayphoneID:   details.PayphoneID,
+		PayphoneTime: details.PayphoneTime,
+		Time:         time.Now().Unix(),
+		PortalURL:    details.URL,
+		Fix:          cfg.fix(),
+		Interface:    cfg.Interface,
+		Test:         cfg.Test,
+	}
+
+	if err := session.Grant(ctx, details); err != nil {
+		// keep the sighting, it goes up the next time we have internet
+		spoolPayload(cfg, data)
+		rotateMAC(cfg)
+		return fmt.Errorf("Can't get through portal: %v", err)
+	}
+	log.Printf("[INFO] %s: successfully connected to internet\n", cfg.Interface)
+
+	if err := send(cfg, data); err != nil {
+		spoolPayload(cfg, data)
+	} else {
+		drainSpool(cfg)
+	}
+
+	// change our MAC address (so we will have to sign in again when we re-see payphone)
+	rotateMAC(cfg)
+	return nil
+}
+
+func send(cfg Config, data common.Payload) error {
+	if err := upload.Validate(data); err != nil {
+		// the server would reject it too, don't spool it
+		log.Println("[ERROR] dropping payload:", err)
+		return nil
+	}
+	response, err := upload.Send(cfg.ServerAddress, cfg.Device, data)
+	cfg.Status.Uploaded(strings.TrimSpace(response), err)
+	if err != nil {
+		log.Println("[ERROR] upload failed:", err)
+		refreshPayloadKey(cfg, keyRetryInterval)
+		return err
+	}
+	log.Printf("[INFO] uploaded payphone %s, server said %q\n", data.PayphoneID, strings.TrimSpace(response))
+	refreshPayloadKey(cfg, keyRefreshInterval)
+	return nil
+}
+
+// refreshPayloadKey fetches the server's active payload key if the last
+// attempt was more than after ago
+func refreshPayloadKey(cfg Config, after time.Duration) {
+	cfg.keyRefresh.mu.Lock()
+	if cfg.PayloadKeyPath == "" || cfg.keyRefresh.fetching || time.Since(cfg.keyRefresh.last) < after {
+		cfg.keyRefresh.mu.Unlock()
+		return
+	}
+	cfg.keyRefresh.last = time.Now()
+	cfg.keyRefresh.fetching = true
+	cfg.keyRefresh.mu.Unlock()
+	defer func() {
+		cfg.keyRefresh.mu.Lock()
+		cfg.keyRefresh.fetching = false
+		cfg.keyRefresh.mu.Unlock()
+	}()
+
+	key, err := upload.FetchPayloadKey(cfg.ServerAddress, cfg.Device)
+	if err != nil {
+		log.Println("[ERROR] can't fetch payload key:", err)
+		return
+	}
+	if key.ID == cfg.Device.PayloadKey().ID {
+		return
+	}
+	if err := upload.SavePayloadKey(cfg.PayloadKeyPath, key); err != nil {
+		log.Println("[ERROR] can't save payload key:", err)
+		return
+	}
+	cfg.Device.SetPayloadKey(key)
+	log.Println("[INFO] switched to payload key", key.ID)
+}
+
+// passiveScan records the payphone hotspots in range every ScanInterval
+func passiveScan(ctx context.Context, cfg Config) {
+	if cfg.ScanInterval <= 0 {
+		return
+	}
+	cfg.scans.mu.Lock()
+	due := time.Since(cfg.scans.last[cfg.Interface]) >= cfg.ScanInterval
+	if due {
+		cfg.scans.last[cfg.Interface] = time.Now()
+	}
+	cfg.scans.mu.Unlock()
+	if !due {
+		return
+	}
+
+	bsses, err := cfg.Scan(ctx, cfg.Interface)
+	if err != nil {
+		log.Printf("[ERROR] %s: passive scan failed: %v\n", cfg.Interface, err)
+		return
+	}
+	sightings := scan.Sightings(bsses, cfg.SSID, time.Now())
+	cfg.Status.Scanned(cfg.Interface, len(bsses), len(sightings))
+	if len(sightings) == 0 {
+		return
+	}
+	fix := cfg.fix()
+	for i := range sightings {
+		sightings[i].Fix = fix
+		sightings[i].Interface = cfg.Interface
+	}
+	log.Printf("[INFO] %s: passive scan heard %d payphone hotspots\n", cfg.Interface, len(sightings))
+
+	cfg.scans.mu.Lock()
+	defer cfg.scans.mu.Unlock()
+	cfg.scans.pending = capPending(append(cfg.scans.pending, sightings...))
+}
+
+// capPending keeps the newest maxPendingSightings of pending
+func capPending(pending []common.Sighting) []common.Sighting {
+	if len(pending) > maxPendingSightings {
+		return pending[len(pending)-maxPendingSightings:]
+	}
+	return pending
+}
+
+// sendSightings uploads the sightings waiting from passive scans. They are
+// taken out of pending for the upload, so scans carry on adding to it and the
+// same sightings don't go up twice, and put back in front if it fails.
+func sendSightings(cfg Config) {
+	cfg.scans.mu.Lock()
+	sightings := cfg.scans.pending
+	cfg.scans.pending = nil
+	cfg.scans.mu.Unlock()
+	if len(sightings) == 0 {
+		return
+	}
+
+	report := common.ScanReport{Time: time.Now().Unix(), Sightings: sightings}
+	response, err := upload.SendSightings(cfg.ServerAddress, cfg.Device, report)
+	if err != nil {
+		log.Println("[ERROR] sighting upload failed:", err)
+		cfg.scans.mu.Lock()
+		cfg.scans.pending = capPending(append(sightings, cfg.scans.pending...))
+		cfg.scans.mu.Unlock()
+		return
+	}
+	log.Printf("[INFO] uploaded %d sightings, server said %q\n", len(report.Sightings), strings.TrimSpace(response))
+}
+
+// uploadLogs sends the log lines the server hasn't seen, at most every LogUploadInterval
+func uploadLogs(cfg Config) {
+	if cfg.Logs == nil || cfg.LogUploadInterval <= 0 {
+		return
+	}
+	cfg.logUploads.mu.Lock()
+	if time.Since(cfg.logUploads.last) < cfg.LogUploadInterval {
+		cfg.logUploads.mu.Unlock()
+		return
+	}
+	cfg.logUploads.last = time.Now()
+	from := cfg.logUploads.next
+	cfg.logUploads.mu.Unlock()
+
+	records, next := cfg.Logs.Since(from)
+	// the first record's sequence number, later than from if lines were pushed out of the ring
+	first := next - uint64(len(records))
+	if first > from {
+		log.Printf("[ERROR] %d log lines were pushed out before they were uploaded\n", first-from)
+	}
+	if len(records) == 0 {
+		return
+	}
+	sent, _, err := upload.SendLogs(cfg.ServerAddress, cfg.Device, records)
+	if err != nil {
+		log.Println("[ERROR] log upload failed:", err)
+		return
+	}
+
+	// the lines that didn't fit go next time
+	cfg.logUploads.mu.Lock()
+	cfg.logUploads.next = max(cfg.logUploads.next, first+uint64(sent))
+	cfg.logUploads.mu.Unlock()
+	log.Printf("[INFO] uploaded %d of %d log lines\n", sent, len(records))
+}
+
+func spoolPayload(cfg Config, data common.Payload) {
+	if err := cfg.Spool.Push(data); err != nil {
+		log.Println("[ERROR] can't spool payload:", err)
+		return
+	}
+	log.Println("[INFO] spooled payphone", data.PayphoneID)
+}
+
+func drainSpool(cfg Config) {
+	sendSightings(cfg)
+	uploadLogs(cfg)
+	if cfg.Spool.Depth() == 0 {
+		return
+	}
+	sent, err := cfg.Spool.Drain(func(data common.Payload) error {
+		return send(cfg, data)
+	})
+	if sent > 0 {
+		log.Printf("[INFO] uploaded %d spooled payloads\n", sent)
+	}
+	if err != nil {
+		log.Println("[INFO] spool not drained:", err)
+	}
+}
+
+func rotateMAC(cfg Config) {
+	addr, err := cfg.RotateMAC(cfg.Interface)
+	if err != nil {
+		log.Printf("[ERROR] %s: failed to change mac address: %v\n", cfg.Interface, err)
+		return
+	}
+	cfg.Status.MACRotated(cfg.Interface, addr.String())
+	log.Printf("[INFO] %s: successfully changed mac address to %s\n", cfg.Interface, addr)
+}
+
+// currentSSID asks iwgetid which network the interface is associated with
+func currentSSID(ctx context.Context, iface string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "iwgetid", "-r", iface).Output()
+	if err != nil {
+		// iwgetid exits non zero when not associated
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", nil
+		}
+		return "", fmt.Errorf("Can't run iwgetid %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,3 @@
+module client-indicum
+
+go 1.21
@@ -0,0 +1,147 @@
+// Package fakegpsd is a stand in gpsd that speaks enough of the JSON protocol
+// for client/gps: it greets with VERSION, answers ?WATCH with DEVICES and
+// WATCH and then sends a TPV report (with a SKY report before it, which the
+// client has to skip) for every fix it was given, or the reports it was given
+// as they are.
+package fakegpsd
+
+import (
+	"bufio"
+	"client-indicum/common"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report is one JSON object sent to a client, e.g. a TPV with only epx and epy
+type Report map[string]interface{}
+
+type GPSD struct {
+	listener net.Listener
+	fixes    []common.Fix
+	reports  []Report
+	interval time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// Start listens on addr (use 127.0.0.1:0 for a free port) and reports fixes to
+// every client that watches, one every interval. Fixes with no Time are
+// stamped with the time they are sent.
+func Start(addr string, fixes []common.Fix, interval time.Duration) (*GPSD, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen for fake gpsd %v", err)
+	}
+	g := &GPSD{listener: listener, fixes: fixes, interval: interval, conns: make(map[net.Conn]bool)}
+	go g.accept()
+	return g, nil
+}
+
+// StartReports is Start sending reports, one every interval, instead of a TPV per fix
+func StartReports(addr string, reports []Report, interval time.Duration) (*GPSD, error) {
+	g, err := Start(addr, nil, interval)
+	if err != nil {
+		return nil, err
+	}
+	g.reports = reports
+	return g, nil
+}
+
+func (g *GPSD) Addr() string {
+	return g.listener.Addr().String()
+}
+
+func (g *GPSD) Close() {
+	g.listener.Close()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for conn := range g.conns {
+		conn.Close()
+	}
+}
+
+func (g *GPSD) accept() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		g.mu.Lock()
+		g.conns[conn] = true
+		g.mu.Unlock()
+		go g.serve(conn)
+	}
+}
+
+func (g *GPSD) serve(conn net.Conn) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.conns, conn)
+		g.mu.Unlock()
+		conn.Close()
+	}()
+
+	send := func(report Report) error {
+		line, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(append(line, '\n'))
+		return err
+	}
+
+	if send(Report{"class": "VERSION", "release": "3.22", "rev": "3.22", "proto_major": 3, "proto_minor": 14}) != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		command, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(command, "?WATCH=") {
+			break
+		}
+	}
+
+	send(Report{"class": "DEVICES", "devices": []map[string]interface{}{{"class": "DEVICE", "path": "/dev/ttyACM0", "driver": "u-blox"}}})
+	send(Report{"class": "WATCH", "enable": true, "json": true})
+
+	for _, report := range g.reports {
+		if send(report) != nil {
+			return
+		}
+		time.Sleep(g.interval)
+	}
+	for _, fix := range g.fixes {
+		fixTime := time.Unix(fix.Time, 0)
+		if fix.Time == 0 {
+			fixTime = time.Now()
+		}
+		if send(Report{"class": "SKY", "device": "/dev/ttyACM0", "satellites": []interface{}{}}) != nil {
+			return
+		}
+		err := send(Report{
+			"class":  "TPV",
+			"device": "/dev/ttyACM0",
+			"mode":   3,
+			"time":   fixTime.UTC().Format(time.RFC3339Nano),
+			"lat":    fix.Lat,
+			"lon":    fix.Long,
+			"eph":    fix.Accuracy,
+		})
+		if err != nil {
+			return
+		}
+		time.Sleep(g.interval)
+	}
+
+	// keep the connection open like gpsd does, until the client or Close hangs up
+	reader.ReadString('\n')
+}
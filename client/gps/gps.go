@@ -0,0 +1,150 @@
+// Package gps reads positions from a local gpsd over its JSON protocol, so
+// devices with a USB GPS can attach where they were to each sighting instead
+// of the user pinning it on the map afterwards.
+//
+// The protocol is line based: the client sends ?WATCH={"enable":true,"json":true};
+// and gpsd answers with one JSON object per line. Only TPV (time, position,
+// velocity) reports are used, everything else (VERSION, DEVICES, SKY, ...) is skipped.
+package gps
+
+import (
+	"bufio"
+	"client-indicum/common"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultAddress is where gpsd listens unless told otherwise
+const DefaultAddress = "127.0.0.1:2947"
+
+const watchCommand = `?WATCH={"enable":true,"json":true};` + "\n"
+
+// how long to wait before reconnecting to gpsd
+const defaultReconnectInterval = 5 * time.Second
+
+// tpv is the part of a gpsd TPV report we use
+type tpv struct {
+	Class string `json:"class"`
+	// 0 unknown, 1 no fix, 2 2D, 3 3D
+	Mode int       `json:"mode"`
+	Time time.Time `json:"time"`
+	Lat  *float64  `json:"lat"`
+	Lon  *float64  `json:"lon"`
+	// eph is the horizontal error estimate, older gpsd only sends epx and epy
+	Eph *float64 `json:"eph"`
+	Epx *float64 `json:"epx"`
+	Epy *float64 `json:"epy"`
+}
+
+// ParseReport reads one line from gpsd. It returns false for anything that
+// isn't a TPV report with at least a 2D fix.
+func ParseReport(line []byte) (common.Fix, bool, error) {
+	var report tpv
+	if err := json.Unmarshal(line, &report); err != nil {
+		return common.Fix{}, false, fmt.Errorf("Can't parse gpsd report %v", err)
+	}
+	if report.Class != "TPV" || report.Mode < 2 || report.Lat == nil || report.Lon == nil || report.Time.IsZero() {
+		return common.Fix{}, false, nil
+	}
+
+	fix := common.Fix{
+		Lat:  *report.Lat,
+		Long: *report.Lon,
+		Time: report.Time.Unix(),
+	}
+	switch {
+	case report.Eph != nil:
+		fix.Accuracy = *report.Eph
+	case report.Epx != nil && report.Epy != nil:
+		fix.Accuracy = max(*report.Epx, *report.Epy)
+	default:
+		// no error estimate, don't claim to be accurate
+		return common.Fix{}, false, nil
+	}
+	return fix, true, nil
+}
+
+// Client keeps the latest fix from gpsd
+type Client struct {
+	addr      string
+	reconnect time.Duration
+
+	mu     sync.Mutex
+	latest *common.Fix
+}
+
+func New(addr string) *Client {
+	if addr == "" {
+		addr = DefaultAddress
+	}
+	return &Client{addr: addr, reconnect: defaultReconnectInterval}
+}
+
+// Run follows gpsd until ctx is cancelled, reconnecting when it goes away
+func (c *Client) Run(ctx context.Context) {
+	for {
+		err := c.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("[ERROR] gpsd:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.reconnect):
+		}
+	}
+}
+
+func (c *Client) watch(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("Can't connect to %s %v", c.addr, err)
+	}
+	defer conn.Close()
+
+	// unblock the read below when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Write([]byte(watchCommand)); err != nil {
+		return fmt.Errorf("Can't send watch command %v", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fix, ok, err := ParseReport(scanner.Bytes())
+		if err != nil {
+			log.Println("[ERROR]", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		c.latest = &fix
+		c.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Lost gpsd %v", err)
+	}
+	return fmt.Errorf("gpsd closed the connection")
+}
+
+// Latest returns the newest fix if it is less than maxAge old, nil otherwise
+func (c *Client) Latest(maxAge time.Duration) *common.Fix {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latest == nil || time.Since(time.Unix(c.latest.Time, 0)) > maxAge {
+		return nil
+	}
+	fix := *c.latest
+	return &fix
+}
@@ -0,0 +1,145 @@
+package gps
+
+import (
+	"client-indicum/common"
+	"client-indicum/gps/fakegpsd"
+	"context"
+	"testing"
+	"time"
+)
+
+// follow runs a client against gpsd until the test ends
+func follow(t *testing.T, addr string) *Client {
+	client := New(addr)
+	client.reconnect = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return client
+}
+
+// waitFor polls Latest until it has a fix at lat
+func waitFor(t *testing.T, client *Client, lat float64) common.Fix {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if fix := client.Latest(time.Hour); fix != nil && fix.Lat == lat {
+			return *fix
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no fix at %v from gpsd, latest is %+v", lat, client.Latest(time.Hour))
+	return common.Fix{}
+}
+
+func tpvReport(lat float64, fields fakegpsd.Report) fakegpsd.Report {
+	report := fakegpsd.Report{
+		"class": "TPV",
+		"mode":  3,
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"lat":   lat,
+		"lon":   144.9631,
+	}
+	for key, value := range fields {
+		report[key] = value
+	}
+	return report
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		report fakegpsd.Report
+		// accuracy is what the fix should have, -1 when the report should be skipped
+		accuracy float64
+	}{
+		{"eph", tpvReport(-37.1, fakegpsd.Report{"eph": 4.2}), 4.2},
+		{"epx and epy", tpvReport(-37.2, fakegpsd.Report{"epx": 3.5, "epy": 6.5}), 6.5},
+		{"eph over epx and epy", tpvReport(-37.3, fakegpsd.Report{"eph": 2.0, "epx": 3.5, "epy": 6.5}), 2.0},
+		{"2D fix", tpvReport(-37.4, fakegpsd.Report{"mode": 2, "eph": 9.0}), 9.0},
+		{"no fix", tpvReport(-37.5, fakegpsd.Report{"mode": 1, "eph": 4.2}), -1},
+		{"unknown mode", tpvReport(-37.6, fakegpsd.Report{"mode": 0, "eph": 4.2}), -1},
+		{"no error estimate", tpvReport(-37.7, nil), -1},
+		{"only epx", tpvReport(-37.8, fakegpsd.Report{"epx": 3.5}), -1},
+		{"SKY", tpvReport(-37.9, fakegpsd.Report{"class": "SKY", "eph": 4.2}), -1},
+		{"no time", tpvReport(-38.0, fakegpsd.Report{"time": nil, "eph": 4.2}), -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a good fix first, a skipped report must not replace it
+			const before = -36.0
+			reports := []fakegpsd.Report{tpvReport(before, fakegpsd.Report{"eph": 1.0}), test.report}
+			gpsd, err := fakegpsd.StartReports("127.0.0.1:0", reports, 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gpsd.Close()
+			client := follow(t, gpsd.Addr())
+
+			if test.accuracy < 0 {
+				waitFor(t, client, before)
+				// the report comes 10ms after the first, give it time to be read
+				time.Sleep(200 * time.Millisecond)
+				if fix := client.Latest(time.Hour); fix == nil || fix.Lat != before {
+					t.Fatalf("skipped report replaced the fix, latest is %+v", fix)
+				}
+				return
+			}
+
+			fix := waitFor(t, client, test.report["lat"].(float64))
+			if fix.Accuracy != test.accuracy || fix.Long != 144.9631 {
+				t.Fatalf("fix is %+v, expected accuracy %v", fix, test.accuracy)
+			}
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	gpsd, err := fakegpsd.Start("127.0.0.1:0", []common.Fix{{Lat: -37.1, Long: 144.9, Accuracy: 4}}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := gpsd.Addr()
+	client := follow(t, addr)
+	waitFor(t, client, -37.1)
+
+	// gpsd restarts, the client keeps its last fix and follows the new one
+	gpsd.Close()
+	gpsd, err = fakegpsd.Start(addr, []common.Fix{{Lat: -37.2, Long: 144.9, Accuracy: 4}}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gpsd.Close()
+	waitFor(t, client, -37.2)
+}
+
+func TestLatestMaxAge(t *testing.T) {
+	recorded := time.Now().Add(-10 * time.Minute).Unix()
+	gpsd, err := fakegpsd.Start("127.0.0.1:0", []common.Fix{{Lat: -37.1, Long: 144.9, Accuracy: 4, Time: recorded}}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gpsd.Close()
+	client := follow(t, gpsd.Addr())
+
+	fix := waitFor(t, client, -37.1)
+	if fix.Time != recorded {
+		t.Fatalf("fix time is %d, expected %d", fix.Time, recorded)
+	}
+	if fix := client.Latest(time.Minute); fix != nil {
+		t.Fatalf("a 10 minute old fix is newer than a minute: %+v", fix)
+	}
+}
+
+func TestLatestBeforeFix(t *testing.T) {
+	if fix := New("127.0.0.1:1").Latest(time.Hour); fix != nil {
+		t.Fatalf("fix before gpsd was read: %+v", fix)
+	}
+}
@@ -0,0 +1,320 @@
+// Package keystore loads the device private key, which can be stored
+// encrypted with a passphrase derived from secrets of the machine it was
+// provisioned on. A key file copied off the SD card is then useless on its own.
+//
+// Encrypted keys are a PEM block of type "INDICUM ENCRYPTED PRIVATE KEY":
+// the PKCS#8 DER sealed with AES-256 GCM, the key derived with
+// PBKDF2-HMAC-SHA256 from the machine secret and a random salt. The KDF
+// parameters and which machine secrets were used are kept in the PEM headers.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	EncryptedBlockType = "INDICUM ENCRYPTED PRIVATE KEY"
+	plainBlockType     = "PRIVATE KEY"
+
+	kdfName           = "pbkdf2-sha256"
+	defaultIterations = 200000
+)
+
+// places the machine secret is read from. machine-id lives on the SD card,
+// the board serial is burnt into the SoC so it doesn't travel with the card.
+var secretSources = map[string]string{
+	"machine-id": "/etc/machine-id",
+	"serial":     "/sys/firmware/devicetree/base/serial-number",
+}
+
+// offCardSources are the sources that aren't on the SD card. A key has to be
+// sealed with one of them, the salt is in the PEM headers so a key sealed with
+// machine-id alone decrypts with nothing but the card.
+var offCardSources = map[string]bool{"serial": true}
+
+// machineSecret reads and concatenates the named sources
+func machineSecret(sources []string) ([]byte, error) {
+	var secret []byte
+	for _, name := range sources {
+		path, ok := secretSources[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown machine secret source %q", name)
+		}
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read machine secret %s: %v", name, err)
+		}
+		value = []byte(strings.Trim(string(value), "\x00\n "))
+		if len(value) == 0 {
+			return nil, fmt.Errorf("Machine secret %s is empty", name)
+		}
+		secret = append(secret, []byte(name+"=")...)
+		secret = append(secret, value...)
+		secret = append(secret, '\n')
+	}
+	return secret, nil
+}
+
+// hasOffCardSource reports whether sources includes one that isn't on the SD card
+func hasOffCardSource(sources []string) bool {
+	for _, name := range sources {
+		if offCardSources[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// availableSources are the sources readable on this machine. machine-id and
+// the board serial are both required, there is no point encrypting without
+// the serial.
+func availableSources() ([]string, error) {
+	sources := []string{"machine-id", "serial"}
+	if _, err := machineSecret(sources); err != nil {
+		return nil, fmt.Errorf("%v, refusing to encrypt: without the board serial the key would decrypt with what's on the SD card alone", err)
+	}
+	return sources, nil
+}
+
+// pbkdf2 is PBKDF2 (RFC 8018) with HMAC-SHA256, one 32 byte block is all AES-256 needs
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	var blockIndex [4]byte
+	binary.BigEndian.PutUint32(blockIndex[:], 1)
+	prf.Write(blockIndex[:])
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// IsEncrypted reports whether the PEM file at path holds an encrypted key
+func IsEncrypted(path string) (bool, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return false, fmt.Errorf("No PEM block in %s", path)
+	}
+	return block.Type == EncryptedBlockType, nil
+}
+
+// Load reads an RSA private key from path, plaintext PKCS#8 or encrypted
+func Load(path string) (*rsa.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read private key file %v", err)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block in %s", path)
+	}
+
+	der := block.Bytes
+	if block.Type == EncryptedBlockType {
+		der, err = decrypt(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parse(der)
+}
+
+func parse(der []byte) (*rsa.PrivateKey, error) {
+	parsedPrivateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse from bytes to rsa.PrivKey: %v", err)
+	}
+	privKey, ok := parsedPrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is a %T, not RSA", parsedPrivateKey)
+	}
+	return privKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals a PKCS#8 DER key for this machine
+func encrypt(der []byte) (*pem.Block, error) {
+	sources, err := availableSources()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := machineSecret(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(pbkdf2(secret, salt, defaultIterations))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: EncryptedBlockType,
+		Headers: map[string]string{
+			"KDF":            kdfName,
+			"Iterations":     strconv.Itoa(defaultIterations),
+			"Salt":           hex.EncodeToString(salt),
+			"Nonce":          hex.EncodeToString(nonce),
+			"Secret-Sources": strings.Join(sources, ","),
+		},
+		Bytes: aesgcm.Seal(nil, nonce, der, []byte(EncryptedBlockType)),
+	}, nil
+}
+
+func decrypt(block *pem.Block) ([]byte, error) {
+	if block.Headers["KDF"] != kdfName {
+		return nil, fmt.Errorf("Unsupported key KDF %q", block.Headers["KDF"])
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("Bad key KDF iterations %q", block.Headers["Iterations"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad key salt %v", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad key nonce %v", err)
+	}
+
+	secret, err := machineSecret(strings.Split(block.Headers["Secret-Sources"], ","))
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(pbkdf2(secret, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aesgcm.NonceSize() {
+		return nil, fmt.Errorf("Bad key nonce length %d", len(nonce))
+	}
+	der, err := aesgcm.Open(nil, nonce, block.Bytes, []byte(EncryptedBlockType))
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt private key, was it provisioned on another machine? %v", err)
+	}
+	return der, nil
+}
+
+// EncryptFile encrypts the plaintext key at path in place. The encrypted key
+// is decrypted and compared before it replaces the original, and the file
+// keeps its permissions. A key sealed with on-card secrets only, by an older
+// client, is decrypted and sealed again. Returns false if the key was already
+// encrypted with the board serial.
+func EncryptFile(path string) (bool, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Can't read private key file %v", err)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return false, fmt.Errorf("No PEM block in %s", path)
+	}
+
+	plain := block.Bytes
+	switch {
+	case block.Type == EncryptedBlockType:
+		if hasOffCardSource(strings.Split(block.Headers["Secret-Sources"], ",")) {
+			return false, nil
+		}
+		if plain, err = decrypt(block); err != nil {
+			return false, err
+		}
+	case block.Type != plainBlockType:
+		return false, fmt.Errorf("Expected a PKCS#8 %q block, got %q", plainBlockType, block.Type)
+	}
+	original, err := parse(plain)
+	if err != nil {
+		return false, err
+	}
+
+	encrypted, err := encrypt(plain)
+	if err != nil {
+		return false, fmt.Errorf("Can't encrypt private key %v", err)
+	}
+
+	// make sure we can get the key back before throwing the plaintext away
+	der, err := decrypt(encrypted)
+	if err != nil {
+		return false, err
+	}
+	roundTrip, err := parse(der)
+	if err != nil || !roundTrip.Equal(original) {
+		return false, fmt.Errorf("Encrypted key doesn't decrypt to the original")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".priv_key-*")
+	if err != nil {
+		return false, fmt.Errorf("Can't create temp key file %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := pem.Encode(tmp, encrypted); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := keepOwner(tmp.Name(), info); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, fmt.Errorf("Can't replace key file %v", err)
+	}
+	return true, nil
+}
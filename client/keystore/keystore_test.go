@@ -0,0 +1,160 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMachine points the secret sources at files in a temp dir, an empty
+// serial leaves it missing like on a board without a device tree serial
+func fakeMachine(t *testing.T, serial string) {
+	dir := t.TempDir()
+	saved := secretSources
+	secretSources = map[string]string{
+		"machine-id": filepath.Join(dir, "machine-id"),
+		"serial":     filepath.Join(dir, "serial-number"),
+	}
+	t.Cleanup(func() { secretSources = saved })
+
+	if err := os.WriteFile(secretSources["machine-id"], []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if serial != "" {
+		if err := os.WriteFile(secretSources["serial"], []byte(serial+"\x00"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeKey(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "priv_key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: plainBlockType, Bytes: der}), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestEncryptFile(t *testing.T) {
+	fakeMachine(t, "10000000a1b2c3d4")
+	path, key := writeKey(t)
+
+	encrypted, err := EncryptFile(path)
+	if err != nil || !encrypted {
+		t.Fatalf("EncryptFile = %v, %v", encrypted, err)
+	}
+	if isEncrypted, _ := IsEncrypted(path); !isEncrypted {
+		t.Fatal("key isn't encrypted")
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("decrypted key isn't the original")
+	}
+	if encrypted, err := EncryptFile(path); err != nil || encrypted {
+		t.Fatalf("encrypting again = %v, %v", encrypted, err)
+	}
+
+	// on another board the serial differs
+	fakeMachine(t, "10000000deadbeef")
+	if _, err := Load(path); err == nil {
+		t.Fatal("key decrypted with another board's serial")
+	}
+}
+
+func TestEncryptFileNeedsSerial(t *testing.T) {
+	fakeMachine(t, "")
+	path, _ := writeKey(t)
+	before, _ := os.ReadFile(path)
+
+	if _, err := EncryptFile(path); err == nil || !strings.Contains(err.Error(), "refusing to encrypt") {
+		t.Fatalf("expected a refusal without the board serial, got %v", err)
+	}
+	after, _ := os.ReadFile(path)
+	if string(before) != string(after) {
+		t.Fatal("key file changed")
+	}
+}
+
+// a key an older client sealed with machine-id alone is sealed again with the serial
+func TestEncryptFileReseals(t *testing.T) {
+	fakeMachine(t, "10000000a1b2c3d4")
+	path, key := writeKey(t)
+	keyBytes, _ := os.ReadFile(path)
+	block, _ := pem.Decode(keyBytes)
+
+	secret, _ := machineSecret([]string{"machine-id"})
+	salt, nonce := make([]byte, 16), make([]byte, 12)
+	aesgcm, _ := newGCM(pbkdf2(secret, salt, 1))
+	weak := &pem.Block{
+		Type: EncryptedBlockType,
+		Headers: map[string]string{
+			"KDF":            kdfName,
+			"Iterations":     "1",
+			"Salt":           hex.EncodeToString(salt),
+			"Nonce":          hex.EncodeToString(nonce),
+			"Secret-Sources": "machine-id",
+		},
+		Bytes: aesgcm.Seal(nil, nonce, block.Bytes, []byte(EncryptedBlockType)),
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(weak), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := EncryptFile(path)
+	if err != nil || !encrypted {
+		t.Fatalf("EncryptFile = %v, %v", encrypted, err)
+	}
+	keyBytes, _ = os.ReadFile(path)
+	block, _ = pem.Decode(keyBytes)
+	if block.Headers["Secret-Sources"] != "machine-id,serial" {
+		t.Fatalf("sealed with %q", block.Headers["Secret-Sources"])
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("decrypted key isn't the original")
+	}
+}
+
+// TestPBKDF2 checks pbkdf2 against the PBKDF2-HMAC-SHA256 vectors in RFC 7914
+// section 11. Those are 64 bytes long, pbkdf2 only makes the first 32 byte
+// block, so it has to match the first half.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got := hex.EncodeToString(pbkdf2([]byte(tt.password), []byte(tt.salt), tt.iterations))
+			if got != tt.want[:64] {
+				t.Fatalf("got %s, want %s", got, tt.want[:64])
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package keystore
+
+import (
+	"os"
+	"syscall"
+)
+
+// keepOwner gives path the owner and group of the original key file,
+// the playbook makes it readable by the indicum group
+func keepOwner(path string, original os.FileInfo) error {
+	stat, ok := original.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Chown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package keystore
+
+import (
+	"os"
+)
+
+func keepOwner(path string, original os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,103 @@
+// Package logring keeps the daemon's recent log lines in memory as
+// structured records so they can be uploaded to the server, and field devices
+// can be debugged without pulling them off the pole.
+package logring
+
+import (
+	"bytes"
+	"client-indicum/common"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSize is how many lines are kept
+const DefaultSize = 2000
+
+// Ring is an io.Writer for the log package. Lines are passed on to out and
+// the newest size of them are kept. Every line gets a sequence number so an
+// uploader can ask for what it hasn't sent yet.
+type Ring struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	records []common.LogRecord
+	// seq is the sequence number of the next line, the oldest kept is seq - len(records)
+	seq     uint64
+	start   int
+	partial []byte
+}
+
+func New(size int, out io.Writer) *Ring {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Ring{out: out, records: make([]common.LogRecord, 0, size)}
+}
+
+func (r *Ring) Write(p []byte) (int, error) {
+	n, err := r.out.Write(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.partial = append(r.partial, p...)
+	for {
+		end := bytes.IndexByte(r.partial, '\n')
+		if end < 0 {
+			break
+		}
+		r.add(string(r.partial[:end]))
+		r.partial = r.partial[end+1:]
+	}
+	return n, err
+}
+
+// add stores one line, must be called with r.mu held
+func (r *Ring) add(line string) {
+	record := parse(line, time.Now())
+	if len(r.records) < cap(r.records) {
+		r.records = append(r.records, record)
+	} else {
+		r.records[r.start] = record
+		r.start = (r.start + 1) % len(r.records)
+	}
+	r.seq++
+}
+
+// the log package prefixes lines with `2006/01/02 15:04:05 ` and the daemon
+// starts messages with a level like `[INFO] `
+func parse(line string, now time.Time) common.LogRecord {
+	record := common.LogRecord{Time: now.UnixMilli(), Message: line}
+	const stamp = "2006/01/02 15:04:05 "
+	if len(line) >= len(stamp) {
+		if _, err := time.ParseInLocation(stamp, line[:len(stamp)], time.Local); err == nil {
+			record.Message = line[len(stamp):]
+		}
+	}
+	if strings.HasPrefix(record.Message, "[") {
+		if end := strings.Index(record.Message, "] "); end > 0 && end < 10 {
+			record.Level = record.Message[1:end]
+			record.Message = record.Message[end+2:]
+		}
+	}
+	return record
+}
+
+// Since returns the lines kept from sequence number seq on, and the sequence
+// number to ask for next time. Lines that have already been pushed out of the
+// ring are skipped.
+func (r *Ring) Since(seq uint64) ([]common.LogRecord, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldest := r.seq - uint64(len(r.records))
+	if seq < oldest {
+		seq = oldest
+	}
+	var records []common.LogRecord
+	for i := seq - oldest; i < uint64(len(r.records)); i++ {
+		records = append(records, r.records[(r.start+int(i))%len(r.records)])
+	}
+	return records, r.seq
+}
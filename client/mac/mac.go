@@ -0,0 +1,94 @@
+// Package mac rotates the hardware address of a network interface so the
+// device looks like a new client to a payphone and has to sign in again.
+// This replaces the old `ifconfig down && macchanger -r && ifconfig up` dance.
+package mac
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+)
+
+// RandomLocal returns a random 48 bit MAC address with the locally
+// administered bit set and the multicast bit cleared, so it can never clash
+// with a vendor assigned (universally administered) address.
+func RandomLocal() (net.HardwareAddr, error) {
+	addr := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(addr); err != nil {
+		return nil, fmt.Errorf("Can't read random bytes %v", err)
+	}
+	// bit 0 of the first octet is unicast/multicast, bit 1 is universal/local
+	addr[0] = (addr[0] &^ 0x01) | 0x02
+	return addr, nil
+}
+
+// IsLocalUnicast reports whether addr is a locally administered unicast address
+func IsLocalUnicast(addr net.HardwareAddr) bool {
+	return len(addr) == 6 && addr[0]&0x01 == 0 && addr[0]&0x02 != 0
+}
+
+// Current returns the hardware address the kernel currently reports for ifname
+func Current(ifname string) (net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, fmt.Errorf("Can't find interface %s: %v", ifname, err)
+	}
+	return iface.HardwareAddr, nil
+}
+
+// Rotate gives ifname a new random locally administered unicast address.
+// The link is taken down for the change (most wifi drivers refuse otherwise)
+// and brought back up if it was up before. The new address is read back from
+// the kernel and an error is returned if it didn't take effect.
+func Rotate(ifname string) (net.HardwareAddr, error) {
+	addr, err := RandomLocal()
+	if err != nil {
+		return nil, err
+	}
+	if err := Set(ifname, addr); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// Set changes the hardware address of ifname to addr and verifies it.
+// Only locally administered unicast addresses are accepted.
+func Set(ifname string, addr net.HardwareAddr) error {
+	if !IsLocalUnicast(addr) {
+		return fmt.Errorf("Refusing to set %s: not a locally administered unicast address", addr)
+	}
+
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return fmt.Errorf("Can't find interface %s: %v", ifname, err)
+	}
+	wasUp := iface.Flags&net.FlagUp != 0
+
+	if wasUp {
+		if err := setLinkUp(iface.Index, false); err != nil {
+			return fmt.Errorf("Can't bring %s down: %v", ifname, err)
+		}
+	}
+
+	setErr := setLinkAddress(iface.Index, addr)
+
+	// always try to restore the link, even if the address change failed
+	if wasUp {
+		if err := setLinkUp(iface.Index, true); err != nil {
+			return fmt.Errorf("Can't bring %s up: %v", ifname, err)
+		}
+	}
+	if setErr != nil {
+		return fmt.Errorf("Can't set address on %s: %v", ifname, setErr)
+	}
+
+	got, err := Current(ifname)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, addr) {
+		return fmt.Errorf("Address on %s is %s after setting %s", ifname, got, addr)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package mac
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRandomLocal(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		addr, err := RandomLocal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsLocalUnicast(addr) {
+			t.Fatalf("%s isn't a locally administered unicast address", addr)
+		}
+		seen[addr.String()] = true
+	}
+	if len(seen) < 100 {
+		t.Fatalf("only %d different addresses in 100", len(seen))
+	}
+}
+
+func TestSetRefusesVendorAddresses(t *testing.T) {
+	for _, addr := range []string{"00:11:22:33:44:55", "03:11:22:33:44:55", "ff:ff:ff:ff:ff:ff"} {
+		hw, _ := net.ParseMAC(addr)
+		if err := Set("lo", hw); err == nil {
+			t.Errorf("Set accepted %s", addr)
+		}
+	}
+}
+
+// hasNetAdmin reports whether the process has CAP_NET_ADMIN in its effective set
+func hasNetAdmin() bool {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		caps, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		effective, err := strconv.ParseUint(strings.TrimSpace(caps), 16, 64)
+		// CAP_NET_ADMIN is capability 12
+		return err == nil && effective&(1<<12) != 0
+	}
+	return false
+}
+
+// TestRotateDummy rotates the address of a dummy interface, it needs
+// CAP_NET_ADMIN and the dummy driver so it's skipped without them:
+//
+//	sudo go test ./mac -run Dummy
+func TestRotateDummy(t *testing.T) {
+	if runtime.GOOS != "linux" || !hasNetAdmin() {
+		t.Skip("needs linux and CAP_NET_ADMIN")
+	}
+	const ifname = "indicumtest0"
+	if out, err := exec.Command("ip", "link", "add", ifname, "type", "dummy").CombinedOutput(); err != nil {
+		t.Skipf("can't create a dummy interface: %v %s", err, out)
+	}
+	defer exec.Command("ip", "link", "del", ifname).Run()
+
+	for _, up := range []bool{false, true} {
+		if up {
+			if out, err := exec.Command("ip", "link", "set", ifname, "up").CombinedOutput(); err != nil {
+				t.Fatalf("can't bring %s up: %v %s", ifname, err, out)
+			}
+		}
+
+		before, err := Current(ifname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := Rotate(ifname)
+		if err != nil {
+			t.Fatalf("rotating with the link up=%v: %v", up, err)
+		}
+		got, err := Current(ifname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, addr) || bytes.Equal(got, before) {
+			t.Fatalf("address is %s after rotating from %s to %s", got, before, addr)
+		}
+
+		iface, err := net.InterfaceByName(ifname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isUp := iface.Flags&net.FlagUp != 0; isUp != up {
+			t.Fatalf("link up is %v after rotating, was %v", isUp, up)
+		}
+	}
+}
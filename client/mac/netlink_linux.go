@@ -0,0 +1,109 @@
+//go:build linux
+
+package mac
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setLinkAddress sends RTM_NEWLINK with an IFLA_ADDRESS attribute
+func setLinkAddress(index int, addr net.HardwareAddr) error {
+	info := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(index),
+	}
+	return linkRequest(info, rtAttr(syscall.IFLA_ADDRESS, addr))
+}
+
+// setLinkUp sends RTM_NEWLINK changing only the IFF_UP flag
+func setLinkUp(index int, up bool) error {
+	info := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(index),
+		Change: syscall.IFF_UP,
+	}
+	if up {
+		info.Flags = syscall.IFF_UP
+	}
+	return linkRequest(info, nil)
+}
+
+func rtAttr(attrType uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	buf := make([]byte, nlAlign(length))
+	binary.NativeEndian.PutUint16(buf[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(buf[2:4], attrType)
+	copy(buf[syscall.SizeofRtAttr:], data)
+	return buf
+}
+
+func nlAlign(length int) int {
+	return (length + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
+
+// linkRequest sends a single RTM_NEWLINK request over rtnetlink and waits for the ack
+func linkRequest(info syscall.IfInfomsg, attrs []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("Can't open netlink socket %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("Can't bind netlink socket %v", err)
+	}
+
+	const seq = 1
+	length := syscall.SizeofNlMsghdr + syscall.SizeofIfInfomsg + len(attrs)
+	msg := make([]byte, length)
+
+	// struct nlmsghdr
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(length))
+	binary.NativeEndian.PutUint16(msg[4:6], syscall.RTM_NEWLINK)
+	binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	binary.NativeEndian.PutUint32(msg[12:16], 0)
+
+	// struct ifinfomsg
+	body := msg[syscall.SizeofNlMsghdr:]
+	body[0] = info.Family
+	binary.NativeEndian.PutUint16(body[2:4], info.Type)
+	binary.NativeEndian.PutUint32(body[4:8], uint32(info.Index))
+	binary.NativeEndian.PutUint32(body[8:12], info.Flags)
+	binary.NativeEndian.PutUint32(body[12:16], info.Change)
+
+	copy(body[syscall.SizeofIfInfomsg:], attrs)
+
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("Can't send netlink request %v", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("Can't read netlink reply %v", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("Can't parse netlink reply %v", err)
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != seq || reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return fmt.Errorf("Short netlink error message")
+			}
+			// an error message with errno 0 is the ack
+			errno := int32(binary.NativeEndian.Uint32(reply.Data[0:4]))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(-errno)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package mac
+
+import (
+	"fmt"
+	"net"
+)
+
+// rtnetlink only exists on linux, the device only ever runs linux
+
+func setLinkAddress(index int, addr net.HardwareAddr) error {
+	return fmt.Errorf("MAC rotation is only supported on linux")
+}
+
+func setLinkUp(index int, up bool) error {
+	return fmt.Errorf("MAC rotation is only supported on linux")
+}
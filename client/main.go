@@ -1,194 +1,427 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"client-indicum/common"
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
-	"encoding/pem"
+	"client-indicum/conformance"
+	"client-indicum/daemon"
+	"client-indicum/gps"
+	"client-indicum/gps/fakegpsd"
+	"client-indicum/keystore"
+	"client-indicum/logring"
+	"client-indicum/mac"
+	"client-indicum/portal"
+	"client-indicum/portal/fakeportal"
+	"client-indicum/scan"
+	"client-indicum/sdnotify"
+	"client-indicum/simulate"
+	"client-indicum/spool"
+	"client-indicum/status"
+	"client-indicum/upload"
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-// frame structure
-// FRAMESTART | frameLength | frameType | data
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const (
+	defaultServerAddress = "touchgrass.au:8888"
+	defaultUUIDPath      = "/etc/indicum/uuid.txt"
+	defaultPrivPath      = "/etc/indicum/priv_key.pem"
+	defaultPayloadKey    = "/etc/indicum/payload_key"
+	defaultSecretPath    = "/etc/indicum/device_secret"
+)
 
 // Read device UUID, public and private key from
 // /etc/indicum/pub_key.pem and /etc/indicum/priv_key.pem and /etc/indicum/uuid.txt
 
 func main() {
 
-	// needed since it is self signed key
-	config := &tls.Config{InsecureSkipVerify: true}
+	// subcommands, anything else is the original
+	// `client-indicum <payphone_mac> <payphone_id> <payphone_time>` usage
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "rotate-mac":
+			rotateMAC(os.Args[2:])
+			return
+		case "encrypt-key":
+			encryptKey(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "scan":
+			runScan(os.Args[2:])
+			return
+		case "gps":
+			runGPS(os.Args[2:])
+			return
+		case "conformance":
+			runConformance(os.Args[2:])
+			return
+		case "version":
+			fmt.Println(version)
+			return
+		}
+	}
 
-	address := "touchgrass.au:8888"
-	deviceUUIDPath := "/etc/indicum/uuid.txt"
-	deviceRSAPrivPath := "/etc/indicum/priv_key.pem"
+	if len(os.Args) < 4 {
+		log.Fatalf("Not enough args")
+	}
 
-	conn, err := tls.Dial("tcp", address, config)
+	device, err := upload.LoadDevice(defaultUUIDPath, defaultPrivPath, defaultSecretPath, defaultPayloadKey)
+	if err != nil {
+		log.Fatalf("Can't load device identity: %v\n", err)
+	}
 
-	defer conn.Close()
+	payphoneTime, _ := strconv.Atoi(os.Args[3])
+	data := common.Payload{
+		PayphoneMAC:  os.Args[1],
+		PayphoneID:   os.Args[2],
+		PayphoneTime: int64(payphoneTime),
+		Time:         time.Now().Unix(),
+	}
+
+	response, err := upload.Send(defaultServerAddress, device, data)
 	if err != nil {
-		log.Println("Can't dial", err)
+		log.Println(err)
 		return
 	}
+	// Convert response to a string and print it
+	fmt.Println("Server said: ", response)
+}
 
-	deviceFileContent, err := os.ReadFile(deviceUUIDPath)
+// runs the device main loop, see client/daemon
+// usage: client-indicum daemon [-iface wlan0] [-status 127.0.0.1:8089] ...
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	ifaces := flags.String("iface", "wlan0", "wifi interfaces to use, comma separated (e.g. wlan0,wlan1)")
+	ssid := flags.String("ssid", "Free Telstra Wi-Fi", "SSID of the payphone hotspots")
+	server := flags.String("server", defaultServerAddress, "address of the device server")
+	statusAddr := flags.String("status", "127.0.0.1:8089", "address for the local status endpoint, empty to disable")
+	spoolDir := flags.String("spool", "/var/lib/indicum/spool", "directory for payloads waiting to be uploaded")
+	uuidPath := flags.String("uuid", defaultUUIDPath, "device UUID file")
+	privPath := flags.String("key", defaultPrivPath, "device private key")
+	secretPath := flags.String("secret", defaultSecretPath, "device attestation secret from enrollment")
+	payloadKeyPath := flags.String("payload-key", defaultPayloadKey, "payload key fetched from the server")
+	interval := flags.Duration("interval", 5*time.Second, "time between checks")
+	scanInterval := flags.Duration("scan-interval", 0, "how often to passively scan for payphone hotspots, 0 disables it")
+	logUploadInterval := flags.Duration("log-upload-interval", time.Hour, "how often to upload recent logs to the server, 0 disables it")
+	test := flags.Bool("test", false, "send payloads as test submissions, they show up on the profile page but don't count")
+	gpsdAddr := flags.String("gpsd", "", "gpsd address (e.g. "+gps.DefaultAddress+") to attach GPS fixes to sightings, empty without a GPS")
+	flags.Parse(args)
+
+	// keep recent lines for the log upload
+	logs := logring.New(logring.DefaultSize, os.Stderr)
+	log.SetOutput(logs)
+
+	device, err := upload.LoadDevice(*uuidPath, *privPath, *secretPath, *payloadKeyPath)
 	if err != nil {
-		log.Fatalf("Can't read deviceUUID file %v\n", err)
+		log.Fatalf("Can't load device identity: %v\n", err)
 	}
-	deviceUUID := string(deviceFileContent)
 
-	deviceRSAPrivBytes, err := os.ReadFile(deviceRSAPrivPath)
+	deviceSpool, err := spool.Open(*spoolDir)
 	if err != nil {
-		log.Fatalf("Can't read deviceRSAPriv file %v\n", err)
+		log.Fatalf("Can't open spool: %v\n", err)
 	}
 
-	deviceRSAPrivBlock, _ := pem.Decode(deviceRSAPrivBytes)
-	parsedPrivateKey, err := x509.ParsePKCS8PrivateKey(deviceRSAPrivBlock.Bytes)
-	if err != nil {
-		log.Fatalf("Can't parse from bytes to rsa.PrivKey: %v\n", err)
+	var interfaces []string
+	for _, iface := range strings.Split(*ifaces, ",") {
+		if iface = strings.TrimSpace(iface); iface != "" {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	if len(interfaces) == 0 {
+		log.Fatalf("No interfaces given\n")
 	}
 
-	deviceRSAPriv := parsedPrivateKey.(*rsa.PrivateKey)
+	st := status.New(version, interfaces)
+	if *statusAddr != "" {
+		go status.Serve(*statusAddr, st)
+	}
 
-	fmt.Printf("Client Private Key Type: %T\n", deviceRSAPriv)
-	fmt.Printf("Client Private Key Size: %d bits\n", deviceRSAPriv.Size()*8)
-	fmt.Printf("Client Private Key Public Exponent: %d\n", deviceRSAPriv.PublicKey.E)
-	fmt.Printf("Client Private Key Public Modulus: %x\n", deviceRSAPriv.PublicKey.N.Bytes())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if len(os.Args) < 3 {
-		log.Fatalf("Not enough args")
+	var gpsClient *gps.Client
+	if *gpsdAddr != "" {
+		gpsClient = gps.New(*gpsdAddr)
+		go gpsClient.Run(ctx)
 	}
 
-	payphoneMAC := os.Args[1]
-	payphoneID := os.Args[2]
-	payphoneTime, _ := strconv.Atoi(os.Args[3])
-	payphoneTime64 := int64(payphoneTime)
-
-	err = sendDeviceData(conn, deviceUUID, deviceRSAPriv, payphoneMAC, payphoneID, payphoneTime64)
+	log.Printf("[INFO] client-indicum %s watching %s for %q\n", version, strings.Join(interfaces, ", "), *ssid)
+	if *test {
+		log.Println("[INFO] test mode, payloads are sent as test submissions")
+	}
+	go notifySystemd(ctx, st, *interval)
+	err = daemon.Run(ctx, daemon.Config{
+		Interfaces:     interfaces,
+		SSID:           *ssid,
+		ServerAddress:  *server,
+		Interval:       *interval,
+		Portal:         portal.Config{},
+		Device:         device,
+		PayloadKeyPath: *payloadKeyPath,
+		Spool:          deviceSpool,
+		Status:         st,
+		ScanInterval:   *scanInterval,
+		GPS:            gpsClient,
+
+		Logs:              logs,
+		LogUploadInterval: *logUploadInterval,
+		Test:              *test,
+	})
+	sdnotify.Notify(sdnotify.Stopping)
+	log.Println("[INFO] daemon stopped:", err)
+}
 
+// notifySystemd tells systemd the daemon is up, then feeds its watchdog for
+// as long as every interface worker keeps finishing passes of its loop, so a
+// wedged worker gets the daemon restarted. Does nothing outside systemd.
+// stepInterval is the time workers wait between passes.
+func notifySystemd(ctx context.Context, st *status.Status, stepInterval time.Duration) {
+	notified, err := sdnotify.Notify(sdnotify.Ready)
 	if err != nil {
-		log.Println("Can't send device data: ", err)
+		log.Println("[ERROR]", err)
+	}
+	if !notified {
 		return
 	}
 
-	err = readResponse(conn)
-
-	if err != nil {
-		log.Println("Can't read response", err)
+	// without a watchdog just keep the status line up to date
+	interval := 30 * time.Second
+	watchdog, watchdogOn := sdnotify.WatchdogInterval()
+	if watchdogOn {
+		interval = watchdog / 2
 	}
 
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		snap := st.Snapshot()
+		line := fmt.Sprintf("%d interfaces, %d uploads ok, %d failed, %d spooled",
+			len(snap.Interfaces), snap.UploadsOK, snap.UploadsFailed, snap.SpoolDepth)
+		if !watchdogOn {
+			sdnotify.Notify(sdnotify.Status(line))
+			continue
+		}
+
+		if stalled := st.Stalled(watchdog + stepInterval); len(stalled) > 0 {
+			// stop feeding the watchdog, systemd restarts us
+			log.Println("[ERROR] workers stalled, not feeding the watchdog:", strings.Join(stalled, ", "))
+			sdnotify.Notify(sdnotify.Status("stalled: " + strings.Join(stalled, ", ")))
+			continue
+		}
+		if _, err := sdnotify.Notify(sdnotify.Watchdog + "\n" + sdnotify.Status(line)); err != nil {
+			log.Println("[ERROR]", err)
+		}
+	}
 }
 
-// function to send data about device to server
-// error check by returning error to main
-func sendDeviceData(conn net.Conn, deviceUUID string, deviceRSAPriv *rsa.PrivateKey, payphoneMAC, payphoneID string, payphoneTime int64) error {
-	// placeholder data
-	// DeviceID and PayphoneID will be 40 chars
-	// will also send geoData (probably through IP geo API)
-	// geoLocation := common.Coord{ Lat: -25.36364, Long: 134.21173}
-	data := common.Payload{
-		PayphoneMAC:  payphoneMAC,
-		PayphoneID:   payphoneID,
-		PayphoneTime: payphoneTime,
-		Time:         time.Now().Unix(),
+// runs the daemon against recorded captive portals, see client/simulate
+// usage: client-indicum simulate [-server 127.0.0.1:8888] [-fixtures dir] [-scenario name]
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	server := flags.String("server", "", "address of a local device server to upload to, empty only checks the portal handling")
+	fixtures := flags.String("fixtures", "", "directory of recorded portal scenarios, defaults to the ones built in")
+	scenario := flags.String("scenario", "", "only run this scenario")
+	uuidPath := flags.String("uuid", defaultUUIDPath, "device UUID file")
+	privPath := flags.String("key", defaultPrivPath, "device private key")
+	secretPath := flags.String("secret", defaultSecretPath, "device attestation secret from enrollment")
+	payloadKeyPath := flags.String("payload-key", defaultPayloadKey, "payload key, common.KeyOne if missing")
+	flags.Parse(args)
+
+	cfg := simulate.Config{
+		Fixtures:      fakeportal.Fixtures(),
+		Scenario:      *scenario,
+		ServerAddress: *server,
 	}
-	if len(data.PayphoneMAC) != 17 {
-		return fmt.Errorf("Incorrect format for MAC\n")
+	if *fixtures != "" {
+		cfg.Fixtures = os.DirFS(*fixtures)
 	}
-	if len(data.PayphoneID) != 40 {
-		return fmt.Errorf("Incorrect format for PayphoneID\n")
+	if *server != "" {
+		device, err := upload.LoadDevice(*uuidPath, *privPath, *secretPath, *payloadKeyPath)
+		if err != nil {
+			log.Fatalf("Can't load device identity: %v\n", err)
+		}
+		cfg.Device = device
 	}
-	if len(data.PayphoneID) != 40 {
-		return fmt.Errorf("Incorrect format for PayphoneID\n")
-	}
-	hash := sha256.New()
-	// add forgeResistance string to allow only trusted data (from this program)
-	// to send requests to server
-	forgeString := data.PayphoneID[3:len(data.PayphoneID)-3] + "_forge_resistance"
-	hash.Write([]byte(forgeString))
-	data.ForgeResistance = hex.EncodeToString(hash.Sum(nil))
 
-	key1, err := hex.DecodeString(common.KeyOne)
+	results, err := simulate.Run(context.Background(), cfg)
 	if err != nil {
-		return fmt.Errorf("Can't decode key %s", err.Error())
+		log.Fatalf("Can't run simulation: %v\n", err)
 	}
 
-	dataBytes, err := json.Marshal(data)
-	// encrypt data using key
-	ciphertext, nonce, err := common.Encrypt(dataBytes, key1)
-	if err != nil {
-		return fmt.Errorf("Can't encrypt %v\n", err)
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", result.Scenario, result.Err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", result.Scenario)
 	}
+	if failed > 0 {
+		fmt.Printf("%d of %d scenarios failed\n", failed, len(results))
+		os.Exit(1)
+	}
+}
 
-	// sign data using public key
-	hashedCipher := sha256.Sum256(ciphertext)
-
-	signature, err := rsa.SignPKCS1v15(nil, deviceRSAPriv, crypto.SHA256, hashedCipher[:])
-
-	fmt.Printf("Client Signature Length: %d bytes\n", len(signature))
+// prints the payphone hotspots in a wifi scan
+// usage: client-indicum scan [-iface wlan0 | -file capture.txt]
+func runScan(args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	iface := flags.String("iface", "wlan0", "wifi interface to scan on")
+	file := flags.String("file", "", "parse captured `iw dev <iface> scan` output instead of scanning")
+	ssid := flags.String("ssid", "Free Telstra Wi-Fi", "SSID of the payphone hotspots, empty prints every BSS")
+	flags.Parse(args)
+
+	var bsses []scan.BSS
+	var err error
+	if *file != "" {
+		var capture *os.File
+		capture, err = os.Open(*file)
+		if err != nil {
+			log.Fatalf("Can't open %s: %v\n", *file, err)
+		}
+		defer capture.Close()
+		bsses, err = scan.Parse(capture)
+	} else {
+		bsses, err = scan.Run(context.Background(), *iface)
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to sign data with deviceRSA public key %v\n", err)
+		log.Fatalf("Can't scan: %v\n", err)
 	}
 
-	// sends the UUID in clear (so server knows how to decrypt)
-	// sends the signature in clear (so server can verify)
-	// sends the nonce in the clear (so the server can decrypt the symmetric encryption)
-	var combinedData bytes.Buffer
-	combinedData.Write([]byte(deviceUUID))
-	combinedData.Write(signature)
-	combinedData.Write(nonce)
-	combinedData.Write(ciphertext)
+	for _, bss := range bsses {
+		if *ssid != "" && bss.SSID != *ssid {
+			continue
+		}
+		fmt.Printf("%s  %6.2f dBm  %4d MHz  %-8v  %q\n", bss.BSSID, bss.Signal, bss.Frequency, bss.LastSeen, bss.SSID)
+	}
+}
 
-	dataLength := combinedData.Len()
+// prints fixes from gpsd as the daemon would see them
+// usage: client-indicum gps [-gpsd 127.0.0.1:2947] [-fake]
+func runGPS(args []string) {
+	flags := flag.NewFlagSet("gps", flag.ExitOnError)
+	gpsdAddr := flags.String("gpsd", gps.DefaultAddress, "gpsd address")
+	fake := flags.Bool("fake", false, "start a fake gpsd with a fixed position and read from that")
+	flags.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *fake {
+		fakeGPSD, err := fakegpsd.Start("127.0.0.1:0", simulate.Fixes, time.Second)
+		if err != nil {
+			log.Fatalf("Can't start fake gpsd: %v\n", err)
+		}
+		defer fakeGPSD.Close()
+		*gpsdAddr = fakeGPSD.Addr()
+	}
 
-	if dataLength >= 65536 {
-		return fmt.Errorf("Payload too large")
+	client := gps.New(*gpsdAddr)
+	go client.Run(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fix := client.Latest(time.Minute)
+		if fix == nil || fix.Time == last {
+			continue
+		}
+		last = fix.Time
+		fmt.Printf("%s  %.7f,%.7f  ±%.1fm\n", time.Unix(fix.Time, 0).Format(time.RFC3339), fix.Lat, fix.Long, fix.Accuracy)
 	}
+}
 
-	binaryDataLen := make([]byte, 2)
-	binary.LittleEndian.PutUint16(binaryDataLen, uint16(dataLength))
+// checks the frame encoder against the shared protocol vectors, exits non zero on a mismatch
+// usage: client-indicum conformance [-dir ../protocol/vectors]
+func runConformance(args []string) {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	dir := flags.String("dir", "../protocol/vectors", "directory with the v<n>/vectors.json files")
+	flags.Parse(args)
 
-	var buf bytes.Buffer
+	results, err := conformance.Check(os.DirFS(*dir))
+	if err != nil {
+		log.Fatalf("Can't check conformance vectors: %v\n", err)
+	}
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", result.Name, result.Err)
+		case result.Skipped:
+			fmt.Printf("skip %s (server only)\n", result.Name)
+		default:
+			fmt.Printf("ok   %s\n", result.Name)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d vectors failed\n", failed, len(results))
+		os.Exit(1)
+	}
+}
 
-	buf.Write(common.FRAMESTART[:])
-	buf.WriteByte(common.FrameTypeSendDeviceData)
-	buf.Write(binaryDataLen)
-	buf.Write(combinedData.Bytes())
-	fmt.Println("length", binaryDataLen)
-	fmt.Println("deviceUUID", deviceUUID)
-	fmt.Println("signature", signature)
-	fmt.Println("nonce", nonce)
-	fmt.Println("ciphertext", ciphertext)
+// encrypts a plaintext device key in place with a passphrase derived from this
+// machine, see client/keystore. Safe to run more than once.
+// usage: client-indicum encrypt-key [-key /etc/indicum/priv_key.pem]
+func encryptKey(args []string) {
+	flags := flag.NewFlagSet("encrypt-key", flag.ExitOnError)
+	privPath := flags.String("key", defaultPrivPath, "device private key to encrypt")
+	flags.Parse(args)
 
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("Failed to write payload %s\n", err)
+	encrypted, err := keystore.EncryptFile(*privPath)
+	if err != nil {
+		log.Fatalf("Can't encrypt %s: %v\n", *privPath, err)
 	}
-
-	return nil
+	if !encrypted {
+		fmt.Println(*privPath, "is already encrypted")
+		return
+	}
+	fmt.Println("Encrypted", *privPath)
 }
 
-func readResponse(conn net.Conn) error {
-	reader := bufio.NewReader(conn)
-	response, err := io.ReadAll(reader)
+// rotates the MAC address of an interface through rtnetlink
+// usage: client-indicum rotate-mac [-iface wlan0]
+func rotateMAC(args []string) {
+	flags := flag.NewFlagSet("rotate-mac", flag.ExitOnError)
+	iface := flags.String("iface", "wlan0", "interface to give a new random MAC address")
+	flags.Parse(args)
 
+	oldAddr, err := mac.Current(*iface)
 	if err != nil {
-		return fmt.Errorf("Can't read response: %v", err)
+		log.Fatalf("Can't read current MAC: %v\n", err)
 	}
-	// Convert response to a string and print it
-	fmt.Println("Client said: ", string(response))
-	return nil
+
+	newAddr, err := mac.Rotate(*iface)
+	if err != nil {
+		log.Fatalf("Can't rotate MAC: %v\n", err)
+	}
+	fmt.Printf("Changed MAC on %s from %s to %s\n", *iface, oldAddr, newAddr)
 }
@@ -0,0 +1,21 @@
+//go:build linux
+
+package portal
+
+import (
+	"syscall"
+)
+
+// bindToDevice pins sockets to one interface, like curl --interface
+func bindToDevice(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package portal
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func bindToDevice(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("Binding to %s is only supported on linux", ifname)
+	}
+}
@@ -0,0 +1,226 @@
+// Package fakeportal serves recorded Telstra captive portal responses so the
+// portal handling can be exercised without standing next to a payphone.
+//
+// Every directory under fixtures/ is a scenario:
+//
+//	scenario.json  status of the probe response, the redirect query string and what the client should extract
+//	probe.html     body returned for the intercepted probe request
+//	splash.html    the splash page, sets the session cookie
+//	grant.html     the grant response, only returned with the session cookie
+//
+// The html files are text/template with {{.Redirect}} and {{.Grant}}
+// pointing back at the fake portal.
+package fakeportal
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed fixtures
+var embedded embed.FS
+
+// Fixtures are the scenarios recorded in this repo
+func Fixtures() fs.FS {
+	sub, _ := fs.Sub(embedded, "fixtures")
+	return sub
+}
+
+// Expect is what the client should pull out of the redirect
+type Expect struct {
+	PayphoneMAC  string `json:"payphoneMAC"`
+	PayphoneID   string `json:"payphoneID"`
+	PayphoneTime int64  `json:"payphoneTime"`
+	// DetectError is set when the portal response should be rejected
+	DetectError bool `json:"detectError"`
+}
+
+type Scenario struct {
+	Name           string `json:"-"`
+	Description    string `json:"description"`
+	ProbeStatus    int    `json:"probeStatus"`
+	LocationHeader bool   `json:"locationHeader"`
+	RedirectQuery  string `json:"redirectQuery"`
+	Expect         Expect `json:"expect"`
+
+	probe  *template.Template
+	splash *template.Template
+	grant  *template.Template
+}
+
+const sessionCookie = "meraki_splash_session"
+
+// Portal is a running fake portal
+type Portal struct {
+	scenarios map[string]*Scenario
+	listener  net.Listener
+	server    *http.Server
+}
+
+// Load reads every scenario in fixtures
+func Load(fixtures fs.FS) ([]*Scenario, error) {
+	entries, err := fs.ReadDir(fixtures, ".")
+	if err != nil {
+		return nil, fmt.Errorf("Can't read fixtures %v", err)
+	}
+
+	var scenarios []*Scenario
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		scenario, err := loadScenario(fixtures, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Scenario %s: %v", entry.Name(), err)
+		}
+		scenarios = append(scenarios, scenario)
+	}
+	sort.Slice(scenarios, func(i, j int) bool { return scenarios[i].Name < scenarios[j].Name })
+	return scenarios, nil
+}
+
+func loadScenario(fixtures fs.FS, name string) (*Scenario, error) {
+	manifest, err := fs.ReadFile(fixtures, name+"/scenario.json")
+	if err != nil {
+		return nil, err
+	}
+	scenario := &Scenario{Name: name}
+	if err := json.Unmarshal(manifest, scenario); err != nil {
+		return nil, fmt.Errorf("Can't parse scenario.json %v", err)
+	}
+
+	for file, tmpl := range map[string]**template.Template{
+		"probe.html":  &scenario.probe,
+		"splash.html": &scenario.splash,
+		"grant.html":  &scenario.grant,
+	} {
+		*tmpl, err = template.ParseFS(fixtures, name+"/"+file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scenario, nil
+}
+
+// Start serves the scenarios on addr (use 127.0.0.1:0 for a random port)
+func Start(addr string, scenarios []*Scenario) (*Portal, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on %s %v", addr, err)
+	}
+
+	p := &Portal{
+		scenarios: make(map[string]*Scenario),
+		listener:  listener,
+	}
+	for _, scenario := range scenarios {
+		p.scenarios[scenario.Name] = scenario
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe/", p.serveProbe)
+	mux.HandleFunc("/splash/", p.serveSplash)
+	mux.HandleFunc("/grant/", p.serveGrant)
+	p.server = &http.Server{Handler: mux}
+
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+func (p *Portal) Close() error {
+	return p.server.Close()
+}
+
+func (p *Portal) base() string {
+	return "http://" + p.listener.Addr().String()
+}
+
+// ProbeURL is what the client should request instead of http://google.com
+func (p *Portal) ProbeURL(scenario string) string {
+	return p.base() + "/probe/" + scenario
+}
+
+// GrantURL is what the client should use instead of the network-auth.com grant url
+func (p *Portal) GrantURL(scenario string) string {
+	return p.base() + "/grant/" + scenario + "?continue_url="
+}
+
+func (p *Portal) redirectURL(scenario *Scenario) string {
+	return p.base() + "/splash/" + scenario.Name + "/?" + scenario.RedirectQuery
+}
+
+// finds the scenario from /<route>/<name>/...
+func (p *Portal) scenario(w http.ResponseWriter, r *http.Request) (*Scenario, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	scenario, ok := p.scenarios[parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return scenario, true
+}
+
+func (p *Portal) render(w http.ResponseWriter, tmpl *template.Template, scenario *Scenario, status int) {
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, map[string]string{
+		"Redirect": p.redirectURL(scenario),
+		"Grant":    p.GrantURL(scenario.Name),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func (p *Portal) serveProbe(w http.ResponseWriter, r *http.Request) {
+	scenario, ok := p.scenario(w, r)
+	if !ok {
+		return
+	}
+	if scenario.LocationHeader {
+		w.Header().Set("Location", p.redirectURL(scenario))
+	}
+	p.render(w, scenario.probe, scenario, scenario.ProbeStatus)
+}
+
+func (p *Portal) serveSplash(w http.ResponseWriter, r *http.Request) {
+	scenario, ok := p.scenario(w, r)
+	if !ok {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: scenario.Name, Path: "/"})
+	p.render(w, scenario.splash, scenario, http.StatusOK)
+}
+
+// like the real portal the grant only works with the splash cookie and the ajax header
+func (p *Portal) serveGrant(w http.ResponseWriter, r *http.Request) {
+	scenario, ok := p.scenario(w, r)
+	if !ok {
+		return
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value != scenario.Name {
+		http.Error(w, "no splash session", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Requested-With") == "" {
+		http.Error(w, "missing X-Requested-With", http.StatusForbidden)
+		return
+	}
+	p.render(w, scenario.grant, scenario, http.StatusOK)
+}
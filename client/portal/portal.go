@@ -0,0 +1,198 @@
+// Package portal talks to the Telstra captive portal. It finds the splash
+// page redirect (which carries the payphone MAC, ID and time), collects the
+// session cookies and asks the portal to grant internet access.
+package portal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// any plain http site works, the portal intercepts it
+	DefaultProbeURL = "http://google.com"
+	DefaultGrantURL = "https://apac.network-auth.com/splash/NAxIVbNc.5.167/grant?continue_url="
+)
+
+type Config struct {
+	// Interface to bind to, empty means let the kernel pick
+	Interface string
+	ProbeURL  string
+	GrantURL  string
+	Timeout   time.Duration
+}
+
+// Details are the payphone fields the portal puts in its redirect URL
+type Details struct {
+	PayphoneMAC  string
+	PayphoneID   string
+	PayphoneTime int64
+	// URL is the full redirect URL the fields came from
+	URL string
+}
+
+// a session holds the cookies for one sign in, so use a new one per portal
+type Session struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewSession(cfg Config) (*Session, error) {
+	if cfg.ProbeURL == "" {
+		cfg.ProbeURL = DefaultProbeURL
+	}
+	if cfg.GrantURL == "" {
+		cfg.GrantURL = DefaultGrantURL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 20 * time.Second
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("Can't create cookie jar %v", err)
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if cfg.Interface != "" {
+		dialer.Control = bindToDevice(cfg.Interface)
+	}
+	transport := &http.Transport{
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: cfg.Timeout,
+	}
+
+	return &Session{
+		cfg: cfg,
+		client: &http.Client{
+			Jar:       jar,
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+	}, nil
+}
+
+// Detect requests the probe URL without following redirects and pulls the
+// payphone details out of the portal redirect
+func (s *Session) Detect(ctx context.Context) (Details, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.ProbeURL, nil)
+	if err != nil {
+		return Details{}, err
+	}
+
+	client := *s.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Details{}, fmt.Errorf("Initial request failed %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return Details{}, fmt.Errorf("Can't read probe response %v", err)
+	}
+
+	if redirect := resp.Header.Get("Location"); redirect != "" {
+		return ParseURL(redirect)
+	}
+	return fromBody(string(body), resp.StatusCode)
+}
+
+// Grant follows the portal redirect chain to pick up the session cookies and
+// then asks the portal to let us through
+func (s *Session) Grant(ctx context.Context, details Details) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, details.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't load splash page %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.GrantURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Requested-With", "XMLHTTPRequest")
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Grant request failed %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Grant request returned %s", resp.Status)
+	}
+	return nil
+}
+
+// HTTPClient returns the interface bound client used by the session
+func (s *Session) HTTPClient() *http.Client {
+	return s.client
+}
+
+var quoted = regexp.MustCompile(`"([^"]*)"`)
+
+// without a Location header the redirect is one of the quoted strings in the
+// splash html, the first one that parses as a portal URL wins
+func fromBody(body string, statusCode int) (Details, error) {
+	var lastErr error
+	for _, match := range quoted.FindAllStringSubmatch(body, -1) {
+		candidate := strings.ReplaceAll(match[1], "&amp;", "&")
+		if !strings.Contains(candidate, "://") {
+			continue
+		}
+		details, err := ParseURL(candidate)
+		if err == nil {
+			return details, nil
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return Details{}, lastErr
+	}
+	return Details{}, fmt.Errorf("No portal redirect in probe response (status %d)", statusCode)
+}
+
+// ParseURL extracts the payphone MAC (mac), ID (a) and time (b) from a portal redirect URL
+func ParseURL(raw string) (Details, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return Details{}, fmt.Errorf("Can't parse portal URL %v", err)
+	}
+	query := parsed.Query()
+
+	details := Details{
+		PayphoneMAC: query.Get("mac"),
+		PayphoneID:  query.Get("a"),
+		URL:         raw,
+	}
+	payphoneTime := query.Get("b")
+
+	if details.PayphoneMAC == "" || details.PayphoneID == "" || payphoneTime == "" {
+		return Details{}, fmt.Errorf("One or more payphone details are missing from %s", raw)
+	}
+
+	details.PayphoneTime, err = strconv.ParseInt(payphoneTime, 10, 64)
+	if err != nil {
+		return Details{}, fmt.Errorf("Payphone time %q is not a number", payphoneTime)
+	}
+	return details, nil
+}
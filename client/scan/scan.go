@@ -0,0 +1,164 @@
+// Package scan reads `iw dev <iface> scan` output so the device can record
+// payphone hotspots it hears without connecting to them. These sightings only
+// have a BSSID and a signal strength, so the server keeps them apart from
+// entries, which need the whole portal sequence to succeed.
+package scan
+
+import (
+	"bufio"
+	"client-indicum/common"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BSS is one access point in the scan output
+type BSS struct {
+	BSSID string `json:"bssid"`
+	SSID  string `json:"ssid"`
+	// Signal is in dBm
+	Signal float64 `json:"signal"`
+	// Frequency is in MHz
+	Frequency int `json:"frequency"`
+	// LastSeen is how long before the scan finished the BSS was heard
+	LastSeen   time.Duration `json:"lastSeen"`
+	Associated bool          `json:"associated"`
+}
+
+// Run scans on iface with iw and parses the result. iw needs root (or
+// CAP_NET_ADMIN) to trigger a scan.
+func Run(ctx context.Context, iface string) ([]BSS, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "iw", "dev", iface, "scan").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("iw scan failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("Can't run iw %v", err)
+	}
+	return Parse(strings.NewReader(string(out)))
+}
+
+// Parse reads the output of `iw dev <iface> scan`. Each BSS starts with a
+// `BSS <mac>(on <iface>)` line at the start of the line and its fields are
+// indented one tab. Anything indented further belongs to an information
+// element (RSN, HT operation, ...) and is skipped.
+func Parse(r io.Reader) ([]BSS, error) {
+	var bsses []BSS
+	var current *BSS
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "BSS ") {
+			bss, err := parseHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", lineNumber, err)
+			}
+			bsses = append(bsses, bss)
+			current = &bsses[len(bsses)-1]
+			continue
+		}
+		if current == nil || !strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "\t\t") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line[1:], ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "SSID":
+			current.SSID = unescapeSSID(value)
+		case "signal":
+			// -61.00 dBm
+			current.Signal, err = strconv.ParseFloat(strings.TrimSuffix(value, " dBm"), 64)
+		case "freq":
+			// 2437, newer iw prints 2437.0
+			var freq float64
+			freq, err = strconv.ParseFloat(value, 64)
+			current.Frequency = int(freq)
+		case "last seen":
+			// iw prints both `last seen: 1432.560s [boottime]` and `last seen: 120 ms ago`
+			if ms, ok := strings.CutSuffix(value, " ms ago"); ok {
+				var n int64
+				n, err = strconv.ParseInt(ms, 10, 64)
+				current.LastSeen = time.Duration(n) * time.Millisecond
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: bad %s %q", lineNumber, key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read scan output %v", err)
+	}
+	return bsses, nil
+}
+
+// BSS 1c:28:af:12:34:56(on wlan0) -- associated
+func parseHeader(line string) (BSS, error) {
+	rest := strings.TrimPrefix(line, "BSS ")
+	end := strings.IndexAny(rest, "( ")
+	if end < 0 {
+		end = len(rest)
+	}
+	addr, err := net.ParseMAC(rest[:end])
+	if err != nil || len(addr) != 6 {
+		return BSS{}, fmt.Errorf("bad BSSID in %q", line)
+	}
+	return BSS{
+		BSSID:      addr.String(),
+		Associated: strings.Contains(rest[end:], "-- associated"),
+	}, nil
+}
+
+// iw escapes bytes outside printable ASCII (and backslash) as \xNN
+func unescapeSSID(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if n, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Sightings picks the BSSes broadcasting ssid out of a scan that finished at scanned
+func Sightings(bsses []BSS, ssid string, scanned time.Time) []common.Sighting {
+	var sightings []common.Sighting
+	for _, bss := range bsses {
+		if bss.SSID != ssid {
+			continue
+		}
+		sightings = append(sightings, common.Sighting{
+			BSSID:     bss.BSSID,
+			SSID:      bss.SSID,
+			Signal:    bss.Signal,
+			Frequency: bss.Frequency,
+			Time:      scanned.Add(-bss.LastSeen).Unix(),
+		})
+	}
+	return sightings
+}
@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseFixtures parses every captured `iw dev wlan0 scan` in testdata,
+// <name>.txt, and compares it with the BSSes in <name>.json. Add a capture
+// there whenever iw changes its output.
+func TestParseFixtures(t *testing.T) {
+	captures, err := filepath.Glob("testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no scan fixtures in testdata")
+	}
+
+	for _, capture := range captures {
+		name := strings.TrimSuffix(filepath.Base(capture), ".txt")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := Parse(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedBytes, err := os.ReadFile(strings.TrimSuffix(capture, ".txt") + ".json")
+			if err != nil {
+				t.Fatalf("can't read expected BSSes %v", err)
+			}
+			var expected []BSS
+			if err := json.Unmarshal(expectedBytes, &expected); err != nil {
+				t.Fatalf("can't parse expected BSSes %v", err)
+			}
+
+			if len(got) != len(expected) {
+				t.Fatalf("parsed %d BSSes, expected %d", len(got), len(expected))
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i], expected[i]) {
+					t.Errorf("BSS %d is %+v, expected %+v", i, got[i], expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"bad bssid", "BSS 1c:28:af:12:34(on wlan0)\n"},
+		{"bad signal", "BSS 1c:28:af:12:34:56(on wlan0)\n\tsignal: loud\n"},
+		{"bad freq", "BSS 1c:28:af:12:34:56(on wlan0)\n\tfreq: 2.4GHz\n"},
+		{"bad last seen", "BSS 1c:28:af:12:34:56(on wlan0)\n\tlast seen: soon ms ago\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bsses, err := Parse(strings.NewReader(test.output)); err == nil {
+				t.Fatalf("parsed %+v", bsses)
+			}
+		})
+	}
+}
+
+func TestSightings(t *testing.T) {
+	scanned := time.Unix(1700000000, 0)
+	bsses := []BSS{
+		{BSSID: "02:1a:11:f3:9c:01", SSID: "Free Telstra Wi-Fi", Signal: -82, Frequency: 2412, LastSeen: 2 * time.Second},
+		{BSSID: "3c:84:6a:aa:bb:cd", SSID: "Cafe Guest", Signal: -56, Frequency: 2462},
+	}
+	sightings := Sightings(bsses, "Free Telstra Wi-Fi", scanned)
+	if len(sightings) != 1 || sightings[0].BSSID != "02:1a:11:f3:9c:01" {
+		t.Fatalf("sightings are %+v", sightings)
+	}
+	if sightings[0].Time != scanned.Unix()-2 {
+		t.Fatalf("sighting time is %d, expected %d", sightings[0].Time, scanned.Unix()-2)
+	}
+}
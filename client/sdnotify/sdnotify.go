@@ -0,0 +1,61 @@
+// Package sdnotify speaks systemd's notify protocol: datagrams of
+// newline separated VAR=value assignments sent to the unix socket in
+// $NOTIFY_SOCKET. It lets indicum.service use Type=notify and WatchdogSec,
+// so systemd knows when the daemon is up and restarts it if it wedges.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status is a one line description of what the daemon is doing, shown by systemctl status
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Notify sends state to systemd. It returns false without an error when the
+// process wasn't started by systemd with a notify socket.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// a leading @ is an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("Can't connect to notify socket %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("Can't notify systemd %v", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval is the WatchdogSec systemd set for this process, false if
+// the watchdog is off (or meant for another process)
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
@@ -0,0 +1,103 @@
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen stands in for systemd's notify socket, name is what goes in NOTIFY_SOCKET
+func listen(t *testing.T, name, address string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func received(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	abstract := fmt.Sprintf("indicum-sdnotify-test-%d", os.Getpid())
+	tests := []struct {
+		name string
+		// socket is NOTIFY_SOCKET, address is where systemd listens
+		socket, address string
+		linuxOnly       bool
+	}{
+		{"path", path, path, false},
+		// the @ becomes a leading NUL, the name mustn't be looked up on disk
+		{"abstract", "@" + abstract, "\x00" + abstract, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("abstract sockets are linux only")
+			}
+			conn := listen(t, tt.socket, tt.address)
+
+			sent, err := Notify(Ready + "\n" + Status("connected"))
+			if err != nil || !sent {
+				t.Fatalf("Notify sent %v, %v", sent, err)
+			}
+			if got := received(t, conn); got != "READY=1\nSTATUS=connected" {
+				t.Fatalf("systemd got %q", got)
+			}
+		})
+	}
+}
+
+func TestNotifyNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatalf("Notify without a socket sent %v, %v", sent, err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if sent, err := Notify(Ready); sent || err == nil {
+		t.Fatalf("Notify to a missing socket sent %v, %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		ok        bool
+	}{
+		{"30000000", "", 30 * time.Second, true},
+		{"30000000", self, 30 * time.Second, true},
+		{"30000000", "1", 0, false},
+		{"", "", 0, false},
+		{"0", "", 0, false},
+		{"-5", "", 0, false},
+		{"30s", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.usec+"/"+tt.pid, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			got, ok := WatchdogInterval()
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("got %v %v, want %v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
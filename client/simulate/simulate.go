@@ -0,0 +1,198 @@
+// Package simulate runs the daemon against the recorded portals in
+// client/portal/fakeportal and checks what it extracted and uploaded.
+// Every scenario goes through the same daemon.Step as a real device, only
+// the SSID lookup and MAC rotation are stubbed out and gpsd is a fake one.
+package simulate
+
+import (
+	"client-indicum/common"
+	"client-indicum/daemon"
+	"client-indicum/gps"
+	"client-indicum/gps/fakegpsd"
+	"client-indicum/portal"
+	"client-indicum/portal/fakeportal"
+	"client-indicum/spool"
+	"client-indicum/status"
+	"client-indicum/upload"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const simulatedSSID = "Free Telstra Wi-Fi"
+
+// Fixes are what the fake gpsd reports, the payphone on Swanston St outside the GPO
+var Fixes = []common.Fix{{Lat: -37.8136, Long: 144.9631, Accuracy: 4.2}}
+
+type Config struct {
+	Fixtures fs.FS
+	// Scenario limits the run to one scenario, empty runs them all
+	Scenario string
+	// ServerAddress of a local device server, empty skips the upload
+	ServerAddress string
+	Device        *upload.Device
+}
+
+type Result struct {
+	Scenario string
+	Err      error
+}
+
+// Run plays every scenario and returns one result per scenario
+func Run(ctx context.Context, cfg Config) ([]Result, error) {
+	scenarios, err := fakeportal.Load(cfg.Fixtures)
+	if err != nil {
+		return nil, err
+	}
+
+	fake, err := fakeportal.Start("127.0.0.1:0", scenarios)
+	if err != nil {
+		return nil, err
+	}
+	defer fake.Close()
+
+	gpsClient, err := startGPS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, scenario := range scenarios {
+		if cfg.Scenario != "" && cfg.Scenario != scenario.Name {
+			continue
+		}
+		err := runScenario(ctx, cfg, fake, gpsClient, scenario)
+		results = append(results, Result{Scenario: scenario.Name, Err: err})
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("No scenario named %q", cfg.Scenario)
+	}
+	return results, nil
+}
+
+// startGPS follows a fake gpsd until ctx is done and waits for the first fix
+func startGPS(ctx context.Context) (*gps.Client, error) {
+	fakeGPSD, err := fakegpsd.Start("127.0.0.1:0", Fixes, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	gpsClient := gps.New(fakeGPSD.Addr())
+	gpsCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		gpsClient.Run(gpsCtx)
+		fakeGPSD.Close()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gpsClient.Latest(time.Minute) == nil {
+		if time.Now().After(deadline) {
+			cancel()
+			return nil, fmt.Errorf("No fix from the fake gpsd")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	context.AfterFunc(ctx, cancel)
+	return gpsClient, nil
+}
+
+func runScenario(ctx context.Context, cfg Config, fake *fakeportal.Portal, gpsClient *gps.Client, scenario *fakeportal.Scenario) error {
+	spoolDir, err := os.MkdirTemp("", "indicum-simulate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spoolDir)
+	scenarioSpool, err := spool.Open(spoolDir)
+	if err != nil {
+		return err
+	}
+
+	st := status.New("simulate", nil)
+	rotations := 0
+	stepErr := daemon.Step(ctx, daemon.Config{
+		SSID:          simulatedSSID,
+		ServerAddress: cfg.ServerAddress,
+		Interval:      time.Second,
+		Portal: portal.Config{
+			ProbeURL: fake.ProbeURL(scenario.Name),
+			GrantURL: fake.GrantURL(scenario.Name),
+			Timeout:  5 * time.Second,
+		},
+		Device: cfg.Device,
+		Spool:  scenarioSpool,
+		Status: st,
+		GPS:    gpsClient,
+		CurrentSSID: func(context.Context, string) (string, error) {
+			return simulatedSSID, nil
+		},
+		RotateMAC: func(string) (net.HardwareAddr, error) {
+			rotations++
+			return net.HardwareAddr{0x02, 0, 0, 0, 0, byte(rotations)}, nil
+		},
+	})
+	snap := st.Snapshot()
+	expect := scenario.Expect
+
+	if expect.DetectError {
+		if stepErr == nil || snap.LastPortal != nil {
+			return fmt.Errorf("Expected the portal to be rejected, got %+v", snap.LastPortal)
+		}
+		if snap.LastUpload != nil {
+			return fmt.Errorf("Uploaded a payload for a rejected portal")
+		}
+		return nil
+	}
+
+	if stepErr != nil {
+		return stepErr
+	}
+	if snap.LastPortal == nil {
+		return fmt.Errorf("No portal detected")
+	}
+	got := snap.LastPortal
+	if got.PayphoneMAC != expect.PayphoneMAC || got.PayphoneID != expect.PayphoneID || got.PayphoneTime != expect.PayphoneTime {
+		return fmt.Errorf("Extracted mac=%s id=%s time=%d, expected mac=%s id=%s time=%d",
+			got.PayphoneMAC, got.PayphoneID, got.PayphoneTime,
+			expect.PayphoneMAC, expect.PayphoneID, expect.PayphoneTime)
+	}
+	if rotations == 0 {
+		return fmt.Errorf("MAC was not rotated after the portal")
+	}
+
+	if cfg.ServerAddress == "" {
+		// without a server the payload is spooled, check what would have gone up
+		return checkSpooled(scenarioSpool)
+	}
+	if snap.LastUpload == nil {
+		return fmt.Errorf("Nothing was uploaded")
+	}
+	if !snap.LastUpload.OK {
+		return fmt.Errorf("Upload failed: %s", snap.LastUpload.Error)
+	}
+	log.Printf("[INFO] %s: server said %q\n", scenario.Name, snap.LastUpload.Response)
+	return nil
+}
+
+// checkSpooled makes sure the payload waiting in the spool has the fake gpsd's fix
+func checkSpooled(scenarioSpool *spool.Spool) error {
+	var spooled []common.Payload
+	scenarioSpool.Drain(func(data common.Payload) error {
+		spooled = append(spooled, data)
+		return nil
+	})
+	if len(spooled) != 1 {
+		return fmt.Errorf("Expected 1 spooled payload, found %d", len(spooled))
+	}
+
+	fix, expected := spooled[0].Fix, Fixes[0]
+	if fix == nil {
+		return fmt.Errorf("Payload has no GPS fix")
+	}
+	if fix.Lat != expected.Lat || fix.Long != expected.Long || fix.Accuracy != expected.Accuracy {
+		return fmt.Errorf("Payload fix is %+v, expected %+v", *fix, expected)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package simulate
+
+import (
+	"client-indicum/portal/fakeportal"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestScenarios plays every recorded portal through daemon.Step, the same as
+// `client-indicum simulate` without a server
+func TestScenarios(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	results, err := Run(ctx, Config{Fixtures: fakeportal.Fixtures()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenarios, _ := fakeportal.Load(fakeportal.Fixtures())
+	if len(results) != len(scenarios) {
+		t.Fatalf("ran %d scenarios, there are %d", len(results), len(scenarios))
+	}
+	for _, result := range results {
+		t.Run(result.Scenario, func(t *testing.T) {
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+		})
+	}
+}
+
+// TestScenarioMismatch makes sure a scenario fails when the client extracts
+// something other than what it expects
+func TestScenarioMismatch(t *testing.T) {
+	fixtures := fstest.MapFS{}
+	err := fs.WalkDir(fakeportal.Fixtures(), "meraki-302", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fakeportal.Fixtures(), path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, "scenario.json") {
+			var scenario map[string]any
+			if err := json.Unmarshal(data, &scenario); err != nil {
+				return err
+			}
+			scenario["expect"].(map[string]any)["payphoneID"] = "0000000000"
+			if data, err = json.Marshal(scenario); err != nil {
+				return err
+			}
+		}
+		fixtures[path] = &fstest.MapFile{Data: data}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	results, err := Run(ctx, Config{Fixtures: fixtures})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("expected the changed scenario to fail, got %+v", results)
+	}
+}
+
+func TestUnknownScenario(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := Run(ctx, Config{Fixtures: fakeportal.Fixtures(), Scenario: "no-such-scenario"}); err == nil {
+		t.Fatal("expected an error for a scenario that doesn't exist")
+	}
+}
@@ -0,0 +1,140 @@
+// Package spool keeps payloads that couldn't be uploaded on disk so they can
+// be retried once the device has internet again.
+package spool
+
+import (
+	"client-indicum/common"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// each payload is one json file, named so they sort oldest first
+type Spool struct {
+	dir string
+	// mu guards the directory, it's never held across a send
+	mu sync.Mutex
+	// drain is held for a whole Drain so two workers don't send the same payload
+	drain sync.Mutex
+}
+
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("Can't create spool dir %v", err)
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Push stores a payload for a later upload
+func (s *Spool) Push(data common.Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("Can't marshal payload %v", err)
+	}
+
+	name := fmt.Sprintf("%020d.json", time.Now().UnixNano())
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, dataBytes, 0640); err != nil {
+		return fmt.Errorf("Can't write spool file %v", err)
+	}
+	// rename so a crash never leaves half a file behind
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+func (s *Spool) names() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read spool dir %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Depth is the number of payloads waiting to be uploaded
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.names()
+	if err != nil {
+		return 0
+	}
+	return len(names)
+}
+
+// Drain calls send for every spooled payload, oldest first. Payloads are
+// removed once send returns nil. It stops at the first error so a dead
+// connection doesn't churn through the whole spool. The spool isn't locked
+// while send runs, so Push and Depth don't wait on an upload.
+func (s *Spool) Drain(send func(common.Payload) error) (int, error) {
+	s.drain.Lock()
+	defer s.drain.Unlock()
+
+	sent := 0
+	// skipped are names that can't be read or parsed, left for someone to look at
+	skipped := map[string]bool{}
+	for {
+		path, data, ok, err := s.next(skipped)
+		if err != nil || !ok {
+			return sent, err
+		}
+
+		if err := send(data); err != nil {
+			return sent, err
+		}
+		s.mu.Lock()
+		err = os.Remove(path)
+		s.mu.Unlock()
+		if err != nil {
+			return sent, fmt.Errorf("Can't remove spool file %v", err)
+		}
+		sent++
+	}
+}
+
+// next reads the oldest payload not in skipped, ok is false when the spool is empty
+func (s *Spool) next(skipped map[string]bool) (string, common.Payload, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := s.names()
+	if err != nil {
+		return "", common.Payload{}, false, err
+	}
+	for _, name := range names {
+		if skipped[name] {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		dataBytes, err := os.ReadFile(path)
+		if err != nil {
+			return "", common.Payload{}, false, fmt.Errorf("Can't read spool file %v", err)
+		}
+
+		var data common.Payload
+		if err := json.Unmarshal(dataBytes, &data); err != nil {
+			// a corrupt file would block the spool forever
+			if os.Rename(path, path+".bad") != nil {
+				skipped[name] = true
+			}
+			continue
+		}
+		return path, data, true, nil
+	}
+	return "", common.Payload{}, false, nil
+}
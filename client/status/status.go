@@ -0,0 +1,258 @@
+// Package status keeps track of what the daemon is doing and serves it on a
+// localhost http endpoint, as json on /status and prometheus text on /metrics.
+// This saves ssh'ing into a device and tailing the log when it misbehaves.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PortalEvent struct {
+	Time         time.Time `json:"time"`
+	Interface    string    `json:"interface"`
+	PayphoneMAC  string    `json:"payphoneMAC"`
+	PayphoneID   string    `json:"payphoneID"`
+	PayphoneTime int64     `json:"payphoneTime"`
+}
+
+type UploadEvent struct {
+	Time     time.Time `json:"time"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+	Response string    `json:"response,omitempty"`
+}
+
+// Interface is the status of one wifi interface, each has its own portal
+// session and MAC rotation
+type Interface struct {
+	Name         string       `json:"name"`
+	CurrentMAC   string       `json:"currentMAC"`
+	LastPortal   *PortalEvent `json:"lastPortal"`
+	PortalsSeen  uint64       `json:"portalsSeen"`
+	MACRotations uint64       `json:"macRotations"`
+	Scans        uint64       `json:"scans"`
+	Sightings    uint64       `json:"sightings"`
+	// LastScanBSSes is how many access points the last passive scan heard
+	LastScanBSSes int `json:"lastScanBSSes"`
+	// LastStep is when the worker last finished a pass of its loop
+	LastStep time.Time `json:"lastStep"`
+}
+
+// Snapshot is what /status returns
+type Snapshot struct {
+	Version       string      `json:"version"`
+	Started       time.Time   `json:"started"`
+	UptimeSeconds int64       `json:"uptimeSeconds"`
+	SpoolDepth    int         `json:"spoolDepth"`
+	Interfaces    []Interface `json:"interfaces"`
+	// LastPortal is the newest portal seen on any interface
+	LastPortal *PortalEvent `json:"lastPortal"`
+	LastUpload *UploadEvent `json:"lastUpload"`
+
+	UploadsOK     uint64 `json:"uploadsOK"`
+	UploadsFailed uint64 `json:"uploadsFailed"`
+}
+
+type Status struct {
+	mu         sync.Mutex
+	snap       Snapshot
+	spoolDepth func() int
+}
+
+func New(version string, ifaces []string) *Status {
+	s := &Status{
+		snap: Snapshot{
+			Version: version,
+			Started: time.Now(),
+		},
+	}
+	for _, iface := range ifaces {
+		s.snap.Interfaces = append(s.snap.Interfaces, Interface{Name: iface})
+	}
+	return s
+}
+
+// iface returns the status of the named interface, adding it if it's new.
+// Must be called with s.mu held.
+func (s *Status) iface(name string) *Interface {
+	for i := range s.snap.Interfaces {
+		if s.snap.Interfaces[i].Name == name {
+			return &s.snap.Interfaces[i]
+		}
+	}
+	s.snap.Interfaces = append(s.snap.Interfaces, Interface{Name: name})
+	return &s.snap.Interfaces[len(s.snap.Interfaces)-1]
+}
+
+// SetSpoolDepth sets the function used to read the spool depth on each request
+func (s *Status) SetSpoolDepth(depth func() int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spoolDepth = depth
+}
+
+func (s *Status) SetMAC(iface, mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iface(iface).CurrentMAC = mac
+}
+
+func (s *Status) MACRotated(iface, mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.iface(iface)
+	st.CurrentMAC = mac
+	st.MACRotations++
+}
+
+func (s *Status) PortalSeen(event PortalEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.iface(event.Interface)
+	st.LastPortal = &event
+	st.PortalsSeen++
+	s.snap.LastPortal = &event
+}
+
+// Scanned records a passive scan on iface that heard bsses access points, sightings of them payphones
+func (s *Status) Scanned(iface string, bsses, sightings int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.iface(iface)
+	st.Scans++
+	st.Sightings += uint64(sightings)
+	st.LastScanBSSes = bsses
+}
+
+// Stepped records the worker for iface finishing a pass of its loop
+func (s *Status) Stepped(iface string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iface(iface).LastStep = time.Now()
+}
+
+// Stalled returns the interfaces whose worker hasn't finished a pass in maxAge
+func (s *Status) Stalled(maxAge time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stalled []string
+	for _, iface := range s.snap.Interfaces {
+		last := iface.LastStep
+		if last.IsZero() {
+			last = s.snap.Started
+		}
+		if time.Since(last) > maxAge {
+			stalled = append(stalled, iface.Name)
+		}
+	}
+	return stalled
+}
+
+func (s *Status) Uploaded(response string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event := UploadEvent{Time: time.Now(), OK: err == nil, Response: response}
+	if err != nil {
+		event.Error = err.Error()
+		s.snap.UploadsFailed++
+	} else {
+		s.snap.UploadsOK++
+	}
+	s.snap.LastUpload = &event
+}
+
+// Snapshot returns a copy of the current status
+func (s *Status) Snapshot() Snapshot {
+	// the depth is read before s.mu is taken, so the status lock is never
+	// held waiting on the spool's
+	s.mu.Lock()
+	spoolDepth := s.spoolDepth
+	s.mu.Unlock()
+	depth := 0
+	if spoolDepth != nil {
+		depth = spoolDepth()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.snap
+	snap.Interfaces = append([]Interface(nil), s.snap.Interfaces...)
+	snap.UptimeSeconds = int64(time.Since(snap.Started).Seconds())
+	snap.SpoolDepth = depth
+	return snap
+}
+
+func (s *Status) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveStatus)
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	return mux
+}
+
+func (s *Status) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(s.Snapshot())
+}
+
+func (s *Status) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	fmt.Fprintf(w, "# HELP indicum_client_info Client version\n# TYPE indicum_client_info gauge\n")
+	fmt.Fprintf(w, "indicum_client_info{version=%q} 1\n", snap.Version)
+	metric("indicum_client_uptime_seconds", "gauge", "Seconds since the daemon started", snap.UptimeSeconds)
+	metric("indicum_client_spool_depth", "gauge", "Payloads waiting to be uploaded", snap.SpoolDepth)
+
+	// one series per interface
+	perInterface := func(name, kind, help string, value func(Interface) interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, iface := range snap.Interfaces {
+			fmt.Fprintf(w, "%s{interface=%q} %v\n", name, iface.Name, value(iface))
+		}
+	}
+	perInterface("indicum_client_portals_seen_total", "counter", "Payphone portals detected",
+		func(iface Interface) interface{} { return iface.PortalsSeen })
+	perInterface("indicum_client_mac_rotations_total", "counter", "MAC address rotations",
+		func(iface Interface) interface{} { return iface.MACRotations })
+	perInterface("indicum_client_scans_total", "counter", "Passive wifi scans",
+		func(iface Interface) interface{} { return iface.Scans })
+	perInterface("indicum_client_sightings_total", "counter", "Payphone hotspots heard in passive scans",
+		func(iface Interface) interface{} { return iface.Sightings })
+
+	fmt.Fprintf(w, "# HELP indicum_client_uploads_total Uploads to the server by result\n# TYPE indicum_client_uploads_total counter\n")
+	fmt.Fprintf(w, "indicum_client_uploads_total{result=\"ok\"} %d\n", snap.UploadsOK)
+	fmt.Fprintf(w, "indicum_client_uploads_total{result=\"error\"} %d\n", snap.UploadsFailed)
+
+	if snap.LastPortal != nil {
+		metric("indicum_client_last_portal_timestamp_seconds", "gauge", "Time the last portal was seen", snap.LastPortal.Time.Unix())
+	}
+	if snap.LastUpload != nil {
+		metric("indicum_client_last_upload_timestamp_seconds", "gauge", "Time of the last upload attempt", snap.LastUpload.Time.Unix())
+	}
+}
+
+// Serve blocks serving the status endpoint on addr. Keep addr on localhost,
+// there is no authentication.
+func Serve(addr string, s *Status) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Println("[INFO] status endpoint listening on", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Println("[ERROR] status endpoint stopped:", err)
+	}
+}
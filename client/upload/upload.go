@@ -0,0 +1,441 @@
+// Package upload signs, encrypts and sends payloads to the indicum server
+// using the frame protocol in client/common.
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"client-indicum/common"
+	"client-indicum/keystore"
+	"compress/gzip"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every frame sent to the server is
+//
+//	FRAMESTART | type (1 byte) | length (uint16 LE) | data
+//
+// except FrameTypeTest, which stops after the type. The server reads them in
+// server/internal/server/frame.
+
+// Device is the identity a device signs its frames with. It is shared by
+// every interface the daemon runs, so the payload key is behind a lock.
+type Device struct {
+	UUID    string
+	PrivKey *rsa.PrivateKey
+	// Secret is given to the device when it is enrolled and attests its
+	// payloads. Devices enrolled before there were secrets don't have one.
+	Secret string
+
+	mu sync.RWMutex
+	// payloadKey encrypts the payloads, see LoadPayloadKey
+	payloadKey PayloadKey
+}
+
+// NewDevice is a device identity using payloadKey
+func NewDevice(uuid string, privKey *rsa.PrivateKey, secret string, payloadKey PayloadKey) *Device {
+	return &Device{UUID: uuid, PrivKey: privKey, Secret: secret, payloadKey: payloadKey}
+}
+
+// PayloadKey is the key payloads are encrypted with
+func (d *Device) PayloadKey() PayloadKey {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.payloadKey
+}
+
+// SetPayloadKey switches to a key fetched from the server
+func (d *Device) SetPayloadKey(key PayloadKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.payloadKey = key
+}
+
+// PayloadKey is a symmetric key from the server keyring and its ID
+type PayloadKey struct {
+	ID     uint16
+	Secret []byte
+}
+
+// LoadDevice reads the device UUID, private key and attestation secret written
+// by the playbook (normally /etc/indicum/uuid.txt, /etc/indicum/priv_key.pem and
+// /etc/indicum/device_secret) and the payload key (/etc/indicum/payload_key).
+func LoadDevice(uuidPath, privPath, secretPath, payloadKeyPath string) (*Device, error) {
+	deviceFileContent, err := os.ReadFile(uuidPath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read deviceUUID file %v", err)
+	}
+
+	// plaintext or encrypted with keystore.EncryptFile
+	deviceRSAPriv, err := keystore.Load(privPath)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadKey, err := LoadPayloadKey(payloadKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// missing on devices enrolled before secrets, they keep sending the legacy attestation
+	secret, err := os.ReadFile(secretPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Can't read device secret %v", err)
+	}
+
+	return NewDevice(strings.TrimSpace(string(deviceFileContent)), deviceRSAPriv, strings.TrimSpace(string(secret)), payloadKey), nil
+}
+
+// LoadPayloadKey reads `<id> <hex key>` from path, as written by SavePayloadKey.
+// Devices that never fetched a key use common.KeyOne, which is key 0.
+func LoadPayloadKey(path string) (PayloadKey, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		secret, err := hex.DecodeString(common.KeyOne)
+		if err != nil {
+			return PayloadKey{}, fmt.Errorf("Can't decode key %s", err.Error())
+		}
+		return PayloadKey{ID: 0, Secret: secret}, nil
+	}
+	if err != nil {
+		return PayloadKey{}, fmt.Errorf("Can't read payload key %v", err)
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return PayloadKey{}, fmt.Errorf("Payload key file %s should be `<id> <hex key>`", path)
+	}
+	id, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return PayloadKey{}, fmt.Errorf("Bad payload key id %q", fields[0])
+	}
+	secret, err := hex.DecodeString(fields[1])
+	if err != nil || len(secret) != 32 {
+		return PayloadKey{}, fmt.Errorf("Payload key in %s is not a 32 byte hex key", path)
+	}
+	return PayloadKey{ID: uint16(id), Secret: secret}, nil
+}
+
+// SavePayloadKey writes key to path, readable by root only
+func SavePayloadKey(path string, key PayloadKey) error {
+	tmp := path + ".tmp"
+	content := fmt.Sprintf("%d %s\n", key.ID, hex.EncodeToString(key.Secret))
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return fmt.Errorf("Can't write payload key %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func dial(address string) (net.Conn, error) {
+	// needed since it is self signed key
+	config := &tls.Config{InsecureSkipVerify: true}
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, fmt.Errorf("Can't dial %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return conn, nil
+}
+
+// Send dials the device server, sends the payload and returns the server response.
+// The server closes the connection without answering when it rejects a frame.
+func Send(address string, device *Device, data common.Payload) (string, error) {
+	return exchange(address, func(conn net.Conn) error {
+		if err := SendDeviceData(conn, device, data); err != nil {
+			return fmt.Errorf("Can't send device data: %v", err)
+		}
+		return nil
+	})
+}
+
+// SendSightings uploads the hotspots heard in passive scans
+func SendSightings(address string, device *Device, report common.ScanReport) (string, error) {
+	return exchange(address, func(conn net.Conn) error {
+		dataBytes, err := json.Marshal(report)
+		if err != nil {
+			return fmt.Errorf("Can't marshal scan report %v", err)
+		}
+		return writeSealed(conn, device, common.FrameTypeScanSightings, dataBytes)
+	})
+}
+
+// largest plaintext that still fits in a frame once it is sealed
+const maxSealedPlaintext = 65535 - common.UUIDLength - common.KeyIDLength - common.SignatureLength - common.NonceLength - 16
+
+// SendLogs uploads log records, gzipped. When they don't fit in one frame only
+// the oldest that do are sent. Returns how many of the records, from the
+// first, were sent.
+func SendLogs(address string, device *Device, records []common.LogRecord) (int, string, error) {
+	var compressed []byte
+	for {
+		var err error
+		compressed, err = compressLogs(records)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(compressed) <= maxSealedPlaintext || len(records) <= 1 {
+			break
+		}
+		records = records[:len(records)-len(records)/4]
+	}
+	if len(compressed) > maxSealedPlaintext {
+		return 0, "", fmt.Errorf("Log record too large to send")
+	}
+
+	response, err := exchange(address, func(conn net.Conn) error {
+		return writeSealed(conn, device, common.FrameTypeDeviceLogs, compressed)
+	})
+	return len(records), response, err
+}
+
+// compressLogs gzips records as one json object per line
+func compressLogs(records []common.LogRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gz)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("Can't encode log record %v", err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("Can't compress logs %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// exchange dials the server, lets write send a frame and reads the answer
+func exchange(address string, write func(net.Conn) error) (string, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := write(conn); err != nil {
+		return "", err
+	}
+
+	response, err := ReadResponse(conn)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(response, "ty") {
+		return response, fmt.Errorf("Server rejected the payload")
+	}
+	return response, nil
+}
+
+// FetchPayloadKey asks the server for its active payload key. The request is
+// signed with the device key and the server encrypts the payload key to the
+// device public key, so it never crosses the wire in the clear.
+func FetchPayloadKey(address string, device *Device) (PayloadKey, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return PayloadKey{}, err
+	}
+	defer conn.Close()
+
+	request, err := EncodeGetKeyRequest(device, time.Now())
+	if err != nil {
+		return PayloadKey{}, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return PayloadKey{}, fmt.Errorf("Failed to write key request %s", err)
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return PayloadKey{}, fmt.Errorf("Can't read key response %v", err)
+	}
+	header := len(common.FRAMESTART) + 1 + 2
+	if len(response) < header+common.KeyIDLength || !bytes.Equal(response[:2], common.FRAMESTART[:]) || response[2] != common.FrameTypeGetKey {
+		return PayloadKey{}, fmt.Errorf("Server refused the key request")
+	}
+	body := response[header:]
+	if int(binary.LittleEndian.Uint16(response[3:5])) != len(body) {
+		return PayloadKey{}, fmt.Errorf("Key response is truncated")
+	}
+
+	secret, err := rsa.DecryptOAEP(sha256.New(), nil, device.PrivKey, body[common.KeyIDLength:], []byte(common.GetKeyContext))
+	if err != nil {
+		return PayloadKey{}, fmt.Errorf("Can't decrypt payload key %v", err)
+	}
+	return PayloadKey{ID: binary.LittleEndian.Uint16(body[:common.KeyIDLength]), Secret: secret}, nil
+}
+
+// EncodeGetKeyRequest returns the FrameTypeGetKey frame asking for the active
+// payload key at timestamp
+func EncodeGetKeyRequest(device *Device, timestamp time.Time) ([]byte, error) {
+	timestampBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestampBytes, uint64(timestamp.Unix()))
+
+	signed := sha256.Sum256(append(append([]byte(common.GetKeyContext), device.UUID...), timestampBytes...))
+	signature, err := rsa.SignPKCS1v15(nil, device.PrivKey, crypto.SHA256, signed[:])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign key request %v", err)
+	}
+
+	var combinedData bytes.Buffer
+	combinedData.Write([]byte(device.UUID))
+	combinedData.Write(timestampBytes)
+	combinedData.Write(signature)
+	return frame(common.FrameTypeGetKey, combinedData.Bytes()), nil
+}
+
+// Validate checks the payphone fields are in the format the server expects
+func Validate(data common.Payload) error {
+	if len(data.PayphoneMAC) != 17 {
+		return fmt.Errorf("Incorrect format for MAC")
+	}
+	if len(data.PayphoneID) != 40 {
+		return fmt.Errorf("Incorrect format for PayphoneID")
+	}
+	return nil
+}
+
+// SendDeviceData writes a FrameTypeSendDeviceDataV2 frame for data to conn
+func SendDeviceData(conn net.Conn, device *Device, data common.Payload) error {
+	dataBytes, err := DeviceDataPlaintext(device, data)
+	if err != nil {
+		return err
+	}
+	return writeSealed(conn, device, common.FrameTypeSendDeviceDataV2, dataBytes)
+}
+
+// DeviceDataPlaintext validates and attests data and returns the JSON that goes
+// in a FrameTypeSendDeviceDataV2 frame
+func DeviceDataPlaintext(device *Device, data common.Payload) ([]byte, error) {
+	if err := Validate(data); err != nil {
+		return nil, err
+	}
+
+	attest(device, &data)
+
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Can't marshal payload %v", err)
+	}
+	return dataBytes, nil
+}
+
+func writeSealed(conn net.Conn, device *Device, frameType byte, plaintext []byte) error {
+	sealed, err := EncodeSealed(device, frameType, plaintext, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(sealed); err != nil {
+		return fmt.Errorf("Failed to write payload %s", err)
+	}
+	return nil
+}
+
+// EncodeSealed encrypts plaintext with the payload key, signs it and returns it
+// framed as UUID | keyID | signature | nonce | ciphertext, the envelope every
+// data frame uses. A nil nonce picks a random one, the conformance vectors
+// pass theirs in.
+func EncodeSealed(device *Device, frameType byte, plaintext, nonce []byte) ([]byte, error) {
+	// encrypt data using key
+	payloadKey := device.PayloadKey()
+	var ciphertext []byte
+	var err error
+	if nonce == nil {
+		ciphertext, nonce, err = common.Encrypt(plaintext, payloadKey.Secret)
+	} else {
+		ciphertext, err = common.EncryptWithNonce(plaintext, payloadKey.Secret, nonce)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't encrypt %v", err)
+	}
+
+	// tells the server which keyring key to decrypt with
+	keyID := make([]byte, common.KeyIDLength)
+	binary.LittleEndian.PutUint16(keyID, payloadKey.ID)
+
+	// sign key ID and data using private key
+	hashedCipher := sha256.Sum256(append(keyID, ciphertext...))
+
+	signature, err := rsa.SignPKCS1v15(nil, device.PrivKey, crypto.SHA256, hashedCipher[:])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign data with deviceRSA private key %v", err)
+	}
+
+	// sends the UUID in clear (so server knows how to decrypt)
+	// sends the signature in clear (so server can verify)
+	// sends the nonce in the clear (so the server can decrypt the symmetric encryption)
+	var combinedData bytes.Buffer
+	combinedData.Write([]byte(device.UUID))
+	combinedData.Write(keyID)
+	combinedData.Write(signature)
+	combinedData.Write(nonce)
+	combinedData.Write(ciphertext)
+
+	if combinedData.Len() >= 65536 {
+		return nil, fmt.Errorf("Payload too large")
+	}
+
+	return frame(frameType, combinedData.Bytes()), nil
+}
+
+// attest sets the fields the server uses to check the payload came from this
+// device: an HMAC with the enrollment secret, or the legacy ForgeResistance hash
+// for devices that were enrolled without one
+func attest(device *Device, data *common.Payload) {
+	if device.Secret != "" {
+		data.AttestationVersion = common.AttestationHMACv1
+		mac := hmac.New(sha256.New, []byte(device.Secret))
+		mac.Write(common.AttestationMessage(common.AttestationHMACv1, *data, device.UUID))
+		data.Attestation = hex.EncodeToString(mac.Sum(nil))
+		return
+	}
+
+	hash := sha256.New()
+	// add forgeResistance string to allow only trusted data (from this program)
+	// to send requests to server
+	forgeString := data.PayphoneID[3:len(data.PayphoneID)-3] + "_forge_resistance"
+	hash.Write([]byte(forgeString))
+	data.AttestationVersion = common.AttestationLegacy
+	data.ForgeResistance = hex.EncodeToString(hash.Sum(nil))
+}
+
+// frame wraps data in the frame header described at the top of this file
+func frame(frameType byte, data []byte) []byte {
+	binaryDataLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(binaryDataLen, uint16(len(data)))
+
+	var buf bytes.Buffer
+
+	buf.Write(common.FRAMESTART[:])
+	buf.WriteByte(frameType)
+	buf.Write(binaryDataLen)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// ReadResponse reads until the server closes the connection
+func ReadResponse(conn net.Conn) (string, error) {
+	reader := bufio.NewReader(conn)
+	response, err := io.ReadAll(reader)
+
+	if err != nil {
+		return "", fmt.Errorf("Can't read response: %v", err)
+	}
+	return string(response), nil
+}
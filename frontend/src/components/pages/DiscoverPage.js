@@ -125,6 +125,10 @@ export default function DiscoverPage() {
         const socket = new WebSocket(`wss://${apiUrl}/ws?jwt=${token}`);
         socket.onmessage = (event) => {
             console.log("SOCKET: Message from server ", event.data);
+            // test submissions are shown on the profile page, they aren't entries
+            if (isTestEntryEvent(event.data)) {
+                return;
+            }
             fetchMostRecentEntry();
 
             playNotificationSound();
@@ -143,6 +147,14 @@ export default function DiscoverPage() {
         };
     };
 
+    const isTestEntryEvent = (data) => {
+        try {
+            return JSON.parse(data).type === "test_entry";
+        } catch {
+            return false;
+        }
+    };
+
     const pinLocation = async () => {
         if (navigator.geolocation) {
             navigator.geolocation.getCurrentPosition(
@@ -375,6 +387,18 @@ export default function DiscoverPage() {
                                                                 }
                                                             </p>
                                                         )}
+                                                    {entry.LocationConfidence >
+                                                        0 && (
+                                                        <p>
+                                                            Located
+                                                            automatically (
+                                                            {Math.round(
+                                                                entry.LocationConfidence *
+                                                                    100
+                                                            )}
+                                                            % sure)
+                                                        </p>
+                                                    )}
                                                     <p>
                                                         <strong>Time:</strong>{" "}
                                                         {new Date(
@@ -2,8 +2,12 @@ import React, { useState, useEffect } from "react";
 import { Button, Input, Card, Badge } from "@nextui-org/react";
 import GlassCard from "@/components/ui/GlassCard";
 import { getProfile } from "@/pages/api/getProfile";
+import { deleteAccount, cancelDeleteAccount } from "@/pages/api/deleteAccount";
 import { ShoppingCart } from "lucide-react";
 import { useRouter } from "next/navigation";
+import { createBrowserClient } from "@supabase/ssr";
+
+const apiUrl = process.env.NEXT_PUBLIC_GOLANG_URL;
 
 export default function ProfilePage() {
     const [username, setUsername] = useState("");
@@ -13,12 +17,56 @@ export default function ProfilePage() {
     const [isLoading, setIsLoading] = useState(true);
     const [error, setError] = useState(null);
     const [hasDevice, setHasDevice] = useState(false);
+    const [testEntry, setTestEntry] = useState(null);
+    const [deletionDue, setDeletionDue] = useState("");
     const router = useRouter();
 
+    const supabase = createBrowserClient(
+        process.env.NEXT_PUBLIC_SUPABASE_URL,
+        process.env.NEXT_PUBLIC_SUPABASE_ANON_KEY
+    );
+
     useEffect(() => {
         fetchProfile();
     }, []);
 
+    // devices running with -test report here instead of adding entries
+    useEffect(() => {
+        let closeSocket;
+        const connect = async () => {
+            const {
+                data: { session },
+            } = await supabase.auth.getSession();
+            if (session) {
+                closeSocket = setupWebSocket(session.access_token);
+            }
+        };
+        connect();
+        return () => closeSocket && closeSocket();
+    }, []);
+
+    const setupWebSocket = (token) => {
+        const socket = new WebSocket(`wss://${apiUrl}/ws?jwt=${token}`);
+        socket.onmessage = (event) => {
+            try {
+                const message = JSON.parse(event.data);
+                if (message.type === "test_entry") {
+                    setTestEntry(message);
+                }
+            } catch {
+                // plain entry notifications are just the UUID
+            }
+        };
+
+        socket.onerror = (error) => {
+            console.log("SOCKET: Socket Error: ", error);
+        };
+
+        return () => {
+            socket.close();
+        };
+    };
+
     const fetchProfile = async () => {
         try {
             setIsLoading(true);
@@ -28,6 +76,7 @@ export default function ProfilePage() {
             setToken(profileData.token || "");
             setUuid(profileData.uuid || "");
             setHasDevice(profileData.hasDevice || false);
+            setDeletionDue(profileData.deletion_due || "");
             setError(null);
         } catch (err) {
             setError("Failed to fetch profile data");
@@ -44,6 +93,42 @@ export default function ProfilePage() {
         await fetchProfile();
     };
 
+    const handleDeleteAccount = async () => {
+        if (
+            !window.confirm(
+                "Your device stops working now and your account and discoveries are erased after the grace period. Delete your account?"
+            )
+        ) {
+            return;
+        }
+        try {
+            const response = await deleteAccount();
+            setDeletionDue(String(response.deletion_due));
+        } catch (err) {
+            setError("Failed to delete account");
+        }
+    };
+
+    const handleCancelDelete = async () => {
+        try {
+            await cancelDeleteAccount();
+            setDeletionDue("");
+        } catch (err) {
+            setError("Failed to cancel account deletion");
+        }
+    };
+
+    // a plain link so the browser streams the file to disk instead of holding it
+    const handleExport = async (format) => {
+        const {
+            data: { session },
+        } = await supabase.auth.getSession();
+        if (!session) {
+            return;
+        }
+        window.location.href = `https://${apiUrl}/export?format=${format}&jwt=${session.access_token}`;
+    };
+
     const handleBuyDevice = () => {
         // Replace with your actual Stripe checkout URL
         router.push("/home");
@@ -103,6 +188,39 @@ export default function ProfilePage() {
                 </Card>
             </GlassCard>
 
+            {hasDevice && (
+                <GlassCard>
+                    <h2 className="text-lg font-bold mb-4">Device test</h2>
+                    {testEntry ? (
+                        <div className="space-y-1">
+                            <p className="text-green-500">
+                                Your device is working
+                            </p>
+                            <p>Payphone {testEntry.payphoneMAC}</p>
+                            <p>
+                                Sent{" "}
+                                {new Date(
+                                    testEntry.recordedTime * 1000
+                                ).toLocaleString()}
+                                {testEntry.attestationVersion === 0 &&
+                                    ", device has no secret, re-enroll it"}
+                            </p>
+                            <p className="text-sm opacity-70">
+                                Test submissions don't count and are deleted{" "}
+                                {new Date(
+                                    testEntry.expiresTime * 1000
+                                ).toLocaleString()}
+                            </p>
+                        </div>
+                    ) : (
+                        <p>
+                            Run the device with -test and keep this page
+                            open, its next submission shows up here.
+                        </p>
+                    )}
+                </GlassCard>
+            )}
+
             <GlassCard>
                 <h2 className="text-lg font-bold mb-4">Your Profile</h2>
                 <div className="space-y-4">
@@ -173,6 +291,52 @@ export default function ProfilePage() {
                     </Button>
                 </div>
             </GlassCard>
+
+            <GlassCard>
+                <h2 className="text-lg font-bold mb-4">Export discoveries</h2>
+                <p className="mb-4">
+                    Download your entries to load into other mapping tools or
+                    keep as a backup.
+                </p>
+                <div className="flex gap-2">
+                    {["geojson", "gpx", "kml", "csv"].map((format) => (
+                        <Button
+                            key={format}
+                            variant="bordered"
+                            onClick={() => handleExport(format)}
+                        >
+                            {format.toUpperCase()}
+                        </Button>
+                    ))}
+                </div>
+            </GlassCard>
+
+            <GlassCard>
+                <h2 className="text-lg font-bold mb-4">Delete account</h2>
+                {deletionDue ? (
+                    <div className="space-y-4">
+                        <p>
+                            Your account will be erased{" "}
+                            {new Date(deletionDue * 1000).toLocaleString()}.
+                            Your device has been revoked, enroll it again
+                            with your token if you keep the account.
+                        </p>
+                        <Button color="primary" onClick={handleCancelDelete}>
+                            Keep my account
+                        </Button>
+                    </div>
+                ) : (
+                    <div className="space-y-4">
+                        <p>
+                            Erases your profile, device, discoveries and
+                            logs. You can change your mind until it happens.
+                        </p>
+                        <Button color="danger" onClick={handleDeleteAccount}>
+                            Delete account
+                        </Button>
+                    </div>
+                )}
+            </GlassCard>
         </div>
     );
 }
@@ -0,0 +1,22 @@
+// api/deleteAccount.js
+import { createApiClient } from "@/utils/apiClient";
+
+export async function deleteAccount(serverSupabase = null) {
+    const apiClient = createApiClient(serverSupabase);
+    try {
+        return await apiClient.post("/delete-account", {});
+    } catch (error) {
+        console.error("Failed to delete account:", error);
+        throw new Error("Failed to delete account");
+    }
+}
+
+export async function cancelDeleteAccount(serverSupabase = null) {
+    const apiClient = createApiClient(serverSupabase);
+    try {
+        return await apiClient.post("/cancel-delete-account", {});
+    } catch (error) {
+        console.error("Failed to cancel account deletion:", error);
+        throw new Error("Failed to cancel account deletion");
+    }
+}
@@ -1,3 +1,7 @@
+-- Development data, the users and entries tables only exist once the server has
+-- run its migrations, so load it after the first start:
+--   psql -h localhost -U indicum_user indicum -f infra/db/dev-data.sql
+
 INSERT INTO users (id, pub_key, uuid, token, created_timestamp)
 VALUES
 (1, '\x2D2D2D2D2D424547494E205055424C4943204B45592D2D2D2D2D0A4D494942496A414E42676B71686B6947397730424151454641414F43415138414D49494243674B4341514541747967326E712F5376496D4C2F5A526E2B7159680A763931324C364957707545424F76637A6B615879462B304737573146715159682B6D7530327A796B68736B79654A3742654F4257364644336C75444B393151520A6F32504C702B4A6365694638556E48494E2B522F474549635930522B42726B7038615A6B613979516F4943305067432F4A676550614D396271702F5A466345760A6B66674E77622F757268397A543732774264517438466E3864346750477256355A624C72466E62425368626E4644526D316F6A33535A595455724E4D474E6A480A6A6F35356453373533724A5470793537777153543168695158514F726761674F4B4D76736633377876382F57524E754831397A71686B6137504B51444E3166790A4438466F525A4249647942516C7243686F395A66782B2B686D303746733232646A4E375A57425665775437796764666363492B4F5758773566656C35387379370A4D774944415141420A2D2D2D2D2D454E44205055424C4943204B45592D2D2D2D2D0A', '196a0e73-3cb7-486c-a26e-9b9ae7a86803', 'phTNIRMNqtxPDi9Q3oVs', '2024-02-26 10:52:50');
@@ -0,0 +1,267 @@
+// frametool decodes and replays device frames captured by the device server
+// (set FRAME_CAPTURE_FILE to turn capturing on).
+//
+//   frametool decode -file captures.jsonl [-index n] [-pubkey device.pem | -db]
+//   frametool decode -hex aa5504...
+//   frametool replay -file captures.jsonl [-index n] [-addr 127.0.0.1:8888] [-insecure]
+//   frametool conformance [-dir ../protocol/vectors]
+//
+// decode decrypts with the keyring from PAYLOAD_KEYRING_FILE / PAYLOAD_KEYRING,
+// the same as the server.
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/rsa"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+    "time"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/conformance"
+    "server-indicum/internal/server/db"
+    "server-indicum/internal/server/frame"
+    "server-indicum/internal/server/keyring"
+)
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "usage: frametool decode|replay|conformance [flags], frametool <command> -h for the flags")
+    os.Exit(2)
+}
+
+func main() {
+    if len(os.Args) < 2 { usage() }
+
+    var err error
+    switch os.Args[1] {
+        case "decode":
+            err = decode(os.Args[2:])
+        case "replay":
+            err = replay(os.Args[2:])
+        case "conformance":
+            err = runConformance(os.Args[2:])
+        default:
+            usage()
+    }
+    if err != nil { log.Fatal(err) }
+}
+
+// loadCaptures reads the captures picked by -file and -index, or the single frame given with -hex
+func loadCaptures(path string, index int, hexFrame string) ([]frame.Capture, error) {
+    if hexFrame != "" {
+        raw, err := hex.DecodeString(strings.Join(strings.Fields(hexFrame), ""))
+        if err != nil { return nil, fmt.Errorf("Frame is not hex %v", err) }
+        return []frame.Capture{{Frame: raw}}, nil
+    }
+    if path == "" { return nil, fmt.Errorf("Need -file or -hex") }
+
+    file, err := os.Open(path)
+    if err != nil { return nil, fmt.Errorf("Can't open capture file %v", err) }
+    defer file.Close()
+    captures, err := frame.ReadCaptures(file)
+    if err != nil { return nil, err }
+
+    if index < 0 { return captures, nil }
+    if index >= len(captures) { return nil, fmt.Errorf("Capture file only has %d frames", len(captures)) }
+    return captures[index:index+1], nil
+}
+
+func decode(args []string) error {
+    flags := flag.NewFlagSet("decode", flag.ExitOnError)
+    path := flags.String("file", "", "capture file written by the server")
+    index := flags.Int("index", -1, "only decode this frame (counting from 0), default all")
+    hexFrame := flags.String("hex", "", "decode this frame instead, hex encoded")
+    pubKeyPath := flags.String("pubkey", "", "device public key PEM to check signatures with")
+    useDB := flags.Bool("db", false, "look up device public keys in the database (DB_* env vars)")
+    flags.Parse(args)
+
+    captures, err := loadCaptures(*path, *index, *hexFrame)
+    if err != nil { return err }
+
+    keys, err := keyring.Load()
+    if err != nil { return err }
+
+    var pubKey *rsa.PublicKey
+    if *pubKeyPath != "" {
+        pemBytes, err := os.ReadFile(*pubKeyPath)
+        if err != nil { return fmt.Errorf("Can't read public key %v", err) }
+        pubKey, err = frame.ParsePublicKey(pemBytes)
+        if err != nil { return err }
+    }
+    if *useDB {
+        if err := db.Connect(); err != nil { return fmt.Errorf("Failed to init DB: %v", err) }
+    }
+
+    // the public key for a device, nil when there is no way to get it
+    findPubKey := func(deviceUUID string) (*rsa.PublicKey, error) {
+        if pubKey != nil { return pubKey, nil }
+        if !*useDB { return nil, nil }
+        pemBytes, err := db.DBFindDeviceRSAPub(context.Background(), deviceUUID)
+        if err != nil { return nil, err }
+        return frame.ParsePublicKey(pemBytes)
+    }
+
+    for i, capture := range captures {
+        if *index >= 0 { i = *index }
+        fmt.Printf("frame %d", i)
+        if !capture.Time.IsZero() { fmt.Printf(" received %s from %s", capture.Time.Format(time.RFC3339), capture.Remote) }
+        fmt.Println()
+        if capture.Error != "" { fmt.Printf("  server error: %s\n", strings.TrimSpace(capture.Error)) }
+        decodeFrame(capture.Frame, keys, findPubKey)
+        fmt.Println()
+    }
+    return nil
+}
+
+func decodeFrame(raw []byte, keys *keyring.Keyring, findPubKey func(string) (*rsa.PublicKey, error)) {
+    f, err := frame.Read(bytes.NewReader(raw))
+    if err != nil { fmt.Printf("  %v\n", strings.TrimSpace(err.Error())); return }
+    fmt.Printf("  type:       %s (%x), %d bytes of data\n", frame.TypeName(f.Type), f.Type, len(f.Data))
+
+    switch {
+        case f.Type == common.FrameTypeGetKey:
+            req, err := frame.ParseGetKeyRequest(f)
+            if err != nil { fmt.Printf("  %v\n", strings.TrimSpace(err.Error())); return }
+            fmt.Printf("  uuid:       %s\n", req.UUID)
+            fmt.Printf("  timestamp:  %s\n", req.Timestamp.UTC().Format(time.RFC3339))
+            fmt.Printf("  signature:  %x\n", req.Signature)
+            pub, err := findPubKey(req.UUID)
+            printVerify(pub, err, func() error { return req.Verify(pub) })
+
+        case frame.IsSealed(f.Type):
+            sealed, err := frame.ParseSealed(f)
+            if err != nil { fmt.Printf("  %v\n", strings.TrimSpace(err.Error())); return }
+            fmt.Printf("  uuid:       %s\n", sealed.UUID)
+            if sealed.HasKeyID {
+                fmt.Printf("  key id:     %d\n", sealed.KeyID)
+            } else {
+                fmt.Printf("  key id:     none (v1 frame, key 0)\n")
+            }
+            digest := sealed.Digest()
+            fmt.Printf("  signature:  %x\n", sealed.Signature)
+            fmt.Printf("  signed:     sha256 %x\n", digest)
+            fmt.Printf("  nonce:      %x\n", sealed.Nonce)
+            fmt.Printf("  ciphertext: %d bytes\n", len(sealed.Ciphertext))
+            pub, err := findPubKey(sealed.UUID)
+            printVerify(pub, err, func() error { return sealed.Verify(pub) })
+
+            plaintext, err := sealed.Open(keys)
+            if err != nil { fmt.Printf("  plaintext:  can't decrypt, %v\n", strings.TrimSpace(err.Error())); return }
+            printPlaintext(f.Type, plaintext)
+    }
+}
+
+func printVerify(pub *rsa.PublicKey, err error, verify func() error) {
+    switch {
+        case err != nil:
+            fmt.Printf("  verified:   can't get public key, %v\n", strings.TrimSpace(err.Error()))
+        case pub == nil:
+            fmt.Printf("  verified:   unknown, no public key (-pubkey or -db)\n")
+        default:
+            if err := verify(); err != nil {
+                fmt.Printf("  verified:   no, %v\n", strings.TrimSpace(err.Error()))
+            } else {
+                fmt.Printf("  verified:   yes\n")
+            }
+    }
+}
+
+func printPlaintext(frameType byte, plaintext []byte) {
+    if frameType == common.FrameTypeDeviceLogs {
+        gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+        if err != nil { fmt.Printf("  plaintext:  %d bytes, not gzipped %v\n", len(plaintext), err); return }
+        unzipped, err := io.ReadAll(io.LimitReader(gz, 16<<20))
+        if err != nil { fmt.Printf("  plaintext:  can't gunzip %v\n", err); return }
+        fmt.Printf("  plaintext:  %d bytes gzipped, %d bytes of log lines\n", len(plaintext), len(unzipped))
+        fmt.Print(indent(string(unzipped)))
+        return
+    }
+
+    var pretty bytes.Buffer
+    if err := json.Indent(&pretty, plaintext, "    ", "  "); err != nil {
+        fmt.Printf("  plaintext:  %d bytes, not JSON\n%s", len(plaintext), indent(hex.Dump(plaintext)))
+        return
+    }
+    fmt.Printf("  plaintext:\n    %s\n", pretty.String())
+}
+
+func indent(text string) string {
+    lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+    return "    " + strings.Join(lines, "\n    ") + "\n"
+}
+
+func replay(args []string) error {
+    flags := flag.NewFlagSet("replay", flag.ExitOnError)
+    path := flags.String("file", "", "capture file written by the server")
+    index := flags.Int("index", -1, "only replay this frame (counting from 0), default all")
+    hexFrame := flags.String("hex", "", "replay this frame instead, hex encoded")
+    addr := flags.String("addr", "127.0.0.1:8888", "device server to send the frames to")
+    insecure := flags.Bool("insecure", false, "don't check the server certificate, for a local server with a self signed one")
+    flags.Parse(args)
+
+    captures, err := loadCaptures(*path, *index, *hexFrame)
+    if err != nil { return err }
+
+    for i, capture := range captures {
+        if *index >= 0 { i = *index }
+        response, err := send(*addr, *insecure, capture.Frame)
+        if err != nil {
+            fmt.Printf("frame %d: %v\n", i, err)
+            continue
+        }
+        if response == "" {
+            fmt.Printf("frame %d: connection closed without a response, the server rejected it (see its log)\n", i)
+            continue
+        }
+        fmt.Printf("frame %d: response %q\n", i, response)
+    }
+    return nil
+}
+
+// send writes raw to the device server and reads until it hangs up, like a device does
+func send(addr string, insecure bool, raw []byte) (string, error) {
+    conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: insecure})
+    if err != nil { return "", fmt.Errorf("Can't connect to %s %v", addr, err) }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+    if _, err := conn.Write(raw); err != nil { return "", fmt.Errorf("Can't send frame %v", err) }
+    response, err := io.ReadAll(conn)
+    if err != nil && len(response) == 0 { return "", nil }
+    return string(response), nil
+}
+
+// runConformance checks the device server's decoder against the shared
+// protocol vectors and exits non zero on a wrong verdict
+func runConformance(args []string) error {
+    flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+    dir := flags.String("dir", "../protocol/vectors", "directory with the v<n>/vectors.json files")
+    flags.Parse(args)
+
+    results, err := conformance.Check(os.DirFS(*dir))
+    if err != nil { return fmt.Errorf("Can't check conformance vectors: %v", err) }
+
+    failed := 0
+    for _, result := range results {
+        if result.Err != nil {
+            failed++
+            fmt.Printf("FAIL %s: %v\n", result.Name, result.Err)
+            continue
+        }
+        fmt.Printf("ok   %s (%s)\n", result.Name, result.Verdict)
+    }
+    if failed > 0 {
+        fmt.Printf("%d of %d vectors failed\n", failed, len(results))
+        os.Exit(1)
+    }
+    return nil
+}
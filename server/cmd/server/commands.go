@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "time"
+
+    "server-indicum/internal/server/db"
+)
+
+func commandUsage() {
+    fmt.Fprintln(os.Stderr, "usage: server                       run the servers")
+    fmt.Fprintln(os.Stderr, "       server dedupe-entries [-window 10m] [-dry-run]")
+    fmt.Fprintln(os.Stderr, "       server import-hotspots [-dry-run] [-allow-removals] <telstra_hotspots.csv>")
+    fmt.Fprintln(os.Stderr, "       server archive-entries [-months 12] [-tablespace name] [-dry-run]")
+    fmt.Fprintln(os.Stderr, "       server erase-account <uuid>")
+    os.Exit(2)
+}
+
+func runCommand(name string, args []string) error {
+    switch name {
+        case "dedupe-entries":
+            return dedupeEntries(args)
+        case "import-hotspots":
+            return importHotspots(args)
+        case "archive-entries":
+            return archiveEntries(args)
+        case "erase-account":
+            return eraseAccount(args)
+        default:
+            commandUsage()
+    }
+    return nil
+}
+
+// dedupeEntries merges the duplicate entries stored before AddEntryToDB
+// suppressed them, it only needs running once
+func dedupeEntries(args []string) error {
+    flags := flag.NewFlagSet("dedupe-entries", flag.ExitOnError)
+    window := flags.Duration("window", db.DuplicateEntryWindow(), "entries for the same payphone this close together are one discovery")
+    dryRun := flags.Bool("dry-run", false, "only count the duplicates")
+    flags.Parse(args)
+
+    if err := db.InitDB(); err != nil { return fmt.Errorf("Failed to init DB: %v", err) }
+    removed, err := db.DedupeEntries(context.Background(), *window, *dryRun)
+    if err != nil { return err }
+
+    if *dryRun {
+        log.Println(removed, "duplicate entries would be merged")
+    } else {
+        log.Println("Merged", removed, "duplicate entries")
+    }
+    return nil
+}
+
+// importHotspots makes a new hotspot CSV the current dataset and prints what changed
+func importHotspots(args []string) error {
+    flags := flag.NewFlagSet("import-hotspots", flag.ExitOnError)
+    dryRun := flags.Bool("dry-run", false, "only report the changes")
+    allowRemovals := flags.Bool("allow-removals", false, "import even if it removes every hotspot or more than 10% of them")
+    flags.Parse(args)
+    if flags.NArg() != 1 { commandUsage() }
+
+    path := flags.Arg(0)
+    csv, err := os.ReadFile(path)
+    if err != nil { return fmt.Errorf("Can't read hotspots %v", err) }
+
+    if err := db.InitDB(); err != nil { return fmt.Errorf("Failed to init DB: %v", err) }
+    report, err := db.ImportHotspots(context.Background(), filepath.Base(path), csv, *dryRun, *allowRemovals)
+    if err != nil { return err }
+
+    for _, change := range report.Changes {
+        switch change.Change {
+            case db.HotspotMoved:
+                fmt.Printf("moved   %s %s (%.0fm)\n", change.UUID, change.Address, change.Distance)
+            case db.HotspotRemoved:
+                fmt.Printf("removed %s %s (still referenced by %d entries)\n", change.UUID, change.Address, change.Entries)
+            default:
+                fmt.Printf("%-7s %s %s\n", change.Change, change.UUID, change.Address)
+        }
+    }
+
+    summary := fmt.Sprintf("%d hotspots: %d added, %d moved, %d removed, %d unchanged", report.Total,
+        report.Count(db.HotspotAdded), report.Count(db.HotspotMoved), report.Count(db.HotspotRemoved), report.Unchanged)
+    if *dryRun {
+        log.Println("Dry run,", summary)
+        if report.TooManyRemovals() && !*allowRemovals { log.Printf("Importing would be refused, it removes %d of the %d current hotspots. Check the CSV, or pass -allow-removals\n", report.Count(db.HotspotRemoved), report.Current) }
+    } else {
+        log.Printf("Imported dataset version %d, %s\n", report.Version, summary)
+    }
+    return nil
+}
+
+// archiveEntries does what the background job does now rather than waiting a
+// day for it, then lists the entry partitions and where they are
+func archiveEntries(args []string) error {
+    flags := flag.NewFlagSet("archive-entries", flag.ExitOnError)
+    months := flags.Int("months", db.EntryArchiveMonths(), "archive months that ended this many months ago")
+    tablespace := flags.String("tablespace", db.EntryArchiveTablespace(), "tablespace to move old partitions to")
+    dryRun := flags.Bool("dry-run", false, "only list the partitions that would move")
+    flags.Parse(args)
+
+    if err := db.InitDB(); err != nil { return fmt.Errorf("Failed to init DB: %v", err) }
+    ctx := context.Background()
+    if !*dryRun {
+        created, err := db.CreateEntryPartitions(ctx, time.Now())
+        if err != nil { return err }
+        for _, name := range created { log.Println("Created", name) }
+    }
+
+    if *tablespace != "" {
+        archived, err := db.ArchiveEntryPartitions(ctx, time.Now(), *months, *tablespace, *dryRun)
+        for _, p := range archived {
+            if *dryRun {
+                log.Println("Would archive", p.Name, "to", *tablespace)
+            } else {
+                log.Println("Archived", p.Name, "to", *tablespace)
+            }
+        }
+        if err != nil { return err }
+    }
+
+    partitions, err := db.ListEntryPartitions(ctx)
+    if err != nil { return err }
+    for _, p := range partitions {
+        tablespace := p.Tablespace
+        if tablespace == "" { tablespace = "default" }
+        fmt.Printf("%s %-12s %10d rows %8d kB\n", p.Name, tablespace, p.Rows, p.Bytes / 1024)
+    }
+    return nil
+}
+
+// eraseAccount erases a user now, for an erasure request that came in some
+// other way than /delete-account
+func eraseAccount(args []string) error {
+    if len(args) != 1 { commandUsage() }
+
+    if err := db.InitDB(); err != nil { return fmt.Errorf("Failed to init DB: %v", err) }
+    erasure, err := db.EraseAccount(context.Background(), args[0])
+    if err != nil { return err }
+    log.Printf("Erased %s: %d entries, %d test entries, %d sightings, %d device log lines, %d placement votes\n",
+        args[0], erasure.Entries, erasure.TestEntries, erasure.Sightings, erasure.DeviceLogs, erasure.Votes)
+    log.Println("Audit subject", db.SubjectHash(args[0]))
+    if path := os.Getenv("FRAME_CAPTURE_FILE"); path != "" { log.Println("Frames this device sent may still be in", path, "which erasure doesn't touch") }
+    return nil
+}
@@ -1,16 +1,45 @@
 package main
 
 import (
+    "context"
     "os"
     "log"
     "os/signal"
+    "syscall"
     "server-indicum/internal/server/http"
     "server-indicum/internal/server/device"
     "server-indicum/internal/server/db"
+    "server-indicum/internal/server/db/memstore"
 )
 
 func main(){
-    
+
+    // maintenance commands run against Postgres and exit, see commands.go
+    if len(os.Args) > 1 {
+        if err := runCommand(os.Args[1], os.Args[2:]); err != nil { log.Fatal(err) }
+        return
+    }
+
+    // cancelled on shutdown, which stops the servers and the queries they are running
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // STORE=memory runs without Postgres, everything is lost on exit
+    if os.Getenv("STORE") == "memory" {
+        store := memstore.New()
+        if path := os.Getenv("HOTSPOTS_CSV"); path != "" {
+            file, err := os.Open(path)
+            if err != nil { log.Fatalf("Can't open hotspots: %v\n", err) }
+            count, err := store.LoadHotspots(file)
+            file.Close()
+            if err != nil { log.Fatalf("Can't load hotspots: %v\n", err) }
+            log.Println("Loaded", count, "hotspots")
+        }
+        log.Println("Using the in memory store")
+        run(ctx, store)
+        return
+    }
+
     err := db.InitDB()
     if err != nil { log.Fatalf("Failed to init DB: %v\n", err) } else {
         log.Println("DB initialized")
@@ -30,14 +59,16 @@ func main(){
 	// 	log.Fatalf("Failed to load env %v\n" ,envErr)
 	// }
 
-    go http.HandleHTTPServer()
-    go device.InitDeviceServer()
-    go db.ListenForDBInserts()
-    go db.PeriodicDBUpdate()
+    go db.ListenForDBInserts(ctx)
+    go db.PeriodicDBUpdate(ctx)
+    run(ctx, db.Postgres{})
+}
+
+func run(ctx context.Context, store db.Store) {
+    go http.HandleHTTPServer(ctx, store)
+    go device.InitDeviceServer(ctx, store)
 
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt)
-    <-c
+    <-ctx.Done()
     log.Println("Graceful shutdown")
 }
 
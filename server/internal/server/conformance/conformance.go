@@ -0,0 +1,209 @@
+// Runs the golden vectors in protocol/vectors (at the root of the repo) through
+// the device server's decoder. The client checks its encoder against the same
+// vectors (client-indicum conformance), so the two common packages and the
+// signing and encryption order can't drift apart without one of them failing.
+//
+// Every vector has a frame and the verdict the server has to reach on it. For
+// accepted frames the decrypted plaintext has to match too, and has to come
+// out the same when the server marshals what it decoded, so a field only the
+// client knows about shows up here.
+package conformance
+
+import (
+    "bytes"
+    "context"
+    "crypto/rsa"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/fs"
+    "path"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/device"
+    "server-indicum/internal/server/frame"
+    "server-indicum/internal/server/keyring"
+)
+
+// File is one version of the vectors, <dir>/v<version>/vectors.json. It is the
+// same format as client/conformance reads.
+type File struct {
+    Version     int
+    Description string
+    Devices     []Device
+    PayloadKeys []PayloadKey
+    // Now is the server clock the verdicts assume, unix seconds
+    Now         int64
+    Vectors     []Vector
+}
+
+type Device struct {
+    Name       string
+    UUID       string
+    PrivateKey string
+    PublicKey  string
+    Secret     string
+}
+
+type PayloadKey struct {
+    ID    uint16
+    State string
+    Key   string
+}
+
+type Vector struct {
+    Name         string
+    Description  string
+    Device       string
+    Signer       string `json:",omitempty"`
+    ClientSecret *string `json:",omitempty"`
+    FrameType    byte
+    KeyID        uint16
+    Nonce        string `json:",omitempty"`
+    Timestamp    int64 `json:",omitempty"`
+    Payload      *common.Payload `json:",omitempty"`
+    ScanReport   *common.ScanReport `json:",omitempty"`
+    LogRecords   []common.LogRecord `json:",omitempty"`
+    Plaintext    string `json:",omitempty"`
+    Frame        string
+    Encoder      bool
+    Verdict      string
+    Reason       string
+}
+
+const (
+    VerdictAccept = "accept"
+    VerdictReject = "reject"
+)
+
+type Result struct {
+    Name string
+    // Verdict is what the server decided, Err says why it isn't the expected one
+    Verdict string
+    Err     error
+}
+
+// Load reads every version of the vectors in fsys
+func Load(fsys fs.FS) ([]File, error) {
+    names, err := fs.Glob(fsys, "v*/vectors.json")
+    if err != nil { return nil, fmt.Errorf("Can't list vectors %v", err) }
+    if len(names) == 0 { return nil, fmt.Errorf("No conformance vectors found") }
+    sort.Strings(names)
+
+    var files []File
+    for _, name := range names {
+        content, err := fs.ReadFile(fsys, name)
+        if err != nil { return nil, fmt.Errorf("Can't read %s %v", name, err) }
+        // a field common.Payload doesn't have is drift, not something to skip over
+        decoder := json.NewDecoder(bytes.NewReader(content))
+        decoder.DisallowUnknownFields()
+        var file File
+        if err := decoder.Decode(&file); err != nil { return nil, fmt.Errorf("Can't parse %s %v", name, err) }
+        if path.Dir(name) != fmt.Sprintf("v%d", file.Version) { return nil, fmt.Errorf("%s says it is version %d", name, file.Version) }
+        files = append(files, file)
+    }
+    return files, nil
+}
+
+// Check decodes every vector in fsys and compares the verdicts
+func Check(fsys fs.FS) ([]Result, error) {
+    files, err := Load(fsys)
+    if err != nil { return nil, err }
+
+    var results []Result
+    for _, file := range files {
+        keys, err := file.keyring()
+        if err != nil { return nil, fmt.Errorf("v%d: %v", file.Version, err) }
+        devices := vectorDevices(file.Devices)
+        now := time.Unix(file.Now, 0)
+
+        for _, vector := range file.Vectors {
+            result := Result{Name: fmt.Sprintf("v%d/%s", file.Version, vector.Name)}
+            result.Verdict, result.Err = checkVector(vector, keys, devices, now)
+            results = append(results, result)
+        }
+    }
+    return results, nil
+}
+
+func (file File) keyring() (*keyring.Keyring, error) {
+    var lines []string
+    for _, key := range file.PayloadKeys {
+        lines = append(lines, fmt.Sprintf("%d %s %s", key.ID, key.State, key.Key))
+    }
+    return keyring.Parse(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+// vectorDevices are the devices in a vector file, by UUID
+type vectorDevices []Device
+
+func (devices vectorDevices) find(deviceUUID string) (Device, error) {
+    for _, d := range devices {
+        if d.UUID == deviceUUID { return d, nil }
+    }
+    return Device{}, fmt.Errorf("No device with UUID %s\n", deviceUUID)
+}
+
+func (devices vectorDevices) PublicKey(ctx context.Context, deviceUUID string) (*rsa.PublicKey, error) {
+    d, err := devices.find(deviceUUID)
+    if err != nil { return nil, err }
+    return frame.ParsePublicKey([]byte(d.PublicKey))
+}
+
+func (devices vectorDevices) Secret(ctx context.Context, deviceUUID string) (string, error) {
+    d, err := devices.find(deviceUUID)
+    if err != nil { return "", err }
+    return d.Secret, nil
+}
+
+func checkVector(vector Vector, keys *keyring.Keyring, devices device.Devices, now time.Time) (string, error) {
+    if vector.Verdict != VerdictAccept && vector.Verdict != VerdictReject { return "", fmt.Errorf("Verdict %q should be accept or reject", vector.Verdict) }
+
+    raw, err := hex.DecodeString(vector.Frame)
+    if err != nil { return "", fmt.Errorf("Frame is not hex") }
+
+    f, err := frame.Read(bytes.NewReader(raw))
+    var decoded *device.Decoded
+    if err == nil { decoded, err = device.Decode(context.Background(), f, keys, devices, now) }
+
+    if err != nil {
+        if vector.Verdict == VerdictAccept { return VerdictReject, fmt.Errorf("rejected, expected accept: %s", strings.TrimSpace(err.Error())) }
+        return VerdictReject, nil
+    }
+    if vector.Verdict == VerdictReject { return VerdictAccept, fmt.Errorf("accepted, expected reject (%s)", vector.Reason) }
+    if !frame.IsSealed(f.Type) { return VerdictAccept, nil }
+
+    return VerdictAccept, checkPlaintext(vector, decoded)
+}
+
+// checkPlaintext compares what an accepted frame decrypted and decoded to with the vector
+func checkPlaintext(vector Vector, decoded *device.Decoded) error {
+    want, err := hex.DecodeString(vector.Plaintext)
+    if err != nil { return fmt.Errorf("Plaintext is not hex") }
+    if !bytes.Equal(decoded.Plaintext, want) { return fmt.Errorf("plaintext differs\n  got  %s\n  want %s", printable(decoded.Plaintext), printable(want)) }
+
+    // marshalling what the server decoded has to give back the same JSON
+    var remarshalled []byte
+    switch {
+        case decoded.Payload != nil:
+            remarshalled, err = json.Marshal(decoded.Payload)
+        case decoded.ScanReport != nil:
+            remarshalled, err = json.Marshal(decoded.ScanReport)
+        default:
+            if !reflect.DeepEqual(decoded.Logs, vector.LogRecords) { return fmt.Errorf("log records differ\n  got  %+v\n  want %+v", decoded.Logs, vector.LogRecords) }
+            return nil
+    }
+    if err != nil { return fmt.Errorf("Can't marshal decoded plaintext %v", err) }
+    if !bytes.Equal(remarshalled, want) { return fmt.Errorf("server common doesn't round trip the plaintext\n  got  %s\n  want %s", remarshalled, want) }
+    return nil
+}
+
+// printable shows JSON plaintext as text and anything else as hex
+func printable(plaintext []byte) string {
+    if json.Valid(plaintext) { return string(plaintext) }
+    return hex.EncodeToString(plaintext)
+}
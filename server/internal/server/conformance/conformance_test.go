@@ -0,0 +1,34 @@
+package conformance
+
+import (
+    "fmt"
+    "os"
+    "testing"
+)
+
+// vectorsDir is protocol/vectors at the root of the repo
+const vectorsDir = "../../../../protocol/vectors"
+
+// TestVectors decodes every vector and checks the server reaches its verdict,
+// the same as frametool conformance
+func TestVectors(t *testing.T) {
+    fsys := os.DirFS(vectorsDir)
+    files, err := Load(fsys)
+    if err != nil { t.Fatal(err) }
+    expected := map[string]string{}
+    for _, file := range files {
+        for _, vector := range file.Vectors {
+            expected[fmt.Sprintf("v%d/%s", file.Version, vector.Name)] = vector.Verdict
+        }
+    }
+
+    results, err := Check(fsys)
+    if err != nil { t.Fatal(err) }
+    if len(results) != len(expected) { t.Fatalf("checked %d vectors, there are %d", len(results), len(expected)) }
+    for _, result := range results {
+        t.Run(result.Name, func(t *testing.T) {
+            if result.Err != nil { t.Fatal(result.Err) }
+            if result.Verdict != expected[result.Name] { t.Fatalf("verdict is %s, the vector says %s", result.Verdict, expected[result.Name]) }
+        })
+    }
+}
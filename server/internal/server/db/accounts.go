@@ -0,0 +1,242 @@
+package db
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// A user leaves by asking for their account to be deleted. Their device is
+// revoked then: its public key and attestation secret are cleared, so the
+// device server rejects anything it sends. The account is erased
+// AccountDeletionGrace later unless they cancel first. Erasing deletes every
+// row keyed by their uuid, withdraws their placement votes and leaves an
+// account_tombstones row with their totals. Each step goes in account_audit.
+
+const defaultAccountDeletionGrace = 30 * 24 * time.Hour
+
+// AccountDeletionGrace is how long a user has to change their mind,
+// ACCOUNT_DELETION_GRACE (a Go duration) overrides it
+func AccountDeletionGrace() time.Duration {
+    grace, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE"))
+    if err != nil || grace < 0 { return defaultAccountDeletionGrace }
+    return grace
+}
+
+// the action column of account_audit
+const (
+    AccountDeletionRequested = "requested"
+    AccountDeletionCancelled = "cancelled"
+    AccountErased            = "erased"
+)
+
+var ErrNoDeletionPending = errors.New("No account deletion pending")
+
+// SubjectHash is how account_audit refers to a user, the uuid itself isn't
+// kept. It is an HMAC keyed with AUDIT_SUBJECT_SECRET: uuids are handed out to
+// devices and show up in frames and logs, so a plain hash of one could be
+// matched back to its user by anyone who has the uuid.
+func SubjectHash(uuid string) string {
+    mac := hmac.New(sha256.New, subjectSecret())
+    mac.Write([]byte(uuid))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+    randomSubjectSecret     []byte
+    randomSubjectSecretOnce sync.Once
+)
+
+// subjectSecret is AUDIT_SUBJECT_SECRET. InitDB won't start without it, so
+// the random one is only ever used by memstore, whose audit doesn't outlive
+// the process anyway.
+func subjectSecret() []byte {
+    if secret := os.Getenv("AUDIT_SUBJECT_SECRET"); secret != "" { return []byte(secret) }
+    randomSubjectSecretOnce.Do(func() {
+        randomSubjectSecret = make([]byte, 32)
+        rand.Read(randomSubjectSecret)
+    })
+    return randomSubjectSecret
+}
+
+func auditAccount(ctx context.Context, tx pgx.Tx, uuid, action string, detail map[string]any) error {
+    _, err := tx.Exec(ctx, "INSERT INTO account_audit (subjectHash, action, detail) VALUES ($1, $2, $3)", SubjectHash(uuid), action, detail)
+    if err != nil { return fmt.Errorf("Can't audit account %s %v\n", action, err) }
+    return nil
+}
+
+// DBRequestAccountDeletion revokes the user's device and schedules their erasure
+// grace from now. Asking again keeps the first request. Returns when it's due.
+func DBRequestAccountDeletion(ctx context.Context, uuid string, grace time.Duration) (time.Time, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return time.Time{}, fmt.Errorf("Can't start account deletion %v\n", err) }
+    defer tx.Rollback(ctx)
+
+    var due *time.Time
+    var enrolled bool
+    err = tx.QueryRow(ctx, "SELECT deletionDueTime, pub_key IS NOT NULL FROM users WHERE uuid = $1 FOR UPDATE", uuid).Scan(&due, &enrolled)
+    if errors.Is(err, pgx.ErrNoRows) { return time.Time{}, fmt.Errorf("no user found with uuid %s", uuid) }
+    if err != nil { return time.Time{}, fmt.Errorf("Can't find user %v\n", err) }
+    if due != nil { return *due, nil }
+
+    var dueTime time.Time
+    err = tx.QueryRow(ctx, `UPDATE users SET deletionRequestedTime = NOW(), deletionDueTime = NOW() + make_interval(secs => $2),
+                                             pub_key = NULL, device_secret = NULL
+                            WHERE uuid = $1
+                            RETURNING deletionDueTime`, uuid, grace.Seconds()).Scan(&dueTime)
+    if err != nil { return time.Time{}, fmt.Errorf("Can't schedule account deletion %v\n", err) }
+
+    if err := auditAccount(ctx, tx, uuid, AccountDeletionRequested, map[string]any{"dueTime": dueTime.Unix(), "deviceRevoked": enrolled}); err != nil { return time.Time{}, err }
+    if err := tx.Commit(ctx); err != nil { return time.Time{}, fmt.Errorf("Can't commit account deletion %v\n", err) }
+    return dueTime, nil
+}
+
+// DBCancelAccountDeletion keeps the account. The device stays revoked, it has
+// to be enrolled again.
+func DBCancelAccountDeletion(ctx context.Context, uuid string) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return fmt.Errorf("Can't start cancelling account deletion %v\n", err) }
+    defer tx.Rollback(ctx)
+
+    tag, err := tx.Exec(ctx, `UPDATE users SET deletionRequestedTime = NULL, deletionDueTime = NULL
+                              WHERE uuid = $1 AND deletionDueTime IS NOT NULL`, uuid)
+    if err != nil { return fmt.Errorf("Can't cancel account deletion %v\n", err) }
+    if tag.RowsAffected() == 0 { return ErrNoDeletionPending }
+
+    if err := auditAccount(ctx, tx, uuid, AccountDeletionCancelled, nil); err != nil { return err }
+    if err := tx.Commit(ctx); err != nil { return fmt.Errorf("Can't commit cancelling account deletion %v\n", err) }
+    return nil
+}
+
+// AccountErasure is how many rows erasing an account deleted from each table
+type AccountErasure struct {
+    Entries     int64
+    TestEntries int64
+    Sightings   int64
+    DeviceLogs  int64
+    Votes       int64
+}
+
+// EraseAccount deletes the user and everything keyed by their uuid in one
+// transaction, whether or not they asked (an operator can erase on request).
+// Payphone identities stay, they are about the payphone, but the user's votes
+// no longer count towards them.
+func EraseAccount(ctx context.Context, uuid string) (AccountErasure, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return AccountErasure{}, fmt.Errorf("Can't start erasing account %v\n", err) }
+    defer tx.Rollback(ctx)
+
+    var requested bool
+    err = tx.QueryRow(ctx, "SELECT deletionDueTime IS NOT NULL FROM users WHERE uuid = $1 FOR UPDATE", uuid).Scan(&requested)
+    if errors.Is(err, pgx.ErrNoRows) { return AccountErasure{}, fmt.Errorf("no user found with uuid %s", uuid) }
+    if err != nil { return AccountErasure{}, fmt.Errorf("Can't find user %v\n", err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO account_tombstones (joinedMonth, total_payphones, total_entries, total_maps)
+                           SELECT date_trunc('month', u.created_timestamp), COUNT(DISTINCT e.payphoneID), COUNT(e.id), COUNT(DISTINCT e.mapLocation)
+                           FROM users u
+                           LEFT JOIN entries e ON e.deviceUUID = u.uuid
+                           WHERE u.uuid = $1
+                           GROUP BY u.created_timestamp`, uuid)
+    if err != nil { return AccountErasure{}, fmt.Errorf("Can't add account tombstone %v\n", err) }
+
+    // the votes go before the entries, settling a payphone needs its MAC
+    type placement struct{ payphoneID, payphoneMAC string }
+    var placements []placement
+    rows, err := tx.Query(ctx, `DELETE FROM placement_votes v WHERE v.voterUUID = $1
+                                RETURNING v.payphoneID, COALESCE((SELECT e.payphoneMAC FROM entries e WHERE e.deviceUUID = $1 AND e.payphoneID = v.payphoneID LIMIT 1), '')`, uuid)
+    if err != nil { return AccountErasure{}, fmt.Errorf("Can't delete placement votes %v\n", err) }
+    for rows.Next() {
+        var p placement
+        if err := rows.Scan(&p.payphoneID, &p.payphoneMAC); err != nil { rows.Close(); return AccountErasure{}, fmt.Errorf("Can't scan placement vote %v\n", err) }
+        placements = append(placements, p)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return AccountErasure{}, fmt.Errorf("Can't delete placement votes %v\n", err) }
+
+    // settled in order so two erasures take the placement locks in the same order
+    sort.Slice(placements, func(i, j int) bool { return placements[i].payphoneID < placements[j].payphoneID })
+    for _, p := range placements {
+        if err := settlePlacement(ctx, tx, p.payphoneID, p.payphoneMAC); err != nil { return AccountErasure{}, err }
+    }
+    erasure := AccountErasure{Votes: int64(len(placements))}
+
+    deletes := []struct {
+        query string
+        count *int64
+    }{
+        {"DELETE FROM entries WHERE deviceUUID = $1", &erasure.Entries},
+        {"DELETE FROM test_entries WHERE deviceUUID = $1", &erasure.TestEntries},
+        {"DELETE FROM scan_sightings WHERE deviceUUID = $1", &erasure.Sightings},
+        {"DELETE FROM device_logs WHERE deviceUUID = $1", &erasure.DeviceLogs},
+        {"DELETE FROM user_statistics WHERE user_id = $1", nil},
+        {"DELETE FROM users WHERE uuid = $1", nil},
+    }
+    for _, d := range deletes {
+        tag, err := tx.Exec(ctx, d.query, uuid)
+        if err != nil { return AccountErasure{}, fmt.Errorf("Can't erase account, %s: %v\n", d.query, err) }
+        if d.count != nil { *d.count = tag.RowsAffected() }
+    }
+
+    detail := map[string]any{
+        "requested":   requested,
+        "entries":     erasure.Entries,
+        "testEntries": erasure.TestEntries,
+        "sightings":   erasure.Sightings,
+        "deviceLogs":  erasure.DeviceLogs,
+        "votes":       erasure.Votes,
+    }
+    if err := auditAccount(ctx, tx, uuid, AccountErased, detail); err != nil { return AccountErasure{}, err }
+    if err := tx.Commit(ctx); err != nil { return AccountErasure{}, fmt.Errorf("Can't commit erasing account %v\n", err) }
+    return erasure, nil
+}
+
+func dueAccountDeletions(ctx context.Context) ([]string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    rows, err := Pool.Query(ctx, "SELECT uuid FROM users WHERE deletionDueTime <= NOW() ORDER BY deletionDueTime")
+    if err != nil { return nil, fmt.Errorf("Can't list due account deletions %v\n", err) }
+    defer rows.Close()
+
+    var uuids []string
+    for rows.Next() {
+        var uuid string
+        if err := rows.Scan(&uuid); err != nil { return nil, fmt.Errorf("Can't scan due account deletion %v\n", err) }
+        uuids = append(uuids, uuid)
+    }
+    if err := rows.Err(); err != nil { return nil, fmt.Errorf("Can't list due account deletions %v\n", err) }
+    return uuids, nil
+}
+
+func eraseDueAccounts(ctx context.Context) {
+    for {
+        uuids, err := dueAccountDeletions(ctx)
+        if err != nil { fmt.Printf("Error erasing accounts: %v\n", err) }
+        erased := 0
+        for _, uuid := range uuids {
+            if _, err := EraseAccount(ctx, uuid); err != nil {
+                fmt.Printf("Error erasing account: %v\n", err)
+                continue
+            }
+            erased++
+        }
+        if erased > 0 { fmt.Println("Erased", erased, "accounts") }
+
+        if !sleep(ctx, 1 * time.Hour) { return }
+    }
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "testing"
+)
+
+func TestSubjectHash(t *testing.T) {
+    const uuid = "0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+
+    t.Setenv("AUDIT_SUBJECT_SECRET", "first secret")
+    first := SubjectHash(uuid)
+    if len(first) != 64 { t.Fatalf("hash is %d characters, account_audit holds 64", len(first)) }
+    if SubjectHash(uuid) != first { t.Fatalf("hash isn't stable") }
+    if SubjectHash(uuid[:35] + "1") == first { t.Fatalf("another uuid has the same hash") }
+
+    // anyone can work out the plain hash of a uuid they've seen
+    plain := sha256.Sum256([]byte(uuid))
+    if first == hex.EncodeToString(plain[:]) { t.Fatalf("hash is the plain sha256 of the uuid") }
+
+    t.Setenv("AUDIT_SUBJECT_SECRET", "second secret")
+    if SubjectHash(uuid) == first { t.Fatalf("hash doesn't depend on the secret") }
+
+    // memstore runs without one and still gets a keyed, stable hash
+    t.Setenv("AUDIT_SUBJECT_SECRET", "")
+    unset := SubjectHash(uuid)
+    if unset == hex.EncodeToString(plain[:]) || SubjectHash(uuid) != unset { t.Fatalf("hash without a secret is %s", unset) }
+}
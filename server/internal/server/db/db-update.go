@@ -3,6 +3,8 @@ package db
 import (
     "context"
     "fmt"
+    "os"
+    "strconv"
 	"time"
 )
 
@@ -10,17 +12,34 @@ import (
 type UserID struct {
     UUID string
 }
-func PeriodicDBUpdate() {
+// PeriodicDBUpdate runs the background jobs until ctx is done
+func PeriodicDBUpdate(ctx context.Context) {
     // Start the background job to update user statistics every 3 hours
-    go updateUserStatistics()
+    go updateUserStatistics(ctx)
+    go pruneDeviceLogs(ctx)
+    go pruneTestEntries(ctx)
+    go maintainEntryPartitions(ctx)
+    go eraseDueAccounts(ctx)
 
-    select {}
+    <-ctx.Done()
 }
 
-func updateUserStatistics() {
+// sleep waits for d, false if ctx was done first
+func sleep(ctx context.Context, d time.Duration) bool {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+        case <-ctx.Done():
+            return false
+        case <-timer.C:
+            return true
+    }
+}
+
+func updateUserStatistics(ctx context.Context) {
     for {
         // Calculate and update user statistics
-        err := calculateAndUpdateUserStatistics()
+        err := calculateAndUpdateUserStatistics(ctx)
         if err != nil {
             fmt.Printf("Error updating user statistics: %v\n", err)
         } else {
@@ -28,13 +47,80 @@ func updateUserStatistics() {
         }
 
         // Sleep for 3 hours before the next update
-        time.Sleep(1 * time.Hour)
+        if !sleep(ctx, 1 * time.Hour) { return }
+    }
+}
+
+// device logs are kept for DEVICE_LOG_RETENTION_DAYS and at most
+// DEVICE_LOG_MAX_ROWS lines per device, whichever runs out first
+const (
+    defaultDeviceLogRetentionDays = 14
+    defaultDeviceLogMaxRows       = 10000
+)
+
+func envInt(name string, fallback int) int {
+    value, err := strconv.Atoi(os.Getenv(name))
+    if err != nil || value <= 0 { return fallback }
+    return value
+}
+
+func pruneDeviceLogs(ctx context.Context) {
+    retentionDays := envInt("DEVICE_LOG_RETENTION_DAYS", defaultDeviceLogRetentionDays)
+    maxRows := envInt("DEVICE_LOG_MAX_ROWS", defaultDeviceLogMaxRows)
+
+    for {
+        count, err := deleteOldDeviceLogs(ctx, retentionDays, maxRows)
+        if err != nil {
+            fmt.Printf("Error pruning device logs: %v\n", err)
+        } else if count > 0 {
+            fmt.Println("Pruned", count, "device log lines")
+        }
+
+        if !sleep(ctx, 1 * time.Hour) { return }
+    }
+}
+
+func deleteOldDeviceLogs(ctx context.Context, retentionDays, maxRows int) (int64, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    query := `
+        DELETE FROM device_logs
+        WHERE loggedTime < NOW() - make_interval(days => $1)
+           OR id IN (
+               SELECT id FROM (
+                   SELECT id, ROW_NUMBER() OVER (PARTITION BY deviceUUID ORDER BY loggedTime DESC, id DESC) AS row
+                   FROM device_logs
+               ) ranked
+               WHERE row > $2
+           )
+    `
+    tag, err := Pool.Exec(ctx, query, retentionDays, maxRows)
+    if err != nil {
+        return 0, fmt.Errorf("failed to delete device logs: %v", err)
+    }
+    return tag.RowsAffected(), nil
+}
+
+func pruneTestEntries(ctx context.Context) {
+    for {
+        queryCtx, cancel := queryContext(ctx)
+        tag, err := Pool.Exec(queryCtx, "DELETE FROM test_entries WHERE expiresTime < NOW()")
+        cancel()
+        if err != nil {
+            fmt.Printf("Error pruning test entries: %v\n", err)
+        } else if tag.RowsAffected() > 0 {
+            fmt.Println("Pruned", tag.RowsAffected(), "expired test entries")
+        }
+
+        if !sleep(ctx, 1 * time.Hour) { return }
     }
 }
 
-func getAllUsers() ([]UserID, error) {
+func getAllUsers(ctx context.Context) ([]UserID, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     query := "SELECT uuid FROM users"
-    rows, err := Pool.Query(context.Background(), query)
+    rows, err := Pool.Query(ctx, query)
     if err != nil {
         return nil, fmt.Errorf("failed to execute query: %v", err)
     }
@@ -55,7 +141,9 @@ func getAllUsers() ([]UserID, error) {
     return users, nil
 }
 
-func calculateTotalCounts(userUUID string) (int, int, int, error) {
+func calculateTotalCounts(ctx context.Context, userUUID string) (int, int, int, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     query := `
         SELECT 
             COUNT(DISTINCT payphoneID) AS total_payphones,
@@ -65,7 +153,7 @@ func calculateTotalCounts(userUUID string) (int, int, int, error) {
         WHERE deviceUUID = $1
     `
     var totalPayphones, totalEntries, totalMaps int
-    err := Pool.QueryRow(context.Background(), query, userUUID).Scan(&totalPayphones, &totalEntries, &totalMaps)
+    err := Pool.QueryRow(ctx, query, userUUID).Scan(&totalPayphones, &totalEntries, &totalMaps)
     if err != nil {
         return 0, 0, 0, fmt.Errorf("failed to execute query: %v", err)
     }
@@ -73,7 +161,9 @@ func calculateTotalCounts(userUUID string) (int, int, int, error) {
     return totalPayphones, totalEntries, totalMaps, nil
 }
 
-func calculateRanks(userUUID string, totalPayphones, totalEntries, totalMaps int) (int, int, int, error) {
+func calculateRanks(ctx context.Context, userUUID string, totalPayphones, totalEntries, totalMaps int) (int, int, int, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     query := `
         SELECT
             (SELECT COUNT(*) + 1 FROM user_statistics WHERE total_payphones > $1) AS payphone_rank,
@@ -81,7 +171,7 @@ func calculateRanks(userUUID string, totalPayphones, totalEntries, totalMaps int
             (SELECT COUNT(*) + 1 FROM user_statistics WHERE total_maps > $3) AS map_rank
     `
     var payphoneRank, entryRank, mapRank int
-    err := Pool.QueryRow(context.Background(), query, totalPayphones, totalEntries, totalMaps).Scan(&payphoneRank, &entryRank, &mapRank)
+    err := Pool.QueryRow(ctx, query, totalPayphones, totalEntries, totalMaps).Scan(&payphoneRank, &entryRank, &mapRank)
     if err != nil {
         return 0, 0, 0, fmt.Errorf("failed to execute query: %v", err)
     }
@@ -89,7 +179,9 @@ func calculateRanks(userUUID string, totalPayphones, totalEntries, totalMaps int
     return payphoneRank, entryRank, mapRank, nil
 }
 
-func updateUserStatisticsInDB(userUUID string, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank int) error {
+func updateUserStatisticsInDB(ctx context.Context, userUUID string, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank int) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     query := `
         INSERT INTO user_statistics (user_id, total_payphones, total_entries, total_maps, payphone_rank, entry_rank, map_rank, last_updated)
         VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
@@ -102,7 +194,7 @@ func updateUserStatisticsInDB(userUUID string, totalPayphones, totalEntries, tot
             map_rank = $7,
             last_updated = NOW()
     `
-    _, err := Pool.Exec(context.Background(), query, userUUID, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank)
+    _, err := Pool.Exec(ctx, query, userUUID, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank)
     if err != nil {
         return fmt.Errorf("failed to update user statistics: %v", err)
     }
@@ -110,9 +202,9 @@ func updateUserStatisticsInDB(userUUID string, totalPayphones, totalEntries, tot
     return nil
 }
 
-func calculateAndUpdateUserStatistics() error {
+func calculateAndUpdateUserStatistics(ctx context.Context) error {
     // Get all users from the users table
-    users, err := getAllUsers()
+    users, err := getAllUsers(ctx)
     if err != nil {
         return fmt.Errorf("failed to get users: %v", err)
     }
@@ -120,19 +212,19 @@ func calculateAndUpdateUserStatistics() error {
     // Iterate over each user
     for _, user := range users {
         // Calculate total counts for the user
-        totalPayphones, totalEntries, totalMaps, err := calculateTotalCounts(user.UUID)
+        totalPayphones, totalEntries, totalMaps, err := calculateTotalCounts(ctx, user.UUID)
         if err != nil {
             return fmt.Errorf("failed to calculate total counts for user %s: %v", user.UUID, err)
         }
 
         // Calculate ranks for the user
-        payphoneRank, entryRank, mapRank, err := calculateRanks(user.UUID, totalPayphones, totalEntries, totalMaps)
+        payphoneRank, entryRank, mapRank, err := calculateRanks(ctx, user.UUID, totalPayphones, totalEntries, totalMaps)
         if err != nil {
             return fmt.Errorf("failed to calculate ranks for user %s: %v", user.UUID, err)
         }
 
         // Update the user's statistics in the user_statistics table
-        err = updateUserStatisticsInDB(user.UUID, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank)
+        err = updateUserStatisticsInDB(ctx, user.UUID, totalPayphones, totalEntries, totalMaps, payphoneRank, entryRank, mapRank)
         if err != nil {
             return fmt.Errorf("failed to update user statistics for user %s: %v", user.UUID, err)
         }
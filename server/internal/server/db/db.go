@@ -3,13 +3,13 @@ package db
 import (
     "context"
     "database/sql"
+    "errors"
     "fmt"
     "os"
     "strconv"
     "github.com/jackc/pgx/v5"
     "github.com/jackc/pgx/v5/pgxpool"
     // "github.com/joho/godotenv"
-    "github.com/gorilla/websocket"
     "time"
     
     "server-indicum/internal/common"
@@ -19,7 +19,33 @@ import (
 // Use capital letter so it can be used in db-update.go
 var Pool *pgxpool.Pool
 
+// every DB function gives up after queryTimeout unless its context is done
+// sooner, so a hung query can't hold a request and a pool connection forever.
+// DB_QUERY_TIMEOUT (a Go duration) overrides it.
+const defaultQueryTimeout = 10 * time.Second
+
+var queryTimeout = defaultQueryTimeout
+
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(ctx, queryTimeout)
+}
+
+// InitDB connects to the database and brings its schema up to date
 func InitDB() error {
+    // without it account_audit rows couldn't be matched to a user again after a restart
+    if os.Getenv("AUDIT_SUBJECT_SECRET") == "" { return fmt.Errorf("AUDIT_SUBJECT_SECRET isn't set, see Account deletion in the README") }
+    if err := Connect(); err != nil { return err }
+    return Migrate(context.Background())
+}
+
+// Connect sets up Pool without touching the schema, for tools that only read
+func Connect() error {
+    if value := os.Getenv("DB_QUERY_TIMEOUT"); value != "" {
+        timeout, err := time.ParseDuration(value)
+        if err != nil || timeout <= 0 { return fmt.Errorf("DB_QUERY_TIMEOUT %q isn't a positive duration", value) }
+        queryTimeout = timeout
+    }
+
 
     config, err := pgx.ParseConfig("")
     if err != nil {
@@ -43,7 +69,8 @@ func InitDB() error {
     }
     pgxpoolConfig.ConnConfig = config
 
-    ctx := context.Background()
+    ctx, cancel := queryContext(context.Background())
+    defer cancel()
     Pool, err = pgxpool.NewWithConfig(ctx, pgxpoolConfig)
     if err != nil {
         return fmt.Errorf("Failed to connect to DB: %s", err)
@@ -63,21 +90,24 @@ func InitDB() error {
 // I have created a notification channel in the database that is triggered
 // when something is added to the entries table. This waits for a notification
 // and then sends a message to the websocket connection with the UUID that was added in the DB
-func ListenForDBInserts() {
-    conn, err := Pool.Acquire(context.Background())
+// It stops when ctx is done.
+func ListenForDBInserts(ctx context.Context) {
+    conn, err := Pool.Acquire(ctx)
     if err != nil {
         fmt.Printf("Failed to acquire connection: %v", err)
         return
     }
     defer conn.Release()
-    _, err = conn.Exec(context.Background(), "LISTEN new_entry")
+    _, err = conn.Exec(ctx, "LISTEN new_entry")
     if err != nil {
         fmt.Printf("Failed to execute LISTEN command: %v", err)
         return
     }
 
     for {
-        notification, err := conn.Conn().WaitForNotification(context.Background())
+        // waits as long as it takes, there is no query to time out
+        notification, err := conn.Conn().WaitForNotification(ctx)
+        if ctx.Err() != nil { return }
         if err != nil {
             fmt.Printf("Error waiting for notification: %v", err)
             time.Sleep(5 * time.Second)
@@ -87,31 +117,32 @@ func ListenForDBInserts() {
         
         // check if there is a websocket with the key of the uuid
         // if so this means that the user is online and they just added a new entry
-        ws.WSConnMutex.Lock()
-        if ws, ok := ws.WSConnections[notification.Payload]; ok {
-            if err := ws.WriteMessage(websocket.TextMessage, []byte(notification.Payload)); err != nil {
-                fmt.Println("Error sending message:", err)
-                // Handle error, possibly close and delete connection
-            }
-        } else {
+        sent, err := ws.Send(notification.Payload, []byte(notification.Payload))
+        if err != nil {
+            fmt.Println("Error sending message:", err)
+            // Handle error, possibly close and delete connection
+        } else if !sent {
             fmt.Println("No connection found for UUID:", notification.Payload)
         }
-        ws.WSConnMutex.Unlock()
 
     }
 }
 
 
-func waitForNotification() (string, error) {
+func waitForNotification(ctx context.Context) (string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var notification string
     // Wait for a notification
-    err := Pool.QueryRow(context.Background(), "SELECT pg_notify").Scan(&notification)
+    err := Pool.QueryRow(ctx, "SELECT pg_notify").Scan(&notification)
     fmt.Println("notification:", notification)
     return notification, err
 }
 
-func DBInitializeUserStatistics(uuid string) error {
-    _, err := Pool.Exec(context.Background(), `
+func DBInitializeUserStatistics(ctx context.Context, uuid string) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    _, err := Pool.Exec(ctx, `
         INSERT INTO user_statistics (
             user_id, total_payphones, total_entries, total_maps,
             payphone_rank, entry_rank, map_rank, last_updated
@@ -120,11 +151,13 @@ func DBInitializeUserStatistics(uuid string) error {
     return err
 }
 
-func DBGetStatistics(uuid string) (common.Statistics, error) {
+func DBGetStatistics(ctx context.Context, uuid string) (common.Statistics, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var stats common.Statistics
 
     var LastUpdated float64
-    err := Pool.QueryRow(context.Background(), `
+    err := Pool.QueryRow(ctx, `
         SELECT 
             total_payphones,
             total_entries,
@@ -152,42 +185,54 @@ func DBGetStatistics(uuid string) (common.Statistics, error) {
     }
     stats.LastUpdated = int64(LastUpdated)
     // get total number of users
-    err = Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM users").Scan(&stats.TotalUsers)
+    err = Pool.QueryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&stats.TotalUsers)
     if err != nil {
         return common.Statistics{}, fmt.Errorf("Failed to get total number of users: %v", err)
     }
     return stats, nil
 }
 
-func DBGetRecentEntry(uuid string) (common.Entry, error) {
+func DBGetRecentEntry(ctx context.Context, uuid string) (common.Entry, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var entry common.Entry
 
-    row := Pool.QueryRow(context.Background(), `
-        SELECT id, deviceUUID, payphoneID, payphoneMAC, payphoneTime, EXTRACT(EPOCH FROM recordedTime) 
-        FROM entries
-        WHERE recordedTime > NOW() - INTERVAL '10 minutes'
-        AND recordedTime < NOW()
-        AND deviceUUID = $1
-        ORDER BY id DESC
+    row := Pool.QueryRow(ctx, `
+        SELECT e.id, e.deviceUUID, e.payphoneID, e.payphoneMAC, e.payphoneTime, EXTRACT(EPOCH FROM e.recordedTime),
+               e.seenAgain, EXTRACT(EPOCH FROM COALESCE(e.lastSeenTime, e.recordedTime)),
+               pi.mapUUID, pi.latitude, pi.longitude
+        FROM entries e
+        LEFT JOIN payphone_identity pi ON pi.payphoneID = e.payphoneID AND pi.canonical
+        WHERE COALESCE(e.lastSeenTime, e.recordedTime) > NOW() - INTERVAL '10 minutes'
+        AND e.recordedTime < NOW()
+        AND e.deviceUUID = $1
+        ORDER BY e.id DESC
         LIMIT 1`, uuid)
 
-    var recordedTime float64
-    if err := row.Scan(&entry.ID, &entry.DeviceUUID, &entry.PayphoneID, &entry.PayphoneMAC, &entry.PayphoneTime, &recordedTime); err != nil {
+    var recordedTime, lastSeenTime float64
+    var canonical canonicalPlacement
+    if err := row.Scan(&entry.ID, &entry.DeviceUUID, &entry.PayphoneID, &entry.PayphoneMAC, &entry.PayphoneTime, &recordedTime,
+                       &entry.SeenAgain, &lastSeenTime, &canonical.MapUUID, &canonical.Latitude, &canonical.Longitude); err != nil {
         return common.Entry{}, fmt.Errorf("No entries in the last 10 minutes")
     }
     entry.RecordedTime = int64(recordedTime)
+    entry.LastSeenTime = int64(lastSeenTime)
+    canonical.setOn(&entry)
 
     return entry, nil
 }
 
-func DBGetNearbyHotspots(lat, lon float64) ([]common.DataPoint, error) {
+func DBGetNearbyHotspots(ctx context.Context, lat, lon float64) ([]common.DataPoint, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var dataPoints []common.DataPoint
     fmt.Println("lat and lon", lat, lon)
     query := `SELECT ST_X(location::geometry) as Latitude, ST_Y(location::geometry) as Longitude, uuid, street_address 
               FROM telstra_hotspots 
-              WHERE ST_DWithin(location::geography, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, 1000);`
+              WHERE ST_DWithin(location::geography, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, 1000)
+              AND removedVersion IS NULL;`
 
-    rows, err := Pool.Query(context.Background(), query, lon, lat)
+    rows, err := Pool.Query(ctx, query, lon, lat)
     if err != nil {
         return nil, fmt.Errorf("Failed to retrieve nearby hotspots: %v", err)
     }
@@ -204,17 +249,110 @@ func DBGetNearbyHotspots(lat, lon float64) ([]common.DataPoint, error) {
     return dataPoints, nil
 }
 
-func AddEntryToDB(entry common.Payload, deviceUUID string) (int64, error) {
+// GPS fixes at least this accurate (metres) place the entry on the map
+// straight away, so the user doesn't have to pin it through /add-location
+const GPSMapAccuracy = 50
+
+// portalURLParser is the portalurl parser version that read entry.PortalURL, 0 if there wasn't one.
+// Entries without an accurate fix are located from their payphone's identity
+// if it has one, accurate fixes teach the identity the hotspot they're next to.
+// A duplicate (see dedupe.go) only updates the entry it duplicates, whose id is returned.
+func AddEntryToDB(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int) (int64, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    var portalURL sql.NullString
+    if entry.PortalURL != "" { portalURL = sql.NullString{String: entry.PortalURL, Valid: true} }
+
+    var gpsLat, gpsLong, gpsAccuracy sql.NullFloat64
+    var gpsTime sql.NullInt64
+    var placeOnMap bool
+    if entry.Fix != nil {
+        gpsLat = sql.NullFloat64{Float64: entry.Fix.Lat, Valid: true}
+        gpsLong = sql.NullFloat64{Float64: entry.Fix.Long, Valid: true}
+        gpsAccuracy = sql.NullFloat64{Float64: entry.Fix.Accuracy, Valid: true}
+        gpsTime = sql.NullInt64{Int64: entry.Fix.Time, Valid: true}
+        placeOnMap = entry.Fix.Accuracy <= GPSMapAccuracy
+    }
+
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return 0, fmt.Errorf("Failed to start entry transaction: %v\n", err) }
+    defer tx.Rollback(ctx)
+
+    if err := lockDevicePayphone(ctx, tx, deviceUUID, entry.PayphoneID); err != nil { return 0, err }
+    duplicateID, found, err := findDuplicateEntry(ctx, tx, deviceUUID, entry.PayphoneID, entry.PayphoneTime, entry.Time, DuplicateEntryWindow())
+    if err != nil { return 0, err }
+    if found {
+        if err := recordSeenAgain(ctx, tx, duplicateID, entry.Time); err != nil { return 0, err }
+        if err := tx.Commit(ctx); err != nil { return 0, fmt.Errorf("Failed to commit entry: %v\n", err) }
+        return duplicateID, nil
+    }
+
+    var mapUUID sql.NullString
+    var mapLat, mapLong, locationConfidence sql.NullFloat64
+    if placeOnMap {
+        mapLat, mapLong = gpsLat, gpsLong
+        hotspot, found, err := nearestHotspot(ctx, tx, entry.Fix.Lat, entry.Fix.Long)
+        if err != nil { return 0, err }
+        if found {
+            if err := learnIdentityFromGPS(ctx, tx, entry.PayphoneID, entry.PayphoneMAC, hotspot); err != nil { return 0, err }
+        }
+    } else {
+        identity, found, err := findIdentity(ctx, tx, entry.PayphoneID)
+        if err != nil { return 0, err }
+        if found {
+            mapUUID = sql.NullString{String: identity.Hotspot.UUID, Valid: true}
+            mapLat = sql.NullFloat64{Float64: identity.Hotspot.Point.Lat, Valid: true}
+            mapLong = sql.NullFloat64{Float64: identity.Hotspot.Point.Long, Valid: true}
+            locationConfidence = sql.NullFloat64{Float64: identity.Confidence(), Valid: true}
+        }
+    }
+
     var id int64
-    err := Pool.QueryRow(context.Background(), `INSERT INTO entries (deviceUUID, payphoneID, payphoneMAC, payphoneTime, recordedTime) 
-                        VALUES ($1, $2, $3, $4, TO_TIMESTAMP($5)) RETURNING id`, deviceUUID, entry.PayphoneID, entry.PayphoneMAC, entry.PayphoneTime, entry.Time).Scan(&id)
+    err = tx.QueryRow(ctx, `INSERT INTO entries (deviceUUID, payphoneID, payphoneMAC, payphoneTime, recordedTime, attestationVersion, portalURL, portalURLParser,
+                                                                     gpsLatitude, gpsLongitude, gpsAccuracy, gpsTime,
+                                                                     mapUUID, mapLatitude, mapLongitude, mapLocation, locationConfidence, deviceInterface) 
+                        VALUES ($1, $2, $3, $4, TO_TIMESTAMP($5), $6, $7, $8,
+                                $9, $10, $11, TO_TIMESTAMP($12),
+                                $13, $14::DOUBLE PRECISION, $15::DOUBLE PRECISION,
+                                ST_SetSRID(ST_MakePoint($15, $14), 4326)::geography, $16, NULLIF($17, '')) RETURNING id`,
+                        deviceUUID, entry.PayphoneID, entry.PayphoneMAC, entry.PayphoneTime, entry.Time, attestationVersion, portalURL, portalURLParser,
+                        gpsLat, gpsLong, gpsAccuracy, gpsTime, mapUUID, mapLat, mapLong, locationConfidence, entry.Interface).Scan(&id)
     if err != nil {
         return 0, fmt.Errorf("Failed to insert entry: %v\n", err)
     }
+    if err := tx.Commit(ctx); err != nil { return 0, fmt.Errorf("Failed to commit entry: %v\n", err) }
     return id, nil
 }
 
-func DBGetLeaderboard() ([]common.LeaderboardVal, error) {
+// DBAddTestEntry stores a test submission, which never counts towards entries
+// or the leaderboard and is deleted once it expires. Returns its id and expiry.
+func DBAddTestEntry(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int, ttl time.Duration) (int64, time.Time, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    var gpsLat, gpsLong, gpsAccuracy sql.NullFloat64
+    if entry.Fix != nil {
+        gpsLat = sql.NullFloat64{Float64: entry.Fix.Lat, Valid: true}
+        gpsLong = sql.NullFloat64{Float64: entry.Fix.Long, Valid: true}
+        gpsAccuracy = sql.NullFloat64{Float64: entry.Fix.Accuracy, Valid: true}
+    }
+
+    var id int64
+    var expires time.Time
+    err := Pool.QueryRow(ctx, `INSERT INTO test_entries (deviceUUID, payphoneID, payphoneMAC, payphoneTime, recordedTime, attestationVersion, portalURL, portalURLParser,
+                                                                          gpsLatitude, gpsLongitude, gpsAccuracy, deviceInterface, expiresTime)
+                        VALUES ($1, $2, $3, $4, TO_TIMESTAMP($5), $6, NULLIF($7, ''), $8, $9, $10, $11, NULLIF($12, ''), NOW() + make_interval(secs => $13))
+                        RETURNING id, expiresTime`,
+                        deviceUUID, entry.PayphoneID, entry.PayphoneMAC, entry.PayphoneTime, entry.Time, attestationVersion, entry.PortalURL, portalURLParser,
+                        gpsLat, gpsLong, gpsAccuracy, entry.Interface, ttl.Seconds()).Scan(&id, &expires)
+    if err != nil {
+        return 0, time.Time{}, fmt.Errorf("Failed to insert test entry: %v\n", err)
+    }
+    return id, expires, nil
+}
+
+func DBGetLeaderboard(ctx context.Context) ([]common.LeaderboardVal, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var leaderboard []common.LeaderboardVal
 
     sqlQuery := `SELECT deviceUUID, COUNT(DISTINCT payphoneID) AS uniquePayphoneCount
@@ -222,7 +360,7 @@ func DBGetLeaderboard() ([]common.LeaderboardVal, error) {
     GROUP BY deviceUUID
     ORDER BY uniquePayphoneCount DESC;`
 
-    rows, err := Pool.Query(context.Background(), sqlQuery)
+    rows, err := Pool.Query(ctx, sqlQuery)
     if err != nil {
         return nil, fmt.Errorf("Failed to retrieve leaderboard: %v", err)
     }
@@ -242,14 +380,20 @@ func DBGetLeaderboard() ([]common.LeaderboardVal, error) {
     return leaderboard, nil
 }
 
-func DBGetEntriesWithUUID(deviceUUID string) ([]common.Entry, error) {
+func DBGetEntriesWithUUID(ctx context.Context, deviceUUID string) ([]common.Entry, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var entries []common.Entry
-    rows, err := Pool.Query(context.Background(), `
-        SELECT id, deviceUUID, payphoneID, payphoneMAC, payphoneTime, 
-               EXTRACT(EPOCH FROM recordedTime), mapUUID, 
-               mapLatitude, mapLongitude, ST_AsText(mapLocation) as mapLocationText
-        FROM entries 
-        WHERE deviceUUID = $1`, deviceUUID)
+    rows, err := Pool.Query(ctx, `
+        SELECT e.id, e.deviceUUID, e.payphoneID, e.payphoneMAC, e.payphoneTime, 
+               EXTRACT(EPOCH FROM e.recordedTime), e.mapUUID, 
+               e.mapLatitude, e.mapLongitude, ST_AsText(e.mapLocation) as mapLocationText,
+               e.attestationVersion, e.locationConfidence,
+               e.seenAgain, EXTRACT(EPOCH FROM COALESCE(e.lastSeenTime, e.recordedTime)),
+               pi.mapUUID, pi.latitude, pi.longitude
+        FROM entries e
+        LEFT JOIN payphone_identity pi ON pi.payphoneID = e.payphoneID AND pi.canonical
+        WHERE e.deviceUUID = $1`, deviceUUID)
     if err != nil {
         return nil, fmt.Errorf("Failed to retrieve entries: %v", err)
     }
@@ -257,8 +401,10 @@ func DBGetEntriesWithUUID(deviceUUID string) ([]common.Entry, error) {
 
     for rows.Next() {
         var e common.Entry
-        var recordedTime float64
+        var recordedTime, lastSeenTime float64
         var sqlMapUUID, sqlMapLatitude, sqlMapLongitude, sqlMapLocationText sql.NullString
+        var sqlLocationConfidence sql.NullFloat64
+        var canonical canonicalPlacement
         if err := rows.Scan(
             &e.ID, 
             &e.DeviceUUID, 
@@ -269,10 +415,18 @@ func DBGetEntriesWithUUID(deviceUUID string) ([]common.Entry, error) {
             &sqlMapUUID, 
             &sqlMapLatitude,
             &sqlMapLongitude,
-            &sqlMapLocationText); err != nil {
+            &sqlMapLocationText,
+            &e.AttestationVersion,
+            &sqlLocationConfidence,
+            &e.SeenAgain,
+            &lastSeenTime,
+            &canonical.MapUUID,
+            &canonical.Latitude,
+            &canonical.Longitude); err != nil {
             return nil, fmt.Errorf("Failed to scan entry: %v", err)
         }
         e.RecordedTime = int64(recordedTime)
+        e.LastSeenTime = int64(lastSeenTime)
         if sqlMapUUID.Valid {
             e.MapUUID = sqlMapUUID.String
         }
@@ -285,6 +439,10 @@ func DBGetEntriesWithUUID(deviceUUID string) ([]common.Entry, error) {
         if sqlMapLocationText.Valid {
             e.MapLocation = sqlMapLocationText.String
         }
+        if sqlLocationConfidence.Valid {
+            e.LocationConfidence = sqlLocationConfidence.Float64
+        }
+        canonical.setOn(&e)
         entries = append(entries, e)
     }
     if err := rows.Err(); err != nil {
@@ -293,25 +451,126 @@ func DBGetEntriesWithUUID(deviceUUID string) ([]common.Entry, error) {
     return entries, nil
 }
 
-func DBFindDeviceRSAPub(deviceUUID string) ([]byte, error) {
+func DBFindDeviceRSAPub(ctx context.Context, deviceUUID string) ([]byte, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var deviceRSAPub []byte
-    err := Pool.QueryRow(context.Background(), `SELECT pub_key FROM users WHERE uuid = $1`, deviceUUID).Scan(&deviceRSAPub)
+    err := Pool.QueryRow(ctx, `SELECT pub_key FROM users WHERE uuid = $1`, deviceUUID).Scan(&deviceRSAPub)
     if err != nil {
         return nil, fmt.Errorf("Can't retrieve pub key %v\n", err)
     }
+    // never enrolled, or revoked when the user asked for their account to be deleted
+    if deviceRSAPub == nil {
+        return nil, fmt.Errorf("Device %s has no pub key\n", deviceUUID)
+    }
 
     return deviceRSAPub, nil
 }
 
-func DBGetRandomPoint() (common.DataPoint, error) {
+// DBAddScanSightings stores the hotspots from a passive scan report, returns how many were added
+func DBAddScanSightings(ctx context.Context, report common.ScanReport, deviceUUID string) (int, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    if len(report.Sightings) == 0 { return 0, nil }
+
+    batch := &pgx.Batch{}
+    for _, sighting := range report.Sightings {
+        var gpsLat, gpsLong, gpsAccuracy sql.NullFloat64
+        var gpsTime sql.NullInt64
+        if sighting.Fix != nil {
+            gpsLat = sql.NullFloat64{Float64: sighting.Fix.Lat, Valid: true}
+            gpsLong = sql.NullFloat64{Float64: sighting.Fix.Long, Valid: true}
+            gpsAccuracy = sql.NullFloat64{Float64: sighting.Fix.Accuracy, Valid: true}
+            gpsTime = sql.NullInt64{Int64: sighting.Fix.Time, Valid: true}
+        }
+        batch.Queue(`INSERT INTO scan_sightings (deviceUUID, bssid, ssid, signal, frequency, seenTime, gpsLatitude, gpsLongitude, gpsAccuracy, gpsTime, deviceInterface)
+                     VALUES ($1, $2, $3, $4, $5, TO_TIMESTAMP($6), $7, $8, $9, TO_TIMESTAMP($10), NULLIF($11, ''))`,
+                     deviceUUID, sighting.BSSID, sighting.SSID, sighting.Signal, sighting.Frequency, sighting.Time,
+                     gpsLat, gpsLong, gpsAccuracy, gpsTime, sighting.Interface)
+    }
+
+    results := Pool.SendBatch(ctx, batch)
+    defer results.Close()
+    for range report.Sightings {
+        if _, err := results.Exec(); err != nil {
+            return 0, fmt.Errorf("Can't insert scan sighting %v\n", err)
+        }
+    }
+    return len(report.Sightings), nil
+}
+
+// DBAddDeviceLogs stores log lines uploaded by a device, returns how many were added
+func DBAddDeviceLogs(ctx context.Context, deviceUUID string, records []common.LogRecord) (int64, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    if len(records) == 0 { return 0, nil }
+
+    received := time.Now()
+    count, err := Pool.CopyFrom(ctx,
+        pgx.Identifier{"device_logs"},
+        []string{"deviceuuid", "loggedtime", "level", "message", "receivedtime"},
+        pgx.CopyFromSlice(len(records), func(i int) ([]any, error) {
+            return []any{deviceUUID, time.UnixMilli(records[i].Time), records[i].Level, records[i].Message, received}, nil
+        }))
+    if err != nil {
+        return 0, fmt.Errorf("Can't insert device logs %v\n", err)
+    }
+    return count, nil
+}
+
+// DBGetDeviceLogs returns the newest log lines from a device, newest first,
+// only those logged after since (unix milliseconds) when it isn't 0
+func DBGetDeviceLogs(ctx context.Context, deviceUUID string, since int64, limit int) ([]common.DeviceLog, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    rows, err := Pool.Query(ctx, `
+        SELECT (EXTRACT(EPOCH FROM loggedTime) * 1000)::BIGINT, level, message, EXTRACT(EPOCH FROM receivedTime)::BIGINT
+        FROM device_logs
+        WHERE deviceUUID = $1 AND loggedTime > TO_TIMESTAMP($2 / 1000.0)
+        ORDER BY loggedTime DESC, id DESC
+        LIMIT $3`, deviceUUID, since, limit)
+    if err != nil {
+        return nil, fmt.Errorf("Can't query device logs %v\n", err)
+    }
+    defer rows.Close()
+
+    logs := []common.DeviceLog{}
+    for rows.Next() {
+        var deviceLog common.DeviceLog
+        if err := rows.Scan(&deviceLog.Time, &deviceLog.Level, &deviceLog.Message, &deviceLog.ReceivedTime); err != nil {
+            return nil, fmt.Errorf("Can't scan device log %v\n", err)
+        }
+        logs = append(logs, deviceLog)
+    }
+    return logs, rows.Err()
+}
+
+// DBFindDeviceSecret returns the attestation secret set when the device was
+// enrolled, empty for devices enrolled before there were secrets
+func DBFindDeviceSecret(ctx context.Context, deviceUUID string) (string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    var secret sql.NullString
+    err := Pool.QueryRow(ctx, `SELECT device_secret FROM users WHERE uuid = $1`, deviceUUID).Scan(&secret)
+    if err != nil {
+        return "", fmt.Errorf("Can't retrieve device secret %v\n", err)
+    }
+
+    return secret.String, nil
+}
+
+func DBGetRandomPoint(ctx context.Context) (common.DataPoint, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var dataPoint common.DataPoint
 
     query := `SELECT ST_X(location::geometry) as Latitude, ST_Y(location::geometry) as Longitude, uuid, street_address 
               FROM telstra_hotspots 
+              WHERE removedVersion IS NULL
               ORDER BY RANDOM() 
               LIMIT 1;`
 
-    row := Pool.QueryRow(context.Background(), query)
+    row := Pool.QueryRow(ctx, query)
 
     var lat, lon float64
     err := row.Scan(&lat, &lon, &dataPoint.UUID, &dataPoint.Address)
@@ -324,8 +583,10 @@ func DBGetRandomPoint() (common.DataPoint, error) {
     return dataPoint, nil
 }
 
-func DBAddUser(uuid, email string) error {
-    _, err := Pool.Exec(context.Background(), "INSERT INTO users (uuid, email) VALUES ($1, $2)", uuid, email)
+func DBAddUser(ctx context.Context, uuid, email string) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    _, err := Pool.Exec(ctx, "INSERT INTO users (uuid, email) VALUES ($1, $2)", uuid, email)
     if err != nil {
         return fmt.Errorf("Failed to insert user: %v", err)
     }
@@ -333,14 +594,17 @@ func DBAddUser(uuid, email string) error {
     return nil
 }
 
-func DBGetUserProfile(uuid string) (map[string]string, error) {
+func DBGetUserProfile(ctx context.Context, uuid string) (map[string]string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     var (
-        email    sql.NullString
-        username sql.NullString
-        token    sql.NullString
+        email       sql.NullString
+        username    sql.NullString
+        token       sql.NullString
+        deletionDue *time.Time
     )
     
-    err := Pool.QueryRow(context.Background(), "SELECT email, username, token FROM users WHERE uuid = $1", uuid).Scan(&email, &username, &token)
+    err := Pool.QueryRow(ctx, "SELECT email, username, token, deletionDueTime FROM users WHERE uuid = $1", uuid).Scan(&email, &username, &token, &deletionDue)
     
     if err == sql.ErrNoRows {
         return nil, fmt.Errorf("no user found with uuid %s", uuid)
@@ -352,6 +616,11 @@ func DBGetUserProfile(uuid string) (map[string]string, error) {
     profile["email"] = email.String
     profile["username"] = username.String
     profile["uuid"] = uuid
+    // unix seconds the account will be erased, empty unless deletion was asked for
+    profile["deletion_due"] = ""
+    if deletionDue != nil {
+        profile["deletion_due"] = strconv.FormatInt(deletionDue.Unix(), 10)
+    }
     
     if !token.Valid {
         newToken, err := common.GenerateRandomString(20)
@@ -359,7 +628,7 @@ func DBGetUserProfile(uuid string) (map[string]string, error) {
             return nil, fmt.Errorf("failed to generate token for user %s: %v", uuid, err)
         }
         
-        _, err = Pool.Exec(context.Background(), "UPDATE users SET token = $1 WHERE uuid = $2", newToken, uuid)
+        _, err = Pool.Exec(ctx, "UPDATE users SET token = $1 WHERE uuid = $2", newToken, uuid)
         if err != nil {
             return nil, fmt.Errorf("failed to update token for user %s: %v", uuid, err)
         }
@@ -373,60 +642,123 @@ func DBGetUserProfile(uuid string) (map[string]string, error) {
     return profile, nil
 }
 
-func DBSavePubKey(token string, pubKey string) (string, error) {
+// DBSavePubKey enrolls a device: saves its public key against the user with
+// token and gives it a new attestation secret. Returns the uuid and the secret.
+func DBSavePubKey(ctx context.Context, token string, pubKey string) (string, string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
     fmt.Println("pubkey", pubKey)
     fmt.Println("token", token)
     // pem decode string into BLOB
     pubKeyByte := []byte(pubKey)
-    // save pubkey to table users where uuid = uuid
-    query := "UPDATE users SET pub_key = $1 WHERE token = $2"
+
+    deviceSecret, err := common.GenerateRandomString(40)
+    if err != nil {
+        return "", "", fmt.Errorf("failed to generate device secret: %v", err)
+    }
+
+    // save pubkey to table users where uuid = uuid, unless they are leaving
+    query := "UPDATE users SET pub_key = $1, device_secret = $2 WHERE token = $3 AND deletionDueTime IS NULL"
 
     // Execute the query with the provided public key and token
-    _, err := Pool.Exec(context.Background(), query, pubKeyByte, token)
+    tag, err := Pool.Exec(ctx, query, pubKeyByte, deviceSecret, token)
     if err != nil {
         fmt.Println(err)
-        return "", fmt.Errorf("failed to save public key: %v", err)
+        return "", "", fmt.Errorf("failed to save public key: %v", err)
+    }
+    if tag.RowsAffected() == 0 {
+        return "", "", fmt.Errorf("No account to enroll with the given token, or its deletion is pending")
     }
 
     // get uuid
     var uuid string
     query = "SELECT uuid FROM users WHERE token = $1"
-    err = Pool.QueryRow(context.Background(), query, token).Scan(&uuid)
+    err = Pool.QueryRow(ctx, query, token).Scan(&uuid)
 
     if err != nil {
         if err == sql.ErrNoRows {
-            return "", fmt.Errorf("No UUID found with the given token")
+            return "", "", fmt.Errorf("No UUID found with the given token")
         } else {
-            return "", fmt.Errorf("%v", err)
+            return "", "", fmt.Errorf("%v", err)
         }
     }
 
-    return uuid, nil
+    return uuid, deviceSecret, nil
 }
 
-func DBAddMapUUIDEntry(entryID int, mapUUID string) error {
-    fmt.Println("testing", entryID, mapUUID)
-    _, err := Pool.Exec(context.Background(), `UPDATE entries SET mapUUID = $1 WHERE id = $2`, mapUUID, entryID)
+// ErrEntryNotFound is an entry that doesn't exist or isn't the user's
+var ErrEntryNotFound = errors.New("No such entry")
 
+// DBAddMapUUIDEntry sets the hotspot a user picked for one of their entries.
+// It is their vote for the payphone's identity, and replaces the location if
+// it was only a guess from the identity.
+func DBAddMapUUIDEntry(ctx context.Context, deviceUUID string, entryID int, mapUUID string) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return fmt.Errorf("Failed to start transaction: %v", err) }
+    defer tx.Rollback(ctx)
+
+    tag, err := tx.Exec(ctx, `UPDATE entries SET mapUUID = $1 WHERE id = $2 AND deviceUUID = $3`, mapUUID, entryID, deviceUUID)
     if err != nil {return fmt.Errorf("Failed to update map %s :%v", mapUUID, err) }
+    if tag.RowsAffected() == 0 { return ErrEntryNotFound }
+
+    hotspot, found, err := hotspotByUUID(ctx, tx, mapUUID)
+    if err != nil { return err }
+    if found {
+        _, err = tx.Exec(ctx, `UPDATE entries SET mapLatitude = $1, mapLongitude = $2, mapLocation = ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography, locationConfidence = NULL
+                               WHERE id = $3 AND deviceUUID = $4 AND locationConfidence IS NOT NULL`, hotspot.Point.Lat, hotspot.Point.Long, entryID, deviceUUID)
+        if err != nil { return fmt.Errorf("Failed to move entry to %s :%v", mapUUID, err) }
+        if err := voteForHotspot(ctx, tx, deviceUUID, entryID, hotspot); err != nil { return err }
+    }
+
+    if err := tx.Commit(ctx); err != nil { return fmt.Errorf("Failed to update map %s :%v", mapUUID, err) }
     fmt.Println("Succesfully added to db")
     return nil
 }
 
-func DBUpdateLocation(entryID int, latitude, longitude string) error {
+// DBUpdateLocation pins one of the user's entries where they are, "0" "0"
+// clears it. A pin next to a hotspot is their vote for the payphone's
+// identity, anywhere else or clearing it withdraws their vote.
+func DBUpdateLocation(ctx context.Context, deviceUUID string, entryID int, latitude, longitude string) error {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return fmt.Errorf("error updating entry: %v", err) }
+    defer tx.Rollback(ctx)
+
     if latitude == "0" && longitude == "0" {
-        _, err := Pool.Exec(context.Background(), `UPDATE entries SET mapLatitude = NULL, mapLongitude = NULL, mapLocation = NULL WHERE id = $1`, entryID)
+        tag, err := tx.Exec(ctx, `UPDATE entries SET mapLatitude = NULL, mapLongitude = NULL, mapLocation = NULL, locationConfidence = NULL WHERE id = $1 AND deviceUUID = $2`, entryID, deviceUUID)
         if err != nil {
             return fmt.Errorf("error clearing location for entry: %v", err)
         }
+        if tag.RowsAffected() == 0 { return ErrEntryNotFound }
+        if err := withdrawVote(ctx, tx, deviceUUID, entryID); err != nil { return err }
+        if err := tx.Commit(ctx); err != nil { return fmt.Errorf("error clearing location for entry: %v", err) }
         fmt.Println("Location cleared for entry ID:", entryID)
+        return nil
+    }
+
+    point := fmt.Sprintf("POINT(%s %s)", longitude, latitude) 
+    tag, err := tx.Exec(ctx, `UPDATE entries SET mapLatitude = $1, mapLongitude = $2, mapLocation = ST_PointFromText($3), locationConfidence = NULL WHERE id = $4 AND deviceUUID = $5`, latitude, longitude, point, entryID, deviceUUID)
+    if err != nil {
+        return fmt.Errorf("error updating entry: %v", err)
+    }
+    if tag.RowsAffected() == 0 { return ErrEntryNotFound }
+
+    // the UPDATE has already checked they're numbers
+    lat, _ := strconv.ParseFloat(latitude, 64)
+    long, _ := strconv.ParseFloat(longitude, 64)
+    hotspot, found, err := nearestHotspot(ctx, tx, lat, long)
+    if err != nil { return err }
+    if found {
+        err = voteForHotspot(ctx, tx, deviceUUID, entryID, hotspot)
     } else {
-        point := fmt.Sprintf("POINT(%s %s)", longitude, latitude) 
-        _, err := Pool.Exec(context.Background(), `UPDATE entries SET mapLatitude = $1, mapLongitude = $2, mapLocation = ST_PointFromText($3) WHERE id = $4`, latitude, longitude, point, entryID)
-        if err != nil {
-            return fmt.Errorf("error updating entry: %v", err)
-        }
-        fmt.Println("Location updated for entry ID:", entryID)
+        err = withdrawVote(ctx, tx, deviceUUID, entryID)
     }
+    if err != nil { return err }
+
+    if err := tx.Commit(ctx); err != nil { return fmt.Errorf("error updating entry: %v", err) }
+    fmt.Println("Location updated for entry ID:", entryID)
     return nil
-}
\ No newline at end of file
+}
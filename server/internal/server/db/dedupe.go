@@ -0,0 +1,199 @@
+package db
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// An entry is a discovery, not a submission. A new one from the same device for
+// the same payphone is a duplicate of an existing entry when it has the same
+// payphoneTime (the device sent the same capture again), or when it comes
+// within DuplicateEntryWindow of the last time that entry was seen. Duplicates
+// add to the entry's seenAgain and move its lastSeenTime instead of adding a
+// row, so a device sitting next to a payphone is one entry.
+
+const defaultDuplicateEntryWindow = 10 * time.Minute
+
+// DuplicateEntryWindow is how long after a payphone was last seen seeing it
+// again is the same discovery, DUPLICATE_ENTRY_WINDOW (a Go duration) overrides it
+func DuplicateEntryWindow() time.Duration {
+    window, err := time.ParseDuration(os.Getenv("DUPLICATE_ENTRY_WINDOW"))
+    if err != nil || window <= 0 { return defaultDuplicateEntryWindow }
+    return window
+}
+
+// lockDevicePayphone serialises adding entries for deviceUUID and payphoneID
+// until the transaction ends, so two submissions can't both miss each other
+func lockDevicePayphone(ctx context.Context, tx pgx.Tx, deviceUUID, payphoneID string) error {
+    _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('entry:' || $1::text || ':' || $2::text))", deviceUUID, payphoneID)
+    if err != nil { return fmt.Errorf("Can't lock entries for %s %v\n", payphoneID, err) }
+    return nil
+}
+
+// findDuplicateEntry returns the entry a submission recorded at recordedTime
+// (unix seconds) duplicates, preferring one with the same payphoneTime. The
+// caller holds lockDevicePayphone.
+func findDuplicateEntry(ctx context.Context, tx pgx.Tx, deviceUUID, payphoneID string, payphoneTime, recordedTime int64, window time.Duration) (int64, bool, error) {
+    var id int64
+    err := tx.QueryRow(ctx, `SELECT id FROM entries
+                             WHERE deviceUUID = $1 AND payphoneID = $2
+                             AND (payphoneTime = $3 OR COALESCE(lastSeenTime, recordedTime) >= TO_TIMESTAMP($4) - make_interval(secs => $5))
+                             ORDER BY payphoneTime = $3 DESC, COALESCE(lastSeenTime, recordedTime) DESC
+                             LIMIT 1`, deviceUUID, payphoneID, payphoneTime, recordedTime, window.Seconds()).Scan(&id)
+    if errors.Is(err, pgx.ErrNoRows) { return 0, false, nil }
+    if err != nil { return 0, false, fmt.Errorf("Can't look for duplicate entries %v\n", err) }
+    return id, true, nil
+}
+
+func recordSeenAgain(ctx context.Context, tx pgx.Tx, id int64, seenTime int64) error {
+    _, err := tx.Exec(ctx, `UPDATE entries SET seenAgain = seenAgain + 1,
+                                               lastSeenTime = GREATEST(COALESCE(lastSeenTime, recordedTime), TO_TIMESTAMP($2))
+                            WHERE id = $1`, id, seenTime)
+    if err != nil { return fmt.Errorf("Can't update entry %d %v\n", id, err) }
+    return nil
+}
+
+// dedupeRow is what clustering duplicates needs of an entry
+type dedupeRow struct {
+    ID           int64
+    PayphoneTime int64
+    RecordedTime time.Time
+    LastSeenTime time.Time
+    SeenAgain    int
+}
+
+// duplicateCluster is an entry to keep and the entries that duplicate it
+type duplicateCluster struct {
+    Keep       dedupeRow
+    Duplicates []dedupeRow
+    // LastSeenTime is the latest any of them was seen
+    LastSeenTime time.Time
+}
+
+// SeenAgain is what Keep's seenAgain becomes once the duplicates are merged into it
+func (c duplicateCluster) SeenAgain() int {
+    seen := c.Keep.SeenAgain
+    for _, d := range c.Duplicates { seen += 1 + d.SeenAgain }
+    return seen
+}
+
+// clusterDuplicates groups one device's entries for one payphone the same way
+// new entries are matched, and returns the clusters with duplicates. The
+// oldest entry of a cluster is kept, whatever order rows are in.
+func clusterDuplicates(rows []dedupeRow, window time.Duration) []*duplicateCluster {
+    rows = append([]dedupeRow(nil), rows...)
+    sort.SliceStable(rows, func(i, j int) bool {
+        if !rows[i].RecordedTime.Equal(rows[j].RecordedTime) { return rows[i].RecordedTime.Before(rows[j].RecordedTime) }
+        return rows[i].ID < rows[j].ID
+    })
+
+    var clusters []*duplicateCluster
+    var current *duplicateCluster
+    byPayphoneTime := make(map[int64]*duplicateCluster)
+    for _, row := range rows {
+        cluster, found := byPayphoneTime[row.PayphoneTime]
+        if !found && current != nil && !row.RecordedTime.After(current.LastSeenTime.Add(window)) { cluster, found = current, true }
+        if !found {
+            current = &duplicateCluster{Keep: row, LastSeenTime: row.LastSeenTime}
+            clusters = append(clusters, current)
+            byPayphoneTime[row.PayphoneTime] = current
+            continue
+        }
+        cluster.Duplicates = append(cluster.Duplicates, row)
+        if row.LastSeenTime.After(cluster.LastSeenTime) { cluster.LastSeenTime = row.LastSeenTime }
+        byPayphoneTime[row.PayphoneTime] = cluster
+        // new entries are matched against whichever was seen last
+        if cluster.LastSeenTime.After(current.LastSeenTime) { current = cluster }
+    }
+
+    var duplicated []*duplicateCluster
+    for _, cluster := range clusters {
+        if len(cluster.Duplicates) > 0 { duplicated = append(duplicated, cluster) }
+    }
+    return duplicated
+}
+
+// DedupeEntries merges the duplicates already in entries, from before they
+// were suppressed, into the oldest entry of each cluster and deletes them. The
+// kept entry takes a duplicate's hotspot and location if it has none. Each
+// device and payphone is done in its own transaction under the same lock new
+// entries take, so it is safe with the server running. Returns how many
+// entries were (or with dryRun would be) deleted.
+func DedupeEntries(ctx context.Context, window time.Duration, dryRun bool) (int, error) {
+    type pair struct{ deviceUUID, payphoneID string }
+    var pairs []pair
+    listCtx, cancel := queryContext(ctx)
+    rows, err := Pool.Query(listCtx, `SELECT deviceUUID, payphoneID FROM entries GROUP BY deviceUUID, payphoneID HAVING COUNT(*) > 1`)
+    if err != nil { cancel(); return 0, fmt.Errorf("Can't list entries to dedupe %v\n", err) }
+    for rows.Next() {
+        var p pair
+        if err := rows.Scan(&p.deviceUUID, &p.payphoneID); err != nil { rows.Close(); cancel(); return 0, fmt.Errorf("Can't scan entries to dedupe %v\n", err) }
+        pairs = append(pairs, p)
+    }
+    rows.Close()
+    cancel()
+    if err := rows.Err(); err != nil { return 0, fmt.Errorf("Can't list entries to dedupe %v\n", err) }
+
+    removed := 0
+    for _, p := range pairs {
+        count, err := dedupeDevicePayphone(ctx, p.deviceUUID, p.payphoneID, window, dryRun)
+        if err != nil { return removed, err }
+        removed += count
+    }
+    return removed, nil
+}
+
+func dedupeDevicePayphone(ctx context.Context, deviceUUID, payphoneID string, window time.Duration, dryRun bool) (int, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return 0, fmt.Errorf("Can't start dedupe transaction %v\n", err) }
+    defer tx.Rollback(ctx)
+    if err := lockDevicePayphone(ctx, tx, deviceUUID, payphoneID); err != nil { return 0, err }
+
+    rows, err := tx.Query(ctx, `SELECT id, payphoneTime, recordedTime, COALESCE(lastSeenTime, recordedTime), seenAgain
+                                FROM entries WHERE deviceUUID = $1 AND payphoneID = $2
+                                ORDER BY recordedTime, id`, deviceUUID, payphoneID)
+    if err != nil { return 0, fmt.Errorf("Can't read entries to dedupe %v\n", err) }
+    var entries []dedupeRow
+    for rows.Next() {
+        var row dedupeRow
+        if err := rows.Scan(&row.ID, &row.PayphoneTime, &row.RecordedTime, &row.LastSeenTime, &row.SeenAgain); err != nil { rows.Close(); return 0, fmt.Errorf("Can't scan entry to dedupe %v\n", err) }
+        entries = append(entries, row)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return 0, fmt.Errorf("Can't read entries to dedupe %v\n", err) }
+
+    removed := 0
+    for _, cluster := range clusterDuplicates(entries, window) {
+        removed += len(cluster.Duplicates)
+        if dryRun { continue }
+
+        var duplicateIDs []int64
+        for _, d := range cluster.Duplicates { duplicateIDs = append(duplicateIDs, d.ID) }
+
+        _, err := tx.Exec(ctx, `UPDATE entries SET seenAgain = $2, lastSeenTime = $3,
+                                    mapUUID = COALESCE(mapUUID, (SELECT d.mapUUID FROM entries d WHERE d.id = ANY($4) AND d.mapUUID IS NOT NULL ORDER BY d.id LIMIT 1))
+                                WHERE id = $1`, cluster.Keep.ID, cluster.SeenAgain(), cluster.LastSeenTime, duplicateIDs)
+        if err != nil { return 0, fmt.Errorf("Can't merge duplicates into entry %d %v\n", cluster.Keep.ID, err) }
+
+        // a pin by hand beats a guess from the payphone's identity
+        _, err = tx.Exec(ctx, `UPDATE entries k SET mapLatitude = d.mapLatitude, mapLongitude = d.mapLongitude, mapLocation = d.mapLocation, locationConfidence = d.locationConfidence
+                               FROM (SELECT mapLatitude, mapLongitude, mapLocation, locationConfidence FROM entries
+                                     WHERE id = ANY($2) AND mapLocation IS NOT NULL
+                                     ORDER BY locationConfidence NULLS FIRST, id LIMIT 1) d
+                               WHERE k.id = $1 AND k.mapLocation IS NULL`, cluster.Keep.ID, duplicateIDs)
+        if err != nil { return 0, fmt.Errorf("Can't merge location into entry %d %v\n", cluster.Keep.ID, err) }
+
+        if _, err := tx.Exec(ctx, `DELETE FROM entries WHERE id = ANY($1)`, duplicateIDs); err != nil { return 0, fmt.Errorf("Can't delete duplicates of entry %d %v\n", cluster.Keep.ID, err) }
+    }
+
+    if err := tx.Commit(ctx); err != nil { return 0, fmt.Errorf("Can't commit dedupe %v\n", err) }
+    return removed, nil
+}
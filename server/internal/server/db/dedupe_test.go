@@ -0,0 +1,66 @@
+package db
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestClusterDuplicates(t *testing.T) {
+    base := time.Unix(1700000000, 0)
+    // row is entry id recorded minutes after base with payphoneTime, last seen when it was recorded
+    row := func(id int64, minutes float64, payphoneTime int64) dedupeRow {
+        recorded := base.Add(time.Duration(minutes * float64(time.Minute)))
+        return dedupeRow{ID: id, PayphoneTime: payphoneTime, RecordedTime: recorded, LastSeenTime: recorded}
+    }
+    seenUntil := func(r dedupeRow, minutes float64, seenAgain int) dedupeRow {
+        r.LastSeenTime = base.Add(time.Duration(minutes * float64(time.Minute)))
+        r.SeenAgain = seenAgain
+        return r
+    }
+    // every 5 minutes for an hour, each only 5 minutes after the last
+    var chain []dedupeRow
+    for i := int64(0); i <= 12; i++ { chain = append(chain, row(i+1, float64(i*5), 100+i)) }
+
+    tests := []struct {
+        name string
+        rows []dedupeRow
+        // clusters is the ids of each cluster with duplicates, the kept one first
+        clusters [][]int64
+        // seenAgain of each cluster once merged
+        seenAgain []int
+    }{
+        {"none", nil, nil, nil},
+        {"one entry", []dedupeRow{row(1, 0, 100)}, nil, nil},
+        {"inside the window", []dedupeRow{row(1, 0, 100), row(2, 9, 101)}, [][]int64{{1, 2}}, []int{1}},
+        {"on the window", []dedupeRow{row(1, 0, 100), row(2, 10, 101)}, [][]int64{{1, 2}}, []int{1}},
+        {"a second past the window", []dedupeRow{row(1, 0, 100), row(2, 10+1.0/60, 101)}, nil, nil},
+        {"window from last seen", []dedupeRow{seenUntil(row(1, 0, 100), 30, 4), row(2, 39, 101)}, [][]int64{{1, 2}}, []int{5}},
+        {"same capture much later", []dedupeRow{row(1, 0, 100), row(2, 60, 101), row(3, 600, 100)}, [][]int64{{1, 3}}, []int{1}},
+        {"chain longer than the window", chain, [][]int64{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}}, []int{12}},
+        {"two visits", []dedupeRow{row(1, 0, 100), row(2, 5, 101), row(3, 120, 102), row(4, 125, 103), row(5, 128, 104)},
+         [][]int64{{1, 2}, {3, 4, 5}}, []int{1, 2}},
+        {"out of order", []dedupeRow{row(5, 128, 104), row(2, 5, 101), row(4, 125, 103), row(1, 0, 100), row(3, 120, 102)},
+         [][]int64{{1, 2}, {3, 4, 5}}, []int{1, 2}},
+        {"same time, lower id kept", []dedupeRow{row(2, 0, 101), row(1, 0, 100)}, [][]int64{{1, 2}}, []int{1}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            clusters := clusterDuplicates(test.rows, 10*time.Minute)
+            var ids [][]int64
+            var seenAgain []int
+            for _, c := range clusters {
+                cluster := []int64{c.Keep.ID}
+                for _, d := range c.Duplicates { cluster = append(cluster, d.ID) }
+                ids = append(ids, cluster)
+                seenAgain = append(seenAgain, c.SeenAgain())
+            }
+            if !reflect.DeepEqual(ids, test.clusters) { t.Fatalf("clusters are %v, expected %v", ids, test.clusters) }
+            if !reflect.DeepEqual(seenAgain, test.seenAgain) { t.Fatalf("seenAgain is %v, expected %v", seenAgain, test.seenAgain) }
+        })
+    }
+
+    // a cluster is last seen when the latest of its entries was
+    clusters := clusterDuplicates(chain, 10*time.Minute)
+    if last := chain[len(chain)-1].LastSeenTime; !clusters[0].LastSeenTime.Equal(last) { t.Fatalf("chain was last seen %v, expected %v", clusters[0].LastSeenTime, last) }
+}
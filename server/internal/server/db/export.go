@@ -0,0 +1,103 @@
+package db
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+
+    "server-indicum/internal/common"
+)
+
+// ExportLocation is everything that can place an exported entry, nil where
+// the entry doesn't have it
+type ExportLocation struct {
+    // Pin is the entry's mapLatitude and mapLongitude, Located when it was
+    // guessed from the payphone's identity rather than set by the user
+    Pin     *common.Coord
+    Located bool
+    // Placed is the hotspot the user picked, Canonical the payphone's canonical hotspot
+    Placed    *common.Coord
+    Canonical *common.Coord
+    GPS       *common.Coord
+}
+
+// Set gives e the most trusted location there is
+func (l ExportLocation) Set(e *common.ExportEntry) {
+    point, source := l.Pin, common.LocationPlaced
+    switch {
+        case l.Pin != nil && l.Located:
+            source = common.LocationLocated
+        case l.Pin != nil:
+        case l.Placed != nil:
+            point = l.Placed
+        case l.Canonical != nil:
+            point, source = l.Canonical, common.LocationHotspot
+        case l.GPS != nil:
+            point, source = l.GPS, common.LocationGPS
+        default:
+            return
+    }
+    e.HasLocation, e.Latitude, e.Longitude, e.LocationSource = true, point.Lat, point.Long, source
+}
+
+func nullCoord(lat, long sql.NullFloat64) *common.Coord {
+    if !lat.Valid || !long.Valid { return nil }
+    return &common.Coord{Lat: lat.Float64, Long: long.Float64}
+}
+
+// DBExportEntries calls each with the device's entries recorded in [from, to)
+// (unix seconds, 0 for no bound), oldest first, as they come off the
+// connection. It isn't bound by the query timeout, an export runs as long as
+// the client keeps reading and stops when ctx is done or each fails.
+func DBExportEntries(ctx context.Context, deviceUUID string, from, to int64, each func(common.ExportEntry) error) error {
+    query := `SELECT e.id, e.payphoneID, e.payphoneMAC,
+                     EXTRACT(EPOCH FROM e.recordedTime), EXTRACT(EPOCH FROM COALESCE(e.lastSeenTime, e.recordedTime)), e.seenAgain,
+                     e.mapLatitude, e.mapLongitude, e.locationConfidence IS NOT NULL,
+                     ST_Y(placed.location::geometry), ST_X(placed.location::geometry),
+                     pi.latitude, pi.longitude,
+                     e.gpsLatitude, e.gpsLongitude,
+                     COALESCE(e.mapUUID, pi.mapUUID, ''), COALESCE(placed.street_address, canonical.street_address, '')
+              FROM entries e
+              LEFT JOIN telstra_hotspots placed ON placed.uuid = e.mapUUID
+              LEFT JOIN payphone_identity pi ON pi.payphoneID = e.payphoneID AND pi.canonical
+              LEFT JOIN telstra_hotspots canonical ON canonical.uuid = pi.mapUUID
+              WHERE e.deviceUUID = $1`
+    args := []any{deviceUUID}
+    // only the bounds asked for, so the planner can skip the partitions outside them
+    if from > 0 {
+        args = append(args, from)
+        query += fmt.Sprintf(" AND e.recordedTime >= TO_TIMESTAMP($%d)", len(args))
+    }
+    if to > 0 {
+        args = append(args, to)
+        query += fmt.Sprintf(" AND e.recordedTime < TO_TIMESTAMP($%d)", len(args))
+    }
+    query += " ORDER BY e.recordedTime, e.id"
+
+    rows, err := Pool.Query(ctx, query, args...)
+    if err != nil { return fmt.Errorf("Can't export entries %v\n", err) }
+    defer rows.Close()
+
+    for rows.Next() {
+        var e common.ExportEntry
+        var recordedTime, lastSeenTime float64
+        var pinLat, pinLong, placedLat, placedLong, canonicalLat, canonicalLong, gpsLat, gpsLong sql.NullFloat64
+        var location ExportLocation
+        if err := rows.Scan(&e.ID, &e.PayphoneID, &e.PayphoneMAC, &recordedTime, &lastSeenTime, &e.SeenAgain,
+                            &pinLat, &pinLong, &location.Located, &placedLat, &placedLong, &canonicalLat, &canonicalLong,
+                            &gpsLat, &gpsLong, &e.MapUUID, &e.HotspotAddress); err != nil {
+            return fmt.Errorf("Can't scan exported entry %v\n", err)
+        }
+        e.RecordedTime = int64(recordedTime)
+        e.LastSeenTime = int64(lastSeenTime)
+        location.Pin = nullCoord(pinLat, pinLong)
+        location.Placed = nullCoord(placedLat, placedLong)
+        location.Canonical = nullCoord(canonicalLat, canonicalLong)
+        location.GPS = nullCoord(gpsLat, gpsLong)
+        location.Set(&e)
+
+        if err := each(e); err != nil { return err }
+    }
+    if err := rows.Err(); err != nil { return fmt.Errorf("Can't export entries %v\n", err) }
+    return nil
+}
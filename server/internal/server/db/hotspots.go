@@ -0,0 +1,239 @@
+package db
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// HotspotRecord is a line of infra/db/csv/telstra_hotspots.csv
+type HotspotRecord struct {
+    UUID      string
+    Latitude  float64
+    Longitude float64
+    Address   string
+    Alias     string
+}
+
+// ReadHotspotsCSV reads latitude|longitude|street_address|uuid|alias lines after
+// a header line naming those columns. A uuid may only appear once.
+func ReadHotspotsCSV(r io.Reader) ([]HotspotRecord, error) {
+    scanner := bufio.NewScanner(r)
+    var records []HotspotRecord
+    seen := make(map[string]int)
+    line := 0
+    for ; scanner.Scan(); line++ {
+        if line == 0 {
+            header := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+            if len(header) < 4 || header[0] != "latitude" || header[1] != "longitude" || header[3] != "uuid" { return nil, fmt.Errorf("Hotspot header %q isn't latitude|longitude|address|uuid|alias", scanner.Text()) }
+            continue
+        }
+        if strings.TrimSpace(scanner.Text()) == "" { continue }
+        fields := strings.Split(scanner.Text(), "|")
+        if len(fields) < 4 { return nil, fmt.Errorf("Hotspot line %d has %d fields", line+1, len(fields)) }
+        lat, err := strconv.ParseFloat(fields[0], 64)
+        if err != nil || lat < -90 || lat > 90 { return nil, fmt.Errorf("Hotspot line %d latitude %q", line+1, fields[0]) }
+        long, err := strconv.ParseFloat(fields[1], 64)
+        if err != nil || long < -180 || long > 180 { return nil, fmt.Errorf("Hotspot line %d longitude %q", line+1, fields[1]) }
+        uuid := strings.TrimSpace(fields[3])
+        if uuid == "" { return nil, fmt.Errorf("Hotspot line %d has no uuid", line+1) }
+        if first, found := seen[uuid]; found { return nil, fmt.Errorf("Hotspot line %d repeats uuid %s from line %d", line+1, uuid, first) }
+        seen[uuid] = line + 1
+
+        record := HotspotRecord{UUID: uuid, Latitude: lat, Longitude: long, Address: fields[2]}
+        if len(fields) > 4 { record.Alias = fields[4] }
+        records = append(records, record)
+    }
+    if err := scanner.Err(); err != nil { return nil, fmt.Errorf("Can't read hotspots %v", err) }
+    if line == 0 { return nil, fmt.Errorf("Hotspot CSV is empty") }
+    return records, nil
+}
+
+// hotspotMoveDistance is how far (metres) a hotspot has to move between
+// datasets to be reported as moved, less is rounding in the CSV
+const hotspotMoveDistance = 1.0
+
+// the change column of hotspot_changes
+const (
+    HotspotAdded   = "added"
+    HotspotMoved   = "moved"
+    HotspotRemoved = "removed"
+)
+
+// hotspotImportLockID is the advisory lock held while importing, so two
+// imports can't interleave
+const hotspotImportLockID = 7469617
+
+type HotspotChange struct {
+    UUID    string
+    Change  string
+    Address string
+    // Distance is how far a moved hotspot went, metres
+    Distance float64
+    // Entries is how many entries reference a removed hotspot, they keep it
+    Entries int
+}
+
+type HotspotImport struct {
+    // Version is the dataset version the import became, 0 for a dry run
+    Version   int
+    Total     int
+    Unchanged int
+    // Current is how many hotspots were current before the import
+    Current   int
+    Changes   []HotspotChange
+}
+
+func (i HotspotImport) Count(change string) int {
+    count := 0
+    for _, c := range i.Changes {
+        if c.Change == change { count++ }
+    }
+    return count
+}
+
+// maxHotspotRemovalPercent is how much of the current dataset an import can
+// remove without -allow-removals. An empty or cut off CSV would remove it all.
+const maxHotspotRemovalPercent = 10
+
+// TooManyRemovals is whether the import removes every current hotspot or more
+// than maxHotspotRemovalPercent of them
+func (i HotspotImport) TooManyRemovals() bool {
+    removed := i.Count(HotspotRemoved)
+    return removed > 0 && (removed == i.Current || removed*100 > i.Current*maxHotspotRemovalPercent)
+}
+
+// ImportHotspots makes the hotspots in the CSV the current dataset. It is an
+// upsert on uuid: new and previously removed hotspots are added, hotspots that
+// moved are updated along with the payphone identities that copied their
+// location, and hotspots missing from the CSV get removedVersion rather than
+// being deleted. The changes are kept in hotspot_changes under the new
+// dataset version. An import that removes too many hotspots, see
+// TooManyRemovals, is refused unless allowRemovals. A dry run only works out
+// the changes, it doesn't use up a dataset version.
+func ImportHotspots(ctx context.Context, source string, csv []byte, dryRun, allowRemovals bool) (HotspotImport, error) {
+    records, err := ReadHotspotsCSV(bytes.NewReader(csv))
+    if err != nil { return HotspotImport{}, err }
+    sum := sha256.Sum256(csv)
+
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't start hotspot import %v\n", err) }
+    defer tx.Rollback(ctx)
+
+    if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", hotspotImportLockID); err != nil { return HotspotImport{}, fmt.Errorf("Can't take hotspot import lock %v\n", err) }
+
+    _, err = tx.Exec(ctx, `CREATE TEMPORARY TABLE hotspot_import (
+                               uuid            VARCHAR(36) PRIMARY KEY,
+                               latitude        DOUBLE PRECISION NOT NULL,
+                               longitude       DOUBLE PRECISION NOT NULL,
+                               street_address  VARCHAR(255),
+                               alias           VARCHAR(255)
+                           ) ON COMMIT DROP`)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't create import table %v\n", err) }
+
+    _, err = tx.CopyFrom(ctx, pgx.Identifier{"hotspot_import"}, []string{"uuid", "latitude", "longitude", "street_address", "alias"},
+        pgx.CopyFromSlice(len(records), func(i int) ([]any, error) {
+            r := records[i]
+            return []any{r.UUID, r.Latitude, r.Longitude, r.Address, r.Alias}, nil
+        }))
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't copy hotspots %v\n", err) }
+
+    // the changes are worked out without a version, it's only taken once the
+    // import is going to be applied
+    _, err = tx.Exec(ctx, `CREATE TEMPORARY TABLE hotspot_import_changes (
+                               uuid         VARCHAR(36) PRIMARY KEY,
+                               change       VARCHAR(10) NOT NULL,
+                               oldLocation  geography(POINT, 4326),
+                               newLocation  geography(POINT, 4326)
+                           ) ON COMMIT DROP`)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't create import changes table %v\n", err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO hotspot_import_changes (uuid, change, oldLocation, newLocation)
+                           SELECT i.uuid,
+                                  CASE WHEN h.uuid IS NULL OR h.removedVersion IS NOT NULL THEN $1 ELSE $2 END,
+                                  CASE WHEN h.removedVersion IS NULL THEN h.location END,
+                                  ST_SetSRID(ST_MakePoint(i.longitude, i.latitude), 4326)::geography
+                           FROM hotspot_import i
+                           LEFT JOIN telstra_hotspots h ON h.uuid = i.uuid
+                           WHERE h.uuid IS NULL OR h.removedVersion IS NOT NULL
+                           OR ST_Distance(h.location, ST_SetSRID(ST_MakePoint(i.longitude, i.latitude), 4326)::geography) > $3`,
+                       HotspotAdded, HotspotMoved, hotspotMoveDistance)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't work out added and moved hotspots %v\n", err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO hotspot_import_changes (uuid, change, oldLocation)
+                           SELECT h.uuid, $1, h.location
+                           FROM telstra_hotspots h
+                           WHERE h.removedVersion IS NULL AND NOT EXISTS (SELECT 1 FROM hotspot_import i WHERE i.uuid = h.uuid)`,
+                       HotspotRemoved)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't work out removed hotspots %v\n", err) }
+
+    report := HotspotImport{Total: len(records)}
+    err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM telstra_hotspots WHERE removedVersion IS NULL`).Scan(&report.Current)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't count current hotspots %v\n", err) }
+
+    rows, err := tx.Query(ctx, `SELECT c.uuid, c.change, COALESCE(h.street_address, i.street_address, ''),
+                                       COALESCE(ST_Distance(c.oldLocation, c.newLocation), 0),
+                                       (SELECT COUNT(*) FROM entries e WHERE e.mapUUID = c.uuid)
+                                FROM hotspot_import_changes c
+                                LEFT JOIN telstra_hotspots h ON h.uuid = c.uuid
+                                LEFT JOIN hotspot_import i ON i.uuid = c.uuid
+                                ORDER BY c.change, c.uuid`)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't read hotspot changes %v\n", err) }
+    for rows.Next() {
+        var change HotspotChange
+        var entries int
+        if err := rows.Scan(&change.UUID, &change.Change, &change.Address, &change.Distance, &entries); err != nil { rows.Close(); return HotspotImport{}, fmt.Errorf("Can't scan hotspot change %v\n", err) }
+        if change.Change == HotspotRemoved { change.Entries = entries }
+        report.Changes = append(report.Changes, change)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return HotspotImport{}, fmt.Errorf("Can't read hotspot changes %v\n", err) }
+    report.Unchanged = report.Total - report.Count(HotspotAdded) - report.Count(HotspotMoved)
+
+    if dryRun { return report, nil }
+    if report.TooManyRemovals() && !allowRemovals {
+        return HotspotImport{}, fmt.Errorf("Import would remove %d of the %d current hotspots, more than %d%%. Check the CSV, or allow the removals\n",
+                                           report.Count(HotspotRemoved), report.Current, maxHotspotRemovalPercent)
+    }
+
+    err = tx.QueryRow(ctx, `INSERT INTO hotspot_datasets (source, sha256, total, added, moved, removed) VALUES ($1, $2, $3, $4, $5, $6) RETURNING version`,
+                      source, hex.EncodeToString(sum[:]), len(records), report.Count(HotspotAdded), report.Count(HotspotMoved), report.Count(HotspotRemoved)).Scan(&report.Version)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't add hotspot dataset %v\n", err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO hotspot_changes (version, uuid, change, oldLocation, newLocation)
+                           SELECT $1, uuid, change, oldLocation, newLocation FROM hotspot_import_changes`, report.Version)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't record hotspot changes %v\n", err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO telstra_hotspots (uuid, location, street_address, alias)
+                           SELECT uuid, ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography, street_address, alias
+                           FROM hotspot_import
+                           ON CONFLICT (uuid) DO UPDATE SET
+                               location = EXCLUDED.location,
+                               street_address = EXCLUDED.street_address,
+                               alias = EXCLUDED.alias,
+                               removedVersion = NULL`)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't upsert hotspots %v\n", err) }
+
+    _, err = tx.Exec(ctx, `UPDATE telstra_hotspots h SET removedVersion = $1
+                           FROM hotspot_import_changes c
+                           WHERE c.change = $2 AND c.uuid = h.uuid`, report.Version, HotspotRemoved)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't remove hotspots %v\n", err) }
+
+    // identities copy their hotspot's location, see learnIdentityFromGPS
+    _, err = tx.Exec(ctx, `UPDATE payphone_identity p SET latitude = ST_Y(h.location::geometry), longitude = ST_X(h.location::geometry), updatedTime = NOW()
+                           FROM hotspot_import_changes c
+                           JOIN telstra_hotspots h ON h.uuid = c.uuid
+                           WHERE c.change = $1 AND p.mapUUID = c.uuid`, HotspotMoved)
+    if err != nil { return HotspotImport{}, fmt.Errorf("Can't move payphone identities %v\n", err) }
+
+    if err := tx.Commit(ctx); err != nil { return HotspotImport{}, fmt.Errorf("Can't commit hotspot import %v\n", err) }
+    return report, nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+    "strings"
+    "testing"
+)
+
+const hotspotHeader = "latitude|longitude|address|uuid|alias\n"
+
+func TestReadHotspotsCSV(t *testing.T) {
+    tests := []struct {
+        name    string
+        csv     string
+        records []HotspotRecord
+        // err is part of the error, empty when the CSV should read
+        err     string
+    }{
+        {"hotspots", hotspotHeader + "-37.8136|144.9631|1 Swanston St|uuid-1|alias-one\n-37.8183|144.9671|2 Flinders St |uuid-2\n",
+         []HotspotRecord{{UUID: "uuid-1", Latitude: -37.8136, Longitude: 144.9631, Address: "1 Swanston St", Alias: "alias-one"},
+                         {UUID: "uuid-2", Latitude: -37.8183, Longitude: 144.9671, Address: "2 Flinders St "}}, ""},
+        {"blank lines", hotspotHeader + "\n-37.8136|144.9631|1 Swanston St| uuid-1 |alias\n  \n", []HotspotRecord{{UUID: "uuid-1", Latitude: -37.8136, Longitude: 144.9631, Address: "1 Swanston St", Alias: "alias"}}, ""},
+        {"header only", hotspotHeader, nil, ""},
+        {"street_address header", "latitude|longitude|street_address|uuid|alias\n", nil, ""},
+        {"empty", "", nil, "empty"},
+        {"no header", "-37.8136|144.9631|1 Swanston St|uuid-1|alias\n", nil, "header"},
+        {"columns out of order", "longitude|latitude|address|uuid|alias\n", nil, "header"},
+        {"comma separated", "latitude,longitude,address,uuid,alias\n", nil, "header"},
+        {"too few fields", hotspotHeader + "-37.8136|144.9631|uuid-1\n", nil, "line 2 has 3 fields"},
+        {"latitude not a number", hotspotHeader + "south|144.9631|1 Swanston St|uuid-1|alias\n", nil, "line 2 latitude"},
+        {"latitude out of range", hotspotHeader + "-91|144.9631|1 Swanston St|uuid-1|alias\n", nil, "line 2 latitude"},
+        {"longitude out of range", hotspotHeader + "-37.8136|180.5|1 Swanston St|uuid-1|alias\n", nil, "line 2 longitude"},
+        {"swapped coordinates", hotspotHeader + "144.9631|-37.8136|1 Swanston St|uuid-1|alias\n", nil, "line 2 latitude"},
+        {"no uuid", hotspotHeader + "-37.8136|144.9631|1 Swanston St| |alias\n", nil, "line 2 has no uuid"},
+        {"duplicate uuid", hotspotHeader + "-37.8136|144.9631|1 Swanston St|uuid-1|a\n-37.8183|144.9671|2 Flinders St|uuid-1|b\n", nil, "line 3 repeats uuid uuid-1 from line 2"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            records, err := ReadHotspotsCSV(strings.NewReader(test.csv))
+            if test.err != "" {
+                if err == nil || !strings.Contains(err.Error(), test.err) { t.Fatalf("expected an error with %q, got %v", test.err, err) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if len(records) != len(test.records) { t.Fatalf("read %d records, expected %d: %+v", len(records), len(test.records), records) }
+            for i := range records {
+                if records[i] != test.records[i] { t.Errorf("record %d is %+v, expected %+v", i, records[i], test.records[i]) }
+            }
+        })
+    }
+}
+
+func TestTooManyRemovals(t *testing.T) {
+    removals := func(n int) []HotspotChange {
+        changes := []HotspotChange{{Change: HotspotAdded}, {Change: HotspotMoved}}
+        for i := 0; i < n; i++ { changes = append(changes, HotspotChange{Change: HotspotRemoved}) }
+        return changes
+    }
+    tests := []struct {
+        name    string
+        current int
+        removed int
+        refused bool
+    }{
+        {"nothing removed", 100, 0, false},
+        {"nothing current", 0, 0, false},
+        {"10%", 100, 10, false},
+        {"over 10%", 100, 11, true},
+        {"every hotspot", 5, 5, true},
+        {"one of a few", 5, 1, true},
+        {"one of many", 1000, 1, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            report := HotspotImport{Current: test.current, Changes: removals(test.removed)}
+            if got := report.TooManyRemovals(); got != test.refused { t.Fatalf("TooManyRemovals is %v removing %d of %d", got, test.removed, test.current) }
+        })
+    }
+}
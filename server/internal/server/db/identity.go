@@ -0,0 +1,249 @@
+package db
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "math"
+
+    "github.com/jackc/pgx/v5"
+
+    "server-indicum/internal/common"
+)
+
+// A payphone's identity is the hotspot it has been placed at. Every user who
+// places one of their entries at a hotspot votes for it, one vote per user per
+// payphone, and the identity follows the hotspot with the most votes. Once it
+// has PLACEMENT_CONSENSUS_VOTES votes and more than any other hotspot it is the
+// payphone's canonical placement. Payphones users disagree about without
+// consensus sit in placement_conflicts. GPS fixes next to a hotspot are weaker
+// evidence and only move an identity no user has voted for.
+
+// IdentityMatchDistance is how close (metres) a GPS fix or a pinned location
+// has to be to a hotspot to count as that payphone
+const IdentityMatchDistance = 50.0
+
+// how much one confirmation or one GPS match takes off the doubt left
+const confirmationWeight = 0.5
+const gpsMatchWeight = 0.2
+
+const defaultConsensusVotes = 3
+
+// ConsensusVotes is how many users have to agree before a placement is
+// canonical, PLACEMENT_CONSENSUS_VOTES overrides it
+func ConsensusVotes() int {
+    return envInt("PLACEMENT_CONSENSUS_VOTES", defaultConsensusVotes)
+}
+
+// IdentityConfidence is how sure an identity with these counts is, 0 to 1
+func IdentityConfidence(confirmations, gpsMatches int) float64 {
+    doubt := math.Pow(1-confirmationWeight, float64(confirmations)) * math.Pow(1-gpsMatchWeight, float64(gpsMatches))
+    return 1 - doubt
+}
+
+// PayphoneIdentity is a row of payphone_identity, Hotspot.Point is the hotspot's
+// real lat/long. Confirmations is how many more votes its hotspot has than any other.
+type PayphoneIdentity struct {
+    PayphoneID    string
+    PayphoneMAC   string
+    Hotspot       common.DataPoint
+    Confirmations int
+    GPSMatches    int
+    Canonical     bool
+}
+
+func (p PayphoneIdentity) Confidence() float64 {
+    return IdentityConfidence(p.Confirmations, p.GPSMatches)
+}
+
+// canonicalPlacement scans the payphone_identity columns of an entry read,
+// all NULL when the payphone has no canonical placement
+type canonicalPlacement struct {
+    MapUUID   sql.NullString
+    Latitude  sql.NullFloat64
+    Longitude sql.NullFloat64
+}
+
+func (c canonicalPlacement) setOn(entry *common.Entry) {
+    if !c.MapUUID.Valid { return }
+    entry.CanonicalMapUUID = c.MapUUID.String
+    entry.CanonicalLatitude = c.Latitude.Float64
+    entry.CanonicalLongitude = c.Longitude.Float64
+}
+
+// Consensus reads a payphone's votes, most first: how far the first hotspot
+// leads by, whether it is canonical, and whether users disagree without one
+func Consensus(tally []common.PlacementVotes, threshold int) (margin int, canonical bool, disputed bool) {
+    if len(tally) == 0 { return 0, false, false }
+    margin = tally[0].Votes
+    if len(tally) > 1 { margin -= tally[1].Votes }
+    canonical = tally[0].Votes >= threshold && margin > 0
+    disputed = len(tally) > 1 && !canonical
+    return margin, canonical, disputed
+}
+
+func findIdentity(ctx context.Context, tx pgx.Tx, payphoneID string) (PayphoneIdentity, bool, error) {
+    identity := PayphoneIdentity{PayphoneID: payphoneID}
+    err := tx.QueryRow(ctx, `SELECT payphoneMAC, mapUUID, latitude, longitude, confirmations, gpsMatches, canonical
+                             FROM payphone_identity WHERE payphoneID = $1`, payphoneID).
+        Scan(&identity.PayphoneMAC, &identity.Hotspot.UUID, &identity.Hotspot.Point.Lat, &identity.Hotspot.Point.Long, &identity.Confirmations, &identity.GPSMatches, &identity.Canonical)
+    if errors.Is(err, pgx.ErrNoRows) { return PayphoneIdentity{}, false, nil }
+    if err != nil { return PayphoneIdentity{}, false, fmt.Errorf("Can't look up payphone identity %v\n", err) }
+    return identity, true, nil
+}
+
+// nearestHotspot is the closest hotspot within IdentityMatchDistance of lat, long
+func nearestHotspot(ctx context.Context, tx pgx.Tx, lat, long float64) (common.DataPoint, bool, error) {
+    var h common.DataPoint
+    err := tx.QueryRow(ctx, `SELECT uuid, ST_Y(location::geometry), ST_X(location::geometry)
+                             FROM telstra_hotspots
+                             WHERE ST_DWithin(location, ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography, $3)
+                             AND removedVersion IS NULL
+                             ORDER BY location <-> ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography
+                             LIMIT 1`, lat, long, IdentityMatchDistance).Scan(&h.UUID, &h.Point.Lat, &h.Point.Long)
+    if errors.Is(err, pgx.ErrNoRows) { return common.DataPoint{}, false, nil }
+    if err != nil { return common.DataPoint{}, false, fmt.Errorf("Can't find nearest hotspot %v\n", err) }
+    return h, true, nil
+}
+
+func hotspotByUUID(ctx context.Context, tx pgx.Tx, mapUUID string) (common.DataPoint, bool, error) {
+    h := common.DataPoint{UUID: mapUUID}
+    err := tx.QueryRow(ctx, `SELECT ST_Y(location::geometry), ST_X(location::geometry) FROM telstra_hotspots WHERE uuid = $1 AND removedVersion IS NULL`, mapUUID).
+        Scan(&h.Point.Lat, &h.Point.Long)
+    if errors.Is(err, pgx.ErrNoRows) { return common.DataPoint{}, false, nil }
+    if err != nil { return common.DataPoint{}, false, fmt.Errorf("Can't find hotspot %s %v\n", mapUUID, err) }
+    return h, true, nil
+}
+
+// learnIdentityFromGPS records a fix next to hotspot. The same hotspot adds to
+// its matches, a different one replaces it if no user has voted for the old one.
+func learnIdentityFromGPS(ctx context.Context, tx pgx.Tx, payphoneID, payphoneMAC string, hotspot common.DataPoint) error {
+    _, err := tx.Exec(ctx, `INSERT INTO payphone_identity (payphoneID, payphoneMAC, mapUUID, latitude, longitude, gpsMatches)
+                            VALUES ($1, $2, $3, $4, $5, 1)
+                            ON CONFLICT (payphoneID) DO UPDATE SET
+                                payphoneMAC = EXCLUDED.payphoneMAC,
+                                mapUUID = EXCLUDED.mapUUID,
+                                latitude = EXCLUDED.latitude,
+                                longitude = EXCLUDED.longitude,
+                                gpsMatches = CASE WHEN payphone_identity.mapUUID = EXCLUDED.mapUUID THEN payphone_identity.gpsMatches + 1 ELSE 1 END,
+                                updatedTime = NOW()
+                            WHERE payphone_identity.mapUUID = EXCLUDED.mapUUID OR payphone_identity.confirmations = 0`,
+                        payphoneID, payphoneMAC, hotspot.UUID, hotspot.Point.Lat, hotspot.Point.Long)
+    if err != nil { return fmt.Errorf("Can't update payphone identity %v\n", err) }
+    return nil
+}
+
+// voteForHotspot is voterUUID placing the payphone of their entry at hotspot
+func voteForHotspot(ctx context.Context, tx pgx.Tx, voterUUID string, entryID int, hotspot common.DataPoint) error {
+    var payphoneID, payphoneMAC string
+    err := tx.QueryRow(ctx, `SELECT payphoneID, payphoneMAC FROM entries WHERE id = $1 AND deviceUUID = $2`, entryID, voterUUID).Scan(&payphoneID, &payphoneMAC)
+    if errors.Is(err, pgx.ErrNoRows) { return nil }
+    if err != nil { return fmt.Errorf("Can't find entry %d %v\n", entryID, err) }
+
+    _, err = tx.Exec(ctx, `INSERT INTO placement_votes (payphoneID, voterUUID, mapUUID) VALUES ($1, $2, $3)
+                           ON CONFLICT (payphoneID, voterUUID) DO UPDATE SET mapUUID = EXCLUDED.mapUUID, votedTime = NOW()`,
+                       payphoneID, voterUUID, hotspot.UUID)
+    if err != nil { return fmt.Errorf("Can't record placement vote %v\n", err) }
+    return settlePlacement(ctx, tx, payphoneID, payphoneMAC)
+}
+
+// withdrawVote is voterUUID unpinning their entry
+func withdrawVote(ctx context.Context, tx pgx.Tx, voterUUID string, entryID int) error {
+    var payphoneID, payphoneMAC string
+    err := tx.QueryRow(ctx, `DELETE FROM placement_votes v USING entries e
+                             WHERE e.id = $1 AND e.deviceUUID = $2 AND v.payphoneID = e.payphoneID AND v.voterUUID = e.deviceUUID
+                             RETURNING e.payphoneID, e.payphoneMAC`, entryID, voterUUID).Scan(&payphoneID, &payphoneMAC)
+    if errors.Is(err, pgx.ErrNoRows) { return nil }
+    if err != nil { return fmt.Errorf("Can't withdraw placement vote %v\n", err) }
+    return settlePlacement(ctx, tx, payphoneID, payphoneMAC)
+}
+
+// settlePlacement counts the payphone's votes and updates its identity and conflict to match.
+// A vote counts once per voter and only while the voter still has an entry for the payphone,
+// see placement_tally.
+func settlePlacement(ctx context.Context, tx pgx.Tx, payphoneID, payphoneMAC string) error {
+    // serialise votes for the payphone so two can't both miss each other's
+    if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('placement:' || $1))", payphoneID); err != nil { return fmt.Errorf("Can't lock payphone placement %v\n", err) }
+
+    rows, err := tx.Query(ctx, `SELECT t.mapUUID, t.votes, ST_Y(h.location::geometry), ST_X(h.location::geometry)
+                                FROM placement_tally t
+                                JOIN telstra_hotspots h ON h.uuid = t.mapUUID
+                                WHERE t.payphoneID = $1
+                                ORDER BY t.votes DESC, t.lastVote DESC`, payphoneID)
+    if err != nil { return fmt.Errorf("Can't count placement votes %v\n", err) }
+    var tally []common.PlacementVotes
+    var leader common.DataPoint
+    for rows.Next() {
+        var votes common.PlacementVotes
+        var lat, long float64
+        if err := rows.Scan(&votes.MapUUID, &votes.Votes, &lat, &long); err != nil { rows.Close(); return fmt.Errorf("Can't scan placement votes %v\n", err) }
+        if len(tally) == 0 { leader = common.DataPoint{UUID: votes.MapUUID, Point: common.Coord{Lat: lat, Long: long}} }
+        tally = append(tally, votes)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return fmt.Errorf("Can't count placement votes %v\n", err) }
+
+    margin, canonical, disputed := Consensus(tally, ConsensusVotes())
+    if len(tally) == 0 {
+        _, err = tx.Exec(ctx, `UPDATE payphone_identity SET confirmations = 0, canonical = FALSE, updatedTime = NOW() WHERE payphoneID = $1`, payphoneID)
+    } else {
+        _, err = tx.Exec(ctx, `INSERT INTO payphone_identity (payphoneID, payphoneMAC, mapUUID, latitude, longitude, confirmations, canonical)
+                               VALUES ($1, $2, $3, $4, $5, $6, $7)
+                               ON CONFLICT (payphoneID) DO UPDATE SET
+                                   payphoneMAC = EXCLUDED.payphoneMAC,
+                                   mapUUID = EXCLUDED.mapUUID,
+                                   latitude = EXCLUDED.latitude,
+                                   longitude = EXCLUDED.longitude,
+                                   confirmations = EXCLUDED.confirmations,
+                                   canonical = EXCLUDED.canonical,
+                                   gpsMatches = CASE WHEN payphone_identity.mapUUID = EXCLUDED.mapUUID THEN payphone_identity.gpsMatches ELSE 0 END,
+                                   updatedTime = NOW()`,
+                           payphoneID, payphoneMAC, leader.UUID, leader.Point.Lat, leader.Point.Long, margin, canonical)
+    }
+    if err != nil { return fmt.Errorf("Can't update payphone identity %v\n", err) }
+
+    if disputed {
+        _, err = tx.Exec(ctx, `INSERT INTO placement_conflicts (payphoneID) VALUES ($1)
+                               ON CONFLICT (payphoneID) WHERE resolvedTime IS NULL DO NOTHING`, payphoneID)
+    } else {
+        var resolvedMapUUID *string
+        if canonical { resolvedMapUUID = &leader.UUID }
+        _, err = tx.Exec(ctx, `UPDATE placement_conflicts SET resolvedTime = NOW(), resolvedMapUUID = $2
+                               WHERE payphoneID = $1 AND resolvedTime IS NULL`, payphoneID, resolvedMapUUID)
+    }
+    if err != nil { return fmt.Errorf("Can't update placement conflict %v\n", err) }
+    return nil
+}
+
+// DBGetPlacementConflicts returns the open conflicts, oldest first, with their votes
+func DBGetPlacementConflicts(ctx context.Context) ([]common.PlacementConflict, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    // the same tally settlePlacement counts
+    rows, err := Pool.Query(ctx, `SELECT c.id, c.payphoneID, EXTRACT(EPOCH FROM c.openedTime), t.mapUUID, t.votes
+                                  FROM placement_conflicts c
+                                  JOIN placement_tally t ON t.payphoneID = c.payphoneID
+                                  WHERE c.resolvedTime IS NULL
+                                  ORDER BY c.openedTime, c.id, t.votes DESC, t.lastVote DESC`)
+    if err != nil { return nil, fmt.Errorf("Failed to retrieve placement conflicts: %v", err) }
+    defer rows.Close()
+
+    var conflicts []common.PlacementConflict
+    for rows.Next() {
+        var conflict common.PlacementConflict
+        var votes common.PlacementVotes
+        var openedTime float64
+        if err := rows.Scan(&conflict.ID, &conflict.PayphoneID, &openedTime, &votes.MapUUID, &votes.Votes); err != nil {
+            return nil, fmt.Errorf("Failed to scan placement conflict: %v", err)
+        }
+        if len(conflicts) == 0 || conflicts[len(conflicts)-1].ID != conflict.ID {
+            conflict.OpenedTime = int64(openedTime)
+            conflicts = append(conflicts, conflict)
+        }
+        last := &conflicts[len(conflicts)-1]
+        last.Votes = append(last.Votes, votes)
+    }
+    if err := rows.Err(); err != nil { return nil, fmt.Errorf("Failed during rows iteration: %v", err) }
+    return conflicts, nil
+}
@@ -0,0 +1,761 @@
+// Package memstore is a db.Store kept in memory, for running the servers and
+// testing the API without Postgres (STORE=memory). It follows the Postgres
+// queries closely, distances are haversine instead of PostGIS and statistics
+// are worked out when they are read instead of by the hourly job. Nothing
+// blocks, so the contexts are only there to satisfy db.Store.
+package memstore
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "math"
+    "math/rand"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/db"
+    "server-indicum/internal/server/ws"
+)
+
+// nearbyDistance is how close /nearby-hotspots looks, metres
+const nearbyDistance = 1000
+
+// recentEntryWindow is how far back GetRecentEntry looks
+const recentEntryWindow = 10 * time.Minute
+
+type user struct {
+    uuid         string
+    email        string
+    username     string
+    token        string
+    pubKey       []byte
+    deviceSecret string
+    hasStats     bool
+    // deletionDue is when the account is erased, zero unless deletion was asked for
+    deletionDue  time.Time
+}
+
+type entry struct {
+    common.Entry
+    portalURL       string
+    portalURLParser int
+    fix             *common.Fix
+    iface           string
+}
+
+type testEntry struct {
+    id         int64
+    payload    common.Payload
+    deviceUUID string
+    expires    time.Time
+}
+
+// vote is a user placing a payphone at a hotspot, seq orders votes made in the same instant
+type vote struct {
+    mapUUID string
+    seq     int
+}
+
+type conflict struct {
+    common.PlacementConflict
+    resolved bool
+}
+
+// auditRecord is a row of account_audit
+type auditRecord struct {
+    subjectHash string
+    action      string
+    at          time.Time
+    detail      map[string]any
+}
+
+// tombstone is a row of account_tombstones
+type tombstone struct {
+    erased                   time.Time
+    payphones, entries, maps int
+}
+
+type sighting struct {
+    deviceUUID string
+    common.Sighting
+}
+
+type deviceLog struct {
+    deviceUUID string
+    common.DeviceLog
+}
+
+type Store struct {
+    mu          sync.Mutex
+    users       map[string]*user
+    entries     []*entry
+    // nextID is the ID of the next entry, erasing entries doesn't reuse theirs
+    nextID      int
+    testEntries []testEntry
+    sightings   []sighting
+    logs        []deviceLog
+    hotspots    []common.DataPoint
+    identities  map[string]*db.PayphoneIdentity
+    // votes by payphone ID then voter
+    votes       map[string]map[string]vote
+    voteSeq     int
+    conflicts   []*conflict
+    audit       []auditRecord
+    tombstones  []tombstone
+
+    // now is the clock, tests can replace it
+    now func() time.Time
+}
+
+var _ db.Store = (*Store)(nil)
+
+func New() *Store {
+    return &Store{users: make(map[string]*user), identities: make(map[string]*db.PayphoneIdentity), votes: make(map[string]map[string]vote), nextID: 1, now: time.Now}
+}
+
+// SetClock makes the store use now instead of time.Now
+func (s *Store) SetClock(now func() time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.now = now
+}
+
+// AddHotspot adds a payphone hotspot, what the init scripts load from the CSV
+func (s *Store) AddHotspot(uuid string, lat, long float64, address string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.hotspots = append(s.hotspots, common.DataPoint{Point: common.Coord{Lat: lat, Long: long}, UUID: uuid, Address: address})
+}
+
+// LoadHotspots reads hotspots in the format of infra/db/csv/telstra_hotspots.csv,
+// see db.ReadHotspotsCSV
+func (s *Store) LoadHotspots(r io.Reader) (int, error) {
+    records, err := db.ReadHotspotsCSV(r)
+    if err != nil { return 0, err }
+    for _, record := range records { s.AddHotspot(record.UUID, record.Latitude, record.Longitude, record.Address) }
+    return len(records), nil
+}
+
+func (s *Store) AddUser(ctx context.Context, uuid, email string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.users[uuid]; ok { return fmt.Errorf("Failed to insert user: uuid %s already exists", uuid) }
+    s.users[uuid] = &user{uuid: uuid, email: email}
+    return nil
+}
+
+func (s *Store) GetUserProfile(ctx context.Context, uuid string) (map[string]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.eraseDueAccounts()
+    u, ok := s.users[uuid]
+    if !ok { return nil, fmt.Errorf("no user found with uuid %s", uuid) }
+
+    if u.token == "" {
+        token, err := common.GenerateRandomString(20)
+        if err != nil { return nil, fmt.Errorf("failed to generate token for user %s: %v", uuid, err) }
+        u.token = token
+    }
+    profile := map[string]string{"email": u.email, "username": u.username, "uuid": uuid, "token": u.token, "deletion_due": ""}
+    if !u.deletionDue.IsZero() { profile["deletion_due"] = strconv.FormatInt(u.deletionDue.Unix(), 10) }
+    return profile, nil
+}
+
+func (s *Store) SavePubKey(ctx context.Context, token string, pubKey string) (string, string, error) {
+    deviceSecret, err := common.GenerateRandomString(40)
+    if err != nil { return "", "", fmt.Errorf("failed to generate device secret: %v", err) }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, u := range s.users {
+        if u.token != "" && u.token == token {
+            if !u.deletionDue.IsZero() { break }
+            u.pubKey = []byte(pubKey)
+            u.deviceSecret = deviceSecret
+            return u.uuid, deviceSecret, nil
+        }
+    }
+    return "", "", fmt.Errorf("No account to enroll with the given token, or its deletion is pending")
+}
+
+func (s *Store) FindDeviceRSAPub(ctx context.Context, deviceUUID string) ([]byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[deviceUUID]
+    if !ok { return nil, fmt.Errorf("Can't retrieve pub key no user %s\n", deviceUUID) }
+    if u.pubKey == nil { return nil, fmt.Errorf("Device %s has no pub key\n", deviceUUID) }
+    return u.pubKey, nil
+}
+
+func (s *Store) FindDeviceSecret(ctx context.Context, deviceUUID string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[deviceUUID]
+    if !ok { return "", fmt.Errorf("Can't retrieve device secret no user %s\n", deviceUUID) }
+    return u.deviceSecret, nil
+}
+
+func (s *Store) RequestAccountDeletion(ctx context.Context, uuid string, grace time.Duration) (time.Time, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[uuid]
+    if !ok { return time.Time{}, fmt.Errorf("no user found with uuid %s", uuid) }
+    if !u.deletionDue.IsZero() { return u.deletionDue, nil }
+
+    enrolled := u.pubKey != nil
+    u.deletionDue = s.now().Add(grace)
+    u.pubKey, u.deviceSecret = nil, ""
+    s.addAudit(uuid, db.AccountDeletionRequested, map[string]any{"dueTime": u.deletionDue.Unix(), "deviceRevoked": enrolled})
+    return u.deletionDue, nil
+}
+
+func (s *Store) CancelAccountDeletion(ctx context.Context, uuid string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[uuid]
+    if !ok || u.deletionDue.IsZero() { return db.ErrNoDeletionPending }
+    u.deletionDue = time.Time{}
+    s.addAudit(uuid, db.AccountDeletionCancelled, nil)
+    return nil
+}
+
+func (s *Store) addAudit(uuid, action string, detail map[string]any) {
+    s.audit = append(s.audit, auditRecord{subjectHash: db.SubjectHash(uuid), action: action, at: s.now(), detail: detail})
+}
+
+// eraseDueAccounts does what the hourly job does for Postgres, it runs when
+// accounts are read instead
+func (s *Store) eraseDueAccounts() {
+    now := s.now()
+    for uuid, u := range s.users {
+        if !u.deletionDue.IsZero() && !now.Before(u.deletionDue) { s.eraseAccount(uuid) }
+    }
+}
+
+// eraseAccount follows db.EraseAccount
+func (s *Store) eraseAccount(uuid string) {
+    t := tombstone{erased: s.now()}
+    t.payphones, t.entries, t.maps = s.totals(uuid)
+    s.tombstones = append(s.tombstones, t)
+
+    var payphoneIDs []string
+    macs := make(map[string]string)
+    for payphoneID, votes := range s.votes {
+        if _, found := votes[uuid]; !found { continue }
+        delete(votes, uuid)
+        payphoneIDs = append(payphoneIDs, payphoneID)
+    }
+    for _, e := range s.entries {
+        if e.DeviceUUID == uuid && macs[e.PayphoneID] == "" { macs[e.PayphoneID] = e.PayphoneMAC }
+    }
+    sort.Strings(payphoneIDs)
+    for _, payphoneID := range payphoneIDs { s.settlePlacement(payphoneID, macs[payphoneID]) }
+
+    var erased, testEntries, sightings, logs int
+    entries := s.entries[:0]
+    for _, e := range s.entries {
+        if e.DeviceUUID == uuid { erased++; continue }
+        entries = append(entries, e)
+    }
+    s.entries = entries
+    kept := s.testEntries[:0]
+    for _, t := range s.testEntries {
+        if t.deviceUUID == uuid { testEntries++; continue }
+        kept = append(kept, t)
+    }
+    s.testEntries = kept
+    keptSightings := s.sightings[:0]
+    for _, sight := range s.sightings {
+        if sight.deviceUUID == uuid { sightings++; continue }
+        keptSightings = append(keptSightings, sight)
+    }
+    s.sightings = keptSightings
+    keptLogs := s.logs[:0]
+    for _, l := range s.logs {
+        if l.deviceUUID == uuid { logs++; continue }
+        keptLogs = append(keptLogs, l)
+    }
+    s.logs = keptLogs
+
+    requested := !s.users[uuid].deletionDue.IsZero()
+    delete(s.users, uuid)
+    s.addAudit(uuid, db.AccountErased, map[string]any{"requested": requested, "entries": erased, "testEntries": testEntries,
+                                                      "sightings": sightings, "deviceLogs": logs, "votes": len(payphoneIDs)})
+}
+
+func (s *Store) InitializeUserStatistics(ctx context.Context, uuid string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[uuid]
+    if !ok { return fmt.Errorf("No user %s for statistics", uuid) }
+    if u.hasStats { return fmt.Errorf("User %s already has statistics", uuid) }
+    u.hasStats = true
+    return nil
+}
+
+// totals for one device, the same counts as calculateTotalCounts
+func (s *Store) totals(deviceUUID string) (payphones, entries, maps int) {
+    payphoneIDs := make(map[string]bool)
+    locations := make(map[string]bool)
+    for _, e := range s.entries {
+        if e.DeviceUUID != deviceUUID { continue }
+        entries++
+        payphoneIDs[e.PayphoneID] = true
+        if e.MapLocation != "" { locations[e.MapLocation] = true }
+    }
+    return len(payphoneIDs), entries, len(locations)
+}
+
+func (s *Store) GetStatistics(ctx context.Context, uuid string) (common.Statistics, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.eraseDueAccounts()
+    u, ok := s.users[uuid]
+    if !ok || !u.hasStats { return common.Statistics{}, fmt.Errorf("User statistics not found for UUID: %s", uuid) }
+
+    stats := common.Statistics{TotalUsers: len(s.users), LastUpdated: s.now().Unix(), PayphoneRank: 1, EntryRank: 1, MapRank: 1}
+    stats.TotalPayphones, stats.TotalEntries, stats.TotalMaps = s.totals(uuid)
+    // rank is one more than the number of users ahead, like calculateRanks
+    for _, other := range s.users {
+        if !other.hasStats || other.uuid == uuid { continue }
+        payphones, entries, maps := s.totals(other.uuid)
+        if payphones > stats.TotalPayphones { stats.PayphoneRank++ }
+        if entries > stats.TotalEntries { stats.EntryRank++ }
+        if maps > stats.TotalMaps { stats.MapRank++ }
+    }
+    return stats, nil
+}
+
+func (s *Store) GetLeaderboard(ctx context.Context) ([]common.LeaderboardVal, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.eraseDueAccounts()
+
+    payphones := make(map[string]map[string]bool)
+    for _, e := range s.entries {
+        if payphones[e.DeviceUUID] == nil { payphones[e.DeviceUUID] = make(map[string]bool) }
+        payphones[e.DeviceUUID][e.PayphoneID] = true
+    }
+    var leaderboard []common.LeaderboardVal
+    for deviceUUID, ids := range payphones {
+        leaderboard = append(leaderboard, common.LeaderboardVal{UUID: deviceUUID, TotalPoints: len(ids)})
+    }
+    sort.Slice(leaderboard, func(i, j int) bool {
+        if leaderboard[i].TotalPoints != leaderboard[j].TotalPoints { return leaderboard[i].TotalPoints > leaderboard[j].TotalPoints }
+        return leaderboard[i].UUID < leaderboard[j].UUID
+    })
+    return leaderboard, nil
+}
+
+func (s *Store) AddEntry(ctx context.Context, payload common.Payload, deviceUUID string, attestationVersion int, portalURLParser int) (int64, error) {
+    s.mu.Lock()
+    if duplicate := s.findDuplicate(deviceUUID, payload.PayphoneID, payload.PayphoneTime, payload.Time); duplicate != nil {
+        duplicate.SeenAgain++
+        duplicate.LastSeenTime = max(duplicate.LastSeenTime, payload.Time)
+        s.mu.Unlock()
+        return int64(duplicate.ID), nil
+    }
+
+    e := &entry{
+        Entry: common.Entry{
+            ID: s.nextID,
+            DeviceUUID: deviceUUID,
+            PayphoneMAC: payload.PayphoneMAC,
+            PayphoneID: payload.PayphoneID,
+            PayphoneTime: payload.PayphoneTime,
+            RecordedTime: payload.Time,
+            LastSeenTime: payload.Time,
+            AttestationVersion: attestationVersion,
+        },
+        portalURL: payload.PortalURL,
+        portalURLParser: portalURLParser,
+        fix: payload.Fix,
+        iface: payload.Interface,
+    }
+    // accurate fixes go straight on the map and teach the payphone's identity,
+    // the rest are located from it, see AddEntryToDB
+    if payload.Fix != nil && payload.Fix.Accuracy <= db.GPSMapAccuracy {
+        setLocation(e, formatDegrees(payload.Fix.Lat), formatDegrees(payload.Fix.Long))
+        if hotspot, found := s.nearestHotspot(payload.Fix.Lat, payload.Fix.Long); found {
+            s.learnIdentityFromGPS(payload.PayphoneID, payload.PayphoneMAC, hotspot)
+        }
+    } else if identity, found := s.identities[payload.PayphoneID]; found {
+        e.MapUUID = identity.Hotspot.UUID
+        setLocation(e, formatDegrees(identity.Hotspot.Point.Lat), formatDegrees(identity.Hotspot.Point.Long))
+        e.LocationConfidence = identity.Confidence()
+    }
+    s.nextID++
+    s.entries = append(s.entries, e)
+    s.mu.Unlock()
+
+    // what the new_entry trigger and ListenForDBInserts do with Postgres
+    if _, err := ws.Send(deviceUUID, []byte(deviceUUID)); err != nil { fmt.Println("Error sending message:", err) }
+    return int64(e.ID), nil
+}
+
+// findDuplicate is the entry a submission duplicates, the same matching as db.findDuplicateEntry
+func (s *Store) findDuplicate(deviceUUID, payphoneID string, payphoneTime, recordedTime int64) *entry {
+    window := int64(db.DuplicateEntryWindow().Seconds())
+    var latest *entry
+    for _, e := range s.entries {
+        if e.DeviceUUID != deviceUUID || e.PayphoneID != payphoneID { continue }
+        if e.PayphoneTime == payphoneTime { return e }
+        if e.LastSeenTime >= recordedTime-window && (latest == nil || e.LastSeenTime > latest.LastSeenTime) { latest = e }
+    }
+    return latest
+}
+
+func formatDegrees(degrees float64) string {
+    return strconv.FormatFloat(degrees, 'f', -1, 64)
+}
+
+func setLocation(e *entry, latitude, longitude string) {
+    e.MapLatitude = latitude
+    e.MapLongitude = longitude
+    e.MapLocation = fmt.Sprintf("POINT(%s %s)", longitude, latitude)
+}
+
+func (s *Store) AddTestEntry(ctx context.Context, payload common.Payload, deviceUUID string, attestationVersion int, portalURLParser int, ttl time.Duration) (int64, time.Time, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // drop the expired ones, the hourly prune job does it for Postgres
+    now := s.now()
+    kept := s.testEntries[:0]
+    for _, t := range s.testEntries {
+        if t.expires.After(now) { kept = append(kept, t) }
+    }
+    s.testEntries = kept
+
+    var id int64 = 1
+    if len(s.testEntries) > 0 { id = s.testEntries[len(s.testEntries)-1].id + 1 }
+    t := testEntry{id: id, payload: payload, deviceUUID: deviceUUID, expires: now.Add(ttl)}
+    s.testEntries = append(s.testEntries, t)
+    return t.id, t.expires, nil
+}
+
+func (s *Store) GetRecentEntry(ctx context.Context, uuid string) (common.Entry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.eraseDueAccounts()
+    now := s.now()
+    for i := len(s.entries) - 1; i >= 0; i-- {
+        e := s.entries[i]
+        recorded := time.Unix(e.RecordedTime, 0)
+        lastSeen := time.Unix(e.LastSeenTime, 0)
+        if e.DeviceUUID == uuid && lastSeen.After(now.Add(-recentEntryWindow)) && recorded.Before(now) {
+            recent := common.Entry{ID: e.ID, DeviceUUID: e.DeviceUUID, PayphoneID: e.PayphoneID, PayphoneMAC: e.PayphoneMAC, PayphoneTime: e.PayphoneTime, RecordedTime: e.RecordedTime,
+                                   SeenAgain: e.SeenAgain, LastSeenTime: e.LastSeenTime}
+            s.setCanonical(&recent)
+            return recent, nil
+        }
+    }
+    return common.Entry{}, fmt.Errorf("No entries in the last 10 minutes")
+}
+
+func (s *Store) GetEntriesWithUUID(ctx context.Context, deviceUUID string) ([]common.Entry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.eraseDueAccounts()
+    var entries []common.Entry
+    for _, e := range s.entries {
+        if e.DeviceUUID != deviceUUID { continue }
+        read := e.Entry
+        s.setCanonical(&read)
+        entries = append(entries, read)
+    }
+    return entries, nil
+}
+
+// ExportEntries follows db.DBExportEntries. The entries are copied first so
+// each runs without the lock held.
+func (s *Store) ExportEntries(ctx context.Context, deviceUUID string, from, to int64, each func(common.ExportEntry) error) error {
+    s.mu.Lock()
+    s.eraseDueAccounts()
+    var exported []common.ExportEntry
+    for _, e := range s.entries {
+        if e.DeviceUUID != deviceUUID || (from > 0 && e.RecordedTime < from) || (to > 0 && e.RecordedTime >= to) { continue }
+        export := common.ExportEntry{ID: int64(e.ID), PayphoneID: e.PayphoneID, PayphoneMAC: e.PayphoneMAC, RecordedTime: e.RecordedTime,
+                                     LastSeenTime: e.LastSeenTime, SeenAgain: e.SeenAgain, MapUUID: e.MapUUID}
+
+        var location db.ExportLocation
+        lat, latErr := strconv.ParseFloat(e.MapLatitude, 64)
+        long, longErr := strconv.ParseFloat(e.MapLongitude, 64)
+        if latErr == nil && longErr == nil {
+            location.Pin = &common.Coord{Lat: lat, Long: long}
+            location.Located = e.LocationConfidence != 0
+        }
+        if hotspot, found := s.hotspotByUUID(e.MapUUID); found {
+            location.Placed = &hotspot.Point
+            export.HotspotAddress = hotspot.Address
+        }
+        if identity, found := s.identities[e.PayphoneID]; found && identity.Canonical {
+            location.Canonical = &common.Coord{Lat: identity.Hotspot.Point.Lat, Long: identity.Hotspot.Point.Long}
+            if export.MapUUID == "" { export.MapUUID = identity.Hotspot.UUID }
+            if export.HotspotAddress == "" { export.HotspotAddress = identity.Hotspot.Address }
+        }
+        if e.fix != nil { location.GPS = &common.Coord{Lat: e.fix.Lat, Long: e.fix.Long} }
+        location.Set(&export)
+        exported = append(exported, export)
+    }
+    s.mu.Unlock()
+
+    sort.SliceStable(exported, func(i, j int) bool { return exported[i].RecordedTime < exported[j].RecordedTime })
+    for _, e := range exported {
+        if err := ctx.Err(); err != nil { return err }
+        if err := each(e); err != nil { return err }
+    }
+    return nil
+}
+
+// setCanonical fills in the payphone's canonical placement, like the join on payphone_identity
+func (s *Store) setCanonical(e *common.Entry) {
+    identity, found := s.identities[e.PayphoneID]
+    if !found || !identity.Canonical { return }
+    e.CanonicalMapUUID = identity.Hotspot.UUID
+    e.CanonicalLatitude = identity.Hotspot.Point.Lat
+    e.CanonicalLongitude = identity.Hotspot.Point.Long
+}
+
+// findEntry is deviceUUID's entry entryID
+func (s *Store) findEntry(deviceUUID string, entryID int) (*entry, error) {
+    for _, e := range s.entries {
+        if e.ID == entryID && e.DeviceUUID == deviceUUID { return e, nil }
+    }
+    return nil, db.ErrEntryNotFound
+}
+
+func (s *Store) AddMapUUIDEntry(ctx context.Context, deviceUUID string, entryID int, mapUUID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    e, err := s.findEntry(deviceUUID, entryID)
+    if err != nil { return err }
+    e.MapUUID = mapUUID
+
+    hotspot, found := s.hotspotByUUID(mapUUID)
+    if !found { return nil }
+    if e.LocationConfidence != 0 {
+        setLocation(e, formatDegrees(hotspot.Point.Lat), formatDegrees(hotspot.Point.Long))
+        e.LocationConfidence = 0
+    }
+    s.voteForHotspot(e, hotspot)
+    return nil
+}
+
+func (s *Store) UpdateLocation(ctx context.Context, deviceUUID string, entryID int, latitude, longitude string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    e, err := s.findEntry(deviceUUID, entryID)
+    if err != nil { return err }
+
+    if latitude == "0" && longitude == "0" {
+        e.MapLatitude, e.MapLongitude, e.MapLocation = "", "", ""
+        e.LocationConfidence = 0
+        s.withdrawVote(e)
+        return nil
+    }
+    // the same checks ST_PointFromText makes
+    lat, err := strconv.ParseFloat(latitude, 64)
+    if err != nil { return fmt.Errorf("error updating entry: latitude %v", err) }
+    long, err := strconv.ParseFloat(longitude, 64)
+    if err != nil { return fmt.Errorf("error updating entry: longitude %v", err) }
+    setLocation(e, latitude, longitude)
+    e.LocationConfidence = 0
+
+    if hotspot, found := s.nearestHotspot(lat, long); found {
+        s.voteForHotspot(e, hotspot)
+    } else {
+        s.withdrawVote(e)
+    }
+    return nil
+}
+
+// nearestHotspot is the closest hotspot within db.IdentityMatchDistance, with its real lat/long
+func (s *Store) nearestHotspot(lat, long float64) (common.DataPoint, bool) {
+    var nearest common.DataPoint
+    nearestDistance := math.Inf(1)
+    for _, h := range s.hotspots {
+        distance := Distance(lat, long, h.Point.Lat, h.Point.Long)
+        if distance <= db.IdentityMatchDistance && distance < nearestDistance { nearest, nearestDistance = h, distance }
+    }
+    return nearest, !math.IsInf(nearestDistance, 1)
+}
+
+func (s *Store) hotspotByUUID(mapUUID string) (common.DataPoint, bool) {
+    for _, h := range s.hotspots {
+        if h.UUID == mapUUID { return h, true }
+    }
+    return common.DataPoint{}, false
+}
+
+// learnIdentityFromGPS follows db.learnIdentityFromGPS: the same hotspot adds
+// to its matches, a different one replaces it unless users have voted for the old one
+func (s *Store) learnIdentityFromGPS(payphoneID, payphoneMAC string, hotspot common.DataPoint) {
+    identity, found := s.identities[payphoneID]
+    if !found || identity.Hotspot.UUID != hotspot.UUID {
+        if found && identity.Confirmations > 0 { return }
+        identity = &db.PayphoneIdentity{PayphoneID: payphoneID}
+        s.identities[payphoneID] = identity
+    }
+    identity.PayphoneMAC = payphoneMAC
+    identity.Hotspot = hotspot
+    identity.GPSMatches++
+}
+
+func (s *Store) voteForHotspot(e *entry, hotspot common.DataPoint) {
+    if s.votes[e.PayphoneID] == nil { s.votes[e.PayphoneID] = make(map[string]vote) }
+    s.voteSeq++
+    s.votes[e.PayphoneID][e.DeviceUUID] = vote{mapUUID: hotspot.UUID, seq: s.voteSeq}
+    s.settlePlacement(e.PayphoneID, e.PayphoneMAC)
+}
+
+func (s *Store) withdrawVote(e *entry) {
+    if _, found := s.votes[e.PayphoneID][e.DeviceUUID]; !found { return }
+    delete(s.votes[e.PayphoneID], e.DeviceUUID)
+    s.settlePlacement(e.PayphoneID, e.PayphoneMAC)
+}
+
+// hasEntryFor is whether deviceUUID has an entry for the payphone
+func (s *Store) hasEntryFor(deviceUUID, payphoneID string) bool {
+    for _, e := range s.entries {
+        if e.DeviceUUID == deviceUUID && e.PayphoneID == payphoneID { return true }
+    }
+    return false
+}
+
+// tally is the payphone's votes per hotspot, most first and then the most recently voted for.
+// Like db.settlePlacement a voter counts once and only while they have an entry for the payphone.
+func (s *Store) tally(payphoneID string) []common.PlacementVotes {
+    counts := make(map[string]int)
+    lastVote := make(map[string]int)
+    for voterUUID, v := range s.votes[payphoneID] {
+        if !s.hasEntryFor(voterUUID, payphoneID) { continue }
+        counts[v.mapUUID]++
+        lastVote[v.mapUUID] = max(lastVote[v.mapUUID], v.seq)
+    }
+    var tally []common.PlacementVotes
+    for mapUUID, votes := range counts { tally = append(tally, common.PlacementVotes{MapUUID: mapUUID, Votes: votes}) }
+    sort.Slice(tally, func(i, j int) bool {
+        if tally[i].Votes != tally[j].Votes { return tally[i].Votes > tally[j].Votes }
+        return lastVote[tally[i].MapUUID] > lastVote[tally[j].MapUUID]
+    })
+    return tally
+}
+
+// settlePlacement follows db.settlePlacement
+func (s *Store) settlePlacement(payphoneID, payphoneMAC string) {
+    tally := s.tally(payphoneID)
+    margin, canonical, disputed := db.Consensus(tally, db.ConsensusVotes())
+
+    identity, found := s.identities[payphoneID]
+    if len(tally) == 0 {
+        if found { identity.Confirmations, identity.Canonical = 0, false }
+    } else {
+        leader, _ := s.hotspotByUUID(tally[0].MapUUID)
+        if !found || identity.Hotspot.UUID != leader.UUID {
+            identity = &db.PayphoneIdentity{PayphoneID: payphoneID}
+            s.identities[payphoneID] = identity
+        }
+        identity.PayphoneMAC = payphoneMAC
+        identity.Hotspot = leader
+        identity.Confirmations = margin
+        identity.Canonical = canonical
+    }
+
+    var open *conflict
+    for _, c := range s.conflicts {
+        if c.PayphoneID == payphoneID && !c.resolved { open = c }
+    }
+    if disputed && open == nil {
+        s.conflicts = append(s.conflicts, &conflict{PlacementConflict: common.PlacementConflict{ID: int64(len(s.conflicts) + 1), PayphoneID: payphoneID, OpenedTime: s.now().Unix()}})
+    } else if !disputed && open != nil {
+        open.resolved = true
+    }
+}
+
+func (s *Store) GetPlacementConflicts(ctx context.Context) ([]common.PlacementConflict, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var conflicts []common.PlacementConflict
+    for _, c := range s.conflicts {
+        if c.resolved { continue }
+        open := c.PlacementConflict
+        open.Votes = s.tally(c.PayphoneID)
+        conflicts = append(conflicts, open)
+    }
+    return conflicts, nil
+}
+
+func (s *Store) AddScanSightings(ctx context.Context, report common.ScanReport, deviceUUID string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, sight := range report.Sightings {
+        s.sightings = append(s.sightings, sighting{deviceUUID: deviceUUID, Sighting: sight})
+    }
+    return len(report.Sightings), nil
+}
+
+func (s *Store) AddDeviceLogs(ctx context.Context, deviceUUID string, records []common.LogRecord) (int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    received := s.now().Unix()
+    for _, record := range records {
+        s.logs = append(s.logs, deviceLog{deviceUUID: deviceUUID, DeviceLog: common.DeviceLog{LogRecord: record, ReceivedTime: received}})
+    }
+    return int64(len(records)), nil
+}
+
+func (s *Store) GetDeviceLogs(ctx context.Context, deviceUUID string, since int64, limit int) ([]common.DeviceLog, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // walked backwards so the stable sort leaves later uploads first on ties, like ORDER BY id DESC
+    logs := []common.DeviceLog{}
+    for i := len(s.logs) - 1; i >= 0; i-- {
+        if s.logs[i].deviceUUID == deviceUUID && s.logs[i].Time > since { logs = append(logs, s.logs[i].DeviceLog) }
+    }
+    sort.SliceStable(logs, func(i, j int) bool { return logs[i].Time > logs[j].Time })
+    if len(logs) > limit { logs = logs[:limit] }
+    return logs, nil
+}
+
+// GetNearbyHotspots returns the hotspots within nearbyDistance. Like
+// DBGetNearbyHotspots, Point.Lat holds the longitude and Point.Long the latitude.
+func (s *Store) GetNearbyHotspots(ctx context.Context, lat, lon float64) ([]common.DataPoint, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var dataPoints []common.DataPoint
+    for _, h := range s.hotspots {
+        if Distance(lat, lon, h.Point.Lat, h.Point.Long) <= nearbyDistance { dataPoints = append(dataPoints, swapped(h)) }
+    }
+    return dataPoints, nil
+}
+
+func (s *Store) GetRandomPoint(ctx context.Context) (common.DataPoint, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.hotspots) == 0 { return common.DataPoint{}, fmt.Errorf("no rows in result set") }
+    return swapped(s.hotspots[rand.Intn(len(s.hotspots))]), nil
+}
+
+// swapped is a hotspot the way the Postgres queries return it, ST_X (longitude) in Lat
+func swapped(h common.DataPoint) common.DataPoint {
+    h.Point = common.Coord{Lat: h.Point.Long, Long: h.Point.Lat}
+    return h
+}
+
+// earthRadius is the mean radius in metres, PostGIS uses the spheroid so
+// distances differ from ST_DWithin by well under a percent
+const earthRadius = 6371008.8
+
+// Distance is the great circle distance in metres between two points in degrees
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+    toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+    dLat := toRadians(lat2 - lat1)
+    dLon := toRadians(lon2 - lon1)
+    a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+    return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
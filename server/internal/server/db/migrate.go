@@ -0,0 +1,110 @@
+package db
+
+import (
+    "context"
+    "embed"
+    "fmt"
+    "io/fs"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// The schema, as ordered migrations named <version>_<name>.sql. InitDB applies
+// the ones a database hasn't had yet, so a change to the schema is a new file
+// here, never an edit to one that has been released.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+    Version int
+    Name    string
+    SQL     string
+}
+
+// migrationLockID is the advisory lock held while migrating, so servers
+// starting at the same time don't both apply a migration
+const migrationLockID = 7469616
+
+func loadMigrations() ([]migration, error) {
+    names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+    if err != nil { return nil, fmt.Errorf("Can't list migrations %v\n", err) }
+
+    var migrations []migration
+    for _, name := range names {
+        base := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+        versionString, migrationName, ok := strings.Cut(base, "_")
+        if !ok { return nil, fmt.Errorf("Migration %s isn't named <version>_<name>.sql\n", name) }
+        version, err := strconv.Atoi(versionString)
+        if err != nil { return nil, fmt.Errorf("Migration %s has no version %v\n", name, err) }
+
+        content, err := migrationFiles.ReadFile(name)
+        if err != nil { return nil, fmt.Errorf("Can't read migration %s %v\n", name, err) }
+        migrations = append(migrations, migration{Version: version, Name: migrationName, SQL: string(content)})
+    }
+
+    sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+    for i, m := range migrations {
+        if m.Version != i+1 { return nil, fmt.Errorf("Migration %d_%s is out of sequence, expected version %d\n", m.Version, m.Name, i+1) }
+    }
+    return migrations, nil
+}
+
+// Migrate applies every migration the database hasn't had yet, each in its own
+// transaction along with its row in schema_migrations
+func Migrate(ctx context.Context) error {
+    migrations, err := loadMigrations()
+    if err != nil { return err }
+
+    conn, err := Pool.Acquire(ctx)
+    if err != nil { return fmt.Errorf("Failed to acquire connection: %v\n", err) }
+    defer conn.Release()
+
+    // a session lock, it has to outlive the per migration transactions
+    if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil { return fmt.Errorf("Can't take migration lock %v\n", err) }
+    defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+    _, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+                                version     INT PRIMARY KEY,
+                                name        TEXT NOT NULL,
+                                appliedTime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+                            )`)
+    if err != nil { return fmt.Errorf("Can't create schema_migrations %v\n", err) }
+
+    applied := make(map[int]bool)
+    rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+    if err != nil { return fmt.Errorf("Can't read schema_migrations %v\n", err) }
+    latest := 0
+    for rows.Next() {
+        var version int
+        if err := rows.Scan(&version); err != nil { rows.Close(); return fmt.Errorf("Can't scan migration version %v\n", err) }
+        applied[version] = true
+        if version > latest { latest = version }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return fmt.Errorf("Can't read schema_migrations %v\n", err) }
+
+    if latest > len(migrations) {
+        fmt.Printf("Database is at migration %d but this server only knows %d, it is older than the schema\n", latest, len(migrations))
+    }
+
+    for _, m := range migrations {
+        if applied[m.Version] { continue }
+
+        tx, err := conn.Begin(ctx)
+        if err != nil { return fmt.Errorf("Can't start migration %d %v\n", m.Version, err) }
+        // no arguments, so pgx sends it as a simple query and several statements are fine
+        if _, err := tx.Exec(ctx, m.SQL); err != nil {
+            tx.Rollback(ctx)
+            return fmt.Errorf("Migration %d_%s failed: %v\n", m.Version, m.Name, err)
+        }
+        if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+            tx.Rollback(ctx)
+            return fmt.Errorf("Can't record migration %d %v\n", m.Version, err)
+        }
+        if err := tx.Commit(ctx); err != nil { return fmt.Errorf("Can't commit migration %d %v\n", m.Version, err) }
+        fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+    }
+    return nil
+}
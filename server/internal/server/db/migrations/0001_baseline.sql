@@ -0,0 +1,68 @@
+-- The schema the init scripts created before there were migrations. Everything
+-- is IF NOT EXISTS so it is a no-op on those databases.
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+CREATE TABLE IF NOT EXISTS entries (
+  id             SERIAL PRIMARY KEY,
+  deviceUUID     VARCHAR(36) NOT NULL,
+  payphoneID     VARCHAR(40) NOT NULL,
+  payphoneMAC    VARCHAR(17) NOT NULL,
+  payphoneTime   INT NOT NULL,
+  recordedTime   TIMESTAMP NOT NULL,
+  mapUUID        VARCHAR(40),
+  mapLatitude    DOUBLE PRECISION,
+  mapLongitude   DOUBLE PRECISION,
+  mapLocation    geography(POINT, 4326)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL PRIMARY KEY,
+  pub_key BYTEA,
+  email VARCHAR(255),
+  uuid VARCHAR(36),
+  token VARCHAR(20),
+  username VARCHAR(255),
+  created_timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  hasDevice BOOLEAN DEFAULT FALSE,
+  UNIQUE (uuid)
+);
+
+CREATE TABLE IF NOT EXISTS user_statistics (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    total_payphones INT DEFAULT 0,
+    total_entries INT DEFAULT 0,
+    total_maps INT DEFAULT 0,
+    payphone_rank INT DEFAULT 0,
+    entry_rank INT DEFAULT 0,
+    map_rank INT DEFAULT 0,
+    last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users (uuid),
+    UNIQUE (user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_statistics_user_id ON user_statistics (user_id);
+
+-- filled from the hotspot CSV by the init scripts
+CREATE TABLE IF NOT EXISTS telstra_hotspots (
+  uuid VARCHAR(36) PRIMARY KEY,
+  location geography(POINT, 4326) NOT NULL,
+  street_address VARCHAR(255),
+  alias VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS idx_location ON telstra_hotspots USING gist (location);
+
+-- notifies ListenForDBInserts when an entry is added
+CREATE OR REPLACE FUNCTION notify_insert()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('new_entry', NEW.deviceuuid);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trigger_notify_insert ON entries;
+CREATE TRIGGER trigger_notify_insert
+AFTER INSERT ON entries
+FOR EACH ROW EXECUTE FUNCTION notify_insert();
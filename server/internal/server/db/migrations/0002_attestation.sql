@@ -0,0 +1,3 @@
+-- per device HMAC secret issued at enrollment, 0 is the legacy attestation
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_secret VARCHAR(64);
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS attestationVersion INT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- raw captive portal URL the device read the payphone fields from, kept for forensics
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS portalURL TEXT;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS portalURLParser INT NOT NULL DEFAULT 0;
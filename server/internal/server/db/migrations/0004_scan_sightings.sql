@@ -0,0 +1,14 @@
+-- payphone hotspots heard in a passive wifi scan, lower confidence than entries
+-- since the device never got through the portal
+CREATE TABLE IF NOT EXISTS scan_sightings (
+  id             SERIAL PRIMARY KEY,
+  deviceUUID     VARCHAR(36) NOT NULL,
+  bssid          VARCHAR(17) NOT NULL,
+  ssid           VARCHAR(32) NOT NULL,
+  signal         DOUBLE PRECISION NOT NULL,
+  frequency      INT NOT NULL,
+  seenTime       TIMESTAMP NOT NULL,
+  recordedTime   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_scan_sightings_bssid ON scan_sightings (bssid);
@@ -0,0 +1,10 @@
+-- GPS fix from the device, accurate ones also fill in the map location
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS gpsLatitude DOUBLE PRECISION;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS gpsLongitude DOUBLE PRECISION;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS gpsAccuracy DOUBLE PRECISION;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS gpsTime TIMESTAMP;
+
+ALTER TABLE scan_sightings ADD COLUMN IF NOT EXISTS gpsLatitude DOUBLE PRECISION;
+ALTER TABLE scan_sightings ADD COLUMN IF NOT EXISTS gpsLongitude DOUBLE PRECISION;
+ALTER TABLE scan_sightings ADD COLUMN IF NOT EXISTS gpsAccuracy DOUBLE PRECISION;
+ALTER TABLE scan_sightings ADD COLUMN IF NOT EXISTS gpsTime TIMESTAMP;
@@ -0,0 +1,3 @@
+-- wifi interface that saw it, devices can have several radios
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS deviceInterface VARCHAR(15);
+ALTER TABLE scan_sightings ADD COLUMN IF NOT EXISTS deviceInterface VARCHAR(15);
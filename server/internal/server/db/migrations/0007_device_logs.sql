@@ -0,0 +1,11 @@
+-- recent daemon logs uploaded by devices, pruned by the server
+CREATE TABLE IF NOT EXISTS device_logs (
+  id             BIGSERIAL PRIMARY KEY,
+  deviceUUID     VARCHAR(36) NOT NULL,
+  loggedTime     TIMESTAMP NOT NULL,
+  level          VARCHAR(16) NOT NULL DEFAULT '',
+  message        TEXT NOT NULL,
+  receivedTime   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_logs_device_time ON device_logs (deviceUUID, loggedTime);
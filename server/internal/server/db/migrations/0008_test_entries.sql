@@ -0,0 +1,21 @@
+-- test submissions from devices, verified like entries but never counted and
+-- deleted by the server once expiresTime passes
+CREATE TABLE IF NOT EXISTS test_entries (
+  id                 SERIAL PRIMARY KEY,
+  deviceUUID         VARCHAR(36) NOT NULL,
+  payphoneID         VARCHAR(40) NOT NULL,
+  payphoneMAC        VARCHAR(17) NOT NULL,
+  payphoneTime       BIGINT NOT NULL,
+  recordedTime       TIMESTAMP NOT NULL,
+  attestationVersion INT NOT NULL DEFAULT 0,
+  portalURL          TEXT,
+  portalURLParser    INT NOT NULL DEFAULT 0,
+  gpsLatitude        DOUBLE PRECISION,
+  gpsLongitude       DOUBLE PRECISION,
+  gpsAccuracy        DOUBLE PRECISION,
+  deviceInterface    VARCHAR(15),
+  receivedTime       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expiresTime        TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_test_entries_expires ON test_entries (expiresTime);
@@ -0,0 +1,17 @@
+-- which hotspot each payphone is, learned from users placing entries and from
+-- accurate GPS fixes next to a hotspot. New entries for a payphone in here are
+-- located from it.
+CREATE TABLE IF NOT EXISTS payphone_identity (
+  payphoneID     VARCHAR(40) PRIMARY KEY,
+  payphoneMAC    VARCHAR(17) NOT NULL,
+  mapUUID        VARCHAR(40) NOT NULL,
+  latitude       DOUBLE PRECISION NOT NULL,
+  longitude      DOUBLE PRECISION NOT NULL,
+  confirmations  INT NOT NULL DEFAULT 0,
+  gpsMatches     INT NOT NULL DEFAULT 0,
+  updatedTime    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- how sure payphone_identity was when it located the entry, NULL when the
+-- device's GPS or a user placed it
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS locationConfidence DOUBLE PRECISION;
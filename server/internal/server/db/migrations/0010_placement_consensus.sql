@@ -0,0 +1,23 @@
+-- each user's vote for where a payphone is, placing it again moves their vote
+CREATE TABLE IF NOT EXISTS placement_votes (
+  payphoneID  VARCHAR(40) NOT NULL,
+  voterUUID   VARCHAR(36) NOT NULL,
+  mapUUID     VARCHAR(40) NOT NULL,
+  votedTime   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (payphoneID, voterUUID)
+);
+
+-- payphones users have placed at different hotspots, open until one of them
+-- reaches consensus or the disagreement goes away
+CREATE TABLE IF NOT EXISTS placement_conflicts (
+  id               SERIAL PRIMARY KEY,
+  payphoneID       VARCHAR(40) NOT NULL,
+  openedTime       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  resolvedTime     TIMESTAMP,
+  resolvedMapUUID  VARCHAR(40)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_placement_conflicts_open ON placement_conflicts (payphoneID) WHERE resolvedTime IS NULL;
+
+-- the identity's hotspot has enough votes to be the payphone's canonical placement
+ALTER TABLE payphone_identity ADD COLUMN IF NOT EXISTS canonical BOOLEAN NOT NULL DEFAULT FALSE;
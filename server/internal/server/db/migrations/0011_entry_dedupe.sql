@@ -0,0 +1,7 @@
+-- an entry is one discovery. The same device seeing the same payphone again
+-- within DUPLICATE_ENTRY_WINDOW of the last time, or sending the same
+-- payphoneTime again, is counted here instead of adding a row.
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS seenAgain INT NOT NULL DEFAULT 0;
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS lastSeenTime TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_entries_device_payphone ON entries (deviceUUID, payphoneID);
@@ -0,0 +1,25 @@
+-- every import of the hotspot CSV, the highest version is the current dataset
+CREATE TABLE IF NOT EXISTS hotspot_datasets (
+  version       SERIAL PRIMARY KEY,
+  source        TEXT NOT NULL,
+  sha256        VARCHAR(64) NOT NULL,
+  importedTime  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  total         INT NOT NULL DEFAULT 0,
+  added         INT NOT NULL DEFAULT 0,
+  moved         INT NOT NULL DEFAULT 0,
+  removed       INT NOT NULL DEFAULT 0
+);
+
+-- what each import changed. Locations are NULL where there wasn't one.
+CREATE TABLE IF NOT EXISTS hotspot_changes (
+  version      INT NOT NULL REFERENCES hotspot_datasets (version),
+  uuid         VARCHAR(36) NOT NULL,
+  change       VARCHAR(10) NOT NULL,
+  oldLocation  geography(POINT, 4326),
+  newLocation  geography(POINT, 4326),
+  PRIMARY KEY (version, uuid)
+);
+
+-- hotspots missing from a later dataset are kept, so entries, votes and
+-- identities that reference them still resolve, but they aren't offered any more
+ALTER TABLE telstra_hotspots ADD COLUMN IF NOT EXISTS removedVersion INT REFERENCES hotspot_datasets (version);
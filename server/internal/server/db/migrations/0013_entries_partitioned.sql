@@ -0,0 +1,60 @@
+-- entries becomes partitioned by month of recordedTime. The old heap table is
+-- copied across and dropped. recordedTime is the device's clock, so rows
+-- outside any month's partition (a clock years out) land in entries_default.
+-- A partition's primary key has to include the partition key, ids still come
+-- from the one sequence so id alone stays unique.
+ALTER TABLE entries RENAME TO entries_heap;
+ALTER SEQUENCE entries_id_seq OWNED BY NONE;
+DROP TRIGGER IF EXISTS trigger_notify_insert ON entries_heap;
+
+CREATE TABLE entries (LIKE entries_heap INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY RANGE (recordedTime);
+ALTER TABLE entries ADD PRIMARY KEY (id, recordedTime);
+CREATE TABLE entries_default PARTITION OF entries DEFAULT;
+
+-- create_entries_partition adds the partition for the month containing
+-- forTime, named entries_YYYY_MM, and returns false if it was already there.
+-- Rows for that month already in entries_default are moved into it before
+-- it's attached, which doesn't fire trigger_notify_insert.
+CREATE OR REPLACE FUNCTION create_entries_partition(forTime TIMESTAMP)
+RETURNS BOOLEAN AS $$
+DECLARE
+    rangeStart    TIMESTAMP := date_trunc('month', forTime);
+    rangeEnd      TIMESTAMP := date_trunc('month', forTime) + INTERVAL '1 month';
+    partitionName TEXT := 'entries_' || to_char(date_trunc('month', forTime), 'YYYY_MM');
+BEGIN
+    IF to_regclass(partitionName) IS NOT NULL THEN
+        RETURN FALSE;
+    END IF;
+    EXECUTE format('CREATE TABLE %I (LIKE entries INCLUDING DEFAULTS INCLUDING CONSTRAINTS)', partitionName);
+    EXECUTE format('INSERT INTO %I SELECT * FROM entries_default WHERE recordedTime >= %L AND recordedTime < %L', partitionName, rangeStart, rangeEnd);
+    DELETE FROM entries_default WHERE recordedTime >= rangeStart AND recordedTime < rangeEnd;
+    EXECUTE format('ALTER TABLE entries ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)', partitionName, rangeStart, rangeEnd);
+    RETURN TRUE;
+END;
+$$ LANGUAGE plpgsql;
+
+-- a partition for every month of the last ten years that has entries, and the
+-- next two, older and later rows stay in entries_default
+SELECT create_entries_partition(month)
+FROM (SELECT DISTINCT date_trunc('month', recordedTime) AS month FROM entries_heap
+      WHERE recordedTime >= LOCALTIMESTAMP - INTERVAL '10 years' AND recordedTime < LOCALTIMESTAMP + INTERVAL '3 months'
+      UNION SELECT date_trunc('month', LOCALTIMESTAMP) + make_interval(months => n) FROM generate_series(0, 2) AS n) months
+ORDER BY month;
+
+INSERT INTO entries SELECT * FROM entries_heap;
+DROP TABLE entries_heap;
+ALTER SEQUENCE entries_id_seq OWNED BY entries.id;
+
+-- created on entries, so every partition gets its own. Duplicate matching and
+-- the leaderboard's distinct payphones per device
+CREATE INDEX IF NOT EXISTS idx_entries_device_payphone ON entries (deviceUUID, payphoneID);
+-- DBGetEntriesWithUUID and the per user statistics
+CREATE INDEX IF NOT EXISTS idx_entries_device_recorded ON entries (deviceUUID, recordedTime);
+-- DBGetRecentEntry and duplicate matching look at when an entry was last seen
+CREATE INDEX IF NOT EXISTS idx_entries_device_last_seen ON entries (deviceUUID, (COALESCE(lastSeenTime, recordedTime)));
+-- entries placed at a hotspot, hotspot imports count them
+CREATE INDEX IF NOT EXISTS idx_entries_map_uuid ON entries (mapUUID) WHERE mapUUID IS NOT NULL;
+
+CREATE TRIGGER trigger_notify_insert
+AFTER INSERT ON entries
+FOR EACH ROW EXECUTE FUNCTION notify_insert();
@@ -0,0 +1,29 @@
+-- a user who asked for their account to be deleted. Their device is revoked
+-- then, and the account is erased once deletionDueTime passes unless they cancel.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletionRequestedTime TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletionDueTime TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_users_deletion_due ON users (deletionDueTime) WHERE deletionDueTime IS NOT NULL;
+
+-- what an erased account added up to, with nothing that leads back to the user,
+-- so totals over everyone who ever took part still add up
+CREATE TABLE IF NOT EXISTS account_tombstones (
+  id               SERIAL PRIMARY KEY,
+  joinedMonth      DATE,
+  erasedTime       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  total_payphones  INT NOT NULL DEFAULT 0,
+  total_entries    INT NOT NULL DEFAULT 0,
+  total_maps       INT NOT NULL DEFAULT 0
+);
+
+-- every deletion request, cancellation and erasure. subjectHash is the sha256 of
+-- the user's uuid, so a user can be shown their erasure without it keeping the uuid.
+CREATE TABLE IF NOT EXISTS account_audit (
+  id           SERIAL PRIMARY KEY,
+  subjectHash  VARCHAR(64) NOT NULL,
+  action       VARCHAR(20) NOT NULL,
+  actionTime   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  detail       JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_audit_subject ON account_audit (subjectHash);
@@ -0,0 +1,8 @@
+-- votes per payphone and hotspot, settling a placement and listing conflicts
+-- both count from here. A user's vote counts once, and only while they still
+-- have an entry for the payphone.
+CREATE OR REPLACE VIEW placement_tally AS
+  SELECT v.payphoneID, v.mapUUID, COUNT(DISTINCT v.voterUUID) AS votes, MAX(v.votedTime) AS lastVote
+  FROM placement_votes v
+  WHERE EXISTS (SELECT 1 FROM entries e WHERE e.deviceUUID = v.voterUUID AND e.payphoneID = v.payphoneID)
+  GROUP BY v.payphoneID, v.mapUUID;
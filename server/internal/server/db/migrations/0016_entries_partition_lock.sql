@@ -0,0 +1,24 @@
+-- create_entries_partition from 0013, locking entries_default before moving
+-- rows out of it. Without the lock an entry for the month could land in
+-- entries_default between the DELETE and the ATTACH, which then fails, and so
+-- would every daily run after it. SHARE ROW EXCLUSIVE holds off inserts into
+-- entries_default until the transaction ends, entries for other months go
+-- to their own partitions and don't wait.
+CREATE OR REPLACE FUNCTION create_entries_partition(forTime TIMESTAMP)
+RETURNS BOOLEAN AS $$
+DECLARE
+    rangeStart    TIMESTAMP := date_trunc('month', forTime);
+    rangeEnd      TIMESTAMP := date_trunc('month', forTime) + INTERVAL '1 month';
+    partitionName TEXT := 'entries_' || to_char(date_trunc('month', forTime), 'YYYY_MM');
+BEGIN
+    IF to_regclass(partitionName) IS NOT NULL THEN
+        RETURN FALSE;
+    END IF;
+    LOCK TABLE entries_default IN SHARE ROW EXCLUSIVE MODE;
+    EXECUTE format('CREATE TABLE %I (LIKE entries INCLUDING DEFAULTS INCLUDING CONSTRAINTS)', partitionName);
+    EXECUTE format('INSERT INTO %I SELECT * FROM entries_default WHERE recordedTime >= %L AND recordedTime < %L', partitionName, rangeStart, rangeEnd);
+    DELETE FROM entries_default WHERE recordedTime >= rangeStart AND recordedTime < rangeEnd;
+    EXECUTE format('ALTER TABLE entries ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)', partitionName, rangeStart, rangeEnd);
+    RETURN TRUE;
+END;
+$$ LANGUAGE plpgsql;
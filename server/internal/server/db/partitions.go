@@ -0,0 +1,165 @@
+package db
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+)
+
+// entries is partitioned by month of recordedTime (migration 0013), one
+// entries_YYYY_MM table a month plus entries_default for rows from a device
+// clock that's far out. Partitions are created ahead of time so entries_default
+// stays small. Once a month is ENTRY_ARCHIVE_MONTHS old its partition is moved
+// to ENTRY_ARCHIVE_TABLESPACE, meant to be on cheaper disk. Nothing here
+// compresses it, it only shrinks if that tablespace's filesystem compresses.
+// It stays attached, so the leaderboard and statistics still see it.
+
+const (
+    // entryPartitionsAhead is how many months after this one have partitions
+    entryPartitionsAhead = 2
+    defaultEntryArchiveMonths = 12
+)
+
+func EntryArchiveMonths() int {
+    return envInt("ENTRY_ARCHIVE_MONTHS", defaultEntryArchiveMonths)
+}
+
+// EntryArchiveTablespace is where old partitions go, "" leaves them where they are
+func EntryArchiveTablespace() string {
+    return os.Getenv("ENTRY_ARCHIVE_TABLESPACE")
+}
+
+type EntryPartition struct {
+    Name string
+    // Month is the first instant of the month the partition holds
+    Month time.Time
+    // Tablespace is "" for the database's default tablespace
+    Tablespace string
+    // Rows is Postgres's estimate, -1 before the partition was first analysed
+    Rows  int64
+    Bytes int64
+}
+
+// ListEntryPartitions returns the monthly partitions of entries, oldest first,
+// entries_default isn't one of them
+func ListEntryPartitions(ctx context.Context) ([]EntryPartition, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    rows, err := Pool.Query(ctx, `SELECT c.relname, COALESCE(t.spcname, ''), c.reltuples::BIGINT, pg_total_relation_size(c.oid)
+                                  FROM pg_inherits i
+                                  JOIN pg_class c ON c.oid = i.inhrelid
+                                  LEFT JOIN pg_tablespace t ON t.oid = c.reltablespace
+                                  WHERE i.inhparent = 'entries'::regclass AND c.relname <> 'entries_default'
+                                  ORDER BY c.relname`)
+    if err != nil { return nil, fmt.Errorf("Can't list entry partitions %v\n", err) }
+    defer rows.Close()
+
+    var partitions []EntryPartition
+    for rows.Next() {
+        var p EntryPartition
+        if err := rows.Scan(&p.Name, &p.Tablespace, &p.Rows, &p.Bytes); err != nil { return nil, fmt.Errorf("Can't scan entry partition %v\n", err) }
+        p.Month, err = time.Parse("entries_2006_01", p.Name)
+        if err != nil { return nil, fmt.Errorf("Entry partition %s isn't named for a month\n", p.Name) }
+        partitions = append(partitions, p)
+    }
+    if err := rows.Err(); err != nil { return nil, fmt.Errorf("Can't list entry partitions %v\n", err) }
+    return partitions, nil
+}
+
+// CreateEntryPartitions makes sure this month and the next entryPartitionsAhead
+// have partitions, returning the ones it created
+func CreateEntryPartitions(ctx context.Context, now time.Time) ([]string, error) {
+    ctx, cancel := queryContext(ctx)
+    defer cancel()
+    month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+    var created []string
+    for i := 0; i <= entryPartitionsAhead; i++ {
+        forTime := month.AddDate(0, i, 0)
+        var added bool
+        // recordedTime is a TIMESTAMP, pass the month as one so the server's zone doesn't shift it
+        err := Pool.QueryRow(ctx, "SELECT create_entries_partition($1::TEXT::TIMESTAMP)", forTime.Format("2006-01-02")).Scan(&added)
+        if err != nil { return created, fmt.Errorf("Can't create entry partition for %s %v\n", forTime.Format("2006-01"), err) }
+        if added { created = append(created, forTime.Format("entries_2006_01")) }
+    }
+    return created, nil
+}
+
+// ArchiveEntryPartitions moves the partitions of months that ended more than
+// months ago, and their indexes, to tablespace. Moving rewrites the partition
+// and holds an exclusive lock on it until done, so a month is done at a time.
+// Returns the partitions that were (or with dryRun would be) moved.
+func ArchiveEntryPartitions(ctx context.Context, now time.Time, months int, tablespace string, dryRun bool) ([]EntryPartition, error) {
+    if tablespace == "" { return nil, fmt.Errorf("No tablespace to archive entries to\n") }
+    partitions, err := ListEntryPartitions(ctx)
+    if err != nil { return nil, err }
+
+    cutoff := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -months, 0)
+    var archived []EntryPartition
+    for _, p := range partitions {
+        if !p.Month.AddDate(0, 1, 0).Before(cutoff) || p.Tablespace == tablespace { continue }
+        archived = append(archived, p)
+        if dryRun { continue }
+        if err := moveEntryPartition(ctx, p.Name, tablespace); err != nil { return archived[:len(archived)-1], err }
+    }
+    return archived, nil
+}
+
+// moveEntryPartition isn't bound by the query timeout, a big month takes a while
+func moveEntryPartition(ctx context.Context, name, tablespace string) error {
+    tx, err := Pool.Begin(ctx)
+    if err != nil { return fmt.Errorf("Can't start archiving %s %v\n", name, err) }
+    defer tx.Rollback(ctx)
+
+    var indexes []string
+    rows, err := tx.Query(ctx, "SELECT indexrelid::regclass::text FROM pg_index WHERE indrelid = $1::regclass", name)
+    if err != nil { return fmt.Errorf("Can't list indexes of %s %v\n", name, err) }
+    for rows.Next() {
+        var index string
+        if err := rows.Scan(&index); err != nil { rows.Close(); return fmt.Errorf("Can't scan index of %s %v\n", name, err) }
+        indexes = append(indexes, index)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return fmt.Errorf("Can't list indexes of %s %v\n", name, err) }
+
+    space := pgx.Identifier{tablespace}.Sanitize()
+    if _, err := tx.Exec(ctx, "ALTER TABLE " + pgx.Identifier{name}.Sanitize() + " SET TABLESPACE " + space); err != nil { return fmt.Errorf("Can't move %s to %s %v\n", name, tablespace, err) }
+    for _, index := range indexes {
+        // regclass text is already quoted where it needs to be
+        if _, err := tx.Exec(ctx, "ALTER INDEX " + index + " SET TABLESPACE " + space); err != nil { return fmt.Errorf("Can't move index %s to %s %v\n", index, tablespace, err) }
+    }
+    if err := tx.Commit(ctx); err != nil { return fmt.Errorf("Can't commit archiving %s %v\n", name, err) }
+
+    // the month won't change much again, freeze it so scans of it skip the
+    // visibility checks and the statistics queries can use index only scans
+    if _, err := Pool.Exec(ctx, "VACUUM (FREEZE, ANALYZE) " + pgx.Identifier{name}.Sanitize()); err != nil {
+        fmt.Printf("Archived %s but couldn't vacuum it: %v\n", name, err)
+    }
+    return nil
+}
+
+func maintainEntryPartitions(ctx context.Context) {
+    months := EntryArchiveMonths()
+    tablespace := EntryArchiveTablespace()
+
+    for {
+        created, err := CreateEntryPartitions(ctx, time.Now())
+        if err != nil {
+            fmt.Printf("Error creating entry partitions: %v\n", err)
+        } else if len(created) > 0 {
+            fmt.Println("Created entry partitions", strings.Join(created, ", "))
+        }
+
+        if tablespace != "" {
+            archived, err := ArchiveEntryPartitions(ctx, time.Now(), months, tablespace, false)
+            if err != nil { fmt.Printf("Error archiving entry partitions: %v\n", err) }
+            for _, p := range archived { fmt.Println("Archived", p.Name, "to", tablespace) }
+        }
+
+        if !sleep(ctx, 24 * time.Hour) { return }
+    }
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+    "context"
+    "time"
+
+    "server-indicum/internal/common"
+)
+
+// Store is everything the HTTP and device servers read and write. Postgres is
+// the real one, memstore keeps it all in memory so the servers can be run and
+// tested without a database.
+type Store interface {
+    // users and enrollment
+    AddUser(ctx context.Context, uuid, email string) error
+    GetUserProfile(ctx context.Context, uuid string) (map[string]string, error)
+    // SavePubKey enrolls the device of the user with token, returns their uuid and the new device secret
+    SavePubKey(ctx context.Context, token string, pubKey string) (string, string, error)
+    FindDeviceRSAPub(ctx context.Context, deviceUUID string) ([]byte, error)
+    FindDeviceSecret(ctx context.Context, deviceUUID string) (string, error)
+    // RequestAccountDeletion revokes the user's device and schedules their erasure, returns when it's due
+    RequestAccountDeletion(ctx context.Context, uuid string, grace time.Duration) (time.Time, error)
+    // CancelAccountDeletion returns ErrNoDeletionPending if there was nothing to cancel
+    CancelAccountDeletion(ctx context.Context, uuid string) error
+
+    InitializeUserStatistics(ctx context.Context, uuid string) error
+    GetStatistics(ctx context.Context, uuid string) (common.Statistics, error)
+    GetLeaderboard(ctx context.Context) ([]common.LeaderboardVal, error)
+
+    // entries and what devices send
+    AddEntry(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int) (int64, error)
+    AddTestEntry(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int, ttl time.Duration) (int64, time.Time, error)
+    GetRecentEntry(ctx context.Context, uuid string) (common.Entry, error)
+    GetEntriesWithUUID(ctx context.Context, deviceUUID string) ([]common.Entry, error)
+    // ExportEntries calls each with the device's entries recorded in [from, to), unix seconds and 0 for no bound, oldest first
+    ExportEntries(ctx context.Context, deviceUUID string, from, to int64, each func(common.ExportEntry) error) error
+    // AddMapUUIDEntry and UpdateLocation return ErrEntryNotFound unless the entry is deviceUUID's
+    AddMapUUIDEntry(ctx context.Context, deviceUUID string, entryID int, mapUUID string) error
+    UpdateLocation(ctx context.Context, deviceUUID string, entryID int, latitude, longitude string) error
+    AddScanSightings(ctx context.Context, report common.ScanReport, deviceUUID string) (int, error)
+    AddDeviceLogs(ctx context.Context, deviceUUID string, records []common.LogRecord) (int64, error)
+    GetDeviceLogs(ctx context.Context, deviceUUID string, since int64, limit int) ([]common.DeviceLog, error)
+    GetPlacementConflicts(ctx context.Context) ([]common.PlacementConflict, error)
+
+    // hotspots
+    GetNearbyHotspots(ctx context.Context, lat, lon float64) ([]common.DataPoint, error)
+    GetRandomPoint(ctx context.Context) (common.DataPoint, error)
+}
+
+// Postgres is the Store on Pool, InitDB has to have been called
+type Postgres struct{}
+
+var _ Store = Postgres{}
+
+func (Postgres) AddUser(ctx context.Context, uuid, email string) error { return DBAddUser(ctx, uuid, email) }
+func (Postgres) GetUserProfile(ctx context.Context, uuid string) (map[string]string, error) { return DBGetUserProfile(ctx, uuid) }
+func (Postgres) SavePubKey(ctx context.Context, token string, pubKey string) (string, string, error) { return DBSavePubKey(ctx, token, pubKey) }
+func (Postgres) FindDeviceRSAPub(ctx context.Context, deviceUUID string) ([]byte, error) { return DBFindDeviceRSAPub(ctx, deviceUUID) }
+func (Postgres) FindDeviceSecret(ctx context.Context, deviceUUID string) (string, error) { return DBFindDeviceSecret(ctx, deviceUUID) }
+
+func (Postgres) RequestAccountDeletion(ctx context.Context, uuid string, grace time.Duration) (time.Time, error) {
+    return DBRequestAccountDeletion(ctx, uuid, grace)
+}
+
+func (Postgres) CancelAccountDeletion(ctx context.Context, uuid string) error { return DBCancelAccountDeletion(ctx, uuid) }
+
+func (Postgres) InitializeUserStatistics(ctx context.Context, uuid string) error { return DBInitializeUserStatistics(ctx, uuid) }
+func (Postgres) GetStatistics(ctx context.Context, uuid string) (common.Statistics, error) { return DBGetStatistics(ctx, uuid) }
+func (Postgres) GetLeaderboard(ctx context.Context) ([]common.LeaderboardVal, error) { return DBGetLeaderboard(ctx) }
+
+func (Postgres) AddEntry(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int) (int64, error) {
+    return AddEntryToDB(ctx, entry, deviceUUID, attestationVersion, portalURLParser)
+}
+
+func (Postgres) AddTestEntry(ctx context.Context, entry common.Payload, deviceUUID string, attestationVersion int, portalURLParser int, ttl time.Duration) (int64, time.Time, error) {
+    return DBAddTestEntry(ctx, entry, deviceUUID, attestationVersion, portalURLParser, ttl)
+}
+
+func (Postgres) GetRecentEntry(ctx context.Context, uuid string) (common.Entry, error) { return DBGetRecentEntry(ctx, uuid) }
+func (Postgres) GetEntriesWithUUID(ctx context.Context, deviceUUID string) ([]common.Entry, error) { return DBGetEntriesWithUUID(ctx, deviceUUID) }
+
+func (Postgres) ExportEntries(ctx context.Context, deviceUUID string, from, to int64, each func(common.ExportEntry) error) error {
+    return DBExportEntries(ctx, deviceUUID, from, to, each)
+}
+
+func (Postgres) AddMapUUIDEntry(ctx context.Context, deviceUUID string, entryID int, mapUUID string) error { return DBAddMapUUIDEntry(ctx, deviceUUID, entryID, mapUUID) }
+func (Postgres) UpdateLocation(ctx context.Context, deviceUUID string, entryID int, latitude, longitude string) error { return DBUpdateLocation(ctx, deviceUUID, entryID, latitude, longitude) }
+func (Postgres) AddScanSightings(ctx context.Context, report common.ScanReport, deviceUUID string) (int, error) { return DBAddScanSightings(ctx, report, deviceUUID) }
+func (Postgres) AddDeviceLogs(ctx context.Context, deviceUUID string, records []common.LogRecord) (int64, error) { return DBAddDeviceLogs(ctx, deviceUUID, records) }
+
+func (Postgres) GetDeviceLogs(ctx context.Context, deviceUUID string, since int64, limit int) ([]common.DeviceLog, error) {
+    return DBGetDeviceLogs(ctx, deviceUUID, since, limit)
+}
+
+func (Postgres) GetPlacementConflicts(ctx context.Context) ([]common.PlacementConflict, error) { return DBGetPlacementConflicts(ctx) }
+
+func (Postgres) GetNearbyHotspots(ctx context.Context, lat, lon float64) ([]common.DataPoint, error) { return DBGetNearbyHotspots(ctx, lat, lon) }
+func (Postgres) GetRandomPoint(ctx context.Context) (common.DataPoint, error) { return DBGetRandomPoint(ctx) }
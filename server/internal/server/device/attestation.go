@@ -0,0 +1,54 @@
+package device
+
+import (
+    "context"
+    "fmt"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+
+    "server-indicum/internal/common"
+)
+
+// verifyAttestation checks the payload was produced by the enrolled device and
+// returns the attestation version to store with the entry.
+//
+// Version 0 is the old ForgeResistance hash. Anyone who has read the repo can
+// compute it, so those entries are accepted but stored as version 0 (flagged).
+// Once a device has a secret it has to send an HMAC, version 0 from it is
+// treated as a downgrade and rejected.
+func verifyAttestation(ctx context.Context, dataPayload common.Payload, deviceUUID string, devices Devices) (int, error) {
+    secret, err := devices.Secret(ctx, deviceUUID)
+    if err != nil { return 0, err }
+
+    switch dataPayload.AttestationVersion {
+        case common.AttestationLegacy:
+            if secret != "" { return 0, fmt.Errorf("Device %s is enrolled with a secret but sent a legacy attestation\n", deviceUUID) }
+            if !legacyForgeResistanceValid(dataPayload) { return 0, fmt.Errorf("Tampering/Forgery detected\n") }
+            fmt.Println("Accepting legacy attestation from", deviceUUID, "entry will be flagged")
+            return common.AttestationLegacy, nil
+
+        case common.AttestationHMACv1:
+            if secret == "" { return 0, fmt.Errorf("Device %s has no enrolled secret\n", deviceUUID) }
+            mac := hmac.New(sha256.New, []byte(secret))
+            mac.Write(common.AttestationMessage(common.AttestationHMACv1, dataPayload, deviceUUID))
+            expected := mac.Sum(nil)
+
+            got, err := hex.DecodeString(dataPayload.Attestation)
+            if err != nil || !hmac.Equal(got, expected) { return 0, fmt.Errorf("Attestation mismatch for %s, tampering/forgery detected\n", deviceUUID) }
+            return common.AttestationHMACv1, nil
+
+        default:
+            return 0, fmt.Errorf("Unknown attestation version %d\n", dataPayload.AttestationVersion)
+    }
+}
+
+func legacyForgeResistanceValid(dataPayload common.Payload) bool {
+    if len(dataPayload.PayphoneID) <= 6 { return false }
+    forgeString := dataPayload.PayphoneID[3:len(dataPayload.PayphoneID)-3] + "_forge_resistance"
+    forgeResistanceHash := sha256.New()
+    forgeResistanceHash.Write([]byte(forgeString))
+    forgeHashString := hex.EncodeToString(forgeResistanceHash.Sum(nil))
+
+    return forgeHashString == dataPayload.ForgeResistance
+}
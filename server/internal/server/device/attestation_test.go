@@ -0,0 +1,107 @@
+package device
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "testing"
+
+    "server-indicum/internal/common"
+)
+
+// fakeDevices has the attestation secret of each device, "" for one enrolled before secrets
+type fakeDevices map[string]string
+
+func (d fakeDevices) PublicKey(ctx context.Context, deviceUUID string) (*rsa.PublicKey, error) {
+    return nil, fmt.Errorf("No public key for %s", deviceUUID)
+}
+
+func (d fakeDevices) Secret(ctx context.Context, deviceUUID string) (string, error) {
+    secret, ok := d[deviceUUID]
+    if !ok { return "", fmt.Errorf("No device %s", deviceUUID) }
+    return secret, nil
+}
+
+// attest signs data the way the client does
+func attest(data common.Payload, secret, deviceUUID string) common.Payload {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(common.AttestationMessage(common.AttestationHMACv1, data, deviceUUID))
+    data.AttestationVersion = common.AttestationHMACv1
+    data.Attestation = hex.EncodeToString(mac.Sum(nil))
+    return data
+}
+
+// legacy is data with the ForgeResistance hash of clients before device secrets
+func legacy(data common.Payload) common.Payload {
+    sum := sha256.Sum256([]byte(data.PayphoneID[3:len(data.PayphoneID)-3] + "_forge_resistance"))
+    data.ForgeResistance = hex.EncodeToString(sum[:])
+    return data
+}
+
+func TestVerifyAttestation(t *testing.T) {
+    devices := fakeDevices{"enrolled": "device-secret", "old": ""}
+    payload := common.Payload{PayphoneMAC: "aa:bb:cc:dd:ee:ff", PayphoneID: "0312345678", PayphoneTime: 1700000000, Time: 1700000005,
+                              PortalURL: "https://portal.example/login?ap=0312345678", Fix: &common.Fix{Lat: -37.8136, Long: 144.9631, Accuracy: 4.5, Time: 1700000004},
+                              Interface: "wlan1"}
+    signed := attest(payload, "device-secret", "enrolled")
+
+    // tamper changes the signed payload after it was attested
+    tamper := func(change func(p *common.Payload)) common.Payload {
+        p := signed
+        change(&p)
+        return p
+    }
+
+    tests := []struct {
+        name     string
+        device   string
+        payload  common.Payload
+        version  int
+        // err is part of the error, empty when the attestation should verify
+        err      string
+    }{
+        {"HMAC", "enrolled", signed, common.AttestationHMACv1, ""},
+        {"HMAC test submission", "enrolled", attest(common.Payload{PayphoneID: "0312345678", Test: true}, "device-secret", "enrolled"), common.AttestationHMACv1, ""},
+        {"tampered PayphoneMAC", "enrolled", tamper(func(p *common.Payload) { p.PayphoneMAC = "aa:bb:cc:dd:ee:00" }), 0, "Attestation mismatch"},
+        {"tampered PayphoneID", "enrolled", tamper(func(p *common.Payload) { p.PayphoneID = "0312345679" }), 0, "Attestation mismatch"},
+        {"tampered PayphoneTime", "enrolled", tamper(func(p *common.Payload) { p.PayphoneTime++ }), 0, "Attestation mismatch"},
+        {"tampered Time", "enrolled", tamper(func(p *common.Payload) { p.Time++ }), 0, "Attestation mismatch"},
+        {"tampered PortalURL", "enrolled", tamper(func(p *common.Payload) { p.PortalURL = "https://portal.example/login?ap=0399999999" }), 0, "Attestation mismatch"},
+        {"removed PortalURL", "enrolled", tamper(func(p *common.Payload) { p.PortalURL = "" }), 0, "Attestation mismatch"},
+        {"moved Fix", "enrolled", tamper(func(p *common.Payload) { p.Fix = &common.Fix{Lat: -37.8183, Long: 144.9631, Accuracy: 4.5, Time: 1700000004} }), 0, "Attestation mismatch"},
+        {"tampered Fix accuracy", "enrolled", tamper(func(p *common.Payload) { p.Fix = &common.Fix{Lat: -37.8136, Long: 144.9631, Accuracy: 1, Time: 1700000004} }), 0, "Attestation mismatch"},
+        {"removed Fix", "enrolled", tamper(func(p *common.Payload) { p.Fix = nil }), 0, "Attestation mismatch"},
+        {"tampered Interface", "enrolled", tamper(func(p *common.Payload) { p.Interface = "wlan0" }), 0, "Attestation mismatch"},
+        {"removed Interface", "enrolled", tamper(func(p *common.Payload) { p.Interface = "" }), 0, "Attestation mismatch"},
+        {"set Test", "enrolled", tamper(func(p *common.Payload) { p.Test = true }), 0, "Attestation mismatch"},
+        {"wrong secret", "enrolled", attest(payload, "another-secret", "enrolled"), 0, "Attestation mismatch"},
+        {"another device's attestation", "enrolled", attest(payload, "device-secret", "other"), 0, "Attestation mismatch"},
+        {"not hex", "enrolled", tamper(func(p *common.Payload) { p.Attestation = "zz" + p.Attestation[2:] }), 0, "Attestation mismatch"},
+        {"truncated", "enrolled", tamper(func(p *common.Payload) { p.Attestation = p.Attestation[:32] }), 0, "Attestation mismatch"},
+        {"empty", "enrolled", tamper(func(p *common.Payload) { p.Attestation = "" }), 0, "Attestation mismatch"},
+        {"legacy from a device with a secret", "enrolled", legacy(payload), 0, "sent a legacy attestation"},
+        {"legacy", "old", legacy(payload), common.AttestationLegacy, ""},
+        // the legacy hash only covers the middle of the payphone ID
+        {"legacy forged", "old", func() common.Payload { p := legacy(payload); p.PayphoneID = "0319345678"; return p }(), 0, "Tampering/Forgery"},
+        {"legacy short payphone ID", "old", common.Payload{PayphoneID: "031234"}, 0, "Tampering/Forgery"},
+        {"HMAC without a secret", "old", attest(payload, "", "old"), 0, "has no enrolled secret"},
+        {"unknown version", "enrolled", tamper(func(p *common.Payload) { p.AttestationVersion = 2 }), 0, "Unknown attestation version 2"},
+        {"unknown device", "nobody", signed, 0, "No device nobody"},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            version, err := verifyAttestation(context.Background(), test.payload, test.device, devices)
+            if test.err != "" {
+                if err == nil || !strings.Contains(err.Error(), test.err) { t.Fatalf("expected an error with %q, got version %d, %v", test.err, version, err) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if version != test.version { t.Fatalf("version is %d, expected %d", version, test.version) }
+        })
+    }
+}
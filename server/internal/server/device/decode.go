@@ -0,0 +1,218 @@
+package device
+
+import (
+    "bytes"
+    "context"
+    "compress/gzip"
+    "crypto/rsa"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "strings"
+    "time"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/db"
+    "server-indicum/internal/server/frame"
+    "server-indicum/internal/server/keyring"
+    "server-indicum/internal/server/portalurl"
+)
+
+// Devices is what the device server needs to know about enrolled devices. The
+// server looks them up in its store, the conformance check (cmd/frametool)
+// uses the devices in the protocol vectors.
+type Devices interface {
+    PublicKey(ctx context.Context, deviceUUID string) (*rsa.PublicKey, error)
+    // Secret is the attestation secret, empty for devices enrolled before secrets
+    Secret(ctx context.Context, deviceUUID string) (string, error)
+}
+
+type storeDevices struct {
+    store db.Store
+}
+
+func (devices storeDevices) PublicKey(ctx context.Context, deviceUUID string) (*rsa.PublicKey, error) {
+    deviceRSAPubBytes, err := devices.store.FindDeviceRSAPub(ctx, deviceUUID)
+    if err != nil { return nil, fmt.Errorf("Failed to get deviceRSAPub %v\n", err)}
+
+    deviceRSAPub, err := frame.ParsePublicKey(deviceRSAPubBytes)
+    if err != nil { return nil, fmt.Errorf("Device %s: %v", deviceUUID, err)}
+    return deviceRSAPub, nil
+}
+
+func (devices storeDevices) Secret(ctx context.Context, deviceUUID string) (string, error) {
+    return devices.store.FindDeviceSecret(ctx, deviceUUID)
+}
+
+// Decoded is a frame that passed every check the device server makes, what is
+// set depends on the frame type
+type Decoded struct {
+    Type       byte
+    DeviceUUID string
+    KeyID      uint16
+    Plaintext  []byte
+
+    // FrameTypeSendDeviceData and FrameTypeSendDeviceDataV2
+    Payload            *common.Payload
+    AttestationVersion int
+    PortalURLParser    int
+    // FrameTypeScanSightings
+    ScanReport *common.ScanReport
+    // FrameTypeDeviceLogs
+    Logs []common.LogRecord
+    // FrameTypeGetKey, the key to encrypt the payload key to
+    DevicePub *rsa.PublicKey
+}
+
+// Decode runs a frame through the device server's checks as if it arrived at
+// now, without storing anything. An error means the server rejects the frame.
+func Decode(ctx context.Context, f frame.Frame, keys *keyring.Keyring, devices Devices, now time.Time) (*Decoded, error) {
+    switch f.Type {
+        case common.FrameTypeSendDeviceData, common.FrameTypeSendDeviceDataV2:
+            return decodeDeviceData(ctx, f, keys, devices)
+        case common.FrameTypeScanSightings:
+            return decodeScanSightings(ctx, f, keys, devices)
+        case common.FrameTypeDeviceLogs:
+            return decodeDeviceLogs(ctx, f, keys, devices)
+        case common.FrameTypeGetKey:
+            return decodeGetKey(ctx, f, devices, now)
+        case common.FrameTypeTest:
+            return &Decoded{Type: f.Type}, nil
+    }
+    return nil, fmt.Errorf("Frame type %x invalid\n", f.Type)
+}
+
+// readSealed checks the signature of a frame in the envelope every device data
+// frame uses (see frame.Sealed) and decrypts it
+func readSealed(ctx context.Context, f frame.Frame, keys *keyring.Keyring, devices Devices) (*Decoded, error) {
+    sealed, err := frame.ParseSealed(f)
+    if err != nil { return nil, err }
+
+    deviceRSAPub, err := devices.PublicKey(ctx, sealed.UUID)
+    if err != nil { return nil, err }
+
+    if err := sealed.Verify(deviceRSAPub); err != nil { return nil, err }
+
+    plaintext, err := sealed.Open(keys)
+    if err != nil { return nil, err }
+
+    return &Decoded{Type: f.Type, DeviceUUID: sealed.UUID, KeyID: sealed.KeyID, Plaintext: plaintext}, nil
+}
+
+func decodeDeviceData(ctx context.Context, f frame.Frame, keys *keyring.Keyring, devices Devices) (*Decoded, error) {
+    decoded, err := readSealed(ctx, f, keys, devices)
+    if err != nil { return nil, err }
+    deviceUUID := decoded.DeviceUUID
+
+    // unmarshals data
+    var dataPayload common.Payload
+    err = json.Unmarshal(decoded.Plaintext, &dataPayload)
+    if err != nil { return nil, fmt.Errorf("Can't unmarshal %v\n", err)}
+
+    if len(dataPayload.PayphoneID) <= 6 { return nil, fmt.Errorf("PayphoneID too short\n") }
+    if err := checkFix(dataPayload.Fix); err != nil { return nil, err }
+    if len(dataPayload.Interface) > maxInterfaceLength { return nil, fmt.Errorf("Interface name %q is too long\n", dataPayload.Interface) }
+
+    // verifies that there was no tampering or forging
+    decoded.AttestationVersion, err = verifyAttestation(ctx, dataPayload, deviceUUID, devices)
+    if err != nil { return nil, err }
+
+    // the server's reading of the portal URL has to match the device's
+    decoded.PortalURLParser, err = portalurl.Check(dataPayload)
+    if err != nil { return nil, fmt.Errorf("Device %s: %v", deviceUUID, err) }
+
+    decoded.Payload = &dataPayload
+    return decoded, nil
+}
+
+// checkFix rejects GPS fixes that can't be real, nil (no GPS) is fine
+func checkFix(fix *common.Fix) error {
+    if fix == nil { return nil }
+    if math.IsNaN(fix.Lat) || math.IsNaN(fix.Long) || fix.Lat < -90 || fix.Lat > 90 || fix.Long < -180 || fix.Long > 180 {
+        return fmt.Errorf("GPS fix %f,%f is out of range\n", fix.Lat, fix.Long)
+    }
+    if math.IsNaN(fix.Accuracy) || fix.Accuracy < 0 { return fmt.Errorf("GPS fix accuracy %f is invalid\n", fix.Accuracy) }
+    return nil
+}
+
+// linux interface names are at most 15 characters (IFNAMSIZ - 1)
+const maxInterfaceLength = 15
+
+// most sightings accepted in one report, the client keeps at most 200 waiting
+const maxSightingsPerReport = 256
+
+func decodeScanSightings(ctx context.Context, f frame.Frame, keys *keyring.Keyring, devices Devices) (*Decoded, error) {
+    decoded, err := readSealed(ctx, f, keys, devices)
+    if err != nil { return nil, err }
+
+    var report common.ScanReport
+    err = json.Unmarshal(decoded.Plaintext, &report)
+    if err != nil { return nil, fmt.Errorf("Can't unmarshal scan report %v\n", err)}
+
+    if len(report.Sightings) > maxSightingsPerReport { return nil, fmt.Errorf("Scan report has %d sightings, limit is %d\n", len(report.Sightings), maxSightingsPerReport) }
+    for i, sighting := range report.Sightings {
+        addr, err := net.ParseMAC(sighting.BSSID)
+        if err != nil || len(addr) != 6 { return nil, fmt.Errorf("Sighting %d has a bad BSSID %q\n", i, sighting.BSSID) }
+        report.Sightings[i].BSSID = addr.String()
+        if len(sighting.SSID) > 32 { return nil, fmt.Errorf("Sighting %d SSID is longer than 32 bytes\n", i) }
+        if err := checkFix(sighting.Fix); err != nil { return nil, fmt.Errorf("Sighting %d: %v", i, err) }
+        if len(sighting.Interface) > maxInterfaceLength { return nil, fmt.Errorf("Sighting %d interface name is too long\n", i) }
+    }
+
+    decoded.ScanReport = &report
+    return decoded, nil
+}
+
+// limits on an uploaded log batch, the frame is at most 64KB but gzip can
+// expand a lot further than that
+const (
+    maxLogBytes         = 4 << 20
+    maxLogRecords       = 20000
+    maxLogMessageLength = 2048
+)
+
+func decodeDeviceLogs(ctx context.Context, f frame.Frame, keys *keyring.Keyring, devices Devices) (*Decoded, error) {
+    decoded, err := readSealed(ctx, f, keys, devices)
+    if err != nil { return nil, err }
+    deviceUUID := decoded.DeviceUUID
+
+    gz, err := gzip.NewReader(bytes.NewReader(decoded.Plaintext))
+    if err != nil { return nil, fmt.Errorf("Logs from %s aren't gzipped %v\n", deviceUUID, err) }
+    defer gz.Close()
+
+    var records []common.LogRecord
+    decoder := json.NewDecoder(io.LimitReader(gz, maxLogBytes))
+    for decoder.More() {
+        var record common.LogRecord
+        if err := decoder.Decode(&record); err != nil { return nil, fmt.Errorf("Can't decode log record from %s %v\n", deviceUUID, err) }
+        if len(records) == maxLogRecords { return nil, fmt.Errorf("Log batch from %s has more than %d records\n", deviceUUID, maxLogRecords) }
+        if len(record.Message) > maxLogMessageLength { record.Message = strings.ToValidUTF8(record.Message[:maxLogMessageLength], "") }
+        if len(record.Level) > 16 { record.Level = record.Level[:16] }
+        records = append(records, record)
+    }
+
+    decoded.Logs = records
+    return decoded, nil
+}
+
+// how far a get key request timestamp can be from our clock
+const getKeyMaxSkew = 5 * time.Minute
+
+// request: UUID | timestamp (int64 LE unix seconds) | signature over GetKeyContext | UUID | timestamp
+func decodeGetKey(ctx context.Context, f frame.Frame, devices Devices, now time.Time) (*Decoded, error) {
+    req, err := frame.ParseGetKeyRequest(f)
+    if err != nil { return nil, err }
+    deviceUUID := req.UUID
+
+    skew := now.Sub(req.Timestamp)
+    if skew > getKeyMaxSkew || skew < -getKeyMaxSkew { return nil, fmt.Errorf("Get key request from %s is %v off\n", deviceUUID, skew) }
+
+    deviceRSAPub, err := devices.PublicKey(ctx, deviceUUID)
+    if err != nil { return nil, err }
+
+    if err := req.Verify(deviceRSAPub); err != nil { return nil, err }
+
+    return &Decoded{Type: f.Type, DeviceUUID: deviceUUID, DevicePub: deviceRSAPub}, nil
+}
@@ -2,30 +2,37 @@
 package device
 
 import (
+    "context"
     "os"
     "fmt"
     "log"
+    "time"
     "crypto/tls"
-    "crypto"
+    "crypto/rand"
     "crypto/rsa"
-    "crypto/x509"
-    "encoding/pem"
-    "encoding/hex"
     "encoding/binary"
     "encoding/json"
     "crypto/sha256"
     "sync/atomic"
     "net"
-    "io"
 
     "server-indicum/internal/common"
     "server-indicum/internal/server/db"
+    "server-indicum/internal/server/frame"
+    "server-indicum/internal/server/keyring"
+    "server-indicum/internal/server/ws"
 
 )
 
 
 
-func InitDeviceServer() {
+// InitDeviceServer serves devices until ctx is done, which also cancels the
+// queries of connections still being handled
+func InitDeviceServer(ctx context.Context, store db.Store) {
+
+    keys, err := keyring.Load()
+    if err != nil { log.Fatalf("Failed to load payload keyring: %v", err) }
+    fmt.Println("Payload keyring loaded:", keys, "active key", keys.Active().ID)
 
     tlsCert := os.Getenv("TLS_CERT_FILE")
     tlsPrivkey := os.Getenv("TLS_PRIV_KEY")
@@ -34,146 +41,172 @@ func InitDeviceServer() {
 
     config := &tls.Config{Certificates: []tls.Certificate{cert},}
     tcpListen := os.Getenv("TCPLISTENADDRESS")
-    ln, err := tls.Listen("tcp", tcpListen, config) 
+    ln, err := tls.Listen("tcp", tcpListen, config)
 
     if err != nil { log.Fatalf("Failed to listen on %s: %v", tcpListen, err)}
 
     fmt.Println("TCP Server listening on address", tcpListen)
 
+    // opt in, records every frame so it can be decoded or replayed with cmd/frametool.
+    // Account erasure doesn't reach the file, it is kept until someone deletes it.
+    var recorder *frame.Recorder
+    if capturePath := os.Getenv("FRAME_CAPTURE_FILE"); capturePath != "" {
+        recorder, err = frame.OpenRecorder(capturePath)
+        if err != nil { log.Fatalf("Failed to open frame capture file: %v", err) }
+        fmt.Println("Capturing device frames to", capturePath)
+    }
+
+    go func() {
+        <-ctx.Done()
+        ln.Close()
+    }()
+
     var connectionCount uint64 = 0
     for {
         conn, err := ln.Accept()
+        if ctx.Err() != nil { return }
         atomic.AddUint64(&connectionCount, 1)
         fmt.Println("Connection count:", connectionCount)
-        if err != nil { 
+        if err != nil {
             log.Println("Error accepting connection:", err)
             continue
         }
-        go handleDeviceConnection(conn)
+        go handleDeviceConnection(ctx, conn, keys, store, recorder)
     }
 }
 
 // If there is an error, log.Printf() the error and then early return
 // handleDeviceConnection will then just close the connection and move on
-func handleDeviceConnection(conn net.Conn) {
+func handleDeviceConnection(ctx context.Context, conn net.Conn, keys *keyring.Keyring, store db.Store, recorder *frame.Recorder) {
     defer conn.Close()
+    // the connection's queries are cancelled as soon as it is handled
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    // First read the frame to ensure that it is coming from one of my devices
+    f, err := frame.Read(conn)
+    if err != nil { log.Println(err); return }
+    received := time.Now()
+
+    // every check happens in Decode, the handlers only store what passed
+    decoded, err := Decode(ctx, f, keys, storeDevices{store}, received)
+
+    // handlers that don't set a response get the default "ty\n"
+    var response []byte
+    if err == nil {
+        switch f.Type {
+            case common.FrameTypeSendDeviceData, common.FrameTypeSendDeviceDataV2:
+                err = handleDeviceData(ctx, store, decoded)
+            case common.FrameTypeScanSightings:
+                err = handleScanSightings(ctx, store, decoded)
+            case common.FrameTypeDeviceLogs:
+                err = handleDeviceLogs(ctx, store, decoded)
+            case common.FrameTypeGetKey:
+                response, err = handleGetKey(decoded, keys)
+            case common.FrameTypeTest:
+        }
+    }
 
-    // First read the first N bytes to ensure that it is coming from one of my devices
-    var frameCheck [2]byte
-    binary.Read(conn, binary.LittleEndian, &frameCheck)
+    capture := frame.Capture{Time: received, Remote: conn.RemoteAddr().String(), Frame: f.Bytes()}
+    if err != nil { capture.Error = err.Error() }
+    if recordErr := recorder.Record(capture); recordErr != nil { log.Println(recordErr) }
 
-    if frameCheck != common.FRAMESTART {
-        log.Println("FRAMESTART doesn't match"); return 
-    }
-    var frameType byte
-    binary.Read(conn, binary.LittleEndian, &frameType)
-
-    var err error
-    switch frameType {
-        case common.FrameTypeSendDeviceData:
-            err = handleDeviceData(conn)
-        case common.FrameTypeGetKey:
-        case common.FrameTypeTest:
-        default:
-            log.Println("Frame type invalid")
-            return
-    }
-    if err != nil { log.Printf("using frametype %x led to :%v\n", frameType, err); return }
+    if err != nil { log.Printf("using frametype %x led to :%v\n", f.Type, err); return }
 
-    err = sendResponse(conn)
+    err = sendResponse(conn, response)
 
     if err != nil { log.Println("can't send response", err); return }
 }
 
 // function that handles when the device sends data about itself to server
 // will include PayphoneID, payphoneID, geodata etc
-func handleDeviceData(conn net.Conn) error {
-
-    key1, err := hex.DecodeString(common.KeyOne)
-    if err != nil { return fmt.Errorf("Can't decode key %v\n", err)}
-
-    // reads 2 bytes (for frame length) and then reads length bytes
-    var length uint16
-    binary.Read(conn, binary.LittleEndian, &length)
-    if length < 310 { return fmt.Errorf("Length is only %d. Make sure you are sending the correct data\n")}
-    data := make([]byte, length)
-    _, err = io.ReadFull(conn, data)
-    if err != nil { return fmt.Errorf("Can't read data %v\n", err)}
-
-    // first 36 bytes is deviceUUID
-    deviceUUID := data[:36]
-    // next 256 bytes is signature
-    signature := data[36:292]
-    // next 12 bytes is nonce
-    nonce := data[292:304]
-    // rest is ciphertext
-    ciphertext := data[304:]
-
-    deviceRSAPubBytes, err := db.DBFindDeviceRSAPub(string(deviceUUID))
-    if err != nil { return fmt.Errorf("Failed to get deviceRSAPub %v\n", err)}
-    fmt.Println("publickeybytes", deviceRSAPubBytes)
-
-    deviceRSAPubBlock, _ := pem.Decode(deviceRSAPubBytes)
-    parsedPublicKey, err := x509.ParsePKIXPublicKey(deviceRSAPubBlock.Bytes)
-    if err != nil { log.Fatalf("Can't parse from bytes to rsa.PubKey: %v\n", err)}
-    
-    deviceRSAPub := parsedPublicKey.(*rsa.PublicKey)
-    fmt.Println("length", length)
-    fmt.Println("deviceUUID", deviceUUID)
-    fmt.Println("signature", signature)
-    fmt.Println("nonce", nonce)
-    fmt.Println("ciphertext", ciphertext)
-
-    hashedCipher := sha256.Sum256(ciphertext)
-
-    fmt.Println("publickey", deviceRSAPub)
-    fmt.Printf("Server Public Key Type: %T\n", deviceRSAPub)
-    fmt.Printf("Server Public Key Size: %d bits\n", deviceRSAPub.Size()*8)
-    fmt.Printf("Server Public Key Exponent: %d\n", deviceRSAPub.E)
-    fmt.Printf("Server Public Key Modulus: %x\n", deviceRSAPub.N.Bytes())
-
-    fmt.Printf("Server Received Signature Length: %d bytes\n", len(signature))
-    fmt.Printf("Server Expected Signature Length: %d bytes\n", deviceRSAPub.Size())
-
-
-    err = rsa.VerifyPKCS1v15(deviceRSAPub, crypto.SHA256, hashedCipher[:], signature)
-    if err != nil { return fmt.Errorf("Failed to sign ciphertext, integrity compromised %v\n", err)}
-
-    plaintext, err := common.Decrypt(ciphertext, key1, nonce)
-    if err != nil { return fmt.Errorf("Can't decrypt %v\n", err)}
-
-    // unmarshals data
-    var dataPayload common.Payload 
-    err = json.Unmarshal(plaintext, &dataPayload)
-    if err != nil { return fmt.Errorf("Can't unmarshal %v\n", err)}
-
-    // fmt.Println("data", dataPayload)
-
-    if len(dataPayload.PayphoneID) <= 6 { return fmt.Errorf("PayphoneID too short\n") }
-    forgeString := dataPayload.PayphoneID[3:len(dataPayload.PayphoneID)-3] + "_forge_resistance"
-    forgeResistanceHash := sha256.New()
-    forgeResistanceHash.Write([]byte(forgeString))
-    forgeHashString := hex.EncodeToString(forgeResistanceHash.Sum(nil))
-    
-    // verifies that there was no tampering or forging
-    if forgeHashString != dataPayload.ForgeResistance{
-        return fmt.Errorf("Tampering/Forgery detected\n")
-    }
+func handleDeviceData(ctx context.Context, store db.Store, decoded *Decoded) error {
+    if decoded.Payload.Test { return handleTestData(ctx, store, decoded) }
 
-    id, err := db.AddEntryToDB(dataPayload, string(deviceUUID))
+    id, err := store.AddEntry(ctx, *decoded.Payload, decoded.DeviceUUID, decoded.AttestationVersion, decoded.PortalURLParser)
 
     if err != nil { return fmt.Errorf("Failed to add to DB: %v\n", err)}
-    
-    fmt.Println("Added data to DB with id", id)
-    
 
+    fmt.Println("Added data to DB with id", id, "payload key", decoded.KeyID, "attestation version", decoded.AttestationVersion)
+
+
+    return nil
+}
+
+// function that handles a test submission. It passed the same checks as real
+// data but goes in test_entries, which expire, and the owner is told over the
+// websocket so they can see their device working from the profile page
+func handleTestData(ctx context.Context, store db.Store, decoded *Decoded) error {
+    id, expires, err := store.AddTestEntry(ctx, *decoded.Payload, decoded.DeviceUUID, decoded.AttestationVersion, decoded.PortalURLParser, testEntryTTL())
+    if err != nil { return fmt.Errorf("Failed to add test entry to DB: %v\n", err)}
+
+    fmt.Println("Added test entry to DB with id", id, "expires", expires.Format(time.RFC3339))
+
+    event, err := json.Marshal(common.TestEntryEvent{
+        Type: "test_entry",
+        ID: id,
+        PayphoneMAC: decoded.Payload.PayphoneMAC,
+        PayphoneID: decoded.Payload.PayphoneID,
+        PayphoneTime: decoded.Payload.PayphoneTime,
+        RecordedTime: decoded.Payload.Time,
+        ExpiresTime: expires.Unix(),
+        AttestationVersion: decoded.AttestationVersion,
+    })
+    if err != nil { return fmt.Errorf("Can't marshal test entry event %v\n", err)}
+
+    // the device did its part, an owner that isn't looking doesn't fail it
+    sent, err := ws.Send(decoded.DeviceUUID, event)
+    if err != nil { log.Println("Can't send test entry event:", err) }
+    if !sent { fmt.Println("No connection found for UUID:", decoded.DeviceUUID) }
     return nil
 }
 
-func sendResponse(conn net.Conn) error {
-    response := []byte("ty\n")
+// testEntryTTL is how long test submissions are kept, TEST_ENTRY_TTL as a Go duration
+func testEntryTTL() time.Duration {
+    ttl, err := time.ParseDuration(os.Getenv("TEST_ENTRY_TTL"))
+    if err != nil || ttl <= 0 { return 24 * time.Hour }
+    return ttl
+}
+
+// function that handles the payphone hotspots a device heard in passive wifi
+// scans. They are lower confidence than entries so they go in their own table.
+func handleScanSightings(ctx context.Context, store db.Store, decoded *Decoded) error {
+    count, err := store.AddScanSightings(ctx, *decoded.ScanReport, decoded.DeviceUUID)
+    if err != nil { return fmt.Errorf("Failed to add sightings to DB: %v\n", err)}
+
+    fmt.Println("Added", count, "scan sightings from", decoded.DeviceUUID)
+    return nil
+}
+
+// function that handles a device uploading its recent logs, gzipped json
+// lines, so the owner can debug it without physical access
+func handleDeviceLogs(ctx context.Context, store db.Store, decoded *Decoded) error {
+    count, err := store.AddDeviceLogs(ctx, decoded.DeviceUUID, decoded.Logs)
+    if err != nil { return fmt.Errorf("Failed to add logs to DB: %v\n", err)}
+
+    fmt.Println("Added", count, "log lines from", decoded.DeviceUUID)
+    return nil
+}
+
+// function that hands the active payload key to a device
+// response: FRAMESTART | FrameTypeGetKey | length | keyID | key encrypted to the device public key (RSA-OAEP SHA-256)
+func handleGetKey(decoded *Decoded, keys *keyring.Keyring) ([]byte, error) {
+    active := keys.Active()
+    encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, decoded.DevicePub, active.Secret, []byte(common.GetKeyContext))
+    if err != nil { return nil, fmt.Errorf("Can't encrypt key for %s %v\n", decoded.DeviceUUID, err) }
+
+    body := make([]byte, common.KeyIDLength, common.KeyIDLength + len(encryptedKey))
+    binary.LittleEndian.PutUint16(body, active.ID)
+    body = append(body, encryptedKey...)
+
+    fmt.Println("Sent payload key", active.ID, "to", decoded.DeviceUUID)
+    return frame.Frame{Type: common.FrameTypeGetKey, Data: body}.Bytes(), nil
+}
+
+func sendResponse(conn net.Conn, response []byte) error {
+    if response == nil { response = []byte("ty\n") }
     _, err := conn.Write(response)
     if err != nil { return fmt.Errorf("Can't write response %s", err.Error()) }
-    fmt.Println("message sent:", string(response))
+    fmt.Println("response sent, length", len(response))
     return nil
 }
@@ -0,0 +1,231 @@
+// Writes a user's entries for other mapping tools, as GeoJSON, GPX, KML or
+// CSV. Each writer streams: entries are written as they are given and nothing
+// is kept. Nothing is written until the first entry or Close, so a handler can
+// still send an error status if the export fails before it starts. GPX and KML
+// only have places, entries without a location are left out of them.
+package export
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "strconv"
+    "time"
+
+    "server-indicum/internal/common"
+)
+
+type Writer interface {
+    Write(common.ExportEntry) error
+    // Close finishes the document, it doesn't close the io.Writer
+    Close() error
+}
+
+type Format struct {
+    Name        string
+    ContentType string
+    Extension   string
+    New         func(io.Writer) Writer
+}
+
+// Formats by the name /export takes in ?format=
+var Formats = map[string]Format{
+    "geojson": {Name: "geojson", ContentType: "application/geo+json", Extension: "geojson", New: NewGeoJSON},
+    "gpx":     {Name: "gpx", ContentType: "application/gpx+xml", Extension: "gpx", New: NewGPX},
+    "kml":     {Name: "kml", ContentType: "application/vnd.google-earth.kml+xml", Extension: "kml", New: NewKML},
+    "csv":     {Name: "csv", ContentType: "text/csv; charset=utf-8", Extension: "csv", New: NewCSV},
+}
+
+func timestamp(unix int64) string {
+    return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// name is what an entry is called in tools that show one label
+func name(e common.ExportEntry) string {
+    if e.HotspotAddress != "" { return e.HotspotAddress }
+    return "Payphone " + e.PayphoneID
+}
+
+// description is the details of an entry for formats without their own fields
+func description(e common.ExportEntry) string {
+    return fmt.Sprintf("Payphone %s (%s), seen again %d times, last seen %s, location %s", e.PayphoneID, e.PayphoneMAC, e.SeenAgain, timestamp(e.LastSeenTime), e.LocationSource)
+}
+
+// document writes head before the first entry and tail on Close, or both on
+// Close if there were no entries
+type document struct {
+    w          io.Writer
+    head, tail string
+    started    bool
+}
+
+func (d *document) begin() error {
+    if d.started { return nil }
+    d.started = true
+    _, err := io.WriteString(d.w, d.head)
+    return err
+}
+
+func (d *document) end() error {
+    if err := d.begin(); err != nil { return err }
+    _, err := io.WriteString(d.w, d.tail)
+    return err
+}
+
+// GeoJSON is a FeatureCollection of points, an entry without a location has a
+// null geometry
+type GeoJSON struct {
+    document
+    features int
+}
+
+func NewGeoJSON(w io.Writer) Writer {
+    return &GeoJSON{document: document{w: w, head: `{"type":"FeatureCollection","features":[`, tail: "]}\n"}}
+}
+
+type geoJSONPoint struct {
+    Type        string     `json:"type"`
+    Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+    Type       string         `json:"type"`
+    Geometry   *geoJSONPoint  `json:"geometry"`
+    Properties map[string]any `json:"properties"`
+}
+
+func (g *GeoJSON) Write(e common.ExportEntry) error {
+    if err := g.begin(); err != nil { return err }
+    feature := geoJSONFeature{Type: "Feature", Properties: map[string]any{
+        "id":             e.ID,
+        "payphoneID":     e.PayphoneID,
+        "payphoneMAC":    e.PayphoneMAC,
+        "recordedTime":   timestamp(e.RecordedTime),
+        "lastSeenTime":   timestamp(e.LastSeenTime),
+        "seenAgain":      e.SeenAgain,
+        "mapUUID":        e.MapUUID,
+        "address":        e.HotspotAddress,
+        "locationSource": e.LocationSource,
+    }}
+    // GeoJSON is longitude first
+    if e.HasLocation { feature.Geometry = &geoJSONPoint{Type: "Point", Coordinates: [2]float64{e.Longitude, e.Latitude}} }
+
+    encoded, err := json.Marshal(feature)
+    if err != nil { return err }
+    if g.features > 0 {
+        if _, err := io.WriteString(g.w, ","); err != nil { return err }
+    }
+    g.features++
+    _, err = g.w.Write(encoded)
+    return err
+}
+
+func (g *GeoJSON) Close() error { return g.end() }
+
+// GPX is a GPX 1.1 file of waypoints
+type GPX struct {
+    document
+    encoder *xml.Encoder
+}
+
+func NewGPX(w io.Writer) Writer {
+    return &GPX{
+        document: document{w: w, tail: "</gpx>\n",
+                           head: xml.Header + `<gpx version="1.1" creator="indicum" xmlns="http://www.topografix.com/GPX/1/1">` + "\n"},
+        encoder:  xml.NewEncoder(w),
+    }
+}
+
+type gpxWaypoint struct {
+    XMLName     xml.Name `xml:"wpt"`
+    Lat         float64  `xml:"lat,attr"`
+    Lon         float64  `xml:"lon,attr"`
+    Time        string   `xml:"time"`
+    Name        string   `xml:"name"`
+    Description string   `xml:"desc"`
+    Type        string   `xml:"type"`
+}
+
+func (g *GPX) Write(e common.ExportEntry) error {
+    if !e.HasLocation { return nil }
+    if err := g.begin(); err != nil { return err }
+    waypoint := gpxWaypoint{Lat: e.Latitude, Lon: e.Longitude, Time: timestamp(e.RecordedTime), Name: name(e), Description: description(e), Type: e.LocationSource}
+    if err := g.encoder.Encode(waypoint); err != nil { return err }
+    _, err := io.WriteString(g.w, "\n")
+    return err
+}
+
+func (g *GPX) Close() error { return g.end() }
+
+// KML is a KML 2.2 document of placemarks
+type KML struct {
+    document
+    encoder *xml.Encoder
+}
+
+func NewKML(w io.Writer) Writer {
+    return &KML{
+        document: document{w: w, tail: "</Document>\n</kml>\n",
+                           head: xml.Header + `<kml xmlns="http://www.opengis.net/kml/2.2">` + "\n<Document>\n<name>Discoveries</name>\n"},
+        encoder:  xml.NewEncoder(w),
+    }
+}
+
+type kmlPlacemark struct {
+    XMLName     xml.Name `xml:"Placemark"`
+    Name        string   `xml:"name"`
+    Description string   `xml:"description"`
+    When        string   `xml:"TimeStamp>when"`
+    // Coordinates is longitude,latitude
+    Coordinates string   `xml:"Point>coordinates"`
+}
+
+func (k *KML) Write(e common.ExportEntry) error {
+    if !e.HasLocation { return nil }
+    if err := k.begin(); err != nil { return err }
+    coordinates := strconv.FormatFloat(e.Longitude, 'f', -1, 64) + "," + strconv.FormatFloat(e.Latitude, 'f', -1, 64)
+    placemark := kmlPlacemark{Name: name(e), Description: description(e), When: timestamp(e.RecordedTime), Coordinates: coordinates}
+    if err := k.encoder.Encode(placemark); err != nil { return err }
+    _, err := io.WriteString(k.w, "\n")
+    return err
+}
+
+func (k *KML) Close() error { return k.end() }
+
+// CSV has a header row and a row per entry, latitude and longitude are empty
+// for entries without a location
+type CSV struct {
+    w       *csv.Writer
+    started bool
+}
+
+func NewCSV(w io.Writer) Writer {
+    return &CSV{w: csv.NewWriter(w)}
+}
+
+var csvHeader = []string{"id", "payphone_id", "payphone_mac", "recorded_time", "last_seen_time", "seen_again", "latitude", "longitude", "location_source", "map_uuid", "address"}
+
+func (c *CSV) begin() error {
+    if c.started { return nil }
+    c.started = true
+    return c.w.Write(csvHeader)
+}
+
+func (c *CSV) Write(e common.ExportEntry) error {
+    if err := c.begin(); err != nil { return err }
+    var lat, long string
+    if e.HasLocation {
+        lat = strconv.FormatFloat(e.Latitude, 'f', -1, 64)
+        long = strconv.FormatFloat(e.Longitude, 'f', -1, 64)
+    }
+    return c.w.Write([]string{strconv.FormatInt(e.ID, 10), e.PayphoneID, e.PayphoneMAC, timestamp(e.RecordedTime), timestamp(e.LastSeenTime),
+                              strconv.Itoa(e.SeenAgain), lat, long, e.LocationSource, e.MapUUID, e.HotspotAddress})
+}
+
+func (c *CSV) Close() error {
+    if err := c.begin(); err != nil { return err }
+    c.w.Flush()
+    return c.w.Error()
+}
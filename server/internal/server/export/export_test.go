@@ -0,0 +1,164 @@
+package export
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "encoding/xml"
+    "strings"
+    "testing"
+
+    "server-indicum/internal/common"
+)
+
+var (
+    located = common.ExportEntry{
+        ID: 7, PayphoneID: "0312345678", PayphoneMAC: "0C:8D:DB:5E:32:63", RecordedTime: 1767225600, LastSeenTime: 1767312000, SeenAgain: 2,
+        HasLocation: true, Latitude: -33.8688, Longitude: 151.2093, LocationSource: common.LocationPlaced, HotspotAddress: "1 George St, Sydney",
+    }
+    // no location, nothing to fall back on either
+    unlocated = common.ExportEntry{ID: 8, PayphoneID: "0387654321", PayphoneMAC: "0C:8D:DB:5E:32:64", RecordedTime: 1767229200, LastSeenTime: 1767229200}
+)
+
+func export(t *testing.T, format string, entries ...common.ExportEntry) string {
+    var buf bytes.Buffer
+    w := Formats[format].New(&buf)
+    for _, e := range entries {
+        if err := w.Write(e); err != nil { t.Fatalf("%s Write: %v", format, err) }
+    }
+    if err := w.Close(); err != nil { t.Fatalf("%s Close: %v", format, err) }
+    return buf.String()
+}
+
+func TestCSV(t *testing.T) {
+    tests := []struct {
+        name    string
+        entries []common.ExportEntry
+        rows    [][]string
+    }{
+        {"no entries", nil, nil},
+        {"located", []common.ExportEntry{located}, [][]string{
+            {"7", "0312345678", "0C:8D:DB:5E:32:63", "2026-01-01T00:00:00Z", "2026-01-02T00:00:00Z", "2", "-33.8688", "151.2093", "placed", "", "1 George St, Sydney"},
+        }},
+        {"unlocated", []common.ExportEntry{unlocated}, [][]string{
+            {"8", "0387654321", "0C:8D:DB:5E:32:64", "2026-01-01T01:00:00Z", "2026-01-01T01:00:00Z", "0", "", "", "", "", ""},
+        }},
+        {"both", []common.ExportEntry{unlocated, located}, [][]string{
+            {"8", "0387654321", "0C:8D:DB:5E:32:64", "2026-01-01T01:00:00Z", "2026-01-01T01:00:00Z", "0", "", "", "", "", ""},
+            {"7", "0312345678", "0C:8D:DB:5E:32:63", "2026-01-01T00:00:00Z", "2026-01-02T00:00:00Z", "2", "-33.8688", "151.2093", "placed", "", "1 George St, Sydney"},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            records, err := csv.NewReader(strings.NewReader(export(t, "csv", tt.entries...))).ReadAll()
+            if err != nil { t.Fatalf("CSV doesn't parse: %v", err) }
+            if len(records) != len(tt.rows) + 1 { t.Fatalf("%d rows, want a header and %d", len(records), len(tt.rows)) }
+            if strings.Join(records[0], ",") != strings.Join(csvHeader, ",") { t.Fatalf("header is %v", records[0]) }
+            for i, row := range tt.rows {
+                if strings.Join(records[i+1], "|") != strings.Join(row, "|") { t.Fatalf("row %d is %q, want %q", i, records[i+1], row) }
+            }
+        })
+    }
+}
+
+func TestGeoJSON(t *testing.T) {
+    var doc struct {
+        Type     string
+        Features []struct {
+            Type       string
+            Geometry   *struct {
+                Type        string
+                Coordinates []float64
+            }
+            Properties map[string]any
+        }
+    }
+    out := export(t, "geojson", unlocated, located)
+    if err := json.Unmarshal([]byte(out), &doc); err != nil { t.Fatalf("GeoJSON doesn't parse: %v\n%s", err, out) }
+    if doc.Type != "FeatureCollection" || len(doc.Features) != 2 { t.Fatalf("%s with %d features", doc.Type, len(doc.Features)) }
+
+    // an unlocated entry is still a feature, with "geometry": null rather than no geometry
+    if !strings.Contains(out, `"geometry":null`) { t.Fatalf("no null geometry in %s", out) }
+    if doc.Features[0].Geometry != nil { t.Fatalf("unlocated entry has geometry %+v", doc.Features[0].Geometry) }
+    if doc.Features[0].Properties["payphoneID"] != "0387654321" || doc.Features[0].Properties["locationSource"] != "" { t.Fatalf("unlocated properties %v", doc.Features[0].Properties) }
+
+    point := doc.Features[1].Geometry
+    if point == nil || point.Type != "Point" || len(point.Coordinates) != 2 || point.Coordinates[0] != 151.2093 || point.Coordinates[1] != -33.8688 {
+        t.Fatalf("located geometry %+v, want longitude first", point)
+    }
+
+    if err := json.Unmarshal([]byte(export(t, "geojson")), &doc); err != nil || len(doc.Features) != 0 { t.Fatalf("empty export %v %d features", err, len(doc.Features)) }
+}
+
+func TestGPX(t *testing.T) {
+    tests := []struct {
+        name      string
+        entries   []common.ExportEntry
+        waypoints int
+    }{
+        {"no entries", nil, 0},
+        {"only unlocated", []common.ExportEntry{unlocated}, 0},
+        {"unlocated left out", []common.ExportEntry{unlocated, located, unlocated}, 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var doc struct {
+                XMLName   xml.Name `xml:"gpx"`
+                Waypoints []struct {
+                    Lat  float64 `xml:"lat,attr"`
+                    Lon  float64 `xml:"lon,attr"`
+                    Name string  `xml:"name"`
+                    Time string  `xml:"time"`
+                } `xml:"wpt"`
+            }
+            out := export(t, "gpx", tt.entries...)
+            if err := xml.Unmarshal([]byte(out), &doc); err != nil { t.Fatalf("GPX doesn't parse: %v\n%s", err, out) }
+            if len(doc.Waypoints) != tt.waypoints { t.Fatalf("%d waypoints, want %d", len(doc.Waypoints), tt.waypoints) }
+            if strings.Contains(out, "0387654321") { t.Fatalf("unlocated entry in %s", out) }
+            if tt.waypoints > 0 {
+                wpt := doc.Waypoints[0]
+                if wpt.Lat != -33.8688 || wpt.Lon != 151.2093 || wpt.Name != "1 George St, Sydney" || wpt.Time != "2026-01-01T00:00:00Z" { t.Fatalf("waypoint %+v", wpt) }
+            }
+        })
+    }
+}
+
+func TestKML(t *testing.T) {
+    tests := []struct {
+        name       string
+        entries    []common.ExportEntry
+        placemarks int
+    }{
+        {"no entries", nil, 0},
+        {"only unlocated", []common.ExportEntry{unlocated}, 0},
+        {"unlocated left out", []common.ExportEntry{unlocated, located}, 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var doc struct {
+                XMLName    xml.Name `xml:"kml"`
+                Placemarks []struct {
+                    Name        string `xml:"name"`
+                    Coordinates string `xml:"Point>coordinates"`
+                } `xml:"Document>Placemark"`
+            }
+            out := export(t, "kml", tt.entries...)
+            if err := xml.Unmarshal([]byte(out), &doc); err != nil { t.Fatalf("KML doesn't parse: %v\n%s", err, out) }
+            if len(doc.Placemarks) != tt.placemarks { t.Fatalf("%d placemarks, want %d", len(doc.Placemarks), tt.placemarks) }
+            if strings.Contains(out, "0387654321") { t.Fatalf("unlocated entry in %s", out) }
+            if tt.placemarks > 0 && doc.Placemarks[0].Coordinates != "151.2093,-33.8688" { t.Fatalf("coordinates %q, want longitude first", doc.Placemarks[0].Coordinates) }
+        })
+    }
+}
+
+// a handler can still send an error status if nothing was written
+func TestNothingWrittenBeforeFirstEntry(t *testing.T) {
+    for name, format := range Formats {
+        var buf bytes.Buffer
+        w := format.New(&buf)
+        if buf.Len() != 0 { t.Fatalf("%s wrote %q before any entry", name, buf.String()) }
+        if err := w.Write(unlocated); err != nil { t.Fatalf("%s Write: %v", name, err) }
+        // GPX and KML skip it, so they still haven't started
+        if (name == "gpx" || name == "kml") && buf.Len() != 0 { t.Fatalf("%s wrote %q for an unlocated entry", name, buf.String()) }
+    }
+}
@@ -0,0 +1,72 @@
+package frame
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+)
+
+// Capture is one frame as the device server received it, stored as a line of
+// JSON in the capture file. Frame is the whole frame, FRAMESTART included, so
+// it can be sent again as is.
+type Capture struct {
+    Time   time.Time
+    Remote string
+    Frame  []byte
+    // Error is what handling the frame failed with, empty if it was accepted
+    Error string `json:",omitempty"`
+}
+
+// Recorder appends captures to a file. A nil Recorder records nothing, so
+// callers don't have to check whether capturing is on.
+type Recorder struct {
+    mu   sync.Mutex
+    file *os.File
+}
+
+// OpenRecorder opens (or creates) the capture file at path for appending. The
+// file has everything devices send in it, so only the owner can read it.
+func OpenRecorder(path string) (*Recorder, error) {
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil { return nil, fmt.Errorf("Can't open capture file %v", err) }
+    return &Recorder{file: file}, nil
+}
+
+func (rec *Recorder) Record(capture Capture) error {
+    if rec == nil { return nil }
+
+    line, err := json.Marshal(capture)
+    if err != nil { return fmt.Errorf("Can't marshal capture %v", err) }
+
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+    if _, err := rec.file.Write(append(line, '\n')); err != nil { return fmt.Errorf("Can't write capture %v", err) }
+    return nil
+}
+
+func (rec *Recorder) Close() error {
+    if rec == nil { return nil }
+    return rec.file.Close()
+}
+
+// ReadCaptures reads every capture in a capture file
+func ReadCaptures(r io.Reader) ([]Capture, error) {
+    var captures []Capture
+    scanner := bufio.NewScanner(r)
+    // a frame is at most 64KB, base64 makes it a third bigger
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    lineNumber := 0
+    for scanner.Scan() {
+        lineNumber++
+        if len(scanner.Bytes()) == 0 { continue }
+        var capture Capture
+        if err := json.Unmarshal(scanner.Bytes(), &capture); err != nil { return nil, fmt.Errorf("Capture line %d: %v", lineNumber, err) }
+        captures = append(captures, capture)
+    }
+    if err := scanner.Err(); err != nil { return nil, fmt.Errorf("Can't read captures %v", err) }
+    return captures, nil
+}
@@ -0,0 +1,103 @@
+package frame
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "server-indicum/internal/common"
+)
+
+func TestRecorder(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "captures.jsonl")
+    at := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+    first := Capture{Time: at, Remote: "10.0.0.1:4000", Frame: Frame{Type: common.FrameTypeDeviceLogs, Data: []byte{0, 1, 2, 0xff}}.Bytes()}
+    second := Capture{Time: at.Add(time.Second), Remote: "10.0.0.2:4000", Frame: Frame{Type: common.FrameTypeTest}.Bytes(), Error: "Device unknown"}
+
+    rec, err := OpenRecorder(path)
+    if err != nil { t.Fatalf("OpenRecorder: %v", err) }
+    if err := rec.Record(first); err != nil { t.Fatalf("Record: %v", err) }
+    if err := rec.Close(); err != nil { t.Fatalf("Close: %v", err) }
+
+    info, err := os.Stat(path)
+    if err != nil { t.Fatalf("Stat: %v", err) }
+    if info.Mode().Perm() != 0600 { t.Fatalf("capture file mode is %v", info.Mode().Perm()) }
+
+    // reopening appends, it doesn't truncate
+    rec, err = OpenRecorder(path)
+    if err != nil { t.Fatalf("OpenRecorder: %v", err) }
+    if err := rec.Record(second); err != nil { t.Fatalf("Record: %v", err) }
+    if err := rec.Close(); err != nil { t.Fatalf("Close: %v", err) }
+
+    file, err := os.Open(path)
+    if err != nil { t.Fatalf("Open: %v", err) }
+    defer file.Close()
+    captures, err := ReadCaptures(file)
+    if err != nil { t.Fatalf("ReadCaptures: %v", err) }
+    if len(captures) != 2 { t.Fatalf("read %d captures", len(captures)) }
+
+    for i, want := range []Capture{first, second} {
+        got := captures[i]
+        if !got.Time.Equal(want.Time) || got.Remote != want.Remote || got.Error != want.Error || !bytes.Equal(got.Frame, want.Frame) {
+            t.Fatalf("capture %d is %+v, recorded %+v", i, got, want)
+        }
+    }
+
+    // a capture can be sent again as is
+    f, err := Read(bytes.NewReader(captures[0].Frame))
+    if err != nil { t.Fatalf("Read captured frame: %v", err) }
+    if f.Type != common.FrameTypeDeviceLogs || !bytes.Equal(f.Data, []byte{0, 1, 2, 0xff}) { t.Fatalf("captured frame is %+v", f) }
+}
+
+func TestNilRecorder(t *testing.T) {
+    var rec *Recorder
+    if err := rec.Record(Capture{Remote: "10.0.0.1:4000"}); err != nil { t.Fatalf("Record: %v", err) }
+    if err := rec.Close(); err != nil { t.Fatalf("Close: %v", err) }
+}
+
+func TestReadCaptures(t *testing.T) {
+    tests := []struct {
+        name  string
+        input string
+        count int
+        err   string
+    }{
+        {"empty", "", 0, ""},
+        {"blank lines", "\n{\"Remote\":\"a\"}\n\n{\"Remote\":\"b\"}\n", 2, ""},
+        {"no trailing newline", "{\"Remote\":\"a\"}", 1, ""},
+        {"bad line", "{\"Remote\":\"a\"}\nnot json\n", 0, "Capture line 2"},
+        {"frame isn't base64", "{\"Frame\":\"!!\"}\n", 0, "Capture line 1"},
+        // the biggest frame is 64KB, a line over the buffer is an error, not a silent stop
+        {"line too long", "{\"Remote\":\"" + strings.Repeat("a", 2*1024*1024) + "\"}\n", 0, "Can't read captures"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            captures, err := ReadCaptures(strings.NewReader(tt.input))
+            if tt.err != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.err) { t.Fatalf("error %v, expected %q", err, tt.err) }
+                return
+            }
+            if err != nil { t.Fatalf("ReadCaptures: %v", err) }
+            if len(captures) != tt.count { t.Fatalf("read %d captures, expected %d", len(captures), tt.count) }
+        })
+    }
+}
+
+func TestReadCapturesBiggestFrame(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "captures.jsonl")
+    rec, err := OpenRecorder(path)
+    if err != nil { t.Fatalf("OpenRecorder: %v", err) }
+    big := Frame{Type: common.FrameTypeDeviceLogs, Data: bytes.Repeat([]byte{0xab}, 0xffff)}.Bytes()
+    if err := rec.Record(Capture{Frame: big}); err != nil { t.Fatalf("Record: %v", err) }
+    rec.Close()
+
+    file, err := os.Open(path)
+    if err != nil { t.Fatalf("Open: %v", err) }
+    defer file.Close()
+    captures, err := ReadCaptures(file)
+    if err != nil { t.Fatalf("ReadCaptures: %v", err) }
+    if len(captures) != 1 || !bytes.Equal(captures[0].Frame, big) { t.Fatalf("biggest frame didn't come back") }
+}
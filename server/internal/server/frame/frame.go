@@ -0,0 +1,197 @@
+// Package frame reads the frames devices send to the TCP server
+//   FRAMESTART | type (1 byte) | length (uint16 LE) | data
+// and splits them into their parts. The device server and cmd/frametool both
+// use it, so a captured frame is decoded exactly the way the server decoded it.
+package frame
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "time"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/keyring"
+)
+
+type Frame struct {
+    Type byte
+    Data []byte
+}
+
+// Read reads one frame. FrameTypeTest has no length or data after the type.
+func Read(r io.Reader) (Frame, error) {
+    var header [3]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil { return Frame{}, fmt.Errorf("Can't read frame header %v\n", err) }
+    if header[0] != common.FRAMESTART[0] || header[1] != common.FRAMESTART[1] { return Frame{}, fmt.Errorf("FRAMESTART doesn't match\n") }
+
+    f := Frame{Type: header[2]}
+    if !Known(f.Type) { return Frame{}, fmt.Errorf("Frame type %x invalid\n", f.Type) }
+    if f.Type == common.FrameTypeTest { return f, nil }
+
+    var length uint16
+    if err := binary.Read(r, binary.LittleEndian, &length); err != nil { return Frame{}, fmt.Errorf("Can't read length %v\n", err)}
+    f.Data = make([]byte, length)
+    if _, err := io.ReadFull(r, f.Data); err != nil { return Frame{}, fmt.Errorf("Can't read data %v\n", err)}
+    return f, nil
+}
+
+// Bytes is the frame as it goes over the wire
+func (f Frame) Bytes() []byte {
+    var buf bytes.Buffer
+    buf.Write(common.FRAMESTART[:])
+    buf.WriteByte(f.Type)
+    if f.Type != common.FrameTypeTest {
+        binary.Write(&buf, binary.LittleEndian, uint16(len(f.Data)))
+        buf.Write(f.Data)
+    }
+    return buf.Bytes()
+}
+
+// Known is true for the frame types the server handles
+func Known(frameType byte) bool {
+    switch frameType {
+        case common.FrameTypeSendDeviceData, common.FrameTypeGetKey, common.FrameTypeTest,
+            common.FrameTypeSendDeviceDataV2, common.FrameTypeScanSightings, common.FrameTypeDeviceLogs:
+            return true
+    }
+    return false
+}
+
+// IsSealed is true for the frame types that use the sealed envelope
+func IsSealed(frameType byte) bool {
+    switch frameType {
+        case common.FrameTypeSendDeviceData, common.FrameTypeSendDeviceDataV2,
+            common.FrameTypeScanSightings, common.FrameTypeDeviceLogs:
+            return true
+    }
+    return false
+}
+
+// TypeName is a readable name for a frame type
+func TypeName(frameType byte) string {
+    switch frameType {
+        case common.FrameTypeSendDeviceData: return "SendDeviceData"
+        case common.FrameTypeGetKey: return "GetKey"
+        case common.FrameTypeTest: return "Test"
+        case common.FrameTypeSendDeviceDataV2: return "SendDeviceDataV2"
+        case common.FrameTypeScanSightings: return "ScanSightings"
+        case common.FrameTypeDeviceLogs: return "DeviceLogs"
+    }
+    return fmt.Sprintf("unknown (%x)", frameType)
+}
+
+// Sealed is the envelope every device data frame uses
+//
+// FrameTypeSendDeviceData:   UUID | signature | nonce | ciphertext, always payload key 0
+// everything newer:          UUID | keyID | signature | nonce | ciphertext,
+// where the signature covers keyID | ciphertext
+type Sealed struct {
+    UUID string
+    // HasKeyID is false for FrameTypeSendDeviceData
+    HasKeyID   bool
+    KeyID      uint16
+    Signature  []byte
+    Nonce      []byte
+    Ciphertext []byte
+}
+
+// ParseSealed splits a sealed frame into its parts, it doesn't check anything
+func ParseSealed(f Frame) (*Sealed, error) {
+    if !IsSealed(f.Type) { return nil, fmt.Errorf("Frame type %x isn't sealed\n", f.Type) }
+
+    s := &Sealed{HasKeyID: f.Type != common.FrameTypeSendDeviceData}
+    headerLength := common.UUIDLength + common.SignatureLength + common.NonceLength
+    if s.HasKeyID { headerLength += common.KeyIDLength }
+    if len(f.Data) < headerLength + 6 { return nil, fmt.Errorf("Length is only %d. Make sure you are sending the correct data\n", len(f.Data))}
+
+    // first 36 bytes is deviceUUID
+    s.UUID = string(f.Data[:common.UUIDLength])
+    rest := f.Data[common.UUIDLength:]
+
+    if s.HasKeyID {
+        s.KeyID = binary.LittleEndian.Uint16(rest[:common.KeyIDLength])
+        rest = rest[common.KeyIDLength:]
+    }
+
+    // next 256 bytes is signature
+    s.Signature = rest[:common.SignatureLength]
+    // next 12 bytes is nonce
+    s.Nonce = rest[common.SignatureLength:common.SignatureLength+common.NonceLength]
+    // rest is ciphertext
+    s.Ciphertext = rest[common.SignatureLength+common.NonceLength:]
+    return s, nil
+}
+
+// Digest is the hash the device signed
+func (s *Sealed) Digest() [32]byte {
+    var signed []byte
+    if s.HasKeyID { signed = binary.LittleEndian.AppendUint16(signed, s.KeyID) }
+    return sha256.Sum256(append(signed, s.Ciphertext...))
+}
+
+// Verify checks the signature against the device's public key
+func (s *Sealed) Verify(deviceRSAPub *rsa.PublicKey) error {
+    digest := s.Digest()
+    err := rsa.VerifyPKCS1v15(deviceRSAPub, crypto.SHA256, digest[:], s.Signature)
+    if err != nil { return fmt.Errorf("Failed to sign ciphertext, integrity compromised %v\n", err)}
+    return nil
+}
+
+// Open decrypts the ciphertext with the key the device says it used
+func (s *Sealed) Open(keys *keyring.Keyring) ([]byte, error) {
+    payloadKey, err := keys.DecryptionKey(s.KeyID)
+    if err != nil { return nil, fmt.Errorf("Device %s: %v\n", s.UUID, err)}
+
+    plaintext, err := common.Decrypt(s.Ciphertext, payloadKey, s.Nonce)
+    if err != nil { return nil, fmt.Errorf("Can't decrypt with key %d %v\n", s.KeyID, err)}
+    return plaintext, nil
+}
+
+// GetKeyRequest is a FrameTypeGetKey frame
+//   UUID | timestamp (int64 LE unix seconds) | signature over GetKeyContext | UUID | timestamp
+type GetKeyRequest struct {
+    UUID      string
+    Timestamp time.Time
+    timestampBytes []byte
+    Signature []byte
+}
+
+func ParseGetKeyRequest(f Frame) (*GetKeyRequest, error) {
+    if f.Type != common.FrameTypeGetKey { return nil, fmt.Errorf("Frame type %x isn't a get key request\n", f.Type) }
+    if len(f.Data) < common.UUIDLength + 8 + common.SignatureLength { return nil, fmt.Errorf("Length is only %d. Make sure you are sending the correct data\n", len(f.Data))}
+
+    req := &GetKeyRequest{
+        UUID: string(f.Data[:common.UUIDLength]),
+        timestampBytes: f.Data[common.UUIDLength:common.UUIDLength+8],
+        Signature: f.Data[common.UUIDLength+8:common.UUIDLength+8+common.SignatureLength],
+    }
+    req.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(req.timestampBytes)), 0)
+    return req, nil
+}
+
+// Verify checks the signature against the device's public key
+func (req *GetKeyRequest) Verify(deviceRSAPub *rsa.PublicKey) error {
+    signed := sha256.Sum256(append(append([]byte(common.GetKeyContext), req.UUID...), req.timestampBytes...))
+    err := rsa.VerifyPKCS1v15(deviceRSAPub, crypto.SHA256, signed[:], req.Signature)
+    if err != nil { return fmt.Errorf("Get key signature invalid for %s %v\n", req.UUID, err) }
+    return nil
+}
+
+// ParsePublicKey reads a device public key as it is stored at enrollment, PEM encoded PKIX
+func ParsePublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+    block, _ := pem.Decode(pemBytes)
+    if block == nil { return nil, fmt.Errorf("No PEM block in device public key\n")}
+    parsedPublicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil { return nil, fmt.Errorf("Can't parse from bytes to rsa.PubKey: %v\n", err)}
+
+    deviceRSAPub, ok := parsedPublicKey.(*rsa.PublicKey)
+    if !ok { return nil, fmt.Errorf("Device public key is a %T, not RSA\n", parsedPublicKey)}
+    return deviceRSAPub, nil
+}
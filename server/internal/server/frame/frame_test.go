@@ -0,0 +1,199 @@
+package frame
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "strings"
+    "testing"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/keyring"
+)
+
+const testUUID = "0b1c2d3e-4f50-6172-8394-a5b6c7d8e9f0"
+
+func TestReadRoundTrip(t *testing.T) {
+    types := []byte{
+        common.FrameTypeSendDeviceData, common.FrameTypeGetKey, common.FrameTypeTest,
+        common.FrameTypeSendDeviceDataV2, common.FrameTypeScanSightings, common.FrameTypeDeviceLogs,
+    }
+    for _, frameType := range types {
+        t.Run(TypeName(frameType), func(t *testing.T) {
+            sent := Frame{Type: frameType, Data: []byte("payload")}
+            if frameType == common.FrameTypeTest { sent.Data = nil }
+
+            // a second frame straight after, Read mustn't take any of it
+            wire := append(sent.Bytes(), Frame{Type: common.FrameTypeTest}.Bytes()...)
+            r := bytes.NewReader(wire)
+
+            got, err := Read(r)
+            if err != nil { t.Fatalf("Read: %v", err) }
+            if got.Type != sent.Type || !bytes.Equal(got.Data, sent.Data) { t.Fatalf("got %+v, sent %+v", got, sent) }
+
+            next, err := Read(r)
+            if err != nil { t.Fatalf("Read second frame: %v", err) }
+            if next.Type != common.FrameTypeTest { t.Fatalf("second frame is type %x", next.Type) }
+        })
+    }
+}
+
+func TestReadBytesLayout(t *testing.T) {
+    wire := Frame{Type: common.FrameTypeDeviceLogs, Data: make([]byte, 0x0102)}.Bytes()
+    if !bytes.Equal(wire[:5], []byte{0xAA, 0x55, common.FrameTypeDeviceLogs, 0x02, 0x01}) { t.Fatalf("header is % x", wire[:5]) }
+    if len(wire) != 5 + 0x0102 { t.Fatalf("frame is %d bytes", len(wire)) }
+
+    if wire := (Frame{Type: common.FrameTypeTest}).Bytes(); !bytes.Equal(wire, []byte{0xAA, 0x55, common.FrameTypeTest}) {
+        t.Fatalf("test frame is % x", wire)
+    }
+}
+
+func TestReadErrors(t *testing.T) {
+    whole := Frame{Type: common.FrameTypeDeviceLogs, Data: []byte("payload")}.Bytes()
+    tests := []struct {
+        name string
+        wire []byte
+        err  string
+    }{
+        {"empty", nil, "Can't read frame header"},
+        {"short header", whole[:2], "Can't read frame header"},
+        {"bad FRAMESTART", append([]byte{0x55, 0xAA}, whole[2:]...), "FRAMESTART doesn't match"},
+        {"unknown type", []byte{0xAA, 0x55, 0x7f, 0x00, 0x00}, "Frame type 7f invalid"},
+        {"no length", whole[:3], "Can't read length"},
+        {"short length", whole[:4], "Can't read length"},
+        {"no data", whole[:5], "Can't read data"},
+        {"short data", whole[:len(whole)-1], "Can't read data"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := Read(bytes.NewReader(tt.wire))
+            if err == nil { t.Fatalf("expected an error") }
+            if !strings.Contains(err.Error(), tt.err) { t.Fatalf("error %q doesn't mention %q", err, tt.err) }
+        })
+    }
+}
+
+// seal builds a sealed frame the way the client does
+func seal(t *testing.T, frameType byte, priv *rsa.PrivateKey, keyID uint16, key []byte, plaintext []byte) Frame {
+    t.Helper()
+    ciphertext, nonce, err := common.Encrypt(plaintext, key)
+    if err != nil { t.Fatalf("Encrypt: %v", err) }
+
+    var signed, keyIDBytes []byte
+    if frameType != common.FrameTypeSendDeviceData {
+        keyIDBytes = binary.LittleEndian.AppendUint16(nil, keyID)
+        signed = append(signed, keyIDBytes...)
+    }
+    digest := sha256.Sum256(append(signed, ciphertext...))
+    signature, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+    if err != nil { t.Fatalf("Sign: %v", err) }
+
+    data := append([]byte(testUUID), keyIDBytes...)
+    data = append(data, signature...)
+    data = append(data, nonce...)
+    data = append(data, ciphertext...)
+    return Frame{Type: frameType, Data: data}
+}
+
+func TestSealed(t *testing.T) {
+    priv, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil { t.Fatalf("GenerateKey: %v", err) }
+    other, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil { t.Fatalf("GenerateKey: %v", err) }
+
+    key0 := bytes.Repeat([]byte{0x11}, 32)
+    key1 := bytes.Repeat([]byte{0x22}, 32)
+    keys, err := keyring.Parse(strings.NewReader("0 decrypt-only " + hex.EncodeToString(key0) + "\n1 active " + hex.EncodeToString(key1)))
+    if err != nil { t.Fatalf("keyring: %v", err) }
+
+    tests := []struct {
+        name      string
+        frameType byte
+        keyID     uint16
+        key       []byte
+        hasKeyID  bool
+    }{
+        {"v1 always key 0", common.FrameTypeSendDeviceData, 0, key0, false},
+        {"v2", common.FrameTypeSendDeviceDataV2, 1, key1, true},
+        {"v2 old key", common.FrameTypeSendDeviceDataV2, 0, key0, true},
+        {"sightings", common.FrameTypeScanSightings, 1, key1, true},
+        {"logs", common.FrameTypeDeviceLogs, 1, key1, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := seal(t, tt.frameType, priv, tt.keyID, tt.key, []byte(`{"hello":"server"}`))
+
+            // through the wire format too, that's what the device server sees
+            f, err := Read(bytes.NewReader(f.Bytes()))
+            if err != nil { t.Fatalf("Read: %v", err) }
+
+            s, err := ParseSealed(f)
+            if err != nil { t.Fatalf("ParseSealed: %v", err) }
+            if s.UUID != testUUID || s.HasKeyID != tt.hasKeyID || s.KeyID != tt.keyID { t.Fatalf("parsed %s keyID %v %d", s.UUID, s.HasKeyID, s.KeyID) }
+            if len(s.Signature) != common.SignatureLength || len(s.Nonce) != common.NonceLength { t.Fatalf("signature %d nonce %d bytes", len(s.Signature), len(s.Nonce)) }
+
+            if err := s.Verify(&priv.PublicKey); err != nil { t.Fatalf("Verify: %v", err) }
+            if err := s.Verify(&other.PublicKey); err == nil { t.Fatalf("verified with another device's key") }
+
+            plaintext, err := s.Open(keys)
+            if err != nil { t.Fatalf("Open: %v", err) }
+            if string(plaintext) != `{"hello":"server"}` { t.Fatalf("opened %q", plaintext) }
+
+            tampered := *s
+            tampered.Ciphertext = append([]byte(nil), s.Ciphertext...)
+            tampered.Ciphertext[0] ^= 1
+            if err := tampered.Verify(&priv.PublicKey); err == nil { t.Fatalf("verified a tampered ciphertext") }
+            if _, err := tampered.Open(keys); err == nil { t.Fatalf("opened a tampered ciphertext") }
+
+            if tt.hasKeyID {
+                // the key ID is signed, so it can't be swapped for another
+                rekeyed := *s
+                rekeyed.KeyID = tt.keyID ^ 1
+                if err := rekeyed.Verify(&priv.PublicKey); err == nil { t.Fatalf("verified with a different key ID") }
+            }
+        })
+    }
+}
+
+func TestSealedRetiredKey(t *testing.T) {
+    priv, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil { t.Fatalf("GenerateKey: %v", err) }
+    key := bytes.Repeat([]byte{0x33}, 32)
+    keys, err := keyring.Parse(strings.NewReader("2 retired " + hex.EncodeToString(key) + "\n3 active " + strings.Repeat("44", 32)))
+    if err != nil { t.Fatalf("keyring: %v", err) }
+
+    for _, keyID := range []uint16{2, 9} {
+        s, err := ParseSealed(seal(t, common.FrameTypeSendDeviceDataV2, priv, keyID, key, []byte("x")))
+        if err != nil { t.Fatalf("ParseSealed: %v", err) }
+        if _, err := s.Open(keys); err == nil { t.Fatalf("opened with key %d", keyID) }
+    }
+}
+
+func TestParseSealedErrors(t *testing.T) {
+    v1Minimum := common.UUIDLength + common.SignatureLength + common.NonceLength + 6
+    tests := []struct {
+        name string
+        f    Frame
+        ok   bool
+    }{
+        {"not sealed", Frame{Type: common.FrameTypeGetKey, Data: make([]byte, 1000)}, false},
+        {"test frame", Frame{Type: common.FrameTypeTest}, false},
+        {"empty", Frame{Type: common.FrameTypeSendDeviceDataV2}, false},
+        {"v1 shortest", Frame{Type: common.FrameTypeSendDeviceData, Data: make([]byte, v1Minimum)}, true},
+        {"v1 a byte short", Frame{Type: common.FrameTypeSendDeviceData, Data: make([]byte, v1Minimum-1)}, false},
+        {"v2 shortest", Frame{Type: common.FrameTypeSendDeviceDataV2, Data: make([]byte, v1Minimum+common.KeyIDLength)}, true},
+        // long enough for v1 but not with a key ID
+        {"v2 a byte short", Frame{Type: common.FrameTypeSendDeviceDataV2, Data: make([]byte, v1Minimum+common.KeyIDLength-1)}, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := ParseSealed(tt.f)
+            if tt.ok && err != nil { t.Fatalf("ParseSealed: %v", err) }
+            if !tt.ok && err == nil { t.Fatalf("expected an error") }
+        })
+    }
+}
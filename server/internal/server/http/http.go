@@ -15,8 +15,13 @@ import (
     "github.com/golang-jwt/jwt/v5"
     "context"
     "strings"
+    "net"
+    "errors"
+    "io"
 
+    "server-indicum/internal/common"
     "server-indicum/internal/server/db"
+    "server-indicum/internal/server/export"
     "server-indicum/internal/server/ws"
 )
 
@@ -123,7 +128,14 @@ func JWTVerifier(jwtSecret []byte) func(http.Handler) http.Handler {
 }
 
 
-func HandleHTTPServer() {
+// api is the handlers that need the store
+type api struct {
+    store db.Store
+}
+
+// HandleHTTPServer serves the API until ctx is done. Requests get their context
+// from ctx, so shutting down cancels the queries they are waiting on.
+func HandleHTTPServer(ctx context.Context, store db.Store) {
 
     logLocation := os.Getenv("LOG_LOCATION")
 
@@ -153,14 +165,54 @@ func HandleHTTPServer() {
         Writer: fileLog,
     })
 
-    // allowedOrigin := os.Getenv("FRONTEND_SERVER_ADDRESS")
-    allowedOrigin := "*"
-
     jwtSecret := []byte(os.Getenv("SUPABASE_JWT_SECRET"))
 
     r := chi.NewRouter()
     // requestlogger automatically has requestID and recoverer middleware
     r.Use(httplog.RequestLogger(logger, []string{"/ping"}))
+    r.Mount("/", NewRouter(store, jwtSecret))
+
+    httpAddress := os.Getenv("HTTPLISTENADDRESS")
+
+    certFile := os.Getenv("TLS_CERT_FILE")
+    keyFile := os.Getenv("TLS_PRIV_KEY")
+
+    _, err = os.ReadFile(certFile)
+    if err != nil {
+        log.Fatalf("Failed to read certificate file: %v", err)
+    }
+
+    _, err = os.ReadFile(keyFile)
+    if err != nil {
+        log.Fatalf("Failed to read key file: %v", err)
+    }
+
+    server := &http.Server{
+        Addr: httpAddress,
+        Handler: r,
+        BaseContext: func(net.Listener) context.Context { return ctx },
+    }
+    go func() {
+        <-ctx.Done()
+        server.Close()
+    }()
+
+    fmt.Println("HTTPS server listening on", httpAddress)
+    if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+        log.Fatalf("Failed to start HTTPS server: %v", err)
+    }
+
+}
+
+// NewRouter has every route but the request logger, which needs the log file
+// HandleHTTPServer opens. Tests can serve it with httptest and a memstore.
+func NewRouter(store db.Store, jwtSecret []byte) http.Handler {
+    a := &api{store: store}
+
+    // allowedOrigin := os.Getenv("FRONTEND_SERVER_ADDRESS")
+    allowedOrigin := "*"
+
+    r := chi.NewRouter()
     r.Use(CORSHandler(allowedOrigin))
     r.Use(middleware.Heartbeat("/ping"))
 
@@ -168,7 +220,7 @@ func HandleHTTPServer() {
     // this is insecure $$
     // need to fix by either having an API key in ansible script (this is still vulnerable to people on device hacking)
     // or something else. I'm tireed rn can't think
-    r.Post("/map-token-pub-key", mapTokenPubKey)
+    r.Post("/map-token-pub-key", a.mapTokenPubKey)
 
 
     r.Group(func(r chi.Router) {
@@ -177,49 +229,36 @@ func HandleHTTPServer() {
         r.Get("/protected", protectedEndpoint)
         // a uuid will be passed in, and its corresponding token will be retreived
         // if no link exists, a token will be generated
-        r.Get("/get-profile", getProfile)
-        r.Get("/random-point", returnRandomPoint)
-        r.Get("/get-entries", getEntriesUUID)
-        r.Get("/leaderboad", getLeaderboard)
-        r.Get("/get-recent-entry", getRecentEntry)
-        r.Get("/statistics", getStatistics)
+        r.Get("/get-profile", a.getProfile)
+        r.Get("/random-point", a.returnRandomPoint)
+        r.Get("/get-entries", a.getEntriesUUID)
+        r.Get("/export", a.exportEntries)
+        r.Get("/leaderboad", a.getLeaderboard)
+        r.Get("/get-recent-entry", a.getRecentEntry)
+        r.Get("/statistics", a.getStatistics)
+        r.Get("/device-logs", a.getDeviceLogs)
+        r.Get("/placement-conflicts", a.getPlacementConflicts)
         // a request will be sent with token and pubkey
         // this will then be saved in the db
-        r.Post("/add-mapuuid", addMapUUIDEntry)
-        r.Post("/add-location" , addLocationEntry)
-        r.Post("/add-user" , addUser)
-        r.Post("/nearby-hotspots", getNearbyHotspots)
+        r.Post("/add-mapuuid", a.addMapUUIDEntry)
+        r.Post("/add-location" , a.addLocationEntry)
+        r.Post("/add-user" , a.addUser)
+        r.Post("/nearby-hotspots", a.getNearbyHotspots)
+        // leaving, see db/accounts.go
+        r.Post("/delete-account", a.deleteAccount)
+        r.Post("/cancel-delete-account", a.cancelDeleteAccount)
 
         r.Get("/ws", ws.WebSocketHandler)
     })
 
-    httpAddress := os.Getenv("HTTPLISTENADDRESS")
-
-    certFile := os.Getenv("TLS_CERT_FILE")
-    keyFile := os.Getenv("TLS_PRIV_KEY")
-
-    _, err = os.ReadFile(certFile)
-    if err != nil {
-        log.Fatalf("Failed to read certificate file: %v", err)
-    }
-
-    _, err = os.ReadFile(keyFile)
-    if err != nil {
-        log.Fatalf("Failed to read key file: %v", err)
-    }
-
-    fmt.Println("HTTPS server listening on", httpAddress)
-    if err := http.ListenAndServeTLS(httpAddress, certFile, keyFile, r); err != nil {
-        log.Fatalf("Failed to start HTTPS server: %v", err)
-    }
-
+    return r
 }
 
 func protectedEndpoint(w http.ResponseWriter, r *http.Request) {
     w.Write([]byte("Protected endpoint"))
 }
 
-func getStatistics(w http.ResponseWriter, r *http.Request) {
+func (a *api) getStatistics(w http.ResponseWriter, r *http.Request) {
     claims, ok := r.Context().Value("claims").(jwt.MapClaims)
     if !ok {
         http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
@@ -227,7 +266,7 @@ func getStatistics(w http.ResponseWriter, r *http.Request) {
     }
     uuid := claims["sub"].(string)
 
-    stats, err := db.DBGetStatistics(uuid)
+    stats, err := a.store.GetStatistics(r.Context(), uuid)
     if err != nil {
         http.Error(w, fmt.Sprintf("%v", err), http.StatusNotFound)
     }
@@ -240,7 +279,7 @@ func getStatistics(w http.ResponseWriter, r *http.Request) {
     w.Write(jsonResponse)
 }
 
-func getRecentEntry(w http.ResponseWriter, r *http.Request) {
+func (a *api) getRecentEntry(w http.ResponseWriter, r *http.Request) {
 
     claims, ok := r.Context().Value("claims").(jwt.MapClaims)
     if !ok {
@@ -249,7 +288,7 @@ func getRecentEntry(w http.ResponseWriter, r *http.Request) {
     }
 	uuid := claims["sub"].(string)
 
-    entry, err := db.DBGetRecentEntry(uuid)
+    entry, err := a.store.GetRecentEntry(r.Context(), uuid)
     if err != nil { 
         if err == fmt.Errorf("No entries in the last 10 minutes") {
             w.WriteHeader(http.StatusNoContent)
@@ -264,7 +303,62 @@ func getRecentEntry(w http.ResponseWriter, r *http.Request) {
     w.Write(jsonResponse)
 }
 
-func getNearbyHotspots(w http.ResponseWriter, r *http.Request) {
+// how many log lines /device-logs returns by default and at most
+const (
+    defaultDeviceLogLimit = 200
+    maxDeviceLogLimit     = 5000
+)
+
+// returns the logs the user's device uploaded, newest first. Takes ?limit=
+// and ?since= (unix milliseconds) to only get lines logged after that
+func (a *api) getDeviceLogs(w http.ResponseWriter, r *http.Request) {
+
+    w.Header().Set("Content-Type", "application/json")
+
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
+    limit := defaultDeviceLogLimit
+    if value := r.URL.Query().Get("limit"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed <= 0 {
+            http.Error(w, "Invalid limit value", http.StatusBadRequest)
+            return
+        }
+        limit = min(parsed, maxDeviceLogLimit)
+    }
+
+    var since int64
+    if value := r.URL.Query().Get("since"); value != "" {
+        parsed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || parsed < 0 {
+            http.Error(w, "Invalid since value", http.StatusBadRequest)
+            return
+        }
+        since = parsed
+    }
+
+    logs, err := a.store.GetDeviceLogs(r.Context(), uuid, since, limit)
+    if err != nil {
+        log.Printf("Can't get device logs: %v\n", err)
+        http.Error(w, "Can't get device logs", http.StatusInternalServerError)
+        return
+    }
+
+    jsonResponse, err := json.Marshal(logs)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    w.Write(jsonResponse)
+}
+
+func (a *api) getNearbyHotspots(w http.ResponseWriter, r *http.Request) {
 
     w.Header().Set("Content-Type", "application/json")
 
@@ -292,7 +386,7 @@ func getNearbyHotspots(w http.ResponseWriter, r *http.Request) {
         return
     }
     fmt.Println("getting nearby hotspots")
-    hotspots, err := db.DBGetNearbyHotspots(lat, lon)
+    hotspots, err := a.store.GetNearbyHotspots(r.Context(), lat, lon)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
@@ -307,17 +401,17 @@ func getNearbyHotspots(w http.ResponseWriter, r *http.Request) {
     w.Write(jsonResponse)
 }
 
-func getLeaderboard(w http.ResponseWriter, r *http.Request) {
+func (a *api) getLeaderboard(w http.ResponseWriter, r *http.Request) {
     
     w.Header().Set("Content-Type", "application/json") 
 
-    leaderboard, err := db.DBGetLeaderboard()
+    leaderboard, err := a.store.GetLeaderboard(r.Context())
     if err != nil {
-        fmt.Println("can't get leaderboard %v\n", err)
+        fmt.Printf("can't get leaderboard %v\n", err)
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
-    fmt.Println("Successfully got leaderboard %+v\n", leaderboard)
+    fmt.Printf("Successfully got leaderboard %+v\n", leaderboard)
     jsonResponse, err := json.Marshal(leaderboard)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -328,7 +422,7 @@ func getLeaderboard(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func addUser(w http.ResponseWriter, r *http.Request) {
+func (a *api) addUser(w http.ResponseWriter, r *http.Request) {
     type requestBody struct {
         UUID  string `json:"id"`
         Email string `json:"email"`
@@ -342,21 +436,21 @@ func addUser(w http.ResponseWriter, r *http.Request) {
     }
 
     // Check if user already exists
-    _, err = db.DBGetStatistics(body.UUID)
+    _, err = a.store.GetStatistics(r.Context(), body.UUID)
     if err == nil {
         // User already exists
         http.Error(w, "User already exists", http.StatusConflict)
         return
     } 
     // Add user
-    err = db.DBAddUser(body.UUID, body.Email)
+    err = a.store.AddUser(r.Context(), body.UUID, body.Email)
     if err != nil {
         http.Error(w, "Failed to add user", http.StatusInternalServerError)
         return
     }
 
     // Initialize user statistics
-    err = db.DBInitializeUserStatistics(body.UUID)
+    err = a.store.InitializeUserStatistics(r.Context(), body.UUID)
     if err != nil {
         http.Error(w, "Failed to initialize user statistics", http.StatusInternalServerError)
         return
@@ -368,12 +462,14 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func getProfile(w http.ResponseWriter, r *http.Request) {
+func (a *api) getProfile(w http.ResponseWriter, r *http.Request) {
     type ProfileResponse struct {
-        Token    string `json:"token"`
-        Email    string `json:"email"`
-        Username string `json:"username"`
-        UUID     string `json:"uuid"`
+        Token       string `json:"token"`
+        Email       string `json:"email"`
+        Username    string `json:"username"`
+        UUID        string `json:"uuid"`
+        // unix seconds the account will be erased, empty unless deletion was asked for
+        DeletionDue string `json:"deletion_due"`
     }
     
     // Set CORS headers first
@@ -386,7 +482,7 @@ func getProfile(w http.ResponseWriter, r *http.Request) {
     }
     
     uuid := claims["sub"].(string)
-    profile, err := db.DBGetUserProfile(uuid)
+    profile, err := a.store.GetUserProfile(r.Context(), uuid)
     if err != nil {
         w.WriteHeader(http.StatusInternalServerError)
         response := map[string]string{"error": "Error retrieving profile"}
@@ -396,17 +492,18 @@ func getProfile(w http.ResponseWriter, r *http.Request) {
     }
     
     response := ProfileResponse{
-        Token:    profile["token"],
-        Email:    profile["email"],
-        Username: profile["username"],
-        UUID:     profile["uuid"],
+        Token:       profile["token"],
+        Email:       profile["email"],
+        Username:    profile["username"],
+        UUID:        profile["uuid"],
+        DeletionDue: profile["deletion_due"],
     }
     
     json.NewEncoder(w).Encode(response) // Encode the response as JSON and write it
 }
 
 
-func mapTokenPubKey(w http.ResponseWriter, r *http.Request) {
+func (a *api) mapTokenPubKey(w http.ResponseWriter, r *http.Request) {
 
     
     w.Header().Set("Content-Type", "application/json") // Set the Content-Type as application/json
@@ -432,8 +529,8 @@ func mapTokenPubKey(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Call the db.SavePubKey method with the token and public key
-    uuid, err := db.DBSavePubKey(body.Token, body.PubKey)
+    // Call the store SavePubKey method with the token and public key
+    uuid, deviceSecret, err := a.store.SavePubKey(r.Context(), body.Token, body.PubKey)
     if err != nil {
         // Log the error for internal debugging.
         log.Printf("Failed to save public key: %v", err)
@@ -444,18 +541,93 @@ func mapTokenPubKey(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // the device keeps the secret to attest its payloads, it is only ever sent here
     type responseBody struct {
-        UUID string `json:"uuid"`
+        UUID         string `json:"uuid"`
+        DeviceSecret string `json:"device_secret"`
     }
 
     w.WriteHeader(http.StatusOK)
-    response := responseBody{UUID: uuid}
+    response := responseBody{UUID: uuid, DeviceSecret: deviceSecret}
     json.NewEncoder(w).Encode(response)
     // Respond to the request indicating success
     // w.Write([]byte("Public key successfully mapped to token"))
 }
 
-func addMapUUIDEntry(w http.ResponseWriter, r *http.Request) {
+// deleteAccount revokes the user's device straight away and erases the account
+// once the grace period is over. Asking again doesn't move the date.
+func (a *api) deleteAccount(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
+    due, err := a.store.RequestAccountDeletion(r.Context(), uuid, db.AccountDeletionGrace())
+    if err != nil {
+        log.Printf("Can't delete account: %v\n", err)
+        http.Error(w, "Can't delete account", http.StatusInternalServerError)
+        return
+    }
+
+    type responseBody struct {
+        DeletionDue int64 `json:"deletion_due"`
+    }
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(responseBody{DeletionDue: due.Unix()})
+}
+
+// cancelDeleteAccount keeps the account if it hasn't been erased yet. The
+// device stays revoked until it is enrolled again.
+func (a *api) cancelDeleteAccount(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
+    err := a.store.CancelAccountDeletion(r.Context(), uuid)
+    if errors.Is(err, db.ErrNoDeletionPending) {
+        http.Error(w, "No account deletion pending", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Printf("Can't cancel account deletion: %v\n", err)
+        http.Error(w, "Can't cancel account deletion", http.StatusInternalServerError)
+        return
+    }
+    w.Write([]byte(`{"message": "Account deletion cancelled"}`))
+}
+
+// getPlacementConflicts lists the payphones users have placed at different
+// hotspots without consensus, so more of them can go and check
+func (a *api) getPlacementConflicts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    conflicts, err := a.store.GetPlacementConflicts(r.Context())
+    if err != nil {
+        log.Printf("Can't get placement conflicts: %v\n", err)
+        http.Error(w, "Can't get placement conflicts", http.StatusInternalServerError)
+        return
+    }
+    if conflicts == nil { conflicts = []common.PlacementConflict{} }
+
+    jsonResponse, err := json.Marshal(conflicts)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error marshaling JSON: %v", err), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+    w.Write(jsonResponse)
+}
+
+func (a *api) addMapUUIDEntry(w http.ResponseWriter, r *http.Request) {
     fmt.Println("adding map to entry");
 
     if r.Method != "POST" {
@@ -468,6 +640,13 @@ func addMapUUIDEntry(w http.ResponseWriter, r *http.Request) {
         MapUUID string
     }
 
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
     var new inputData
     err := json.NewDecoder(r.Body).Decode(&new)
     fmt.Println("getting there")
@@ -475,10 +654,15 @@ func addMapUUIDEntry(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
-    err = db.DBAddMapUUIDEntry(new.EntryID, new.MapUUID)
+    err = a.store.AddMapUUIDEntry(r.Context(), uuid, new.EntryID, new.MapUUID)
+    if errors.Is(err, db.ErrEntryNotFound) {
+        http.Error(w, "No such entry", http.StatusNotFound)
+        return
+    }
     if err != nil { 
-        fmt.Println("Can't add to DB %v\n", err)
+        fmt.Printf("Can't add to DB %v\n", err)
         http.Error(w, fmt.Sprintf("Failed to add to DB: %v", err), http.StatusBadRequest)
+        return
     }
 
 
@@ -487,7 +671,7 @@ func addMapUUIDEntry(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func addLocationEntry(w http.ResponseWriter, r *http.Request) {
+func (a *api) addLocationEntry(w http.ResponseWriter, r *http.Request) {
     fmt.Println("adding location to entry");
 
     if r.Method != "POST" {
@@ -501,6 +685,13 @@ func addLocationEntry(w http.ResponseWriter, r *http.Request) {
         Longitude string
     }
 
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
     var new inputData
     err := json.NewDecoder(r.Body).Decode(&new)
     fmt.Println("getting there")
@@ -508,10 +699,15 @@ func addLocationEntry(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
-    err = db.DBUpdateLocation(new.EntryID, new.Latitude, new.Longitude)
+    err = a.store.UpdateLocation(r.Context(), uuid, new.EntryID, new.Latitude, new.Longitude)
+    if errors.Is(err, db.ErrEntryNotFound) {
+        http.Error(w, "No such entry", http.StatusNotFound)
+        return
+    }
     if err != nil { 
-        fmt.Println("Can't add to DB %v\n", err)
+        fmt.Printf("Can't add to DB %v\n", err)
         http.Error(w, fmt.Sprintf("Failed to add to DB: %v", err), http.StatusBadRequest)
+        return
     }
 
 
@@ -519,7 +715,7 @@ func addLocationEntry(w http.ResponseWriter, r *http.Request) {
     w.Write([]byte(`{"message": "Entry updated successfully"}`))
 }
 
-func getEntriesUUID(w http.ResponseWriter, r *http.Request) {
+func (a *api) getEntriesUUID(w http.ResponseWriter, r *http.Request) {
 
     claims, ok := r.Context().Value("claims").(jwt.MapClaims)
     if !ok {
@@ -533,13 +729,13 @@ func getEntriesUUID(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    entries, err := db.DBGetEntriesWithUUID(uuid)
+    entries, err := a.store.GetEntriesWithUUID(r.Context(), uuid)
     if err != nil {
-        fmt.Println("can't get entries %v\n", err)
+        fmt.Printf("can't get entries %v\n", err)
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
-    fmt.Println("Successfully got entries %+v\n", entries)
+    fmt.Printf("Successfully got entries %+v\n", entries)
     jsonResponse, err := json.Marshal(entries)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -551,8 +747,72 @@ func getEntriesUUID(w http.ResponseWriter, r *http.Request) {
     w.Write(jsonResponse)
 }
 
-func returnRandomPoint(w http.ResponseWriter, r *http.Request) {
-    dataPoint, err := db.DBGetRandomPoint()
+// sentWriter notes whether anything has been written, after that an error can't
+// change the status any more
+type sentWriter struct {
+    w    io.Writer
+    sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+    s.sent = true
+    return s.w.Write(p)
+}
+
+// exportEntries streams the user's entries, with their hotspots, in ?format=
+// geojson (the default), gpx, kml or csv. ?from= and ?to= (unix seconds) only
+// export entries recorded from and before then.
+func (a *api) exportEntries(w http.ResponseWriter, r *http.Request) {
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Could not get claims from context", http.StatusInternalServerError)
+        return
+    }
+    uuid := claims["sub"].(string)
+
+    name := r.URL.Query().Get("format")
+    if name == "" { name = "geojson" }
+    format, ok := export.Formats[name]
+    if !ok {
+        http.Error(w, "Unknown format, use geojson, gpx, kml or csv", http.StatusBadRequest)
+        return
+    }
+
+    var bounds [2]int64
+    for i, param := range []string{"from", "to"} {
+        value := r.URL.Query().Get(param)
+        if value == "" { continue }
+        parsed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || parsed <= 0 {
+            http.Error(w, fmt.Sprintf("Invalid %s value", param), http.StatusBadRequest)
+            return
+        }
+        bounds[i] = parsed
+    }
+    from, to := bounds[0], bounds[1]
+    if from > 0 && to > 0 && from >= to {
+        http.Error(w, "from has to be before to", http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", format.ContentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="discoveries.%s"`, format.Extension))
+    out := &sentWriter{w: w}
+    writer := format.New(out)
+    err := a.store.ExportEntries(r.Context(), uuid, from, to, writer.Write)
+    if err == nil { err = writer.Close() }
+    if err != nil {
+        log.Printf("Can't export entries: %v\n", err)
+        // once the document has started the client gets it cut short instead
+        if !out.sent {
+            w.Header().Del("Content-Disposition")
+            http.Error(w, "Can't export entries", http.StatusInternalServerError)
+        }
+    }
+}
+
+func (a *api) returnRandomPoint(w http.ResponseWriter, r *http.Request) {
+    dataPoint, err := a.store.GetRandomPoint(r.Context())
     if err != nil { 
         http.Error(w, fmt.Sprintf("Can't get point: %v", err), http.StatusInternalServerError)
     }
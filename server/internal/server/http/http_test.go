@@ -0,0 +1,286 @@
+package http
+
+import (
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+
+    "server-indicum/internal/common"
+    "server-indicum/internal/server/db/memstore"
+)
+
+var testSecret = []byte("test-jwt-secret")
+
+// token is a JWT for uuid the way Supabase signs them
+func token(t *testing.T, uuid string, expires time.Time) string {
+    signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": uuid, "exp": expires.Unix()}).SignedString(testSecret)
+    if err != nil { t.Fatal(err) }
+    return signed
+}
+
+// testAPI is the router over a memstore with users a and b and a hotspot
+type testAPI struct {
+    store   *memstore.Store
+    handler http.Handler
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+    store := memstore.New()
+    store.AddHotspot("hotspot-1", -37.8136, 144.9631, "1 Swanston St")
+    store.AddHotspot("hotspot-2", -37.8183, 144.9671, "2 Flinders St")
+    for _, uuid := range []string{"a", "b"} {
+        if err := store.AddUser(context.Background(), uuid, uuid+"@example.com"); err != nil { t.Fatal(err) }
+    }
+    return &testAPI{store: store, handler: NewRouter(store, testSecret)}
+}
+
+// addEntry gives uuid an entry recorded at recorded, with a GPS fix next to hotspot-1 if located
+func (a *testAPI) addEntry(t *testing.T, uuid, payphoneID string, recorded int64, located bool) int {
+    payload := common.Payload{PayphoneID: payphoneID, PayphoneMAC: "aa:bb:cc:dd:ee:ff", PayphoneTime: recorded, Time: recorded}
+    if located { payload.Fix = &common.Fix{Lat: -37.8136, Long: 144.9631, Accuracy: 5, Time: recorded} }
+    id, err := a.store.AddEntry(context.Background(), payload, uuid, 1, 0)
+    if err != nil { t.Fatal(err) }
+    return int(id)
+}
+
+// do sends a request as uuid, no uuid sends it without a token
+func (a *testAPI) do(t *testing.T, method, target, uuid string, body any) *httptest.ResponseRecorder {
+    var reader *strings.Reader
+    if body == nil {
+        reader = strings.NewReader("")
+    } else {
+        encoded, err := json.Marshal(body)
+        if err != nil { t.Fatal(err) }
+        reader = strings.NewReader(string(encoded))
+    }
+    r := httptest.NewRequest(method, target, reader)
+    if uuid != "" { r.Header.Set("Authorization", "Bearer "+token(t, uuid, time.Now().Add(time.Hour))) }
+    w := httptest.NewRecorder()
+    a.handler.ServeHTTP(w, r)
+    return w
+}
+
+func (a *testAPI) entries(t *testing.T, uuid string) []common.Entry {
+    w := a.do(t, "GET", "/get-entries", uuid, nil)
+    if w.Code != http.StatusOK { t.Fatalf("/get-entries is %d %s", w.Code, w.Body) }
+    var entries []common.Entry
+    if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil { t.Fatal(err) }
+    return entries
+}
+
+func TestAuth(t *testing.T) {
+    a := newTestAPI(t)
+    otherSecret, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "a"}).SignedString([]byte("another secret"))
+    unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "a"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+    tests := []struct {
+        name   string
+        header string
+        query  string
+        status int
+        body   string
+    }{
+        {"no token", "", "", http.StatusUnauthorized, "Unauthorized"},
+        {"not bearer", "Basic " + token(t, "a", time.Now().Add(time.Hour)), "", http.StatusUnauthorized, "Unauthorized"},
+        {"garbage", "Bearer not-a-jwt", "", http.StatusUnauthorized, "Invalid token"},
+        {"other secret", "Bearer " + otherSecret, "", http.StatusUnauthorized, "Invalid token"},
+        {"unsigned", "Bearer " + unsigned, "", http.StatusUnauthorized, "Invalid token"},
+        {"expired", "Bearer " + token(t, "a", time.Now().Add(-time.Hour)), "", http.StatusUnauthorized, "Token expired"},
+        {"header", "Bearer " + token(t, "a", time.Now().Add(time.Hour)), "", http.StatusOK, "Protected endpoint"},
+        {"query", "", "?jwt=" + token(t, "a", time.Now().Add(time.Hour)), http.StatusOK, "Protected endpoint"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/protected"+test.query, nil)
+            if test.header != "" { r.Header.Set("Authorization", test.header) }
+            w := httptest.NewRecorder()
+            a.handler.ServeHTTP(w, r)
+            if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) { t.Fatalf("got %d %q, expected %d %q", w.Code, w.Body, test.status, test.body) }
+        })
+    }
+
+    // every route but the heartbeat and enrolment needs the token
+    for _, route := range []string{"GET /get-entries", "GET /export", "POST /add-mapuuid", "POST /add-location", "POST /delete-account"} {
+        method, path, _ := strings.Cut(route, " ")
+        if w := a.do(t, method, path, "", nil); w.Code != http.StatusUnauthorized { t.Errorf("%s without a token is %d", route, w.Code) }
+    }
+    if w := a.do(t, "GET", "/ping", "", nil); w.Code != http.StatusOK { t.Errorf("/ping is %d", w.Code) }
+}
+
+func TestGetEntries(t *testing.T) {
+    a := newTestAPI(t)
+    a.addEntry(t, "a", "0312345678", 1700000000, true)
+    a.addEntry(t, "a", "0312345679", 1700000100, false)
+    a.addEntry(t, "b", "0312345680", 1700000200, false)
+
+    entries := a.entries(t, "a")
+    if len(entries) != 2 { t.Fatalf("a has %d entries, expected 2", len(entries)) }
+    for _, e := range entries {
+        if e.DeviceUUID != "a" { t.Fatalf("a got %s's entry %d", e.DeviceUUID, e.ID) }
+    }
+    if entries[0].MapLatitude == "" { t.Fatalf("entry with a GPS fix isn't located: %+v", entries[0]) }
+
+    if entries := a.entries(t, "b"); len(entries) != 1 || entries[0].PayphoneID != "0312345680" { t.Fatalf("b's entries are %+v", entries) }
+}
+
+func TestAddMapUUIDOwnership(t *testing.T) {
+    a := newTestAPI(t)
+    id := a.addEntry(t, "a", "0312345678", 1700000000, false)
+
+    tests := []struct {
+        name   string
+        uuid   string
+        body   map[string]any
+        status int
+    }{
+        {"someone else's entry", "b", map[string]any{"EntryID": id, "MapUUID": "hotspot-2"}, http.StatusNotFound},
+        {"no such entry", "a", map[string]any{"EntryID": id + 10, "MapUUID": "hotspot-2"}, http.StatusNotFound},
+        {"bad body", "a", map[string]any{"EntryID": "one"}, http.StatusBadRequest},
+        {"own entry", "a", map[string]any{"EntryID": id, "MapUUID": "hotspot-1"}, http.StatusOK},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if w := a.do(t, "POST", "/add-mapuuid", test.uuid, test.body); w.Code != test.status { t.Fatalf("got %d %s, expected %d", w.Code, w.Body, test.status) }
+        })
+    }
+    if entries := a.entries(t, "a"); entries[0].MapUUID != "hotspot-1" { t.Fatalf("entry is placed at %q, expected hotspot-1", entries[0].MapUUID) }
+
+    // /add-location has the same check
+    if w := a.do(t, "POST", "/add-location", "b", map[string]any{"EntryID": id, "Latitude": "-37.8183", "Longitude": "144.9671"}); w.Code != http.StatusNotFound {
+        t.Fatalf("b moving a's entry is %d %s", w.Code, w.Body)
+    }
+    if entries := a.entries(t, "a"); entries[0].MapLatitude != "" { t.Fatalf("b moved a's entry to %s", entries[0].MapLatitude) }
+    if w := a.do(t, "POST", "/add-location", "a", map[string]any{"EntryID": id, "Latitude": "-37.8183", "Longitude": "144.9671"}); w.Code != http.StatusOK {
+        t.Fatalf("a moving their entry is %d %s", w.Code, w.Body)
+    }
+    if entries := a.entries(t, "a"); entries[0].MapLatitude != "-37.8183" { t.Fatalf("entry is at %s after moving it", entries[0].MapLatitude) }
+}
+
+func TestExport(t *testing.T) {
+    a := newTestAPI(t)
+    a.addEntry(t, "a", "0312345678", 1700000000, true)
+    a.addEntry(t, "a", "0312345679", 1700000100, false)
+    a.addEntry(t, "a", "0312345680", 1700000200, true)
+    a.addEntry(t, "b", "0312345681", 1700000300, true)
+
+    // count is how many of a's entries the document has, GPX and KML leave out the unlocated one
+    count := map[string]func(t *testing.T, body []byte) int{
+        "geojson": func(t *testing.T, body []byte) int {
+            var collection struct{ Features []json.RawMessage }
+            if err := json.Unmarshal(body, &collection); err != nil { t.Fatal(err) }
+            return len(collection.Features)
+        },
+        "gpx": func(t *testing.T, body []byte) int {
+            var gpx struct{ Waypoints []struct{} `xml:"wpt"` }
+            if err := xml.Unmarshal(body, &gpx); err != nil { t.Fatal(err) }
+            return len(gpx.Waypoints)
+        },
+        "kml": func(t *testing.T, body []byte) int {
+            var kml struct{ Placemarks []struct{} `xml:"Document>Placemark"` }
+            if err := xml.Unmarshal(body, &kml); err != nil { t.Fatal(err) }
+            return len(kml.Placemarks)
+        },
+        "csv": func(t *testing.T, body []byte) int {
+            // less the header row
+            return strings.Count(string(body), "\n") - 1
+        },
+    }
+
+    tests := []struct {
+        format      string
+        query       string
+        contentType string
+        entries     int
+    }{
+        {"geojson", "", "application/geo+json", 3},
+        {"geojson", "format=geojson", "application/geo+json", 3},
+        {"gpx", "format=gpx", "application/gpx+xml", 2},
+        {"kml", "format=kml", "application/vnd.google-earth.kml+xml", 2},
+        {"csv", "format=csv", "text/csv; charset=utf-8", 3},
+        {"geojson", "from=1700000100", "application/geo+json", 2},
+        {"geojson", "to=1700000100", "application/geo+json", 1},
+        {"csv", "format=csv&from=1700000100&to=1700000200", "text/csv; charset=utf-8", 1},
+        {"csv", "format=csv&from=1800000000", "text/csv; charset=utf-8", 0},
+        {"gpx", "format=gpx&from=1800000000", "application/gpx+xml", 0},
+    }
+    for _, test := range tests {
+        t.Run(test.query, func(t *testing.T) {
+            w := a.do(t, "GET", "/export?"+test.query, "a", nil)
+            if w.Code != http.StatusOK { t.Fatalf("got %d %s", w.Code, w.Body) }
+            if got := w.Header().Get("Content-Type"); got != test.contentType { t.Fatalf("content type is %q, expected %q", got, test.contentType) }
+            disposition := fmt.Sprintf(`attachment; filename="discoveries.%s"`, test.format)
+            if got := w.Header().Get("Content-Disposition"); got != disposition { t.Fatalf("content disposition is %q", got) }
+            if got := count[test.format](t, w.Body.Bytes()); got != test.entries { t.Fatalf("exported %d entries, expected %d:\n%s", got, test.entries, w.Body) }
+            if strings.Contains(w.Body.String(), "0312345681") { t.Fatal("exported b's entry") }
+        })
+    }
+
+    for _, query := range []string{"format=shp", "from=yesterday", "to=-5", "from=0", "from=1700000200&to=1700000100", "from=1700000100&to=1700000100"} {
+        t.Run(query, func(t *testing.T) {
+            w := a.do(t, "GET", "/export?"+query, "a", nil)
+            if w.Code != http.StatusBadRequest { t.Fatalf("got %d %s, expected 400", w.Code, w.Body) }
+            if w.Header().Get("Content-Disposition") != "" { t.Fatal("an error is sent as an attachment") }
+        })
+    }
+}
+
+func TestDeleteAccount(t *testing.T) {
+    t.Setenv("ACCOUNT_DELETION_GRACE", "72h")
+    a := newTestAPI(t)
+    now := time.Unix(1700000000, 0)
+    a.store.SetClock(func() time.Time { return now })
+    a.addEntry(t, "a", "0312345678", 1700000000, true)
+    a.addEntry(t, "b", "0312345679", 1700000000, true)
+
+    deletionDue := func(w *httptest.ResponseRecorder) int64 {
+        if w.Code != http.StatusAccepted { t.Fatalf("/delete-account is %d %s", w.Code, w.Body) }
+        var response struct{ DeletionDue int64 `json:"deletion_due"` }
+        if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil { t.Fatal(err) }
+        return response.DeletionDue
+    }
+    due := deletionDue(a.do(t, "POST", "/delete-account", "a", nil))
+    if expected := now.Add(72 * time.Hour).Unix(); due != expected { t.Fatalf("deletion is due %d, expected %d", due, expected) }
+
+    // asking again doesn't move the date
+    now = now.Add(time.Hour)
+    if again := deletionDue(a.do(t, "POST", "/delete-account", "a", nil)); again != due { t.Fatalf("asking again moved the deletion to %d from %d", again, due) }
+
+    if w := a.do(t, "POST", "/cancel-delete-account", "a", nil); w.Code != http.StatusOK { t.Fatalf("cancelling is %d %s", w.Code, w.Body) }
+    if w := a.do(t, "POST", "/cancel-delete-account", "a", nil); w.Code != http.StatusNotFound { t.Fatalf("cancelling without a deletion pending is %d %s", w.Code, w.Body) }
+
+    // once the grace period is over the entries are gone, b's are kept
+    deletionDue(a.do(t, "POST", "/delete-account", "a", nil))
+    now = now.Add(73 * time.Hour)
+    if entries := a.entries(t, "a"); len(entries) != 0 { t.Fatalf("a still has %d entries after the account was erased", len(entries)) }
+    if entries := a.entries(t, "b"); len(entries) != 1 { t.Fatalf("b has %d entries after a was erased", len(entries)) }
+    if w := a.do(t, "POST", "/cancel-delete-account", "a", nil); w.Code != http.StatusNotFound { t.Fatalf("cancelling after the erasure is %d %s", w.Code, w.Body) }
+}
+
+// erasing an account leaves the other users' entry IDs where they were
+func TestPlaceAfterErasure(t *testing.T) {
+    t.Setenv("ACCOUNT_DELETION_GRACE", "0s")
+    a := newTestAPI(t)
+    a.addEntry(t, "a", "0312345678", 1700000000, false)
+    id := a.addEntry(t, "b", "0312345679", 1700000100, false)
+
+    if w := a.do(t, "POST", "/delete-account", "a", nil); w.Code != http.StatusAccepted { t.Fatalf("/delete-account is %d %s", w.Code, w.Body) }
+    if entries := a.entries(t, "a"); len(entries) != 0 { t.Fatalf("a still has %d entries after the account was erased", len(entries)) }
+
+    if w := a.do(t, "POST", "/add-mapuuid", "b", map[string]any{"EntryID": id, "MapUUID": "hotspot-1"}); w.Code != http.StatusOK { t.Fatalf("b placing their entry is %d %s", w.Code, w.Body) }
+    newID := a.addEntry(t, "b", "0312345680", 1700000200, false)
+    if newID == id { t.Fatalf("new entry reused ID %d", id) }
+
+    entries := a.entries(t, "b")
+    if len(entries) != 2 || entries[0].ID != id || entries[0].MapUUID != "hotspot-1" || entries[1].MapUUID != "" { t.Fatalf("b's entries are %+v", entries) }
+    if w := a.do(t, "POST", "/add-location", "b", map[string]any{"EntryID": newID, "Latitude": "-37.8183", "Longitude": "144.9671"}); w.Code != http.StatusOK {
+        t.Fatalf("b moving their new entry is %d %s", w.Code, w.Body)
+    }
+}
@@ -0,0 +1,125 @@
+// The keyring holds the symmetric keys used to encrypt device payloads. Every
+// frame says which key it was encrypted with, so keys can be rotated without
+// updating the whole fleet at once:
+//   active        the key handed out to devices (FrameTypeGetKey), exactly one
+//   decrypt-only  still accepted from devices that haven't picked up the new key
+//   retired       rejected
+package keyring
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+
+    "server-indicum/internal/common"
+)
+
+type State string
+
+const (
+    StateActive      State = "active"
+    StateDecryptOnly State = "decrypt-only"
+    StateRetired     State = "retired"
+)
+
+type Key struct {
+    ID     uint16
+    State  State
+    Secret []byte
+}
+
+type Keyring struct {
+    keys   map[uint16]*Key
+    active *Key
+}
+
+// Load reads the keyring from the file in PAYLOAD_KEYRING_FILE, or from
+// PAYLOAD_KEYRING with the lines separated by ';'. If neither is set the
+// keyring is just common.KeyOne as key 0, which is what every device used
+// before frames carried a key ID.
+func Load() (*Keyring, error) {
+    if path := os.Getenv("PAYLOAD_KEYRING_FILE"); path != "" {
+        file, err := os.Open(path)
+        if err != nil { return nil, fmt.Errorf("Can't open keyring file %v", err) }
+        defer file.Close()
+        return Parse(file)
+    }
+    if inline := os.Getenv("PAYLOAD_KEYRING"); inline != "" {
+        return Parse(strings.NewReader(strings.ReplaceAll(inline, ";", "\n")))
+    }
+    return Parse(strings.NewReader("0 active " + common.KeyOne))
+}
+
+// Parse reads one key per line as `<id> <state> <hex key>`, # starts a comment
+func Parse(r io.Reader) (*Keyring, error) {
+    k := &Keyring{keys: make(map[uint16]*Key)}
+
+    scanner := bufio.NewScanner(r)
+    lineNumber := 0
+    for scanner.Scan() {
+        lineNumber++
+        line := scanner.Text()
+        if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+        fields := strings.Fields(line)
+        if len(fields) == 0 { continue }
+        if len(fields) != 3 { return nil, fmt.Errorf("Keyring line %d: expected <id> <state> <key>", lineNumber) }
+
+        id, err := strconv.ParseUint(fields[0], 10, 16)
+        if err != nil { return nil, fmt.Errorf("Keyring line %d: bad key id %q", lineNumber, fields[0]) }
+
+        state := State(fields[1])
+        if state != StateActive && state != StateDecryptOnly && state != StateRetired {
+            return nil, fmt.Errorf("Keyring line %d: unknown state %q", lineNumber, fields[1])
+        }
+
+        secret, err := hex.DecodeString(fields[2])
+        if err != nil { return nil, fmt.Errorf("Keyring line %d: key is not hex", lineNumber) }
+        // AES-256 GCM, retired keys are kept for the record so don't check them
+        if state != StateRetired && len(secret) != 32 {
+            return nil, fmt.Errorf("Keyring line %d: key %d is %d bytes, expected 32", lineNumber, id, len(secret))
+        }
+
+        if _, ok := k.keys[uint16(id)]; ok { return nil, fmt.Errorf("Keyring line %d: duplicate key id %d", lineNumber, id) }
+        key := &Key{ID: uint16(id), State: state, Secret: secret}
+        k.keys[key.ID] = key
+
+        if state == StateActive {
+            if k.active != nil { return nil, fmt.Errorf("Keyring has more than one active key (%d and %d)", k.active.ID, key.ID) }
+            k.active = key
+        }
+    }
+    if err := scanner.Err(); err != nil { return nil, fmt.Errorf("Can't read keyring %v", err) }
+    if k.active == nil { return nil, fmt.Errorf("Keyring has no active key") }
+
+    return k, nil
+}
+
+// DecryptionKey returns the key a frame with keyID should be decrypted with
+func (k *Keyring) DecryptionKey(keyID uint16) ([]byte, error) {
+    key, ok := k.keys[keyID]
+    if !ok { return nil, fmt.Errorf("Unknown payload key %d", keyID) }
+    if key.State == StateRetired { return nil, fmt.Errorf("Payload key %d is retired", keyID) }
+    return key.Secret, nil
+}
+
+// Active is the key devices should be encrypting with
+func (k *Keyring) Active() *Key {
+    return k.active
+}
+
+func (k *Keyring) String() string {
+    var ids []int
+    for id := range k.keys { ids = append(ids, int(id)) }
+    sort.Ints(ids)
+
+    var parts []string
+    for _, id := range ids {
+        parts = append(parts, fmt.Sprintf("%d:%s", id, k.keys[uint16(id)].State))
+    }
+    return strings.Join(parts, " ")
+}
@@ -0,0 +1,127 @@
+package keyring
+
+import (
+    "bytes"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "server-indicum/internal/common"
+)
+
+var (
+    key1 = strings.Repeat("11", 32)
+    key2 = strings.Repeat("22", 32)
+    key3 = strings.Repeat("33", 32)
+)
+
+func TestParse(t *testing.T) {
+    tests := []struct {
+        name   string
+        ring   string
+        active uint16
+        // err is part of the error, empty when the keyring should parse
+        err    string
+    }{
+        {"one key", "1 active " + key1, 1, ""},
+        {"rotation", "# rotated in March\n1 retired abcd\n2 decrypt-only " + key2 + "\n\n3 active " + key3 + " # current\n", 3, ""},
+        {"no keys", "", 0, "no active key"},
+        {"only comments", "# 1 active " + key1 + "\n", 0, "no active key"},
+        {"no active key", "1 decrypt-only " + key1 + "\n2 retired " + key2, 0, "no active key"},
+        {"two active keys", "1 active " + key1 + "\n2 active " + key2, 0, "more than one active key (1 and 2)"},
+        {"unknown state", "1 Active " + key1, 0, `line 1: unknown state "Active"`},
+        {"revoked state", "1 active " + key1 + "\n2 revoked " + key2, 0, `line 2: unknown state "revoked"`},
+        {"duplicate id", "1 decrypt-only " + key1 + "\n1 active " + key2, 0, "line 2: duplicate key id 1"},
+        {"duplicate retired id", "1 active " + key1 + "\n1 retired " + key2, 0, "line 2: duplicate key id 1"},
+        {"not hex", "1 active " + strings.Repeat("zz", 32), 0, "line 1: key is not hex"},
+        {"odd length hex", "1 active " + key1[1:], 0, "line 1: key is not hex"},
+        {"short key", "1 active " + key1[:62], 0, "line 1: key 1 is 31 bytes, expected 32"},
+        {"long decrypt-only key", "1 active " + key1 + "\n2 decrypt-only " + key2 + "00", 0, "line 2: key 2 is 33 bytes"},
+        {"id too big", "65536 active " + key1, 0, `line 1: bad key id "65536"`},
+        {"negative id", "-1 active " + key1, 0, `line 1: bad key id "-1"`},
+        {"missing key", "1 active", 0, "line 1: expected <id> <state> <key>"},
+        {"extra field", "1 active " + key1 + " spare", 0, "line 1: expected <id> <state> <key>"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            ring, err := Parse(strings.NewReader(test.ring))
+            if test.err != "" {
+                if err == nil || !strings.Contains(err.Error(), test.err) { t.Fatalf("expected an error with %q, got %v", test.err, err) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            if ring.Active().ID != test.active || ring.Active().State != StateActive { t.Fatalf("active key is %+v, expected %d", ring.Active(), test.active) }
+        })
+    }
+}
+
+func TestDecryptionKey(t *testing.T) {
+    ring, err := Parse(strings.NewReader("1 retired abcd\n2 decrypt-only " + key2 + "\n3 active " + key3))
+    if err != nil { t.Fatal(err) }
+
+    for id, expected := range map[uint16]string{2: key2, 3: key3} {
+        secret, err := ring.DecryptionKey(id)
+        if err != nil { t.Fatalf("key %d: %v", id, err) }
+        if hex.EncodeToString(secret) != expected { t.Fatalf("key %d is %x", id, secret) }
+    }
+    if _, err := ring.DecryptionKey(1); err == nil || !strings.Contains(err.Error(), "retired") { t.Fatalf("retired key 1 decrypts, err %v", err) }
+    if _, err := ring.DecryptionKey(4); err == nil || !strings.Contains(err.Error(), "Unknown") { t.Fatalf("unknown key 4 decrypts, err %v", err) }
+    if got := ring.String(); got != "1:retired 2:decrypt-only 3:active" { t.Fatalf("String is %q", got) }
+}
+
+// Load takes PAYLOAD_KEYRING_FILE over PAYLOAD_KEYRING over the legacy key 0
+func TestLoad(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "keyring")
+    if err := os.WriteFile(file, []byte("5 active "+key1+"\n"), 0600); err != nil { t.Fatal(err) }
+    tests := []struct {
+        name   string
+        file   string
+        inline string
+        active uint16
+        secret string
+        err    string
+    }{
+        {"file", file, "", 5, key1, ""},
+        {"file over inline", file, "6 active " + key2, 5, key1, ""},
+        {"inline", "", "6 decrypt-only " + key1 + ";7 active " + key2, 7, key2, ""},
+        {"missing file", filepath.Join(t.TempDir(), "missing"), "6 active " + key2, 0, "", "Can't open keyring file"},
+        {"bad inline", "", "6 active " + key2 + ";7 active " + key3, 0, "", "more than one active key"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            t.Setenv("PAYLOAD_KEYRING_FILE", test.file)
+            t.Setenv("PAYLOAD_KEYRING", test.inline)
+            ring, err := Load()
+            if test.err != "" {
+                if err == nil || !strings.Contains(err.Error(), test.err) { t.Fatalf("expected an error with %q, got %v", test.err, err) }
+                return
+            }
+            if err != nil { t.Fatal(err) }
+            active := ring.Active()
+            if active.ID != test.active || !bytes.Equal(active.Secret, mustHex(t, test.secret)) { t.Fatalf("active key is %d %x, expected %d %s", active.ID, active.Secret, test.active, test.secret) }
+        })
+    }
+
+    // with neither set it's common.KeyOne as key 0, a build that still has the
+    // placeholder key fails the same way
+    t.Run("legacy key 0", func(t *testing.T) {
+        t.Setenv("PAYLOAD_KEYRING_FILE", "")
+        t.Setenv("PAYLOAD_KEYRING", "")
+        ring, err := Load()
+        legacy, legacyErr := Parse(strings.NewReader("0 active " + common.KeyOne))
+        if legacyErr != nil {
+            if err == nil || err.Error() != legacyErr.Error() { t.Fatalf("Load error is %v, parsing key 0 is %v", err, legacyErr) }
+            return
+        }
+        if err != nil { t.Fatal(err) }
+        if ring.Active().ID != 0 || !bytes.Equal(ring.Active().Secret, legacy.Active().Secret) { t.Fatalf("active key is %d, expected the legacy key 0", ring.Active().ID) }
+    })
+}
+
+func mustHex(t *testing.T, s string) []byte {
+    decoded, err := hex.DecodeString(s)
+    if err != nil { t.Fatal(err) }
+    return decoded
+}
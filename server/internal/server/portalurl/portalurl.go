@@ -0,0 +1,88 @@
+// Parses the captive portal redirect URL that devices send with their payload.
+// Devices used to be the only ones reading the URL, so every change in the
+// portal format needed a fleet update. Now they send the raw URL as well and
+// the server parses it with the parsers below, newest first. When the format
+// changes, add a parser with the next version instead of editing an old one so
+// stored entries still say which parser read them.
+package portalurl
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+
+    "server-indicum/internal/common"
+)
+
+// Fields are the payphone details a portal URL carries
+type Fields struct {
+    PayphoneMAC  string
+    PayphoneID   string
+    PayphoneTime int64
+}
+
+type Parser struct {
+    Version int
+    Name    string
+    Parse   func(*url.URL) (Fields, error)
+}
+
+// Parsers are tried from the last to the first
+var Parsers = []Parser{
+    {Version: 1, Name: "meraki-query", Parse: parseMerakiQuery},
+}
+
+// v1: the Meraki splash redirect, mac, a (payphone ID) and b (payphone time)
+// in the query string. This is what client/portal.ParseURL reads.
+func parseMerakiQuery(parsed *url.URL) (Fields, error) {
+    query := parsed.Query()
+    fields := Fields{
+        PayphoneMAC: query.Get("mac"),
+        PayphoneID:  query.Get("a"),
+    }
+    payphoneTime := query.Get("b")
+    if fields.PayphoneMAC == "" || fields.PayphoneID == "" || payphoneTime == "" {
+        return Fields{}, fmt.Errorf("mac, a or b missing")
+    }
+
+    var err error
+    fields.PayphoneTime, err = strconv.ParseInt(payphoneTime, 10, 64)
+    if err != nil { return Fields{}, fmt.Errorf("b %q is not a number", payphoneTime) }
+    return fields, nil
+}
+
+// Parse runs the parsers on raw and returns the fields from the newest one that
+// understands it, along with that parser's version
+func Parse(raw string) (Fields, int, error) {
+    parsed, err := url.Parse(raw)
+    if err != nil { return Fields{}, 0, fmt.Errorf("Can't parse portal URL %v\n", err) }
+
+    var errs []string
+    for i := len(Parsers) - 1; i >= 0; i-- {
+        fields, err := Parsers[i].Parse(parsed)
+        if err == nil { return fields, Parsers[i].Version, nil }
+        errs = append(errs, fmt.Sprintf("%s: %v", Parsers[i].Name, err))
+    }
+    return Fields{}, 0, fmt.Errorf("No parser understands portal URL %q %v\n", raw, errs)
+}
+
+// Check parses the raw portal URL in dataPayload and makes sure it agrees with
+// the fields the device pulled out of it. Returns the parser version, 0 when
+// the device didn't send a URL (clients from before it was added).
+func Check(dataPayload common.Payload) (int, error) {
+    if dataPayload.PortalURL == "" { return 0, nil }
+
+    fields, version, err := Parse(dataPayload.PortalURL)
+    if err != nil { return 0, err }
+
+    if fields.PayphoneMAC != dataPayload.PayphoneMAC {
+        return 0, fmt.Errorf("Portal URL has MAC %q, device sent %q\n", fields.PayphoneMAC, dataPayload.PayphoneMAC)
+    }
+    if fields.PayphoneID != dataPayload.PayphoneID {
+        return 0, fmt.Errorf("Portal URL has payphone ID %q, device sent %q\n", fields.PayphoneID, dataPayload.PayphoneID)
+    }
+    if fields.PayphoneTime != dataPayload.PayphoneTime {
+        return 0, fmt.Errorf("Portal URL has payphone time %d, device sent %d\n", fields.PayphoneTime, dataPayload.PayphoneTime)
+    }
+    return version, nil
+}
@@ -0,0 +1,87 @@
+package portalurl
+
+import (
+    "testing"
+
+    "server-indicum/internal/common"
+)
+
+const (
+    mac          = "0C:8D:DB:5E:32:63"
+    payphoneID   = "a17554a0d2b15a664c0e73900184544f19e70227"
+    splash       = "https://n148.network-auth.com/splash/"
+    // the whole redirect as the portal sends it, from the protocol vectors
+    portalURL    = splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&real_ip=10.176.40.12&client_ip=10.176.40.12&client_mac=06%3A19%3Ac2%3A7e%3Ab0%3A41&vap=0&a=" + payphoneID + "&b=2055467&auth_version=5&continue_url=http%3A%2F%2Fgoogle.com%2F"
+)
+
+func TestParse(t *testing.T) {
+    tests := []struct {
+        name string
+        raw  string
+        want Fields
+        ok   bool
+    }{
+        {"portal redirect", portalURL, Fields{mac, payphoneID, 2055467}, true},
+        {"just the fields", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=2055467", Fields{mac, payphoneID, 2055467}, true},
+        {"colons not escaped", splash + "?mac=" + mac + "&a=" + payphoneID + "&b=2055467", Fields{mac, payphoneID, 2055467}, true},
+        {"any order", splash + "?b=2055467&a=" + payphoneID + "&mac=0C%3A8D%3ADB%3A5E%3A32%3A63", Fields{mac, payphoneID, 2055467}, true},
+        {"fragment ignored", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=2055467#b=1", Fields{mac, payphoneID, 2055467}, true},
+        // the first value wins, the same as the device's url.Values.Get
+        {"repeated field", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=2055467&b=1", Fields{mac, payphoneID, 2055467}, true},
+        {"case kept", splash + "?mac=0c%3a8d%3adb%3a5e%3a32%3a63&a=" + payphoneID + "&b=2055467", Fields{"0c:8d:db:5e:32:63", payphoneID, 2055467}, true},
+        {"no host", "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=2055467", Fields{mac, payphoneID, 2055467}, true},
+        {"no query", splash, Fields{}, false},
+        {"empty", "", Fields{}, false},
+        {"missing mac", splash + "?a=" + payphoneID + "&b=2055467", Fields{}, false},
+        {"missing a", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&b=2055467", Fields{}, false},
+        {"empty b", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=", Fields{}, false},
+        {"b not a number", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=20554x", Fields{}, false},
+        {"b with a space", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=%202055467", Fields{}, false},
+        {"b too big", splash + "?mac=0C%3A8D%3ADB%3A5E%3A32%3A63&a=" + payphoneID + "&b=99999999999999999999", Fields{}, false},
+        // a bad escape drops that pair from the query, so mac is missing
+        {"bad escape", splash + "?mac=0C%3G8D&a=" + payphoneID + "&b=2055467", Fields{}, false},
+        {"not a URL", "https://n148.network-auth.com/%zz?mac=x&a=y&b=1", Fields{}, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fields, version, err := Parse(tt.raw)
+            if !tt.ok {
+                if err == nil { t.Fatalf("parsed %+v, expected an error", fields) }
+                return
+            }
+            if err != nil { t.Fatalf("Parse: %v", err) }
+            if version != 1 { t.Fatalf("version %d", version) }
+            if fields != tt.want { t.Fatalf("got %+v, want %+v", fields, tt.want) }
+        })
+    }
+}
+
+func TestCheck(t *testing.T) {
+    payload := func(portalURL, mac, payphoneID string, payphoneTime int64) common.Payload {
+        return common.Payload{PortalURL: portalURL, PayphoneMAC: mac, PayphoneID: payphoneID, PayphoneTime: payphoneTime}
+    }
+    tests := []struct {
+        name    string
+        payload common.Payload
+        version int
+        ok      bool
+    }{
+        {"agrees", payload(portalURL, mac, payphoneID, 2055467), 1, true},
+        {"no URL, older client", payload("", mac, payphoneID, 2055467), 0, true},
+        {"other MAC", payload(portalURL, "0C:8D:DB:5E:32:64", payphoneID, 2055467), 0, false},
+        // nothing is folded, the device read the same URL so it has the same case
+        {"MAC case differs", payload(portalURL, "0c:8d:db:5e:32:63", payphoneID, 2055467), 0, false},
+        {"MAC still escaped", payload(portalURL, "0C%3A8D%3ADB%3A5E%3A32%3A63", payphoneID, 2055467), 0, false},
+        {"other payphone ID", payload(portalURL, mac, payphoneID[:39]+"8", 2055467), 0, false},
+        {"other payphone time", payload(portalURL, mac, payphoneID, 2055468), 0, false},
+        {"URL doesn't parse", payload(splash, mac, payphoneID, 2055467), 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            version, err := Check(tt.payload)
+            if tt.ok && err != nil { t.Fatalf("Check: %v", err) }
+            if !tt.ok && err == nil { t.Fatalf("expected an error") }
+            if version != tt.version { t.Fatalf("version %d, want %d", version, tt.version) }
+        })
+    }
+}
@@ -6,12 +6,23 @@ import (
     "github.com/gorilla/websocket"
     "github.com/golang-jwt/jwt/v5"
 	"sync"
+	"time"
 )
 //
 // A map of connections between the server and clients
 
+// Conn is a user's websocket, gorilla allows one writer at a time so writes
+// take writeMu. WSConnMutex only guards the map and is never held for a write.
+type Conn struct {
+    *websocket.Conn
+    writeMu sync.Mutex
+}
+
+// writeTimeout is how long a write waits on a browser that isn't reading
+const writeTimeout = 10 * time.Second
+
 var WSConnMutex = &sync.Mutex{}
-var WSConnections = make(map[string]*websocket.Conn)  // Map of UUID to WebSocket connection
+var WSConnections = make(map[string]*Conn)  // Map of UUID to WebSocket connection
 
 var upgrader = websocket.Upgrader{
     CheckOrigin: func(r *http.Request) bool {
@@ -36,14 +47,16 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
     }
 	uuid := claims["sub"].(string)
 
+	conn := &Conn{Conn: ws}
 	WSConnMutex.Lock()
-    WSConnections[uuid] = ws
+    WSConnections[uuid] = conn
     WSConnMutex.Unlock()
 
 	fmt.Println("Websocket connection opened", uuid)
     defer func() {
         WSConnMutex.Lock()
-        delete(WSConnections, uuid)
+        // a newer connection from the same user may have replaced this one
+        if WSConnections[uuid] == conn { delete(WSConnections, uuid) }
         WSConnMutex.Unlock()
 		fmt.Println("Websocket connection closed", uuid)
     }()
@@ -56,6 +69,18 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// Send writes msg to the user's websocket if they have one open, false if they don't
+func Send(uuid string, msg []byte) (bool, error) {
+    WSConnMutex.Lock()
+    conn, ok := WSConnections[uuid]
+    WSConnMutex.Unlock()
+    if !ok { return false, nil }
+
+    conn.writeMu.Lock()
+    defer conn.writeMu.Unlock()
+    if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil { return true, err }
+    return true, conn.WriteMessage(websocket.TextMessage, msg)
+}
 
 // // Use claims
 // fmt.Println("Access granted. User ID: ", claims["sub"])